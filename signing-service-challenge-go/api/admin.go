@@ -0,0 +1,104 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/config"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/ratelimit"
+	"github.com/google/uuid"
+)
+
+// WithAdminToken enables the admin API under `/admin`, which requires
+// the token as `Authorization: Bearer <token>`.
+// Without this option, the admin API is not served.
+func WithAdminToken(token string) ServerOption {
+	return func(s *Server) {
+		s.adminToken = token
+	}
+}
+
+// requireAdmin is a middleware rejecting requests without the admin token.
+func (s *Server) requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		token, ok := strings.CutPrefix(request.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) != 1 {
+			response.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			WriteErrorResponse(response, http.StatusUnauthorized, []string{
+				"admin token required",
+			})
+			return
+		}
+		next.ServeHTTP(response, request)
+	})
+}
+
+type RateLimitsResponse struct {
+	// keyed by ClientKey
+	Clients ratelimit.Limits `json:"clients"`
+	// keyed by device ID
+	Devices ratelimit.Limits `json:"devices"`
+}
+
+type UpdateRateLimitsRequest = RateLimitsResponse
+
+func (s *Server) rateLimits() RateLimitsResponse {
+	return RateLimitsResponse{
+		Clients: s.clientLimiter.Limits(),
+		Devices: s.deviceLimiter.Limits(),
+	}
+}
+
+// GetRateLimits writes the current rate limits.
+func (s *Server) GetRateLimits(response http.ResponseWriter, request *http.Request) {
+	WriteAPIResponse(response, request, http.StatusOK, s.rateLimits())
+}
+
+// UpdateRateLimits replaces all rate limits. It takes effect immediately.
+func (s *Server) UpdateRateLimits(response http.ResponseWriter, request *http.Request) {
+	var requestBody UpdateRateLimitsRequest
+	decoder := json.NewDecoder(request.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&requestBody); err != nil {
+		WriteErrorResponse(response, http.StatusBadRequest, []string{
+			"invalid json",
+		})
+		return
+	}
+
+	problems := config.RateLimitsConfig{
+		Clients: rateLimitConfig(requestBody.Clients),
+		Devices: rateLimitConfig(requestBody.Devices),
+	}.Validate("")
+	if len(problems) > 0 {
+		WriteErrorResponse(response, http.StatusBadRequest, problems)
+		return
+	}
+
+	// device IDs in URLs are normalized the same way by limitDevices
+	deviceOverrides := map[string]ratelimit.Limit{}
+	for deviceID, limit := range requestBody.Devices.Overrides {
+		deviceOverrides[uuid.MustParse(deviceID).String()] = limit
+	}
+	requestBody.Devices.Overrides = deviceOverrides
+
+	s.clientLimiter.SetLimits(requestBody.Clients)
+	s.deviceLimiter.SetLimits(requestBody.Devices)
+
+	WriteAPIResponse(response, request, http.StatusOK, s.rateLimits())
+}
+
+// rateLimitConfig returns the limits as configured, to be validated the
+// same way.
+func rateLimitConfig(limits ratelimit.Limits) config.RateLimitConfig {
+	c := config.RateLimitConfig{
+		Default:   config.RateLimit(limits.Default),
+		Overrides: map[string]config.RateLimit{},
+	}
+	for key, limit := range limits.Overrides {
+		c.Overrides[key] = config.RateLimit(limit)
+	}
+	return c
+}
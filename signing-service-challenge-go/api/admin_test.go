@@ -0,0 +1,134 @@
+package api_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/api"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/ratelimit"
+	"github.com/google/go-cmp/cmp"
+)
+
+const testAdminToken = "test-admin-token"
+
+func sendAdminRequest(t *testing.T, httpMethod, url, token string, body any) *http.Response {
+	t.Helper()
+
+	var bodyBytes []byte
+	if body != nil {
+		var err error
+		if bodyBytes, err = json.Marshal(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	request, err := http.NewRequest(httpMethod, url, bytes.NewReader(bodyBytes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set(api.RequestIDHeader, testRequestID)
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+func TestAdminRateLimits(t *testing.T) {
+	t.Run("is not served without an admin token", func(t *testing.T) {
+		_, serverURL, _ := newRateLimitedServer(t, ratelimit.Limits{}, ratelimit.Limits{})
+
+		response := sendAdminRequest(t, http.MethodGet, serverURL+"/admin/rate_limits", testAdminToken, nil)
+		readBody(t, response)
+		if response.StatusCode != http.StatusNotFound {
+			t.Errorf("expected status code: %d, got: %d", http.StatusNotFound, response.StatusCode)
+		}
+	})
+
+	t.Run("requires the admin token", func(t *testing.T) {
+		_, serverURL, _ := newRateLimitedServer(t, ratelimit.Limits{}, ratelimit.Limits{}, api.WithAdminToken(testAdminToken))
+
+		for _, token := range []string{"", "wrong-token"} {
+			response := sendAdminRequest(t, http.MethodGet, serverURL+"/admin/rate_limits", token, nil)
+			body := readBody(t, response)
+			if response.StatusCode != http.StatusUnauthorized {
+				t.Errorf("expected status code: %d, got: %d", http.StatusUnauthorized, response.StatusCode)
+			}
+			expectedBody := `{"errors":["admin token required"],"request_id":"test-request-id"}`
+			if body != expectedBody {
+				t.Errorf("expected: %s, got: %s", expectedBody, body)
+			}
+		}
+	})
+
+	t.Run("changes the limits at runtime", func(t *testing.T) {
+		_, serverURL, deviceIDs := newRateLimitedServer(t, ratelimit.Limits{}, ratelimit.Limits{}, api.WithAdminToken(testAdminToken))
+
+		limits := api.UpdateRateLimitsRequest{
+			Clients: ratelimit.Limits{
+				Overrides: map[string]ratelimit.Limit{"cert:CN=till-1": {Rate: 5, Burst: 10}},
+			},
+			Devices: ratelimit.Limits{
+				Default: ratelimit.Limit{Rate: 1, Burst: 1},
+				Overrides: map[string]ratelimit.Limit{
+					strings.ToUpper(deviceIDs[1].String()): {},
+				},
+			},
+		}
+		response := sendAdminRequest(t, http.MethodPut, serverURL+"/admin/rate_limits", testAdminToken, limits)
+		readBody(t, response)
+		if response.StatusCode != http.StatusOK {
+			t.Fatalf("expected status code: %d, got: %d", http.StatusOK, response.StatusCode)
+		}
+
+		sign(t, serverURL, deviceIDs[0])
+		if response := sign(t, serverURL, deviceIDs[0]); response.StatusCode != http.StatusTooManyRequests {
+			t.Errorf("expected new device limit to apply, got: %d", response.StatusCode)
+		}
+		for i := 0; i < 3; i++ {
+			if response := sign(t, serverURL, deviceIDs[1]); response.StatusCode != http.StatusOK {
+				t.Errorf("expected device override to apply, got: %d", response.StatusCode)
+			}
+		}
+
+		response = sendAdminRequest(t, http.MethodGet, serverURL+"/admin/rate_limits", testAdminToken, nil)
+		var responseBody struct {
+			Data api.RateLimitsResponse `json:"data"`
+		}
+		if err := json.NewDecoder(response.Body).Decode(&responseBody); err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		// device IDs are normalized
+		limits.Devices.Overrides = map[string]ratelimit.Limit{deviceIDs[1].String(): {}}
+		if diff := cmp.Diff(responseBody.Data, limits); diff != "" {
+			t.Errorf("unexpected diff: %s", diff)
+		}
+	})
+
+	t.Run("rejects invalid limits", func(t *testing.T) {
+		_, serverURL, _ := newRateLimitedServer(t, ratelimit.Limits{}, ratelimit.Limits{}, api.WithAdminToken(testAdminToken))
+
+		limits := api.UpdateRateLimitsRequest{
+			Clients: ratelimit.Limits{Default: ratelimit.Limit{Rate: -1}},
+			Devices: ratelimit.Limits{
+				Overrides: map[string]ratelimit.Limit{"till-1": {Burst: -1}},
+			},
+		}
+		response := sendAdminRequest(t, http.MethodPut, serverURL+"/admin/rate_limits", testAdminToken, limits)
+		body := readBody(t, response)
+		if response.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected status code: %d, got: %d", http.StatusBadRequest, response.StatusCode)
+		}
+		expectedBody := `{"errors":["clients.default.rate must not be negative","devices.overrides[\"till-1\"].burst must not be negative","devices.overrides: \"till-1\" is not a valid uuid"],"request_id":"test-request-id"}`
+		if body != expectedBody {
+			t.Errorf("expected: %s, got: %s", expectedBody, body)
+		}
+	})
+}
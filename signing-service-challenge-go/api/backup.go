@@ -0,0 +1,87 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/backup"
+)
+
+// maxBackupSize limits the archives accepted by RestoreBackup.
+const maxBackupSize = 256 << 20
+
+// WithBackups enables the backup and restore of all devices via the admin
+// API under `/admin/backup` and `/admin/restore`. The archives are
+// encrypted with the key, see backup.KeySize.
+func WithBackups(key []byte) ServerOption {
+	return func(s *Server) {
+		s.backupKey = key
+	}
+}
+
+type RestoreBackupResponse struct {
+	// devices missing in the store, or behind the backup
+	Restored int `json:"restored"`
+	// devices with the same signature counter in the store, which are kept
+	Unchanged int `json:"unchanged"`
+}
+
+// CreateBackup writes an encrypted archive of all devices, including their
+// private keys.
+func (s *Server) CreateBackup(response http.ResponseWriter, request *http.Request) {
+	archive, err := backup.Create(s.signatureService.repositoryProvider, s.backupKey)
+	if err != nil {
+		WriteInternalError(response, request, err)
+		return
+	}
+
+	filename := fmt.Sprintf("signing-service-%s.backup", time.Now().UTC().Format("20060102T150405Z"))
+	response.Header().Set("Content-Type", "application/octet-stream")
+	response.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	response.WriteHeader(http.StatusOK)
+	response.Write(archive)
+}
+
+// RestoreBackup restores the devices of the archive in the request body.
+// It responds with 409 Conflict, and restores nothing, when a device has
+// created signatures since the backup.
+func (s *Server) RestoreBackup(response http.ResponseWriter, request *http.Request) {
+	archive, err := io.ReadAll(http.MaxBytesReader(response, request.Body, maxBackupSize))
+	if err != nil {
+		WriteErrorResponse(response, http.StatusRequestEntityTooLarge, []string{
+			fmt.Sprintf("backup must not be larger than %d bytes", maxBackupSize),
+		})
+		return
+	}
+
+	result, err := backup.Restore(s.signatureService.repositoryProvider, archive, s.backupKey)
+	var rollbackError backup.RollbackError
+	switch {
+	case errors.Is(err, backup.ErrInvalidArchive):
+		WriteErrorResponse(response, http.StatusBadRequest, []string{err.Error()})
+		return
+	case errors.As(err, &rollbackError):
+		problems := []string{}
+		for _, rollback := range rollbackError.Rollbacks {
+			problems = append(problems, fmt.Sprintf(
+				"signature device %s has signature counter %d, the backup %d",
+				rollback.DeviceID,
+				rollback.StoreCounter,
+				rollback.BackupCounter,
+			))
+		}
+		WriteErrorResponse(response, http.StatusConflict, problems)
+		return
+	case err != nil:
+		WriteInternalError(response, request, err)
+		return
+	}
+
+	WriteAPIResponse(response, request, http.StatusOK, RestoreBackupResponse{
+		Restored:  result.Restored,
+		Unchanged: result.Unchanged,
+	})
+}
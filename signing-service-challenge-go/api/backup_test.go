@@ -0,0 +1,151 @@
+package api_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/api"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/persistence"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/ratelimit"
+	"github.com/google/go-cmp/cmp"
+)
+
+var testBackupKey = bytes.Repeat([]byte{42}, 32)
+
+func downloadBackup(t *testing.T, serverURL string) []byte {
+	t.Helper()
+
+	response := sendAdminRequest(t, http.MethodGet, serverURL+"/admin/backup", testAdminToken, nil)
+	body := readBody(t, response)
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("expected status code: %d, got: %d, body: %s", http.StatusOK, response.StatusCode, body)
+	}
+	if contentType := response.Header.Get("Content-Type"); contentType != "application/octet-stream" {
+		t.Errorf("expected an octet stream, got: %s", contentType)
+	}
+	return []byte(body)
+}
+
+func uploadBackup(t *testing.T, serverURL string, archive []byte) (*http.Response, string) {
+	t.Helper()
+
+	request, err := http.NewRequest(http.MethodPost, serverURL+"/admin/restore", bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set(api.RequestIDHeader, testRequestID)
+	request.Header.Set("Authorization", "Bearer "+testAdminToken)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response, readBody(t, response)
+}
+
+func TestAdminBackup(t *testing.T) {
+	t.Run("is not served without a backup key", func(t *testing.T) {
+		_, serverURL, _ := newRateLimitedServer(t, ratelimit.Limits{}, ratelimit.Limits{}, api.WithAdminToken(testAdminToken))
+
+		response := sendAdminRequest(t, http.MethodGet, serverURL+"/admin/backup", testAdminToken, nil)
+		readBody(t, response)
+		if response.StatusCode != http.StatusNotFound {
+			t.Errorf("expected status code: %d, got: %d", http.StatusNotFound, response.StatusCode)
+		}
+	})
+
+	t.Run("restores the devices into another server", func(t *testing.T) {
+		_, serverURL, deviceIDs := newRateLimitedServer(
+			t,
+			ratelimit.Limits{},
+			ratelimit.Limits{},
+			api.WithAdminToken(testAdminToken),
+			api.WithBackups(testBackupKey),
+		)
+		sign(t, serverURL, deviceIDs[0])
+		archive := downloadBackup(t, serverURL)
+
+		emptyServer := httptest.NewServer(api.NewServer(
+			"",
+			api.NewSignatureService(persistence.NewInMemorySignatureDeviceRepositoryProvider(
+				persistence.NewInMemorySignatureDeviceRepository(),
+			)),
+			api.WithAdminToken(testAdminToken),
+			api.WithBackups(testBackupKey),
+		).HTTPHandler())
+		t.Cleanup(emptyServer.Close)
+
+		response, body := uploadBackup(t, emptyServer.URL, archive)
+		if response.StatusCode != http.StatusOK {
+			t.Fatalf("expected status code: %d, got: %d, body: %s", http.StatusOK, response.StatusCode, body)
+		}
+		var restoreResponse struct {
+			Data api.RestoreBackupResponse `json:"data"`
+		}
+		if err := json.Unmarshal([]byte(body), &restoreResponse); err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(restoreResponse.Data, api.RestoreBackupResponse{Restored: 2}); diff != "" {
+			t.Errorf("unexpected diff: %s", diff)
+		}
+
+		response = sendJsonRequest(t, http.MethodGet, fmt.Sprintf("%s/api/v0/signature_devices/%s", emptyServer.URL, deviceIDs[0]))
+		var deviceResponse struct {
+			Data api.FindSignatureDeviceResponse `json:"data"`
+		}
+		if err := json.Unmarshal([]byte(readBody(t, response)), &deviceResponse); err != nil {
+			t.Fatal(err)
+		}
+		if deviceResponse.Data.SignatureCounter != 1 {
+			t.Errorf("expected counter 1, got: %d", deviceResponse.Data.SignatureCounter)
+		}
+	})
+
+	t.Run("refuses to roll back signature counters", func(t *testing.T) {
+		_, serverURL, deviceIDs := newRateLimitedServer(
+			t,
+			ratelimit.Limits{},
+			ratelimit.Limits{},
+			api.WithAdminToken(testAdminToken),
+			api.WithBackups(testBackupKey),
+		)
+		archive := downloadBackup(t, serverURL)
+		sign(t, serverURL, deviceIDs[1])
+
+		response, body := uploadBackup(t, serverURL, archive)
+
+		if response.StatusCode != http.StatusConflict {
+			t.Errorf("expected status code: %d, got: %d", http.StatusConflict, response.StatusCode)
+		}
+		expectedBody := fmt.Sprintf(
+			`{"errors":["signature device %s has signature counter 1, the backup 0"],"request_id":"test-request-id"}`,
+			deviceIDs[1],
+		)
+		if body != expectedBody {
+			t.Errorf("expected: %s, got: %s", expectedBody, body)
+		}
+	})
+
+	t.Run("rejects invalid archives", func(t *testing.T) {
+		_, serverURL, _ := newRateLimitedServer(
+			t,
+			ratelimit.Limits{},
+			ratelimit.Limits{},
+			api.WithAdminToken(testAdminToken),
+			api.WithBackups(testBackupKey),
+		)
+
+		response, body := uploadBackup(t, serverURL, []byte("not a backup"))
+
+		if response.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected status code: %d, got: %d", http.StatusBadRequest, response.StatusCode)
+		}
+		expectedBody := `{"errors":["invalid backup archive: not a backup archive"],"request_id":"test-request-id"}`
+		if body != expectedBody {
+			t.Errorf("expected: %s, got: %s", expectedBody, body)
+		}
+	})
+}
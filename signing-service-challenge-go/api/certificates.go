@@ -0,0 +1,272 @@
+package api
+
+import (
+	"context"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/ca"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/crypto"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+// WithCertificateAuthority serves the certificates the authority issues
+// for devices without uploaded certificate chain under
+// `/api/v0/signature_devices/{deviceID}/certificate`, and its revocation
+// list under `/api/v0/ca/crl`. The certificates are included in the
+// signatures with `format=cms` as well.
+func WithCertificateAuthority(authority *ca.Authority) ServerOption {
+	return func(s *Server) {
+		s.authority = authority
+		s.signatureService.authority = authority
+	}
+}
+
+// maxCertificateChainSize limits the chains accepted by
+// StoreCertificateChain.
+const maxCertificateChainSize = 1 << 20
+
+// CreateCertificateRequestRequest sets the subject of a certificate
+// signing request. All fields are optional; the subject always holds the
+// device ID as serial number.
+type CreateCertificateRequestRequest struct {
+	// defaults to the label of the device, or its ID when it has none
+	CommonName         string `json:"common_name"`
+	Organization       string `json:"organization"`
+	OrganizationalUnit string `json:"organizational_unit"`
+	// ISO 3166 alpha-2 code
+	Country string `json:"country"`
+}
+
+type CreateCertificateRequestResponse struct {
+	// PEM encoded PKCS#10 certificate signing request
+	CSR string `json:"csr"`
+}
+
+// CreateCertificateRequest responds with a certificate signing request for
+// the public key of a device, signed by the device, to obtain a
+// certificate from an external CA. The issued chain is uploaded with
+// StoreCertificateChain.
+func (s *SignatureService) CreateCertificateRequest(response http.ResponseWriter, request *http.Request) {
+	deviceID, err := uuid.Parse(chi.URLParam(request, "deviceID"))
+	if err != nil {
+		WriteErrorResponse(response, http.StatusBadRequest, []string{
+			"id is not a valid uuid",
+		})
+		return
+	}
+
+	// the body is optional
+	var requestBody CreateCertificateRequestRequest
+	err = json.NewDecoder(request.Body).Decode(&requestBody)
+	if err != nil && !errors.Is(err, io.EOF) {
+		WriteErrorResponse(response, http.StatusBadRequest, []string{
+			"invalid json",
+		})
+		return
+	}
+	if requestBody.Country != "" && !isCountryCode(requestBody.Country) {
+		WriteErrorResponse(response, http.StatusBadRequest, []string{
+			"country must be an ISO 3166 alpha-2 code",
+		})
+		return
+	}
+
+	var device domain.SignatureDevice
+	var deviceFound bool
+	err = domain.ReadTx(request.Context(), s.repositoryProvider, func(ctx context.Context, repository domain.SignatureDeviceRepository) error {
+		device, deviceFound, err = repository.Find(deviceID)
+		return err
+	})
+	if err != nil {
+		WriteInternalError(response, request, err)
+		return
+	}
+	if !deviceFound {
+		writeError(response, request, errDeviceNotFound)
+		return
+	}
+	if device.Status == domain.DeviceStatusDeactivated {
+		writeError(response, request, errDeviceDeactivated)
+		return
+	}
+
+	subject := pkix.Name{
+		CommonName:   requestBody.CommonName,
+		SerialNumber: device.ID.String(),
+	}
+	if subject.CommonName == "" {
+		subject.CommonName = device.Label
+	}
+	if subject.CommonName == "" {
+		subject.CommonName = device.ID.String()
+	}
+	if requestBody.Organization != "" {
+		subject.Organization = []string{requestBody.Organization}
+	}
+	if requestBody.OrganizationalUnit != "" {
+		subject.OrganizationalUnit = []string{requestBody.OrganizationalUnit}
+	}
+	if requestBody.Country != "" {
+		subject.Country = []string{requestBody.Country}
+	}
+
+	csr, err := crypto.CreateCertificateRequest(device.KeyPair, subject)
+	if err != nil {
+		WriteInternalError(response, request, err)
+		return
+	}
+
+	WriteAPIResponse(response, request, http.StatusOK, CreateCertificateRequestResponse{CSR: string(csr)})
+}
+
+func isCountryCode(value string) bool {
+	if len(value) != 2 {
+		return false
+	}
+	for _, r := range value {
+		if r < 'A' || r > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// StoreCertificateChain stores the PEM encoded certificate chain of the
+// request body with a device, e.g. the one an external CA issued for a
+// certificate signing request. The chain must start with a certificate of
+// the public key of the device, followed by the certificates of the
+// issuing CAs. It replaces the chain stored before.
+func (s *SignatureService) StoreCertificateChain(response http.ResponseWriter, request *http.Request) {
+	deviceID, err := uuid.Parse(chi.URLParam(request, "deviceID"))
+	if err != nil {
+		WriteErrorResponse(response, http.StatusBadRequest, []string{
+			"id is not a valid uuid",
+		})
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(response, request.Body, maxCertificateChainSize))
+	if err != nil {
+		WriteErrorResponse(response, http.StatusRequestEntityTooLarge, []string{
+			fmt.Sprintf("certificate chain must not be larger than %d bytes", maxCertificateChainSize),
+		})
+		return
+	}
+	chain, err := crypto.DecodeCertificateChain(body)
+	if err != nil {
+		WriteErrorResponse(response, http.StatusBadRequest, []string{
+			fmt.Sprintf("certificate chain must be PEM encoded certificates: %s", err),
+		})
+		return
+	}
+
+	_, deviceFound, err := domain.StoreCertificateChain(
+		request.Context(),
+		deviceID,
+		s.repositoryProvider,
+		chain,
+		func(keyPair domain.KeyPair) error {
+			if err := crypto.VerifyCertificateChain(keyPair, chain, time.Now()); err != nil {
+				return requestError{http.StatusBadRequest, err.Error()}
+			}
+			return nil
+		},
+	)
+	if errors.Is(err, domain.ErrDeviceDeactivated) {
+		err = errDeviceDeactivated
+	}
+	if err != nil {
+		writeError(response, request, err)
+		return
+	}
+	if !deviceFound {
+		writeError(response, request, errDeviceNotFound)
+		return
+	}
+
+	response.WriteHeader(http.StatusNoContent)
+}
+
+// FindCertificate responds with the PEM encoded certificate chain of a
+// device. An uploaded chain, see StoreCertificateChain, is preferred.
+// Otherwise it is the certificate of the internal CA followed by the CA
+// certificate; devices created while no certificates were issued get
+// theirs now.
+func (s *Server) FindCertificate(response http.ResponseWriter, request *http.Request) {
+	deviceID, err := uuid.Parse(chi.URLParam(request, "deviceID"))
+	if err != nil {
+		WriteErrorResponse(response, http.StatusBadRequest, []string{
+			"id is not a valid uuid",
+		})
+		return
+	}
+
+	var device domain.SignatureDevice
+	var deviceFound bool
+	err = domain.ReadTx(request.Context(), s.signatureService.repositoryProvider, func(ctx context.Context, repository domain.SignatureDeviceRepository) error {
+		device, deviceFound, err = repository.Find(deviceID)
+		return err
+	})
+	if err != nil {
+		WriteInternalError(response, request, err)
+		return
+	}
+	if !deviceFound {
+		WriteErrorResponse(response, http.StatusNotFound, []string{
+			"signature device not found",
+		})
+		return
+	}
+
+	if len(device.CertificateChain) > 0 {
+		writeCertificateChain(response, device.CertificateChain)
+		return
+	}
+	if s.authority == nil {
+		WriteErrorResponse(response, http.StatusNotFound, []string{
+			"signature device has no certificate",
+		})
+		return
+	}
+
+	certificate, err := s.authority.Issue(device)
+	if errors.Is(err, ca.ErrDeactivated) {
+		WriteErrorResponse(response, http.StatusNotFound, []string{
+			"signature device is deactivated and has no certificate",
+		})
+		return
+	}
+	if err != nil {
+		WriteInternalError(response, request, err)
+		return
+	}
+	writeCertificateChain(response, [][]byte{certificate, s.authority.Certificate()})
+}
+
+func writeCertificateChain(response http.ResponseWriter, chain [][]byte) {
+	response.Header().Set("Content-Type", "application/pem-certificate-chain")
+	response.WriteHeader(http.StatusOK)
+	response.Write(crypto.EncodeCertificateChain(chain))
+}
+
+// GetCRL responds with the DER encoded revocation list of the
+// certificates of deactivated devices.
+func (s *Server) GetCRL(response http.ResponseWriter, request *http.Request) {
+	crl, err := s.authority.CRL(request.Context(), s.signatureService.repositoryProvider)
+	if err != nil {
+		WriteInternalError(response, request, err)
+		return
+	}
+
+	response.Header().Set("Content-Type", "application/pkix-crl")
+	response.WriteHeader(http.StatusOK)
+	response.Write(crl)
+}
@@ -0,0 +1,264 @@
+package api_test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/api"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/ca"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/ratelimit"
+	"github.com/google/uuid"
+)
+
+// parseChain decodes the PEM encoded certificates of a chain.
+func parseChain(t *testing.T, chain string) []*x509.Certificate {
+	t.Helper()
+
+	certificates := []*x509.Certificate{}
+	rest := []byte(chain)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			return certificates
+		}
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		certificates = append(certificates, certificate)
+	}
+}
+
+// newExternalCA returns the certificate and key of a self-signed CA.
+func newExternalCA(t *testing.T) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "External CA"},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certificate, key
+}
+
+func putCertificateChain(t *testing.T, url string, chain []byte) (*http.Response, string) {
+	t.Helper()
+
+	request, err := http.NewRequest(http.MethodPut, url, bytes.NewReader(chain))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set(api.RequestIDHeader, testRequestID)
+	request.Header.Set("Content-Type", "application/pem-certificate-chain")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response, readBody(t, response)
+}
+
+func TestCertificates(t *testing.T) {
+	t.Run("has no certificates without a certificate authority", func(t *testing.T) {
+		_, serverURL, deviceIDs := newRateLimitedServer(t, ratelimit.Limits{}, ratelimit.Limits{})
+
+		response := sendJsonRequest(t, http.MethodGet, fmt.Sprintf("%s/api/v0/signature_devices/%s/certificate", serverURL, deviceIDs[0]))
+		body := readBody(t, response)
+		if response.StatusCode != http.StatusNotFound {
+			t.Errorf("expected status code: %d, got: %d", http.StatusNotFound, response.StatusCode)
+		}
+		expectedBody := `{"errors":["signature device has no certificate"],"request_id":"test-request-id"}`
+		if body != expectedBody {
+			t.Errorf("expected: %s, got: %s", expectedBody, body)
+		}
+	})
+
+	t.Run("issues certificates and revokes them on deactivation", func(t *testing.T) {
+		authority, err := ca.Open(t.TempDir(), ca.Options{CertificateValidity: time.Hour})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, serverURL, deviceIDs := newRateLimitedServer(t, ratelimit.Limits{}, ratelimit.Limits{}, api.WithCertificateAuthority(authority))
+		url := fmt.Sprintf("%s/api/v0/signature_devices/%s/certificate", serverURL, deviceIDs[0])
+
+		response := sendJsonRequest(t, http.MethodGet, url)
+		body := readBody(t, response)
+		if response.StatusCode != http.StatusOK {
+			t.Fatalf("expected status code: %d, got: %d, body: %s", http.StatusOK, response.StatusCode, body)
+		}
+		if contentType := response.Header.Get("Content-Type"); contentType != "application/pem-certificate-chain" {
+			t.Errorf("expected a PEM certificate chain, got: %s", contentType)
+		}
+		chain := parseChain(t, body)
+		if len(chain) != 2 {
+			t.Fatalf("expected the device and the CA certificate, got %d certificates", len(chain))
+		}
+		if chain[0].Subject.SerialNumber != deviceIDs[0].String() {
+			t.Errorf("expected the certificate of the device, got: %s", chain[0].Subject)
+		}
+		if err := chain[0].CheckSignatureFrom(chain[1]); err != nil {
+			t.Errorf("expected the certificate to be issued by the CA, got: %s", err)
+		}
+
+		response = sendJsonRequest(t, http.MethodGet, serverURL+"/api/v0/ca/crl")
+		crl, err := x509.ParseRevocationList([]byte(readBody(t, response)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(crl.RevokedCertificateEntries) != 0 {
+			t.Errorf("expected no revoked certificates, got: %v", crl.RevokedCertificateEntries)
+		}
+
+		response = sendJsonRequest(t, http.MethodPost, fmt.Sprintf("%s/api/v0/signature_devices/%s/deactivate", serverURL, deviceIDs[0]))
+		readBody(t, response)
+
+		// listed in the cached CRL right away, although no issuer handles
+		// the event of the deactivation
+		response = sendJsonRequest(t, http.MethodGet, serverURL+"/api/v0/ca/crl")
+		crl, err = x509.ParseRevocationList([]byte(readBody(t, response)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(crl.RevokedCertificateEntries) != 1 || crl.RevokedCertificateEntries[0].SerialNumber.Cmp(chain[0].SerialNumber) != 0 {
+			t.Errorf("expected the certificate to be revoked, got: %v", crl.RevokedCertificateEntries)
+		}
+		response = sendJsonRequest(t, http.MethodGet, url)
+		if revoked := parseChain(t, readBody(t, response)); !revoked[0].Equal(chain[0]) {
+			t.Error("expected the certificate of the deactivated device")
+		}
+
+		response = sendJsonRequest(t, http.MethodGet, fmt.Sprintf("%s/api/v0/signature_devices/%s/certificate", serverURL, uuid.New()))
+		readBody(t, response)
+		if response.StatusCode != http.StatusNotFound {
+			t.Errorf("expected status code: %d, got: %d", http.StatusNotFound, response.StatusCode)
+		}
+	})
+	t.Run("creates certificate signing requests and stores the issued chain", func(t *testing.T) {
+		authority, err := ca.Open(t.TempDir(), ca.Options{CertificateValidity: time.Hour})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, serverURL, deviceIDs := newRateLimitedServer(t, ratelimit.Limits{}, ratelimit.Limits{}, api.WithCertificateAuthority(authority))
+		url := fmt.Sprintf("%s/api/v0/signature_devices/%s", serverURL, deviceIDs[0])
+
+		response := sendJsonRequest(t, http.MethodPost, url+"/csr", api.CreateCertificateRequestRequest{
+			Organization: "Example GmbH",
+			Country:      "DE",
+		})
+		body := readBody(t, response)
+		if response.StatusCode != http.StatusOK {
+			t.Fatalf("expected status code: %d, got: %d, body: %s", http.StatusOK, response.StatusCode, body)
+		}
+		var csrResponse struct {
+			Data api.CreateCertificateRequestResponse `json:"data"`
+		}
+		if err := json.Unmarshal([]byte(body), &csrResponse); err != nil {
+			t.Fatal(err)
+		}
+		block, _ := pem.Decode([]byte(csrResponse.Data.CSR))
+		if block == nil || block.Type != "CERTIFICATE REQUEST" {
+			t.Fatalf("expected a PEM encoded CSR, got: %s", csrResponse.Data.CSR)
+		}
+		csr, err := x509.ParseCertificateRequest(block.Bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := csr.CheckSignature(); err != nil {
+			t.Errorf("expected the CSR to be signed by the device, got: %s", err)
+		}
+		expectedSubject := fmt.Sprintf("SERIALNUMBER=%s,CN=%s,O=Example GmbH,C=DE", deviceIDs[0], deviceIDs[0])
+		if csr.Subject.String() != expectedSubject {
+			t.Errorf("expected subject: %s, got: %s", expectedSubject, csr.Subject)
+		}
+
+		externalCA, externalKey := newExternalCA(t)
+		der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			Subject:      csr.Subject,
+			NotBefore:    time.Now().Add(-time.Minute),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+		}, externalCA, csr.PublicKey, externalKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chain := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+		chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: externalCA.Raw})...)
+
+		response, body = putCertificateChain(t, url+"/certificate", chain)
+		if response.StatusCode != http.StatusNoContent {
+			t.Fatalf("expected status code: %d, got: %d, body: %s", http.StatusNoContent, response.StatusCode, body)
+		}
+
+		// the uploaded chain is preferred over the internal CA
+		response = sendJsonRequest(t, http.MethodGet, url+"/certificate")
+		if body := readBody(t, response); body != string(chain) {
+			t.Errorf("expected the uploaded chain, got: %s", body)
+		}
+
+		// certificates of other keys are rejected
+		response, body = putCertificateChain(t, fmt.Sprintf("%s/api/v0/signature_devices/%s/certificate", serverURL, deviceIDs[1]), chain)
+		if response.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected status code: %d, got: %d", http.StatusBadRequest, response.StatusCode)
+		}
+		expectedBody := `{"errors":["certificate 1 is not issued for the public key of the device"],"request_id":"test-request-id"}`
+		if body != expectedBody {
+			t.Errorf("expected: %s, got: %s", expectedBody, body)
+		}
+
+		response, body = putCertificateChain(t, url+"/certificate", []byte("not a certificate"))
+		if response.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected status code: %d, got: %d", http.StatusBadRequest, response.StatusCode)
+		}
+		expectedBody = `{"errors":["certificate chain must be PEM encoded certificates: unexpected data after the last PEM block"],"request_id":"test-request-id"}`
+		if body != expectedBody {
+			t.Errorf("expected: %s, got: %s", expectedBody, body)
+		}
+
+		response = sendJsonRequest(t, http.MethodPost, url+"/csr", api.CreateCertificateRequestRequest{Country: "Germany"})
+		body = readBody(t, response)
+		expectedBody = `{"errors":["country must be an ISO 3166 alpha-2 code"],"request_id":"test-request-id"}`
+		if body != expectedBody {
+			t.Errorf("expected: %s, got: %s", expectedBody, body)
+		}
+
+		response = sendJsonRequest(t, http.MethodPost, url+"/deactivate")
+		readBody(t, response)
+		response = sendJsonRequest(t, http.MethodPost, url+"/csr")
+		body = readBody(t, response)
+		if response.StatusCode != http.StatusConflict {
+			t.Errorf("expected status code: %d, got: %d", http.StatusConflict, response.StatusCode)
+		}
+		response, body = putCertificateChain(t, url+"/certificate", chain)
+		if response.StatusCode != http.StatusConflict {
+			t.Errorf("expected status code: %d, got: %d, body: %s", http.StatusConflict, response.StatusCode, body)
+		}
+	})
+}
@@ -1,41 +1,124 @@
 package api
 
 import (
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"log/slog"
 	"net/http"
-	"sort"
+	"strings"
+	"time"
 
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/ca"
 	"github.com/fiskaly/coding-challenges/signing-service-challenge/crypto"
 	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/events"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/jobs"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/logging"
 	"github.com/go-chi/chi/v5"
 	"github.com/google/uuid"
 )
 
 type SignatureService struct {
 	repositoryProvider domain.SignatureDeviceRepositoryProvider
+	// when empty, every supported algorithm is allowed
+	allowedAlgorithms []string
+	// checked for private keys provided when creating a signature device
+	keyPolicy crypto.KeyPolicy
+	// nil when asynchronous processing is disabled
+	jobs *jobs.Queue
+	// nil when events are disabled
+	events *events.Bus
+	// issues the certificates included in CMS signatures of devices without
+	// uploaded certificate chain; nil without certificate authority
+	authority *ca.Authority
 }
 
-func NewSignatureService(p domain.SignatureDeviceRepositoryProvider) SignatureService {
-	return SignatureService{
+// SignatureServiceOption configures optional behaviour of a SignatureService.
+type SignatureServiceOption func(*SignatureService)
+
+// WithAllowedAlgorithms restricts the algorithms that can be chosen
+// when creating a signature device.
+func WithAllowedAlgorithms(algorithmNames ...string) SignatureServiceOption {
+	return func(s *SignatureService) {
+		s.allowedAlgorithms = algorithmNames
+	}
+}
+
+// WithKeyPolicy sets the minimum strength of private keys provided when
+// creating a signature device.
+func WithKeyPolicy(policy crypto.KeyPolicy) SignatureServiceOption {
+	return func(s *SignatureService) {
+		s.keyPolicy = policy
+	}
+}
+
+func NewSignatureService(p domain.SignatureDeviceRepositoryProvider, options ...SignatureServiceOption) SignatureService {
+	service := SignatureService{
 		repositoryProvider: p,
 	}
+	for _, option := range options {
+		option(&service)
+	}
+	return service
+}
+
+func (s *SignatureService) findKeyPairGenerator(algorithmName string) (domain.KeyPairGenerator, bool) {
+	if len(s.allowedAlgorithms) > 0 {
+		allowed := false
+		for _, allowedAlgorithm := range s.allowedAlgorithms {
+			if allowedAlgorithm == algorithmName {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return nil, false
+		}
+	}
+
+	return crypto.FindKeyPairGenerator(algorithmName)
 }
 
 type ApiSignatureDevice struct {
-	ID               string `json:"id"`
-	Label            string `json:"label"`
-	PublicKey        string `json:"public_key"`
+	ID     string              `json:"id"`
+	Label  string              `json:"label"`
+	Status domain.DeviceStatus `json:"status"`
+	// a PEM or base64 encoded DER string, or a JWK object, depending on
+	// the `format` query parameter
+	PublicKey        any    `json:"public_key"`
 	Algorithm        string `json:"algorithm"`
 	SignatureCounter uint   `json:"signature_counter"`
 	LastSignature    string `json:"last_signature"`
 }
 
+func newApiSignatureDevice(device domain.SignatureDevice, format crypto.PublicKeyFormat) (ApiSignatureDevice, error) {
+	publicKey, err := crypto.EncodePublicKey(device.KeyPair, format)
+	if err != nil {
+		return ApiSignatureDevice{}, err
+	}
+
+	return ApiSignatureDevice{
+		ID:               device.ID.String(),
+		Label:            device.Label,
+		Status:           device.Status,
+		PublicKey:        publicKey,
+		Algorithm:        device.KeyPair.AlgorithmName(),
+		SignatureCounter: device.SignatureCounter,
+		LastSignature:    device.LastSignature,
+	}, nil
+}
+
 type CreateSignatureDeviceResponse = ApiSignatureDevice
 
 type CreateSignatureDeviceRequest struct {
 	ID        string `json:"id"`
 	Algorithm string `json:"algorithm"`
 	Label     string `json:"label"` // optional
+	// (optional) PEM encoded private key to create the device with instead
+	// of generating one; the algorithm is detected when it is empty
+	PrivateKey string `json:"private_key"`
 }
 
 func (s *SignatureService) CreateSignatureDevice(response http.ResponseWriter, request *http.Request) {
@@ -56,68 +139,83 @@ func (s *SignatureService) CreateSignatureDevice(response http.ResponseWriter, r
 		return
 	}
 
-	var idIsDuplicate bool
-	var algorithmIsInvalid bool
-	var device domain.SignatureDevice
-	err = s.repositoryProvider.WriteTx(func(repository domain.SignatureDeviceRepository) error {
-		_, ok, err := repository.Find(id)
-		if err != nil {
-			return err
-		}
-		if ok {
-			idIsDuplicate = true
-			return nil
+	var generator domain.KeyPairGenerator
+	if requestBody.PrivateKey != "" {
+		var problem string
+		generator, problem = s.providedKeyPair(requestBody.Algorithm, requestBody.PrivateKey)
+		if problem != "" {
+			WriteErrorResponse(response, http.StatusBadRequest, []string{problem})
+			return
 		}
-
-		generator, found := crypto.FindKeyPairGenerator(requestBody.Algorithm)
+	} else {
+		var found bool
+		generator, found = s.findKeyPairGenerator(requestBody.Algorithm)
 		if !found {
-			algorithmIsInvalid = true
-			return nil
-		}
-
-		device, err = domain.BuildSignatureDevice(id, generator, requestBody.Label)
-		if err != nil {
-			return err
-		}
-
-		if err := repository.Create(device); err != nil {
-			return err
+			WriteErrorResponse(response, http.StatusBadRequest, []string{
+				"algorithm is not supported",
+			})
+			return
 		}
+	}
 
-		return nil
-	})
-	if err != nil {
-		WriteInternalError(response)
+	format, ok := parsePublicKeyFormat(response, request)
+	if !ok {
 		return
 	}
-	if idIsDuplicate {
-		WriteErrorResponse(response, http.StatusBadRequest, []string{
-			"duplicate id",
-		})
+	async, ok := parseAsync(response, request)
+	if !ok {
 		return
 	}
-	if algorithmIsInvalid {
-		WriteErrorResponse(response, http.StatusBadRequest, []string{
-			"algorithm is not supported",
+	if async {
+		s.submitJob(response, request, id, func(ctx context.Context) (any, error) {
+			return s.createSignatureDevice(ctx, id, generator, requestBody.Label, format)
 		})
 		return
 	}
 
-	publicKey, err := device.KeyPair.EncodedPublicKey()
+	responseBody, err := s.createSignatureDevice(request.Context(), id, generator, requestBody.Label, format)
 	if err != nil {
-		WriteInternalError(response)
+		writeError(response, request, err)
 		return
 	}
+	WriteAPIResponse(response, request, http.StatusCreated, responseBody)
+}
 
-	responseBody := CreateSignatureDeviceResponse{
-		ID:               device.ID.String(),
-		Label:            device.Label,
-		PublicKey:        publicKey,
-		Algorithm:        device.KeyPair.AlgorithmName(),
-		SignatureCounter: device.SignatureCounter,
-		LastSignature:    device.LastSignature,
+// providedKeyPair parses a private key provided for a new signature
+// device, or returns the problem with it.
+func (s *SignatureService) providedKeyPair(algorithmName string, privateKey string) (domain.KeyPairGenerator, string) {
+	keyPair, err := crypto.ParsePrivateKey([]byte(privateKey))
+	if err != nil {
+		return nil, "private_key must be a PEM encoded RSA or ECDSA private key"
+	}
+	if algorithmName != "" && algorithmName != keyPair.AlgorithmName() {
+		return nil, "algorithm does not match the algorithm of private_key"
 	}
-	WriteAPIResponse(response, http.StatusCreated, responseBody)
+	if _, found := s.findKeyPairGenerator(keyPair.AlgorithmName()); !found {
+		return nil, "algorithm is not supported"
+	}
+	if err := s.keyPolicy.Check(keyPair); err != nil {
+		return nil, "private_key is too weak: " + err.Error()
+	}
+	return domain.ProvidedKeyPair{KeyPair: keyPair}, ""
+}
+
+func (s *SignatureService) createSignatureDevice(
+	ctx context.Context,
+	id uuid.UUID,
+	generator domain.KeyPairGenerator,
+	label string,
+	format crypto.PublicKeyFormat,
+) (CreateSignatureDeviceResponse, error) {
+	device, err := domain.CreateSignatureDevice(ctx, id, s.repositoryProvider, generator, label)
+	if errors.Is(err, domain.ErrDuplicateDevice) {
+		return CreateSignatureDeviceResponse{}, errDuplicateID
+	}
+	if err != nil {
+		return CreateSignatureDeviceResponse{}, err
+	}
+
+	return newApiSignatureDevice(device, format)
 }
 
 type SignTransactionRequest struct {
@@ -127,6 +225,61 @@ type SignTransactionRequest struct {
 type SignTransactionResponse struct {
 	Signature  string `json:"signature"`
 	SignedData string `json:"signed_data"`
+	// the signed data as compact JWS, only with `format=jws`
+	JWS string `json:"jws,omitempty"`
+	// the signed data signed as detached CMS SignedData, DER and base64
+	// encoded, only with `format=cms`
+	CMS string `json:"cms,omitempty"`
+}
+
+// SignatureFormat selects additional encodings of the signature in the
+// responses of SignTransaction. The JWS and CMS formats carry a second
+// signature of the device over the signed data, made with the algorithm
+// of the format; `signature` stays the one of the signature chain. Both
+// are created in the same transaction, so either both or none are made.
+type SignatureFormat string
+
+const (
+	// only the base64 encoded signature of the signed data
+	SignatureFormatRaw SignatureFormat = "raw"
+	// additionally the signed data as JWS, signed again by the device with
+	// the JWS algorithm of its key: PS384, ES256, ES384 or ES512.
+	// PS384 requires RSA keys of at least 784 bits, so RSA devices with
+	// smaller keys, provided or generated by earlier versions, reject it
+	// with 400 Bad Request.
+	SignatureFormatJWS SignatureFormat = "jws"
+	// additionally the signed data signed again by the device as detached
+	// CMS SignedData, with the signing time as signed attribute and the
+	// certificate chain of the device, if it has one
+	SignatureFormatCMS SignatureFormat = "cms"
+)
+
+// SignatureFormats are all supported signature formats.
+var SignatureFormats = []SignatureFormat{
+	SignatureFormatRaw,
+	SignatureFormatJWS,
+	SignatureFormatCMS,
+}
+
+// parseSignatureFormat reads the `format` query parameter of
+// SignTransaction. Raw is the default.
+func parseSignatureFormat(response http.ResponseWriter, request *http.Request) (SignatureFormat, bool) {
+	value := request.URL.Query().Get("format")
+	if value == "" {
+		return SignatureFormatRaw, true
+	}
+
+	formats := []string{}
+	for _, format := range SignatureFormats {
+		if string(format) == value {
+			return format, true
+		}
+		formats = append(formats, string(format))
+	}
+	WriteErrorResponse(response, http.StatusBadRequest, []string{
+		"format must be one of " + strings.Join(formats, ", "),
+	})
+	return "", false
 }
 
 func (s *SignatureService) SignTransaction(response http.ResponseWriter, request *http.Request) {
@@ -148,30 +301,113 @@ func (s *SignatureService) SignTransaction(response http.ResponseWriter, request
 		return
 	}
 
+	format, ok := parseSignatureFormat(response, request)
+	if !ok {
+		return
+	}
+	async, ok := parseAsync(response, request)
+	if !ok {
+		return
+	}
+	if async {
+		s.submitJob(response, request, deviceID, func(ctx context.Context) (any, error) {
+			return s.signTransaction(ctx, deviceID, requestBody.DataToBeSigned, format)
+		})
+		return
+	}
+
+	responseBody, err := s.signTransaction(request.Context(), deviceID, requestBody.DataToBeSigned, format)
+	if err != nil {
+		writeError(response, request, err)
+		return
+	}
+	WriteAPIResponse(response, request, http.StatusOK, responseBody)
+}
+
+func (s *SignatureService) signTransaction(
+	ctx context.Context,
+	deviceID uuid.UUID,
+	dataToBeSigned string,
+	format SignatureFormat,
+) (SignTransactionResponse, error) {
+	// the further formats are created within the transaction taking the
+	// signature counter, which is rolled back when they fail, also when
+	// the device does not support them
+	var responseBody SignTransactionResponse
+	encoders := []domain.SignatureEncoder{}
+	switch format {
+	case SignatureFormatJWS:
+		encoders = append(encoders, func(device domain.SignatureDevice, signedData string) error {
+			if _, err := crypto.JWSAlgorithm(device.KeyPair); err != nil {
+				return requestError{http.StatusBadRequest, "format jws is not supported by the signature device: " + err.Error()}
+			}
+			var err error
+			responseBody.JWS, err = crypto.SignJWS(device.KeyPair, crypto.JWSHeader{
+				KeyID:            deviceID.String(),
+				SignatureCounter: device.SignatureCounter,
+			}, []byte(signedData))
+			return err
+		})
+	case SignatureFormatCMS:
+		encoders = append(encoders, func(device domain.SignatureDevice, signedData string) error {
+			chain, err := s.certificateChain(device)
+			if err != nil {
+				return err
+			}
+			cms, err := crypto.SignCMS(device.KeyPair, []byte(signedData), time.Now(), chain)
+			if err != nil {
+				return err
+			}
+			responseBody.CMS = base64.StdEncoding.EncodeToString(cms)
+			return nil
+		})
+	}
+
 	deviceFound, encodedSignature, signedData, err := domain.SignTransaction(
+		ctx,
 		deviceID,
 		s.repositoryProvider,
-		requestBody.DataToBeSigned,
+		dataToBeSigned,
+		encoders...,
 	)
+	if errors.Is(err, domain.ErrDeviceDeactivated) {
+		return SignTransactionResponse{}, errDeviceDeactivated
+	}
 	if err != nil {
-		WriteInternalError(response)
-		return
+		return SignTransactionResponse{}, err
 	}
 	if !deviceFound {
-		WriteErrorResponse(response, http.StatusNotFound, []string{
-			"signature device not found",
-		})
-		return
+		return SignTransactionResponse{}, errDeviceNotFound
 	}
 
-	WriteAPIResponse(
-		response,
-		http.StatusOK,
-		SignTransactionResponse{
-			Signature:  encodedSignature,
-			SignedData: signedData,
-		},
-	)
+	responseBody.Signature = encodedSignature
+	responseBody.SignedData = signedData
+	return responseBody, nil
+}
+
+// certificateChain returns the uploaded certificate chain of the device,
+// or else the certificate the authority issued for it, followed by the
+// one of the authority. It is empty when there is neither. Certificates
+// are issued when devices are created, so that only devices whose event
+// was missed get theirs here.
+func (s *SignatureService) certificateChain(device domain.SignatureDevice) ([][]byte, error) {
+	if len(device.CertificateChain) > 0 {
+		return device.CertificateChain, nil
+	}
+	if s.authority == nil {
+		return nil, nil
+	}
+	if certificate, found := s.authority.Find(device.ID); found {
+		return [][]byte{certificate, s.authority.Certificate()}, nil
+	}
+	certificate, err := s.authority.Issue(device)
+	if errors.Is(err, ca.ErrDeactivated) {
+		return nil, errDeviceDeactivated
+	}
+	if err != nil {
+		return nil, err
+	}
+	return [][]byte{certificate, s.authority.Certificate()}, nil
 }
 
 type FindSignatureDeviceResponse = ApiSignatureDevice
@@ -186,14 +422,19 @@ func (s *SignatureService) FindSignatureDevice(response http.ResponseWriter, req
 		return
 	}
 
+	format, ok := parsePublicKeyFormat(response, request)
+	if !ok {
+		return
+	}
+
 	var device domain.SignatureDevice
 	var deviceFound bool
-	err = s.repositoryProvider.ReadTx(func(repository domain.SignatureDeviceRepository) error {
+	err = domain.ReadTx(request.Context(), s.repositoryProvider, func(ctx context.Context, repository domain.SignatureDeviceRepository) error {
 		device, deviceFound, err = repository.Find(deviceID)
 		return err
 	})
 	if err != nil {
-		WriteInternalError(response)
+		WriteInternalError(response, request, err)
 		return
 	}
 	if !deviceFound {
@@ -203,31 +444,81 @@ func (s *SignatureService) FindSignatureDevice(response http.ResponseWriter, req
 		return
 	}
 
-	publicKey, err := device.KeyPair.EncodedPublicKey()
+	responseBody, err := newApiSignatureDevice(device, format)
 	if err != nil {
-		WriteInternalError(response)
+		WriteInternalError(response, request, err)
 		return
 	}
 
-	WriteAPIResponse(
-		response,
-		http.StatusOK,
-		FindSignatureDeviceResponse{
-			ID:               device.ID.String(),
-			Label:            device.Label,
-			PublicKey:        publicKey,
-			Algorithm:        device.KeyPair.AlgorithmName(),
-			SignatureCounter: device.SignatureCounter,
-			LastSignature:    device.LastSignature,
-		},
+	WriteAPIResponse(response, request, http.StatusOK, responseBody)
+}
+
+type DeactivateSignatureDeviceResponse = ApiSignatureDevice
+
+// DeactivateSignatureDevice deactivates the device for good, so that it
+// cannot create signatures anymore.
+func (s *SignatureService) DeactivateSignatureDevice(response http.ResponseWriter, request *http.Request) {
+	deviceID, err := uuid.Parse(chi.URLParam(request, "deviceID"))
+	if err != nil {
+		WriteErrorResponse(response, http.StatusBadRequest, []string{
+			"id is not a valid uuid",
+		})
+		return
+	}
+
+	format, ok := parsePublicKeyFormat(response, request)
+	if !ok {
+		return
+	}
+
+	device, deviceFound, err := domain.DeactivateSignatureDevice(
+		request.Context(),
+		deviceID,
+		s.repositoryProvider,
 	)
+	if err != nil {
+		WriteInternalError(response, request, err)
+		return
+	}
+	if !deviceFound {
+		WriteErrorResponse(response, http.StatusNotFound, []string{
+			"signature device not found",
+		})
+		return
+	}
+	// revoked right away, so that the cached CRL is not served without it
+	// until the event of the deactivation is handled
+	if s.authority != nil {
+		if err := s.authority.Revoke(deviceID, time.Now()); err != nil {
+			logging.FromContext(request.Context()).LogAttrs(
+				request.Context(),
+				slog.LevelWarn,
+				"could not revoke the certificate of a signature device",
+				slog.String("device_id", deviceID.String()),
+				slog.String("error", err.Error()),
+			)
+		}
+	}
+
+	responseBody, err := newApiSignatureDevice(device, format)
+	if err != nil {
+		WriteInternalError(response, request, err)
+		return
+	}
+
+	WriteAPIResponse(response, request, http.StatusOK, responseBody)
 }
 
 type ListSignatureDevicesResponse = []ApiSignatureDevice
 
 func (s *SignatureService) ListSignatureDevice(response http.ResponseWriter, request *http.Request) {
+	format, ok := parsePublicKeyFormat(response, request)
+	if !ok {
+		return
+	}
+
 	var devices []domain.SignatureDevice
-	err := s.repositoryProvider.ReadTx(func(repository domain.SignatureDeviceRepository) error {
+	err := domain.ReadTx(request.Context(), s.repositoryProvider, func(ctx context.Context, repository domain.SignatureDeviceRepository) error {
 		d, err := repository.List()
 		if err != nil {
 			return err
@@ -236,35 +527,19 @@ func (s *SignatureService) ListSignatureDevice(response http.ResponseWriter, req
 		return nil
 	})
 	if err != nil {
-		WriteInternalError(response)
+		WriteInternalError(response, request, err)
 		return
 	}
 
-	// sort devices by ID
-	// This is just so that the order remains stable, what the order is determined by
-	// is irrelevant
-	sort.SliceStable(devices, func(a, b int) bool {
-		deviceA := devices[a]
-		deviceB := devices[b]
-		return deviceA.ID.String() < deviceB.ID.String()
-	})
-
 	responseBody := ListSignatureDevicesResponse{}
 	for _, device := range devices {
-		publicKey, err := device.KeyPair.EncodedPublicKey()
+		apiDevice, err := newApiSignatureDevice(device, format)
 		if err != nil {
-			WriteInternalError(response)
+			WriteInternalError(response, request, err)
 			return
 		}
-		responseBody = append(responseBody, ApiSignatureDevice{
-			ID:               device.ID.String(),
-			Label:            device.Label,
-			Algorithm:        device.KeyPair.AlgorithmName(),
-			PublicKey:        publicKey,
-			SignatureCounter: device.SignatureCounter,
-			LastSignature:    device.LastSignature,
-		})
+		responseBody = append(responseBody, apiDevice)
 	}
 
-	WriteAPIResponse(response, http.StatusOK, responseBody)
+	WriteAPIResponse(response, request, http.StatusOK, responseBody)
 }
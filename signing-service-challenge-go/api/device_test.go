@@ -1,19 +1,32 @@
 package api_test
 
 import (
+	"bytes"
+	stdcrypto "crypto"
 	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/asn1"
 	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/fiskaly/coding-challenges/signing-service-challenge/api"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/ca"
 	"github.com/fiskaly/coding-challenges/signing-service-challenge/crypto"
 	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
 	"github.com/fiskaly/coding-challenges/signing-service-challenge/persistence"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/ratelimit"
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/uuid"
 )
@@ -49,7 +62,7 @@ func TestCreateSignatureDeviceResponse(t *testing.T) {
 
 		// check body
 		body := readBody(t, response)
-		expectedBody := `{"errors":["id is not a valid uuid"]}`
+		expectedBody := `{"errors":["id is not a valid uuid"],"request_id":"test-request-id"}`
 		if body != expectedBody {
 			t.Errorf("expected: %s, got: %s", expectedBody, body)
 		}
@@ -94,7 +107,7 @@ func TestCreateSignatureDeviceResponse(t *testing.T) {
 
 		// check body
 		body := readBody(t, response)
-		expectedBody := `{"errors":["duplicate id"]}`
+		expectedBody := `{"errors":["duplicate id"],"request_id":"test-request-id"}`
 		if body != expectedBody {
 			t.Errorf("expected: %s, got: %s", expectedBody, body)
 		}
@@ -130,7 +143,41 @@ func TestCreateSignatureDeviceResponse(t *testing.T) {
 
 		// check body
 		body := readBody(t, response)
-		expectedBody := `{"errors":["algorithm is not supported"]}`
+		expectedBody := `{"errors":["algorithm is not supported"],"request_id":"test-request-id"}`
+		if body != expectedBody {
+			t.Errorf("expected: %s, got: %s", expectedBody, body)
+		}
+	})
+
+	t.Run("fails when algorithm is not allowed", func(t *testing.T) {
+		signatureService := api.NewSignatureService(
+			persistence.NewInMemorySignatureDeviceRepositoryProvider(
+				persistence.NewInMemorySignatureDeviceRepository(),
+			),
+			api.WithAllowedAlgorithms(crypto.ECCAlgorithmName),
+		)
+		server := httptest.NewServer(api.NewServer("", signatureService).HTTPHandler())
+		defer server.Close()
+
+		response := sendJsonRequest(
+			t,
+			http.MethodPost,
+			server.URL+"/api/v0/signature_devices",
+			api.CreateSignatureDeviceRequest{
+				ID:        uuid.NewString(),
+				Algorithm: crypto.RSAAlgorithmName,
+			},
+		)
+
+		// check status code
+		expectedStatusCode := http.StatusBadRequest
+		if response.StatusCode != expectedStatusCode {
+			t.Errorf("expected status code: %d, got: %d", expectedStatusCode, response.StatusCode)
+		}
+
+		// check body
+		body := readBody(t, response)
+		expectedBody := `{"errors":["algorithm is not supported"],"request_id":"test-request-id"}`
 		if body != expectedBody {
 			t.Errorf("expected: %s, got: %s", expectedBody, body)
 		}
@@ -182,6 +229,7 @@ func TestCreateSignatureDeviceResponse(t *testing.T) {
 				ID:        id.String(),
 				Algorithm: algorithmName,
 				Label:     "",
+				Status:    domain.DeviceStatusActive,
 				PublicKey: publicKey,
 			},
 		)
@@ -235,10 +283,117 @@ func TestCreateSignatureDeviceResponse(t *testing.T) {
 				ID:        id.String(),
 				Algorithm: algorithmName,
 				Label:     label,
+				Status:    domain.DeviceStatusActive,
+				PublicKey: publicKey,
+			},
+		)
+	})
+
+	t.Run("creates a SignatureDevice with a provided private key", func(t *testing.T) {
+		id := uuid.New()
+		privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		repository := persistence.NewInMemorySignatureDeviceRepository()
+		signatureService := api.NewSignatureService(
+			persistence.NewInMemorySignatureDeviceRepositoryProvider(repository),
+			api.WithKeyPolicy(crypto.KeyPolicy{ECCCurves: []string{"P-256"}}),
+		)
+		server := httptest.NewServer(api.NewServer("", signatureService).HTTPHandler())
+		defer server.Close()
+
+		response := sendJsonRequest(
+			t,
+			http.MethodPost,
+			server.URL+"/api/v0/signature_devices",
+			api.CreateSignatureDeviceRequest{
+				ID:         id.String(),
+				PrivateKey: string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+			},
+		)
+
+		// check status code
+		expectedStatusCode := http.StatusCreated
+		if response.StatusCode != expectedStatusCode {
+			t.Errorf("expected status code: %d, got: %d", expectedStatusCode, response.StatusCode)
+		}
+
+		// check body
+		publicKey, err := crypto.ECCKeyPair{Public: &privateKey.PublicKey, Private: privateKey}.EncodedPublicKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		compareResponseBodyData(
+			t,
+			response,
+			api.CreateSignatureDeviceResponse{
+				ID:        id.String(),
+				Algorithm: crypto.ECCAlgorithmName,
+				Status:    domain.DeviceStatusActive,
 				PublicKey: publicKey,
 			},
 		)
 	})
+
+	t.Run("fails when the provided private key is invalid", func(t *testing.T) {
+		weakPrivateKey, err := rsa.GenerateKey(rand.Reader, 512)
+		if err != nil {
+			t.Fatal(err)
+		}
+		weakKey, err := crypto.EncodePrivateKey(&crypto.RSAKeyPair{Private: weakPrivateKey, Public: &weakPrivateKey.PublicKey})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		signatureService := api.NewSignatureService(
+			persistence.NewInMemorySignatureDeviceRepositoryProvider(
+				persistence.NewInMemorySignatureDeviceRepository(),
+			),
+			api.WithKeyPolicy(crypto.KeyPolicy{MinRSABits: 2048}),
+		)
+		server := httptest.NewServer(api.NewServer("", signatureService).HTTPHandler())
+		defer server.Close()
+
+		tests := []struct {
+			name         string
+			request      api.CreateSignatureDeviceRequest
+			expectedBody string
+		}{
+			{
+				name:         "not PEM encoded",
+				request:      api.CreateSignatureDeviceRequest{ID: uuid.NewString(), PrivateKey: "not a key"},
+				expectedBody: `{"errors":["private_key must be a PEM encoded RSA or ECDSA private key"],"request_id":"test-request-id"}`,
+			},
+			{
+				name:         "other algorithm",
+				request:      api.CreateSignatureDeviceRequest{ID: uuid.NewString(), Algorithm: crypto.ECCAlgorithmName, PrivateKey: string(weakKey)},
+				expectedBody: `{"errors":["algorithm does not match the algorithm of private_key"],"request_id":"test-request-id"}`,
+			},
+			{
+				name:         "too weak",
+				request:      api.CreateSignatureDeviceRequest{ID: uuid.NewString(), PrivateKey: string(weakKey)},
+				expectedBody: `{"errors":["private_key is too weak: RSA keys must have at least 2048 bits, got: 512"],"request_id":"test-request-id"}`,
+			},
+		}
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				response := sendJsonRequest(t, http.MethodPost, server.URL+"/api/v0/signature_devices", test.request)
+
+				if response.StatusCode != http.StatusBadRequest {
+					t.Errorf("expected status code: %d, got: %d", http.StatusBadRequest, response.StatusCode)
+				}
+				if body := readBody(t, response); body != test.expectedBody {
+					t.Errorf("expected: %s, got: %s", test.expectedBody, body)
+				}
+			})
+		}
+	})
 }
 
 func TestSignTransaction(t *testing.T) {
@@ -268,7 +423,7 @@ func TestSignTransaction(t *testing.T) {
 
 		// check body
 		body := readBody(t, response)
-		expectedBody := `{"errors":["signature device not found"]}`
+		expectedBody := `{"errors":["signature device not found"],"request_id":"test-request-id"}`
 		diff := cmp.Diff(body, expectedBody)
 		if diff != "" {
 			t.Errorf("unexpected diff: %s", diff)
@@ -602,6 +757,220 @@ func TestSignTransaction(t *testing.T) {
 			t.Errorf("device last signature should be updated to %s, got: %s", jsonBody.Data.Signature, device.LastSignature)
 		}
 	})
+
+	t.Run("signs data as JWS with format jws", func(t *testing.T) {
+		id := uuid.New()
+		device, err := domain.BuildSignatureDevice(id, crypto.ECCGenerator{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		device.SignatureCounter = 1
+		device.LastSignature = "bGFzdC1zaWduYXR1cmU="
+		repository := persistence.NewInMemorySignatureDeviceRepository()
+		if err := repository.Create(device); err != nil {
+			t.Fatal(err)
+		}
+		testServer := httptest.NewServer(api.NewServer(":8888", api.NewSignatureService(
+			persistence.NewInMemorySignatureDeviceRepositoryProvider(repository),
+		)).HTTPHandler())
+		defer testServer.Close()
+
+		response := sendJsonRequest(
+			t,
+			http.MethodPost,
+			fmt.Sprintf("%s/api/v0/signature_devices/%s/signatures?format=jws", testServer.URL, id),
+			api.SignTransactionRequest{DataToBeSigned: "some-data"},
+		)
+		body := readBody(t, response)
+		if response.StatusCode != http.StatusOK {
+			t.Fatalf("expected status code: %d, got: %d, body: %s", http.StatusOK, response.StatusCode, body)
+		}
+		jsonBody := struct {
+			Data api.SignTransactionResponse `json:"data"`
+		}{}
+		if err := json.Unmarshal([]byte(body), &jsonBody); err != nil {
+			t.Fatal(err)
+		}
+
+		// verified with the standard library only, as a JOSE library would
+		parts := strings.Split(jsonBody.Data.JWS, ".")
+		if len(parts) != 3 {
+			t.Fatalf("expected a compact JWS, got: %s", jsonBody.Data.JWS)
+		}
+		header, _ := base64.RawURLEncoding.DecodeString(parts[0])
+		expectedHeader := fmt.Sprintf(`{"alg":"ES384","kid":"%s","signature_counter":1}`, id)
+		if string(header) != expectedHeader {
+			t.Errorf("expected header: %s, got: %s", expectedHeader, header)
+		}
+		payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		if string(payload) != jsonBody.Data.SignedData {
+			t.Errorf("expected the signed data as payload, got: %s", payload)
+		}
+		signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		digest := sha512.Sum384([]byte(parts[0] + "." + parts[1]))
+		r := new(big.Int).SetBytes(signature[:48])
+		s := new(big.Int).SetBytes(signature[48:])
+		if !ecdsa.Verify(device.KeyPair.(*crypto.ECCKeyPair).Public, digest[:], r, s) {
+			t.Error("expected a valid JWS signature")
+		}
+	})
+
+	t.Run("fails with format jws for RSA devices with keys too small for PS384", func(t *testing.T) {
+		id := uuid.New()
+		privateKey, err := rsa.GenerateKey(rand.Reader, 512)
+		if err != nil {
+			t.Fatal(err)
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		repository := persistence.NewInMemorySignatureDeviceRepository()
+		testServer := httptest.NewServer(api.NewServer(":8888", api.NewSignatureService(
+			persistence.NewInMemorySignatureDeviceRepositoryProvider(repository),
+		)).HTTPHandler())
+		defer testServer.Close()
+		response := sendJsonRequest(t, http.MethodPost, testServer.URL+"/api/v0/signature_devices", api.CreateSignatureDeviceRequest{
+			ID:         id.String(),
+			PrivateKey: string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		})
+		if response.StatusCode != http.StatusCreated {
+			t.Fatalf("expected status code: %d, got: %d", http.StatusCreated, response.StatusCode)
+		}
+		url := fmt.Sprintf("%s/api/v0/signature_devices/%s/signatures", testServer.URL, id)
+
+		response = sendJsonRequest(t, http.MethodPost, url+"?format=jws", api.SignTransactionRequest{DataToBeSigned: "some-data"})
+		body := readBody(t, response)
+		if response.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected status code: %d, got: %d", http.StatusBadRequest, response.StatusCode)
+		}
+		expectedBody := `{"errors":["format jws is not supported by the signature device: RSA keys of 512 bits are too small for PS384"],"request_id":"test-request-id"}`
+		if body != expectedBody {
+			t.Errorf("expected: %s, got: %s", expectedBody, body)
+		}
+
+		response = sendJsonRequest(t, http.MethodPost, url+"?format=xml", api.SignTransactionRequest{DataToBeSigned: "some-data"})
+		body = readBody(t, response)
+		expectedBody = `{"errors":["format must be one of raw, jws, cms"],"request_id":"test-request-id"}`
+		if body != expectedBody {
+			t.Errorf("expected: %s, got: %s", expectedBody, body)
+		}
+
+		// no signature was created
+		device, _, err := repository.Find(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if device.SignatureCounter != 0 {
+			t.Errorf("expected signature counter: 0, got: %d", device.SignatureCounter)
+		}
+	})
+
+	t.Run("signs data as JWS with PS384 for RSA devices with a generated key", func(t *testing.T) {
+		id := uuid.New()
+		repository := persistence.NewInMemorySignatureDeviceRepository()
+		testServer := httptest.NewServer(api.NewServer(":8888", api.NewSignatureService(
+			persistence.NewInMemorySignatureDeviceRepositoryProvider(repository),
+		)).HTTPHandler())
+		defer testServer.Close()
+		response := sendJsonRequest(t, http.MethodPost, testServer.URL+"/api/v0/signature_devices", api.CreateSignatureDeviceRequest{
+			ID:        id.String(),
+			Algorithm: crypto.RSAAlgorithmName,
+		})
+		if response.StatusCode != http.StatusCreated {
+			t.Fatalf("expected status code: %d, got: %d", http.StatusCreated, response.StatusCode)
+		}
+		device, _, err := repository.Find(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		response = sendJsonRequest(
+			t,
+			http.MethodPost,
+			fmt.Sprintf("%s/api/v0/signature_devices/%s/signatures?format=jws", testServer.URL, id),
+			api.SignTransactionRequest{DataToBeSigned: "some-data"},
+		)
+		body := readBody(t, response)
+		if response.StatusCode != http.StatusOK {
+			t.Fatalf("expected status code: %d, got: %d, body: %s", http.StatusOK, response.StatusCode, body)
+		}
+		jsonBody := struct {
+			Data api.SignTransactionResponse `json:"data"`
+		}{}
+		if err := json.Unmarshal([]byte(body), &jsonBody); err != nil {
+			t.Fatal(err)
+		}
+
+		parts := strings.Split(jsonBody.Data.JWS, ".")
+		if len(parts) != 3 {
+			t.Fatalf("expected a compact JWS, got: %s", jsonBody.Data.JWS)
+		}
+		header, _ := base64.RawURLEncoding.DecodeString(parts[0])
+		expectedHeader := fmt.Sprintf(`{"alg":"PS384","kid":"%s","signature_counter":0}`, id)
+		if string(header) != expectedHeader {
+			t.Errorf("expected header: %s, got: %s", expectedHeader, header)
+		}
+		signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		digest := sha512.Sum384([]byte(parts[0] + "." + parts[1]))
+		options := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: stdcrypto.SHA384}
+		if err := rsa.VerifyPSS(device.KeyPair.(*crypto.RSAKeyPair).Public, stdcrypto.SHA384, digest[:], signature, options); err != nil {
+			t.Errorf("expected a valid JWS signature, got: %s", err)
+		}
+	})
+
+	t.Run("signs data as CMS with format cms", func(t *testing.T) {
+		authority, err := ca.Open(t.TempDir(), ca.Options{CertificateValidity: time.Hour})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, serverURL, deviceIDs := newRateLimitedServer(t, ratelimit.Limits{}, ratelimit.Limits{}, api.WithCertificateAuthority(authority))
+		url := fmt.Sprintf("%s/api/v0/signature_devices/%s", serverURL, deviceIDs[0])
+
+		response := sendJsonRequest(t, http.MethodPost, url+"/signatures?format=cms", api.SignTransactionRequest{DataToBeSigned: "some-data"})
+		body := readBody(t, response)
+		if response.StatusCode != http.StatusOK {
+			t.Fatalf("expected status code: %d, got: %d, body: %s", http.StatusOK, response.StatusCode, body)
+		}
+		jsonBody := struct {
+			Data api.SignTransactionResponse `json:"data"`
+		}{}
+		if err := json.Unmarshal([]byte(body), &jsonBody); err != nil {
+			t.Fatal(err)
+		}
+		if jsonBody.Data.JWS != "" {
+			t.Errorf("expected no JWS, got: %s", jsonBody.Data.JWS)
+		}
+		cms, err := base64.StdEncoding.DecodeString(jsonBody.Data.CMS)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var contentInfo struct {
+			ContentType asn1.ObjectIdentifier
+			Content     asn1.RawValue `asn1:"explicit,tag:0"`
+		}
+		if rest, err := asn1.Unmarshal(cms, &contentInfo); err != nil || len(rest) > 0 {
+			t.Fatalf("expected a CMS ContentInfo, got: %v", err)
+		}
+		if !contentInfo.ContentType.Equal(asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}) {
+			t.Errorf("expected content type SignedData, got: %s", contentInfo.ContentType)
+		}
+
+		// the certificate chain of the device and the digest of the signed
+		// data are included, see the crypto package for the structure and
+		// the signature
+		response = sendJsonRequest(t, http.MethodGet, url+"/certificate")
+		chain := parseChain(t, readBody(t, response))
+		for _, certificate := range chain {
+			if !bytes.Contains(cms, certificate.Raw) {
+				t.Errorf("expected the certificate of %s", certificate.Subject)
+			}
+		}
+		digest := sha512.Sum384([]byte(jsonBody.Data.SignedData))
+		if !bytes.Contains(cms, digest[:]) {
+			t.Error("expected the digest of the signed data")
+		}
+	})
 }
 
 func TestFindSignatureDevice(t *testing.T) {
@@ -629,7 +998,7 @@ func TestFindSignatureDevice(t *testing.T) {
 
 		// check body
 		body := readBody(t, response)
-		expectedBody := `{"errors":["signature device not found"]}`
+		expectedBody := `{"errors":["signature device not found"],"request_id":"test-request-id"}`
 		diff := cmp.Diff(body, expectedBody)
 		if diff != "" {
 			t.Errorf("unexpected diff: %s", diff)
@@ -682,6 +1051,7 @@ func TestFindSignatureDevice(t *testing.T) {
 			api.FindSignatureDeviceResponse{
 				ID:        device.ID.String(),
 				Label:     label,
+				Status:    domain.DeviceStatusActive,
 				PublicKey: publicKey,
 				Algorithm: "ECC",
 			},
@@ -751,12 +1121,14 @@ func TestListSignatureDevices(t *testing.T) {
 		{
 			ID:        eccDevice.ID.String(),
 			Label:     eccDevice.Label,
+			Status:    domain.DeviceStatusActive,
 			Algorithm: eccDevice.KeyPair.AlgorithmName(),
 			PublicKey: eccPublicKey,
 		},
 		{
 			ID:        rsaDevice.ID.String(),
 			Label:     rsaDevice.Label,
+			Status:    domain.DeviceStatusActive,
 			Algorithm: rsaDevice.KeyPair.AlgorithmName(),
 			PublicKey: rsaPublicKey,
 		},
@@ -0,0 +1,230 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/events"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+// WithEvents enables the server-sent event streams of the changes of
+// signature devices published on the bus, see outbox.Dispatcher.
+// The caller must close the bus on shutdown, which ends the streams.
+func WithEvents(bus *events.Bus) SignatureServiceOption {
+	return func(s *SignatureService) {
+		s.events = bus
+	}
+}
+
+// comments sent while no events happen, so that idle streams are not
+// closed by proxies
+const streamHeartbeatInterval = 15 * time.Second
+
+type ApiEvent struct {
+	Type             domain.EventType    `json:"type"`
+	DeviceID         string              `json:"device_id"`
+	Status           domain.DeviceStatus `json:"status"`
+	SignatureCounter uint                `json:"signature_counter"`
+	// only set for signature.created. The signed data is not included, as
+	// it holds the data of the customer.
+	Signature string    `json:"signature,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+func newApiEvent(event domain.Event) ApiEvent {
+	return ApiEvent{
+		Type:             event.Type,
+		DeviceID:         event.Device.ID.String(),
+		Status:           event.Device.Status,
+		SignatureCounter: event.Device.SignatureCounter,
+		Signature:        event.Signature,
+		Time:             event.Time.UTC(),
+	}
+}
+
+// parseLastEventID reads the `Last-Event-ID` header sent by clients
+// reconnecting to a stream. It writes an error response and returns
+// ok: false when it is invalid.
+func parseLastEventID(response http.ResponseWriter, request *http.Request) (lastEventID uint64, present bool, ok bool) {
+	value := request.Header.Get("Last-Event-ID")
+	if value == "" {
+		return 0, false, true
+	}
+
+	lastEventID, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		WriteErrorResponse(response, http.StatusBadRequest, []string{
+			"Last-Event-ID must be a number",
+		})
+		return 0, false, false
+	}
+	return lastEventID, true, true
+}
+
+// StreamDeviceEvents streams the signatures and status changes of a device
+// as server-sent events. Signature events have the signature counter of
+// the device after the signature as ID. When reconnecting with
+// `Last-Event-ID`, the events after that signature are replayed, as far
+// as they are still kept; a status change at the same counter may be
+// replayed again.
+func (s *SignatureService) StreamDeviceEvents(response http.ResponseWriter, request *http.Request) {
+	deviceID, err := uuid.Parse(chi.URLParam(request, "deviceID"))
+	if err != nil {
+		WriteErrorResponse(response, http.StatusBadRequest, []string{
+			"id is not a valid uuid",
+		})
+		return
+	}
+
+	lastEventID, resume, ok := parseLastEventID(response, request)
+	if !ok {
+		return
+	}
+
+	var deviceFound bool
+	err = domain.ReadTx(request.Context(), s.repositoryProvider, func(ctx context.Context, repository domain.SignatureDeviceRepository) error {
+		_, deviceFound, err = repository.Find(deviceID)
+		return err
+	})
+	if err != nil {
+		WriteInternalError(response, request, err)
+		return
+	}
+	if !deviceFound {
+		WriteErrorResponse(response, http.StatusNotFound, []string{
+			"signature device not found",
+		})
+		return
+	}
+
+	filter := func(message events.Message) bool {
+		return message.Device.ID == deviceID
+	}
+	var replay func(events.Message) bool
+	if resume {
+		replay = func(message events.Message) bool {
+			counter := uint64(message.Device.SignatureCounter)
+			if message.Type == domain.EventSignatureCreated {
+				return counter > lastEventID
+			}
+			return counter >= lastEventID
+		}
+	}
+	eventID := func(message events.Message) string {
+		if message.Type != domain.EventSignatureCreated {
+			return ""
+		}
+		return strconv.FormatUint(uint64(message.Device.SignatureCounter), 10)
+	}
+
+	s.stream(response, request, filter, replay, eventID)
+}
+
+// StreamEvents streams the changes of all devices the client is allowed to
+// use, see authorizeDevice, as server-sent events. Events have a sequence
+// number as ID, which starts over when the service restarts. When
+// reconnecting with `Last-Event-ID`, the events after it are replayed, as
+// far as they are still kept.
+func (s *Server) StreamEvents(response http.ResponseWriter, request *http.Request) {
+	if err := s.checkDeviceBinding(request, ""); errors.Is(err, errClientCertificateRequired) {
+		writeError(response, request, err)
+		return
+	}
+	lastEventID, resume, ok := parseLastEventID(response, request)
+	if !ok {
+		return
+	}
+
+	filter := func(message events.Message) bool {
+		return s.checkDeviceBinding(request, message.Device.ID.String()) == nil
+	}
+	var replay func(events.Message) bool
+	if resume {
+		replay = func(message events.Message) bool {
+			return message.Sequence > lastEventID
+		}
+	}
+	eventID := func(message events.Message) string {
+		return strconv.FormatUint(message.Sequence, 10)
+	}
+
+	s.signatureService.stream(response, request, filter, replay, eventID)
+}
+
+// stream writes the replayed and then all new messages matching filter,
+// until the client disconnects or the subscription ends, e.g. because the
+// client does not keep up. Clients are expected to reconnect then.
+func (s *SignatureService) stream(
+	response http.ResponseWriter,
+	request *http.Request,
+	filter func(events.Message) bool,
+	replay func(events.Message) bool,
+	eventID func(events.Message) string,
+) {
+	subscription, replayed := s.events.Subscribe(filter, replay)
+	defer subscription.Close()
+
+	controller := http.NewResponseController(response)
+	// the write timeout of the server would end every stream
+	controller.SetWriteDeadline(time.Time{})
+
+	response.Header().Set("Content-Type", "text/event-stream")
+	response.Header().Set("Cache-Control", "no-cache")
+	response.WriteHeader(http.StatusOK)
+
+	for _, message := range replayed {
+		if err := writeEvent(response, message, eventID(message)); err != nil {
+			return
+		}
+	}
+	if err := controller.Flush(); err != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(streamHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-request.Context().Done():
+			return
+		case message, ok := <-subscription.Messages():
+			if !ok {
+				return
+			}
+			if err := writeEvent(response, message, eventID(message)); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(response, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		}
+		if err := controller.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// writeEvent writes the message in the text/event-stream format.
+// The ID is omitted when empty.
+func writeEvent(response http.ResponseWriter, message events.Message, id string) error {
+	// marshaling strings and numbers cannot fail
+	data, _ := json.Marshal(newApiEvent(message.Event))
+
+	if id != "" {
+		if _, err := fmt.Fprintf(response, "id: %s\n", id); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(response, "event: %s\ndata: %s\n\n", message.Type, data)
+	return err
+}
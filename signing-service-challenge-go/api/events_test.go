@@ -0,0 +1,333 @@
+package api_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/api"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/crypto"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/events"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/logging"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/outbox"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/persistence"
+	"github.com/google/uuid"
+)
+
+type streamedEvent struct {
+	id    string
+	event string
+	data  api.ApiEvent
+}
+
+type eventStream struct {
+	response *http.Response
+	events   chan streamedEvent
+}
+
+// openStream connects to the event stream, and parses the events it sends
+// in the background until the test ends.
+func openStream(t *testing.T, url string, lastEventID string) *eventStream {
+	t.Helper()
+	return openStreamWith(t, http.DefaultClient, url, lastEventID)
+}
+
+func openStreamWith(t *testing.T, client *http.Client, url string, lastEventID string) *eventStream {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastEventID != "" {
+		request.Header.Set("Last-Event-ID", lastEventID)
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("expected status code: %d, got: %d", http.StatusOK, response.StatusCode)
+	}
+	if contentType := response.Header.Get("Content-Type"); contentType != "text/event-stream" {
+		t.Errorf("expected event stream, got: %s", contentType)
+	}
+
+	stream := &eventStream{response: response, events: make(chan streamedEvent, 100)}
+	go func() {
+		defer response.Body.Close()
+		defer close(stream.events)
+
+		scanner := bufio.NewScanner(response.Body)
+		event := streamedEvent{}
+		for scanner.Scan() {
+			field, value, _ := strings.Cut(scanner.Text(), ": ")
+			switch field {
+			case "id":
+				event.id = value
+			case "event":
+				event.event = value
+			case "data":
+				json.Unmarshal([]byte(value), &event.data)
+			case "":
+				stream.events <- event
+				event = streamedEvent{}
+			}
+		}
+	}()
+	return stream
+}
+
+func (s *eventStream) next(t *testing.T) streamedEvent {
+	t.Helper()
+
+	select {
+	case event, ok := <-s.events:
+		if !ok {
+			t.Fatal("stream ended")
+		}
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event received")
+		return streamedEvent{}
+	}
+}
+
+func newEventsTestServer(t *testing.T, repository persistence.InMemorySignatureDeviceRepository) string {
+	t.Helper()
+
+	bus := events.NewBus(events.Options{History: 100})
+	outboxDispatcher := outbox.NewDispatcher(
+		persistence.NewInMemorySignatureDeviceRepositoryProvider(repository),
+		[]domain.EventPublisher{bus},
+		outbox.Options{PollInterval: time.Second, BatchSize: 100},
+		logging.Discard(),
+	)
+	signatureService := api.NewSignatureService(
+		outboxDispatcher.Provider(),
+		api.WithEvents(bus),
+	)
+	server := httptest.NewServer(api.NewServer("", signatureService).HTTPHandler())
+	// closing the bus ends the streams, which server.Close waits for
+	t.Cleanup(server.Close)
+	t.Cleanup(bus.Close)
+	t.Cleanup(func() { outboxDispatcher.Close(context.Background()) })
+
+	return server.URL
+}
+
+func createDevice(t *testing.T, repository persistence.InMemorySignatureDeviceRepository) uuid.UUID {
+	t.Helper()
+
+	id := uuid.New()
+	device, err := domain.BuildSignatureDevice(id, crypto.ECCGenerator{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repository.Create(device); err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func signData(t *testing.T, serverURL string, deviceID uuid.UUID, data string) {
+	t.Helper()
+
+	response := sendJsonRequest(
+		t,
+		http.MethodPost,
+		fmt.Sprintf("%s/api/v0/signature_devices/%s/signatures", serverURL, deviceID),
+		api.SignTransactionRequest{DataToBeSigned: data},
+	)
+	body := readBody(t, response)
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("expected status code: %d, got: %d %s", http.StatusOK, response.StatusCode, body)
+	}
+}
+
+func TestStreamDeviceEvents(t *testing.T) {
+	t.Run("streams the signatures and status changes of the device", func(t *testing.T) {
+		repository := persistence.NewInMemorySignatureDeviceRepository()
+		serverURL := newEventsTestServer(t, repository)
+		deviceID := createDevice(t, repository)
+		otherDeviceID := createDevice(t, repository)
+
+		stream := openStream(t, fmt.Sprintf("%s/api/v0/signature_devices/%s/signatures/stream", serverURL, deviceID), "")
+		signData(t, serverURL, otherDeviceID, "other-data")
+		signData(t, serverURL, deviceID, "first")
+		signData(t, serverURL, deviceID, "second")
+		response := sendJsonRequest(t, http.MethodPost, fmt.Sprintf("%s/api/v0/signature_devices/%s/deactivate", serverURL, deviceID))
+		readBody(t, response)
+
+		for i, data := range []string{"first", "second"} {
+			event := stream.next(t)
+			if event.id != fmt.Sprint(i+1) || event.event != "signature.created" {
+				t.Errorf("expected signature %d, got: id %s, event %s", i+1, event.id, event.event)
+			}
+			if event.data.DeviceID != deviceID.String() || event.data.SignatureCounter != uint(i+1) {
+				t.Errorf("unexpected event data: %+v", event.data)
+			}
+			if event.data.Signature == "" {
+				t.Errorf("expected the signature of %s, got: %+v", data, event.data)
+			}
+		}
+
+		event := stream.next(t)
+		if event.id != "" || event.event != "device.deactivated" || event.data.Status != domain.DeviceStatusDeactivated {
+			t.Errorf("expected device deactivation without id, got: %+v", event)
+		}
+	})
+
+	t.Run("resumes after the last event ID", func(t *testing.T) {
+		repository := persistence.NewInMemorySignatureDeviceRepository()
+		serverURL := newEventsTestServer(t, repository)
+		deviceID := createDevice(t, repository)
+
+		for i := 0; i < 3; i++ {
+			signData(t, serverURL, deviceID, fmt.Sprint("data-", i))
+		}
+
+		stream := openStream(t, fmt.Sprintf("%s/api/v0/signature_devices/%s/signatures/stream", serverURL, deviceID), "1")
+		signData(t, serverURL, deviceID, "data-3")
+
+		for _, expectedID := range []string{"2", "3", "4"} {
+			if event := stream.next(t); event.id != expectedID {
+				t.Errorf("expected event %s, got: %s", expectedID, event.id)
+			}
+		}
+	})
+
+	t.Run("returns 404 when the device does not exist", func(t *testing.T) {
+		serverURL := newEventsTestServer(t, persistence.NewInMemorySignatureDeviceRepository())
+
+		response := sendJsonRequest(t, http.MethodGet, fmt.Sprintf("%s/api/v0/signature_devices/%s/signatures/stream", serverURL, uuid.New()))
+		body := readBody(t, response)
+		expectedBody := `{"errors":["signature device not found"],"request_id":"test-request-id"}`
+		if response.StatusCode != http.StatusNotFound || body != expectedBody {
+			t.Errorf("expected: %s, got: %d %s", expectedBody, response.StatusCode, body)
+		}
+	})
+
+	t.Run("rejects an invalid last event ID", func(t *testing.T) {
+		repository := persistence.NewInMemorySignatureDeviceRepository()
+		serverURL := newEventsTestServer(t, repository)
+		deviceID := createDevice(t, repository)
+
+		request, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/api/v0/signature_devices/%s/signatures/stream", serverURL, deviceID), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.Header.Set("Last-Event-ID", "latest")
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		readBody(t, response)
+		if response.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected status code: %d, got: %d", http.StatusBadRequest, response.StatusCode)
+		}
+	})
+
+	t.Run("is not served when events are disabled", func(t *testing.T) {
+		repository := persistence.NewInMemorySignatureDeviceRepository()
+		deviceID := createDevice(t, repository)
+		signatureService := api.NewSignatureService(persistence.NewInMemorySignatureDeviceRepositoryProvider(repository))
+		server := httptest.NewServer(api.NewServer("", signatureService).HTTPHandler())
+		defer server.Close()
+
+		response := sendJsonRequest(t, http.MethodGet, fmt.Sprintf("%s/api/v0/signature_devices/%s/signatures/stream", server.URL, deviceID))
+		readBody(t, response)
+		if response.StatusCode != http.StatusNotFound {
+			t.Errorf("expected status code: %d, got: %d", http.StatusNotFound, response.StatusCode)
+		}
+	})
+}
+
+func TestStreamEvents(t *testing.T) {
+	repository := persistence.NewInMemorySignatureDeviceRepository()
+	serverURL := newEventsTestServer(t, repository)
+
+	stream := openStream(t, serverURL+"/api/v0/signature_devices/stream", "")
+	deviceID := uuid.New()
+	response := sendJsonRequest(t, http.MethodPost, serverURL+"/api/v0/signature_devices", api.CreateSignatureDeviceRequest{
+		ID:        deviceID.String(),
+		Algorithm: "ECC",
+	})
+	readBody(t, response)
+	signData(t, serverURL, deviceID, "some-data")
+
+	event := stream.next(t)
+	if event.id != "1" || event.event != "device.created" || event.data.DeviceID != deviceID.String() || event.data.Status != domain.DeviceStatusActive {
+		t.Errorf("expected device creation, got: %+v", event)
+	}
+	event = stream.next(t)
+	if event.id != "2" || event.event != "signature.created" || event.data.SignatureCounter != 1 {
+		t.Errorf("expected signature, got: %+v", event)
+	}
+
+	// resume after the device creation
+	stream = openStream(t, serverURL+"/api/v0/signature_devices/stream", "1")
+	if event := stream.next(t); event.id != "2" {
+		t.Errorf("expected event 2 to be replayed, got: %+v", event)
+	}
+}
+
+func TestDeactivateSignatureDevice(t *testing.T) {
+	t.Run("deactivates the device, which cannot sign anymore", func(t *testing.T) {
+		repository := persistence.NewInMemorySignatureDeviceRepository()
+		deviceID := createDevice(t, repository)
+		signatureService := api.NewSignatureService(persistence.NewInMemorySignatureDeviceRepositoryProvider(repository))
+		server := httptest.NewServer(api.NewServer("", signatureService).HTTPHandler())
+		defer server.Close()
+
+		for i := 0; i < 2; i++ {
+			response := sendJsonRequest(t, http.MethodPost, fmt.Sprintf("%s/api/v0/signature_devices/%s/deactivate", server.URL, deviceID))
+			var responseBody struct {
+				Data api.DeactivateSignatureDeviceResponse `json:"data"`
+			}
+			if err := json.NewDecoder(response.Body).Decode(&responseBody); err != nil {
+				t.Fatal(err)
+			}
+			response.Body.Close()
+			if response.StatusCode != http.StatusOK || responseBody.Data.Status != domain.DeviceStatusDeactivated {
+				t.Errorf("expected deactivated device, got: %d %+v", response.StatusCode, responseBody.Data)
+			}
+		}
+
+		response := sendJsonRequest(
+			t,
+			http.MethodPost,
+			fmt.Sprintf("%s/api/v0/signature_devices/%s/signatures", server.URL, deviceID),
+			api.SignTransactionRequest{DataToBeSigned: "some-data"},
+		)
+		body := readBody(t, response)
+		expectedBody := `{"errors":["signature device is deactivated"],"request_id":"test-request-id"}`
+		if response.StatusCode != http.StatusConflict || body != expectedBody {
+			t.Errorf("expected: %s, got: %d %s", expectedBody, response.StatusCode, body)
+		}
+	})
+
+	t.Run("returns 404 when the device does not exist", func(t *testing.T) {
+		signatureService := api.NewSignatureService(persistence.NewInMemorySignatureDeviceRepositoryProvider(
+			persistence.NewInMemorySignatureDeviceRepository(),
+		))
+		server := httptest.NewServer(api.NewServer("", signatureService).HTTPHandler())
+		defer server.Close()
+
+		response := sendJsonRequest(t, http.MethodPost, fmt.Sprintf("%s/api/v0/signature_devices/%s/deactivate", server.URL, uuid.New()))
+		body := readBody(t, response)
+		expectedBody := `{"errors":["signature device not found"],"request_id":"test-request-id"}`
+		if response.StatusCode != http.StatusNotFound || body != expectedBody {
+			t.Errorf("expected: %s, got: %d %s", expectedBody, response.StatusCode, body)
+		}
+	})
+}
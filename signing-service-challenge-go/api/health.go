@@ -1,6 +1,17 @@
 package api
 
-import "net/http"
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/crypto"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/version"
+)
 
 type HealthResponse struct {
 	Status  string `json:"status"`
@@ -10,9 +21,205 @@ type HealthResponse struct {
 // Health evaluates the health of the service and writes a standardized response.
 func (s *Server) Health(response http.ResponseWriter, request *http.Request) {
 	health := HealthResponse{
-		Status:  "pass",
-		Version: "v0",
+		Status:  HealthStatusPass,
+		Version: version.Version,
+	}
+
+	WriteAPIResponse(response, request, http.StatusOK, health)
+}
+
+// Health check responses of /livez and /readyz follow the format of
+// https://datatracker.ietf.org/doc/html/draft-inadarei-api-health-check
+const (
+	HealthContentType = "application/health+json"
+
+	HealthStatusPass = "pass"
+	HealthStatusFail = "fail"
+)
+
+const serviceID = "signing-service"
+
+// readiness checks that take longer are considered failed
+const readinessTimeout = 2 * time.Second
+
+// the algorithm self-tests generate key pairs, which is too expensive to
+// repeat on every probe of the unauthenticated /readyz
+const selfTestInterval = time.Minute
+
+type HealthCheckResponse struct {
+	Status      string `json:"status"`
+	Version     string `json:"version"`
+	ReleaseID   string `json:"releaseId,omitempty"`
+	ServiceID   string `json:"serviceId"`
+	Description string `json:"description"`
+	// keyed by "<component>:<measurement>"
+	Checks map[string][]ComponentCheck `json:"checks,omitempty"`
+}
+
+// ComponentCheck is the result of checking a single component.
+type ComponentCheck struct {
+	ComponentID   string  `json:"componentId,omitempty"`
+	ComponentType string  `json:"componentType,omitempty"`
+	ObservedValue float64 `json:"observedValue"`
+	ObservedUnit  string  `json:"observedUnit"`
+	Status        string  `json:"status"`
+	Time          string  `json:"time"`
+	// the reason of a failed check
+	Output string `json:"output,omitempty"`
+}
+
+func newHealthCheckResponse(status, description string) HealthCheckResponse {
+	return HealthCheckResponse{
+		Status:      status,
+		Version:     version.Version,
+		ReleaseID:   version.Revision(),
+		ServiceID:   serviceID,
+		Description: description,
+	}
+}
+
+// Livez reports whether the process is able to serve requests at all.
+// It deliberately does not check any dependencies, as restarting the
+// service does not fix an unavailable dependency.
+func (s *Server) Livez(response http.ResponseWriter, request *http.Request) {
+	writeHealthCheckResponse(response, newHealthCheckResponse(HealthStatusPass, "signing service is alive"))
+}
+
+// Readyz reports whether the service can currently create signature
+// devices and signatures: the storage must respond, and every supported
+// algorithm must pass a sign-and-verify self-test. The result of the
+// self-tests is reused for selfTestInterval.
+func (s *Server) Readyz(response http.ResponseWriter, request *http.Request) {
+	ctx, cancel := context.WithTimeout(request.Context(), readinessTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var storageCheck ComponentCheck
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		storageCheck = checkStorage(ctx, s.signatureService.repositoryProvider)
+	}()
+	algorithmChecks := s.selfTests.checks(ctx)
+	wg.Wait()
+
+	health := newHealthCheckResponse(HealthStatusPass, "signing service is ready")
+	health.Checks = map[string][]ComponentCheck{
+		"storage:responseTime": {storageCheck},
+		"algorithms:selfTest":  algorithmChecks,
 	}
+	for _, checks := range health.Checks {
+		for _, check := range checks {
+			if check.Status != HealthStatusPass {
+				health.Status = HealthStatusFail
+				health.Description = "signing service is not ready"
+			}
+		}
+	}
+
+	writeHealthCheckResponse(response, health)
+}
+
+// runCheck measures check and fails it when ctx expires first.
+// The check keeps running in the background in that case.
+func runCheck(ctx context.Context, check func() error) ComponentCheck {
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		done <- check()
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = fmt.Errorf("no result after %s", readinessTimeout)
+	}
+
+	result := ComponentCheck{
+		ObservedValue: float64(time.Since(start).Microseconds()) / 1000,
+		ObservedUnit:  "ms",
+		Status:        HealthStatusPass,
+		Time:          start.UTC().Format(time.RFC3339),
+	}
+	if err != nil {
+		result.Status = HealthStatusFail
+		result.Output = err.Error()
+	}
+	return result
+}
+
+// checkStorage starts an empty read transaction, which requires the
+// storage to be reachable and not closed.
+func checkStorage(ctx context.Context, repositoryProvider domain.SignatureDeviceRepositoryProvider) ComponentCheck {
+	check := runCheck(ctx, func() error {
+		return repositoryProvider.ReadTx(func(domain.SignatureDeviceRepository) error {
+			return nil
+		})
+	})
+	check.ComponentType = "datastore"
+	return check
+}
+
+// selfTestCache holds the result of the last self-tests of all supported
+// algorithms.
+type selfTestCache struct {
+	mu        sync.Mutex
+	results   []ComponentCheck
+	checkedAt time.Time
+}
+
+// checks returns the cached self-test results, and runs the self-tests
+// again once they are older than selfTestInterval. Concurrent probes wait
+// for a single run instead of starting their own.
+func (c *selfTestCache) checks(ctx context.Context) []ComponentCheck {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.results != nil && time.Since(c.checkedAt) < selfTestInterval {
+		return c.results
+	}
+
+	algorithmNames := crypto.SupportedAlgorithmNames()
+	results := make([]ComponentCheck, len(algorithmNames))
+	var wg sync.WaitGroup
+	for i, algorithmName := range algorithmNames {
+		wg.Add(1)
+		go func(i int, algorithmName string) {
+			defer wg.Done()
+			results[i] = checkAlgorithm(ctx, algorithmName)
+		}(i, algorithmName)
+	}
+	wg.Wait()
+
+	c.results = results
+	c.checkedAt = time.Now()
+	return results
+}
+
+func checkAlgorithm(ctx context.Context, algorithmName string) ComponentCheck {
+	check := runCheck(ctx, func() error {
+		return crypto.SelfTest(algorithmName)
+	})
+	check.ComponentID = algorithmName
+	check.ComponentType = "component"
+	return check
+}
+
+// writeHealthCheckResponse responds with 503 Service Unavailable
+// when the check failed, so that load balancers can act on the status
+// code alone.
+func writeHealthCheckResponse(response http.ResponseWriter, health HealthCheckResponse) {
+	code := http.StatusOK
+	if health.Status == HealthStatusFail {
+		code = http.StatusServiceUnavailable
+	}
+
+	// marshaling strings and numbers cannot fail
+	bytes, _ := json.MarshalIndent(health, "", "  ")
 
-	WriteAPIResponse(response, http.StatusOK, health)
+	response.Header().Set("Content-Type", HealthContentType)
+	response.Header().Set("Cache-Control", "no-store")
+	response.WriteHeader(code)
+	response.Write(bytes)
 }
@@ -1,12 +1,14 @@
 package api_test
 
 import (
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 
 	"github.com/fiskaly/coding-challenges/signing-service-challenge/api"
 	"github.com/fiskaly/coding-challenges/signing-service-challenge/persistence"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/version"
 )
 
 func TestHealth(t *testing.T) {
@@ -33,10 +35,135 @@ func TestHealth(t *testing.T) {
 	expectedBody := `{
   "data": {
     "status": "pass",
-    "version": "v0"
+    "version": "` + version.Version + `"
   }
 }`
 	if body != expectedBody {
 		t.Errorf("expected: %s, got: %s", expectedBody, body)
 	}
 }
+
+func getHealthCheck(t *testing.T, url string) (int, api.HealthCheckResponse) {
+	t.Helper()
+
+	response := sendJsonRequest(t, http.MethodGet, url)
+	defer response.Body.Close()
+
+	if contentType := response.Header.Get("Content-Type"); contentType != api.HealthContentType {
+		t.Errorf("expected content type: %s, got: %s", api.HealthContentType, contentType)
+	}
+	var health api.HealthCheckResponse
+	if err := json.NewDecoder(response.Body).Decode(&health); err != nil {
+		t.Fatal(err)
+	}
+	return response.StatusCode, health
+}
+
+func TestLivez(t *testing.T) {
+	provider := persistence.NewInMemorySignatureDeviceRepositoryProvider(
+		persistence.NewInMemorySignatureDeviceRepository(),
+	)
+	server := httptest.NewServer(api.NewServer("", api.NewSignatureService(provider)).HTTPHandler())
+	defer server.Close()
+
+	// a closed storage makes the service unready, but not dead
+	provider.Close()
+
+	statusCode, health := getHealthCheck(t, server.URL+"/livez")
+
+	if statusCode != http.StatusOK {
+		t.Errorf("expected status code: %d, got: %d", http.StatusOK, statusCode)
+	}
+	if health.Status != api.HealthStatusPass {
+		t.Errorf("expected status pass, got: %s", health.Status)
+	}
+	if health.Version != version.Version || health.ServiceID == "" {
+		t.Errorf("expected version and service ID, got: %+v", health)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	t.Run("passes when the storage responds and all algorithms work", func(t *testing.T) {
+		provider := persistence.NewInMemorySignatureDeviceRepositoryProvider(
+			persistence.NewInMemorySignatureDeviceRepository(),
+		)
+		server := httptest.NewServer(api.NewServer("", api.NewSignatureService(provider)).HTTPHandler())
+		defer server.Close()
+
+		statusCode, health := getHealthCheck(t, server.URL+"/readyz")
+
+		if statusCode != http.StatusOK {
+			t.Errorf("expected status code: %d, got: %d", http.StatusOK, statusCode)
+		}
+		if health.Status != api.HealthStatusPass {
+			t.Errorf("expected status pass, got: %+v", health)
+		}
+
+		storageChecks := health.Checks["storage:responseTime"]
+		if len(storageChecks) != 1 || storageChecks[0].Status != api.HealthStatusPass {
+			t.Errorf("expected passing storage check, got: %+v", storageChecks)
+		}
+		algorithmChecks := map[string]string{}
+		for _, check := range health.Checks["algorithms:selfTest"] {
+			algorithmChecks[check.ComponentID] = check.Status
+		}
+		expectedAlgorithmChecks := map[string]string{
+			"ECC": api.HealthStatusPass,
+			"RSA": api.HealthStatusPass,
+		}
+		for algorithm, status := range expectedAlgorithmChecks {
+			if algorithmChecks[algorithm] != status {
+				t.Errorf("expected self-test of %s to %s, got: %+v", algorithm, status, algorithmChecks)
+			}
+		}
+	})
+
+	t.Run("fails with the reason when the storage does not respond", func(t *testing.T) {
+		provider := persistence.NewInMemorySignatureDeviceRepositoryProvider(
+			persistence.NewInMemorySignatureDeviceRepository(),
+		)
+		server := httptest.NewServer(api.NewServer("", api.NewSignatureService(provider)).HTTPHandler())
+		defer server.Close()
+		provider.Close()
+
+		statusCode, health := getHealthCheck(t, server.URL+"/readyz")
+
+		if statusCode != http.StatusServiceUnavailable {
+			t.Errorf("expected status code: %d, got: %d", http.StatusServiceUnavailable, statusCode)
+		}
+		if health.Status != api.HealthStatusFail {
+			t.Errorf("expected status fail, got: %s", health.Status)
+		}
+		storageChecks := health.Checks["storage:responseTime"]
+		if len(storageChecks) != 1 || storageChecks[0].Output != "repository provider is closed" {
+			t.Errorf("expected failed storage check with reason, got: %+v", storageChecks)
+		}
+		for _, check := range health.Checks["algorithms:selfTest"] {
+			if check.Status != api.HealthStatusPass {
+				t.Errorf("expected algorithms to still pass, got: %+v", check)
+			}
+		}
+	})
+
+	t.Run("reuses the result of the algorithm self-tests", func(t *testing.T) {
+		provider := persistence.NewInMemorySignatureDeviceRepositoryProvider(
+			persistence.NewInMemorySignatureDeviceRepository(),
+		)
+		server := httptest.NewServer(api.NewServer("", api.NewSignatureService(provider)).HTTPHandler())
+		defer server.Close()
+
+		_, first := getHealthCheck(t, server.URL+"/readyz")
+		_, second := getHealthCheck(t, server.URL+"/readyz")
+
+		firstChecks := first.Checks["algorithms:selfTest"]
+		secondChecks := second.Checks["algorithms:selfTest"]
+		if len(firstChecks) == 0 || len(firstChecks) != len(secondChecks) {
+			t.Fatalf("expected self-test checks in both responses, got: %+v, %+v", firstChecks, secondChecks)
+		}
+		for i := range firstChecks {
+			if firstChecks[i] != secondChecks[i] {
+				t.Errorf("expected the cached self-test result, got: %+v, then: %+v", firstChecks[i], secondChecks[i])
+			}
+		}
+	})
+}
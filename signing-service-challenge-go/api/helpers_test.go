@@ -7,8 +7,13 @@ import (
 	"io"
 	"net/http"
 	"testing"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/api"
 )
 
+// sent with every request, so that error responses are predictable
+const testRequestID = "test-request-id"
+
 func sendJsonRequest(
 	t *testing.T,
 	httpMethod string,
@@ -31,6 +36,7 @@ func sendJsonRequest(
 		t.Fatal(fmt.Sprintf("json.Marshal failed: err"))
 	}
 	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(api.RequestIDHeader, testRequestID)
 
 	response, err := http.DefaultClient.Do(request)
 	if err != nil {
@@ -0,0 +1,156 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/jobs"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/logging"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+// WithJobs enables asynchronous processing of requests with `?async=true`
+// on the queue. The caller must close the queue on shutdown.
+func WithJobs(queue *jobs.Queue) SignatureServiceOption {
+	return func(s *SignatureService) {
+		s.jobs = queue
+	}
+}
+
+type JobResponse struct {
+	ID     string      `json:"id"`
+	Status jobs.Status `json:"status"`
+	// the response the synchronous request would have returned,
+	// only set when the job succeeded
+	Result any `json:"result,omitempty"`
+	// only set when the job failed
+	Errors     []string   `json:"errors,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+func newJobResponse(job jobs.Job) JobResponse {
+	response := JobResponse{
+		ID:        job.ID.String(),
+		Status:    job.Status,
+		Result:    job.Result,
+		CreatedAt: job.CreatedAt.UTC(),
+	}
+	if job.Status == jobs.StatusFailed {
+		response.Errors = []string{job.Error}
+	}
+	if !job.FinishedAt.IsZero() {
+		finishedAt := job.FinishedAt.UTC()
+		response.FinishedAt = &finishedAt
+	}
+	return response
+}
+
+// parseAsync reads the `async` query parameter.
+// It writes an error response and returns ok: false when it is invalid.
+func parseAsync(response http.ResponseWriter, request *http.Request) (async bool, ok bool) {
+	value := request.URL.Query().Get("async")
+	if value == "" {
+		return false, true
+	}
+
+	async, err := strconv.ParseBool(value)
+	if err != nil {
+		WriteErrorResponse(response, http.StatusBadRequest, []string{
+			"async must be true or false",
+		})
+		return false, false
+	}
+	return async, true
+}
+
+// submitJob runs the work of a request on the job queue and responds with
+// 202 Accepted and the job, which can be polled at its `Location`.
+// Jobs of the same device are run in the order they were submitted.
+func (s *SignatureService) submitJob(
+	response http.ResponseWriter,
+	request *http.Request,
+	deviceID uuid.UUID,
+	run func(ctx context.Context) (any, error),
+) {
+	if s.jobs == nil {
+		WriteErrorResponse(response, http.StatusBadRequest, []string{
+			"asynchronous processing is not enabled",
+		})
+		return
+	}
+
+	// keep the logger and trace of the request, which ends before the job
+	ctx := context.WithoutCancel(request.Context())
+	job, err := s.jobs.Submit(ctx, deviceID.String(), func(ctx context.Context) (any, error) {
+		result, err := run(ctx)
+		var reqErr requestError
+		if err != nil && !errors.As(err, &reqErr) {
+			logging.FromContext(ctx).LogAttrs(
+				ctx,
+				slog.LevelError,
+				"job failed",
+				slog.String("error", err.Error()),
+			)
+			return nil, errors.New(http.StatusText(http.StatusInternalServerError))
+		}
+		return result, err
+	})
+	switch {
+	case errors.Is(err, jobs.ErrQueueFull):
+		response.Header().Set("Retry-After", "1")
+		WriteErrorResponse(response, http.StatusServiceUnavailable, []string{
+			"too many pending jobs",
+		})
+		return
+	case errors.Is(err, jobs.ErrQueueClosed):
+		WriteErrorResponse(response, http.StatusServiceUnavailable, []string{
+			"service is shutting down",
+		})
+		return
+	case err != nil:
+		WriteInternalError(response, request, err)
+		return
+	}
+
+	response.Header().Set("Location", "/api/v0/jobs/"+job.ID.String())
+	WriteAPIResponse(response, request, http.StatusAccepted, newJobResponse(job))
+}
+
+type FindJobResponse = JobResponse
+
+// FindJob returns the state of a job, and its result once it is finished.
+// Finished jobs can only be retrieved for a limited time, and only by
+// clients allowed to use the device of the job, see authorizeDevice.
+func (s *Server) FindJob(response http.ResponseWriter, request *http.Request) {
+	jobID, err := uuid.Parse(chi.URLParam(request, "jobID"))
+	if err != nil {
+		WriteErrorResponse(response, http.StatusBadRequest, []string{
+			"id is not a valid uuid",
+		})
+		return
+	}
+
+	var job jobs.Job
+	found := false
+	if s.signatureService.jobs != nil {
+		job, found = s.signatureService.jobs.Get(jobID)
+	}
+	if !found {
+		WriteErrorResponse(response, http.StatusNotFound, []string{
+			"job not found",
+		})
+		return
+	}
+	if err := s.checkDeviceBinding(request, job.Key); err != nil {
+		writeError(response, request, err)
+		return
+	}
+
+	WriteAPIResponse(response, request, http.StatusOK, newJobResponse(job))
+}
@@ -0,0 +1,257 @@
+package api_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/api"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/crypto"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/jobs"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/persistence"
+	"github.com/google/uuid"
+)
+
+func newJobsTestServer(t *testing.T, repository persistence.InMemorySignatureDeviceRepository) string {
+	t.Helper()
+
+	queue := jobs.NewQueue(jobs.Options{Workers: 4, QueueSize: 100, Retention: time.Hour})
+	t.Cleanup(func() { queue.Close(context.Background()) })
+
+	signatureService := api.NewSignatureService(
+		persistence.NewInMemorySignatureDeviceRepositoryProvider(repository),
+		api.WithJobs(queue),
+	)
+	server := httptest.NewServer(api.NewServer("", signatureService).HTTPHandler())
+	t.Cleanup(server.Close)
+
+	return server.URL
+}
+
+// submitJob sends the request and returns the URL of the accepted job.
+func submitJob(t *testing.T, httpMethod, url string, body any) string {
+	t.Helper()
+
+	response := sendJsonRequest(t, httpMethod, url, body)
+	var responseBody struct {
+		Data api.JobResponse `json:"data"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&responseBody); err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected status code: %d, got: %d", http.StatusAccepted, response.StatusCode)
+	}
+	if responseBody.Data.Status != jobs.StatusPending {
+		t.Errorf("expected pending job, got: %s", responseBody.Data.Status)
+	}
+	location := response.Header.Get("Location")
+	if location != "/api/v0/jobs/"+responseBody.Data.ID {
+		t.Errorf("expected Location of the job, got: %s", location)
+	}
+	return location
+}
+
+// waitForJob polls the job until it is finished, and decodes its result.
+func waitForJob(t *testing.T, serverURL, location string, result any) api.JobResponse {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		response := sendJsonRequest(t, http.MethodGet, serverURL+location)
+		var responseBody struct {
+			Data struct {
+				api.JobResponse
+				Result json.RawMessage `json:"result"`
+			} `json:"data"`
+		}
+		if err := json.NewDecoder(response.Body).Decode(&responseBody); err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			t.Fatalf("expected status code: %d, got: %d", http.StatusOK, response.StatusCode)
+		}
+
+		job := responseBody.Data.JobResponse
+		if job.Status != jobs.StatusPending {
+			if job.Status == jobs.StatusSucceeded {
+				if err := json.Unmarshal(responseBody.Data.Result, result); err != nil {
+					t.Fatal(err)
+				}
+			}
+			return job
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("job %s did not finish", location)
+	return api.JobResponse{}
+}
+
+func TestAsyncSignTransaction(t *testing.T) {
+	t.Run("signs in submission order", func(t *testing.T) {
+		id := uuid.New()
+		device, err := domain.BuildSignatureDevice(id, crypto.ECCGenerator{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		repository := persistence.NewInMemorySignatureDeviceRepository()
+		if err := repository.Create(device); err != nil {
+			t.Fatal(err)
+		}
+		serverURL := newJobsTestServer(t, repository)
+
+		locations := []string{}
+		for i := 0; i < 20; i++ {
+			locations = append(locations, submitJob(
+				t,
+				http.MethodPost,
+				fmt.Sprintf("%s/api/v0/signature_devices/%s/signatures?async=true", serverURL, id),
+				api.SignTransactionRequest{DataToBeSigned: fmt.Sprintf("transaction-%d", i)},
+			))
+		}
+
+		for i, location := range locations {
+			var result api.SignTransactionResponse
+			job := waitForJob(t, serverURL, location, &result)
+			if job.Status != jobs.StatusSucceeded {
+				t.Fatalf("expected job to succeed, got: %+v", job)
+			}
+			if job.FinishedAt == nil {
+				t.Error("expected finished_at to be set")
+			}
+			expectedPrefix := fmt.Sprintf("%d_transaction-%d_", i, i)
+			if !strings.HasPrefix(result.SignedData, expectedPrefix) {
+				t.Errorf("expected signed data to start with %s, got: %s", expectedPrefix, result.SignedData)
+			}
+			if result.Signature == "" {
+				t.Error("expected a signature")
+			}
+		}
+	})
+
+	t.Run("fails the job when the device does not exist", func(t *testing.T) {
+		serverURL := newJobsTestServer(t, persistence.NewInMemorySignatureDeviceRepository())
+
+		location := submitJob(
+			t,
+			http.MethodPost,
+			fmt.Sprintf("%s/api/v0/signature_devices/%s/signatures?async=true", serverURL, uuid.New()),
+			api.SignTransactionRequest{DataToBeSigned: "some-data"},
+		)
+
+		job := waitForJob(t, serverURL, location, nil)
+		if job.Status != jobs.StatusFailed {
+			t.Fatalf("expected job to fail, got: %s", job.Status)
+		}
+		if len(job.Errors) != 1 || job.Errors[0] != "signature device not found" {
+			t.Errorf("expected device not found error, got: %v", job.Errors)
+		}
+	})
+
+	t.Run("validates the request before accepting it", func(t *testing.T) {
+		serverURL := newJobsTestServer(t, persistence.NewInMemorySignatureDeviceRepository())
+
+		response := sendJsonRequest(
+			t,
+			http.MethodPost,
+			serverURL+"/api/v0/signature_devices/not-a-uuid/signatures?async=true",
+			api.SignTransactionRequest{DataToBeSigned: "some-data"},
+		)
+		body := readBody(t, response)
+		expectedBody := `{"errors":["id is not a valid uuid"],"request_id":"test-request-id"}`
+		if response.StatusCode != http.StatusBadRequest || body != expectedBody {
+			t.Errorf("expected: %s, got: %d %s", expectedBody, response.StatusCode, body)
+		}
+
+		response = sendJsonRequest(
+			t,
+			http.MethodPost,
+			fmt.Sprintf("%s/api/v0/signature_devices/%s/signatures?async=maybe", serverURL, uuid.New()),
+			api.SignTransactionRequest{DataToBeSigned: "some-data"},
+		)
+		body = readBody(t, response)
+		expectedBody = `{"errors":["async must be true or false"],"request_id":"test-request-id"}`
+		if response.StatusCode != http.StatusBadRequest || body != expectedBody {
+			t.Errorf("expected: %s, got: %d %s", expectedBody, response.StatusCode, body)
+		}
+	})
+
+	t.Run("rejects async requests when jobs are not enabled", func(t *testing.T) {
+		signatureService := api.NewSignatureService(
+			persistence.NewInMemorySignatureDeviceRepositoryProvider(
+				persistence.NewInMemorySignatureDeviceRepository(),
+			),
+		)
+		server := httptest.NewServer(api.NewServer("", signatureService).HTTPHandler())
+		defer server.Close()
+
+		response := sendJsonRequest(
+			t,
+			http.MethodPost,
+			fmt.Sprintf("%s/api/v0/signature_devices/%s/signatures?async=true", server.URL, uuid.New()),
+			api.SignTransactionRequest{DataToBeSigned: "some-data"},
+		)
+		body := readBody(t, response)
+		expectedBody := `{"errors":["asynchronous processing is not enabled"],"request_id":"test-request-id"}`
+		if response.StatusCode != http.StatusBadRequest || body != expectedBody {
+			t.Errorf("expected: %s, got: %d %s", expectedBody, response.StatusCode, body)
+		}
+	})
+}
+
+func TestAsyncCreateSignatureDevice(t *testing.T) {
+	repository := persistence.NewInMemorySignatureDeviceRepository()
+	serverURL := newJobsTestServer(t, repository)
+	id := uuid.New()
+
+	location := submitJob(
+		t,
+		http.MethodPost,
+		serverURL+"/api/v0/signature_devices?async=true",
+		api.CreateSignatureDeviceRequest{ID: id.String(), Algorithm: "RSA", Label: "till-1"},
+	)
+
+	var result api.CreateSignatureDeviceResponse
+	job := waitForJob(t, serverURL, location, &result)
+	if job.Status != jobs.StatusSucceeded {
+		t.Fatalf("expected job to succeed, got: %+v", job)
+	}
+	if result.ID != id.String() || result.Label != "till-1" || result.Algorithm != "RSA" || result.PublicKey == "" {
+		t.Errorf("unexpected result: %+v", result)
+	}
+	if _, found, _ := repository.Find(id); !found {
+		t.Error("expected device to be created")
+	}
+
+	// the duplicate is only detected by the job
+	location = submitJob(
+		t,
+		http.MethodPost,
+		serverURL+"/api/v0/signature_devices?async=true",
+		api.CreateSignatureDeviceRequest{ID: id.String(), Algorithm: "RSA"},
+	)
+	job = waitForJob(t, serverURL, location, nil)
+	if job.Status != jobs.StatusFailed || len(job.Errors) != 1 || job.Errors[0] != "duplicate id" {
+		t.Errorf("expected job to fail with duplicate id, got: %+v", job)
+	}
+}
+
+func TestFindJob(t *testing.T) {
+	serverURL := newJobsTestServer(t, persistence.NewInMemorySignatureDeviceRepository())
+
+	response := sendJsonRequest(t, http.MethodGet, serverURL+"/api/v0/jobs/"+uuid.NewString())
+	body := readBody(t, response)
+	expectedBody := `{"errors":["job not found"],"request_id":"test-request-id"}`
+	if response.StatusCode != http.StatusNotFound || body != expectedBody {
+		t.Errorf("expected: %s, got: %d %s", expectedBody, response.StatusCode, body)
+	}
+}
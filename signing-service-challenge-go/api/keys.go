@@ -0,0 +1,145 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/crypto"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+// media types of the public key formats, in the order they are preferred
+// when negotiating
+var publicKeyMediaTypes = []struct {
+	mediaType string
+	format    crypto.PublicKeyFormat
+}{
+	{"application/x-pem-file", crypto.PublicKeyFormatPEM},
+	{"application/jwk+json", crypto.PublicKeyFormatJWK},
+	{"application/octet-stream", crypto.PublicKeyFormatDER},
+}
+
+// parsePublicKeyFormat reads the `format` query parameter, which selects
+// the encoding of public keys in responses. PEM is the default.
+func parsePublicKeyFormat(response http.ResponseWriter, request *http.Request) (crypto.PublicKeyFormat, bool) {
+	value := request.URL.Query().Get("format")
+	if value == "" {
+		return crypto.PublicKeyFormatPEM, true
+	}
+
+	formats := []string{}
+	for _, format := range crypto.PublicKeyFormats {
+		if string(format) == value {
+			return format, true
+		}
+		formats = append(formats, string(format))
+	}
+	WriteErrorResponse(response, http.StatusBadRequest, []string{
+		"format must be one of " + strings.Join(formats, ", "),
+	})
+	return "", false
+}
+
+// negotiatePublicKeyFormat picks the public key format of the `format`
+// query parameter or, without it, of the `Accept` header.
+func negotiatePublicKeyFormat(response http.ResponseWriter, request *http.Request) (crypto.PublicKeyFormat, bool) {
+	if request.URL.Query().Has("format") {
+		return parsePublicKeyFormat(response, request)
+	}
+
+	accept := request.Header.Get("Accept")
+	if accept == "" {
+		return crypto.PublicKeyFormatPEM, true
+	}
+	for _, value := range strings.Split(accept, ",") {
+		mediaType, _, err := mime.ParseMediaType(value)
+		if err != nil {
+			continue
+		}
+		if mediaType == "*/*" || mediaType == "application/*" {
+			return crypto.PublicKeyFormatPEM, true
+		}
+		for _, candidate := range publicKeyMediaTypes {
+			if candidate.mediaType == mediaType {
+				return candidate.format, true
+			}
+		}
+	}
+
+	mediaTypes := []string{}
+	for _, candidate := range publicKeyMediaTypes {
+		mediaTypes = append(mediaTypes, candidate.mediaType)
+	}
+	WriteErrorResponse(response, http.StatusNotAcceptable, []string{
+		"Accept must be one of " + strings.Join(mediaTypes, ", "),
+	})
+	return "", false
+}
+
+// FindPublicKey responds with the bare public key of a device, in the
+// format chosen by the `format` query parameter or the `Accept` header:
+// PEM, a JWK or DER.
+func (s *SignatureService) FindPublicKey(response http.ResponseWriter, request *http.Request) {
+	deviceID, err := uuid.Parse(chi.URLParam(request, "deviceID"))
+	if err != nil {
+		WriteErrorResponse(response, http.StatusBadRequest, []string{
+			"id is not a valid uuid",
+		})
+		return
+	}
+
+	format, ok := negotiatePublicKeyFormat(response, request)
+	if !ok {
+		return
+	}
+
+	var device domain.SignatureDevice
+	var deviceFound bool
+	err = domain.ReadTx(request.Context(), s.repositoryProvider, func(ctx context.Context, repository domain.SignatureDeviceRepository) error {
+		device, deviceFound, err = repository.Find(deviceID)
+		return err
+	})
+	if err != nil {
+		WriteInternalError(response, request, err)
+		return
+	}
+	if !deviceFound {
+		WriteErrorResponse(response, http.StatusNotFound, []string{
+			"signature device not found",
+		})
+		return
+	}
+
+	var body []byte
+	var mediaType string
+	switch format {
+	case crypto.PublicKeyFormatJWK:
+		mediaType = "application/jwk+json"
+		var jwk crypto.JWK
+		if jwk, err = crypto.PublicKeyJWK(device.KeyPair); err == nil {
+			body, err = json.Marshal(jwk)
+		}
+	case crypto.PublicKeyFormatDER:
+		mediaType = "application/octet-stream"
+		body, err = crypto.MarshalPublicKey(device.KeyPair)
+	default:
+		mediaType = "application/x-pem-file"
+		var publicKey string
+		publicKey, err = device.KeyPair.EncodedPublicKey()
+		body = []byte(publicKey)
+	}
+	if err != nil {
+		WriteInternalError(response, request, err)
+		return
+	}
+
+	response.Header().Set("Content-Type", mediaType)
+	response.Header().Set("Vary", "Accept")
+	response.WriteHeader(http.StatusOK)
+	response.Write(body)
+}
@@ -0,0 +1,128 @@
+package api_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/api"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/crypto"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/persistence"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/uuid"
+)
+
+func newKeyServer(t *testing.T) (string, domain.SignatureDevice) {
+	t.Helper()
+
+	device, err := domain.BuildSignatureDevice(uuid.New(), crypto.ECCGenerator{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	repository := persistence.NewInMemorySignatureDeviceRepository()
+	if err := repository.Create(device); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(api.NewServer(
+		"",
+		api.NewSignatureService(persistence.NewInMemorySignatureDeviceRepositoryProvider(repository)),
+	).HTTPHandler())
+	t.Cleanup(server.Close)
+	return server.URL, device
+}
+
+func getPublicKey(t *testing.T, url string, accept string) *http.Response {
+	t.Helper()
+
+	request, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set(api.RequestIDHeader, testRequestID)
+	if accept != "" {
+		request.Header.Set("Accept", accept)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+func TestPublicKeyFormats(t *testing.T) {
+	t.Run("encodes public keys of devices in the requested format", func(t *testing.T) {
+		serverURL, device := newKeyServer(t)
+		jwk, err := crypto.PublicKeyJWK(device.KeyPair)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		response := sendJsonRequest(t, http.MethodGet, fmt.Sprintf("%s/api/v0/signature_devices/%s?format=jwk", serverURL, device.ID))
+
+		var body struct {
+			Data struct {
+				PublicKey crypto.JWK `json:"public_key"`
+			} `json:"data"`
+		}
+		if err := json.Unmarshal([]byte(readBody(t, response)), &body); err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(body.Data.PublicKey, jwk); diff != "" {
+			t.Errorf("unexpected diff: %s", diff)
+		}
+
+		response = sendJsonRequest(t, http.MethodGet, serverURL+"/api/v0/signature_devices?format=xml")
+		if response.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected status code: %d, got: %d", http.StatusBadRequest, response.StatusCode)
+		}
+		expectedBody := `{"errors":["format must be one of pem, der, jwk"],"request_id":"test-request-id"}`
+		if body := readBody(t, response); body != expectedBody {
+			t.Errorf("expected: %s, got: %s", expectedBody, body)
+		}
+	})
+
+	t.Run("serves the bare public key by content negotiation", func(t *testing.T) {
+		serverURL, device := newKeyServer(t)
+		url := fmt.Sprintf("%s/api/v0/signature_devices/%s/public_key", serverURL, device.ID)
+		expectedPEM, _ := device.KeyPair.EncodedPublicKey()
+		expectedDER, _ := crypto.MarshalPublicKey(device.KeyPair)
+
+		tests := []struct {
+			name                string
+			url                 string
+			accept              string
+			expectedContentType string
+			expectedBody        string
+		}{
+			{"PEM by default", url, "", "application/x-pem-file", expectedPEM},
+			{"DER", url, "application/octet-stream", "application/octet-stream", string(expectedDER)},
+			{"first supported type", url, "text/html, application/jwk+json;q=0.9", "application/jwk+json", ""},
+			{"format parameter", url + "?format=der", "application/jwk+json", "application/octet-stream", string(expectedDER)},
+		}
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				response := getPublicKey(t, test.url, test.accept)
+				body := readBody(t, response)
+
+				if response.StatusCode != http.StatusOK {
+					t.Fatalf("expected status code: %d, got: %d, body: %s", http.StatusOK, response.StatusCode, body)
+				}
+				if contentType := response.Header.Get("Content-Type"); contentType != test.expectedContentType {
+					t.Errorf("expected content type: %s, got: %s", test.expectedContentType, contentType)
+				}
+				if test.expectedBody != "" && body != test.expectedBody {
+					t.Errorf("expected: %q, got: %q", test.expectedBody, body)
+				}
+			})
+		}
+
+		response := getPublicKey(t, url, "text/html")
+		readBody(t, response)
+		if response.StatusCode != http.StatusNotAcceptable {
+			t.Errorf("expected status code: %d, got: %d", http.StatusNotAcceptable, response.StatusCode)
+		}
+	})
+}
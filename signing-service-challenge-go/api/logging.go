@@ -0,0 +1,79 @@
+package api
+
+import (
+	"log/slog"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/logging"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const RequestIDHeader = "X-Request-ID"
+
+// incoming request IDs are only accepted if they cannot break log lines
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// WithLogger writes an access log line for every request, and logs
+// the underlying errors of internal server errors.
+func WithLogger(logger *slog.Logger) ServerOption {
+	return func(s *Server) {
+		s.logger = logger
+	}
+}
+
+// assignRequestID is a middleware that accepts the request ID of the client
+// or generates one, echoes it in the response headers and makes it, and
+// a logger including it, available in the request context.
+func (s *Server) assignRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		requestID := request.Header.Get(RequestIDHeader)
+		if !validRequestID.MatchString(requestID) {
+			requestID = uuid.NewString()
+		}
+		response.Header().Set(RequestIDHeader, requestID)
+
+		logger := s.logger.With(slog.String("request_id", requestID))
+		// correlate log lines with the trace of the request, if it is traced
+		if spanContext := trace.SpanContextFromContext(request.Context()); spanContext.IsValid() {
+			logger = logger.With(slog.String("trace_id", spanContext.TraceID().String()))
+		}
+
+		ctx := logging.WithRequestID(request.Context(), requestID)
+		ctx = logging.NewContext(ctx, logger)
+		next.ServeHTTP(response, request.WithContext(ctx))
+	})
+}
+
+// logRequests is a middleware writing an access log line for every request.
+// Request and response bodies are never logged, as they contain private keys
+// and the data to be signed.
+func (s *Server) logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		start := time.Now()
+		wrappedResponse := middleware.NewWrapResponseWriter(response, request.ProtoMajor)
+
+		next.ServeHTTP(wrappedResponse, request)
+
+		status := wrappedResponse.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		logging.FromContext(request.Context()).LogAttrs(
+			request.Context(),
+			slog.LevelInfo,
+			"request served",
+			slog.String("method", request.Method),
+			slog.String("path", request.URL.Path),
+			slog.String("route", chi.RouteContext(request.Context()).RoutePattern()),
+			slog.Int("status", status),
+			slog.Int("bytes", wrappedResponse.BytesWritten()),
+			slog.Duration("duration", time.Since(start)),
+			slog.String("remote_address", request.RemoteAddr),
+		)
+	})
+}
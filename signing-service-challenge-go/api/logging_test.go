@@ -0,0 +1,203 @@
+package api_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/api"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/logging"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/persistence"
+	"github.com/google/uuid"
+)
+
+// syncBuffer collects log output written by concurrent requests.
+type syncBuffer struct {
+	mutex  sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.String()
+}
+
+// logLines parses the JSON log lines written to the buffer.
+func (b *syncBuffer) logLines(t *testing.T) []map[string]any {
+	t.Helper()
+
+	lines := []map[string]any{}
+	for _, line := range strings.Split(strings.TrimSpace(b.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		parsed := map[string]any{}
+		if err := json.Unmarshal([]byte(line), &parsed); err != nil {
+			t.Fatalf("log line is not valid JSON: %s", line)
+		}
+		lines = append(lines, parsed)
+	}
+	return lines
+}
+
+type failingRepositoryProvider struct {
+	err error
+}
+
+func (p failingRepositoryProvider) WriteTx(func(domain.SignatureDeviceRepository) error) error {
+	return p.err
+}
+
+func (p failingRepositoryProvider) ReadTx(func(domain.SignatureDeviceRepository) error) error {
+	return p.err
+}
+
+func TestRequestID(t *testing.T) {
+	signatureService := api.NewSignatureService(
+		persistence.NewInMemorySignatureDeviceRepositoryProvider(
+			persistence.NewInMemorySignatureDeviceRepository(),
+		),
+	)
+	server := httptest.NewServer(api.NewServer("", signatureService).HTTPHandler())
+	defer server.Close()
+
+	getWithRequestID := func(requestID string) string {
+		request, err := http.NewRequest(http.MethodGet, server.URL+"/api/v0/health", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if requestID != "" {
+			request.Header.Set(api.RequestIDHeader, requestID)
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		return response.Header.Get(api.RequestIDHeader)
+	}
+
+	t.Run("echoes the request ID of the client", func(t *testing.T) {
+		got := getWithRequestID("till-1:42")
+		if got != "till-1:42" {
+			t.Errorf("expected request ID to be echoed, got: %s", got)
+		}
+	})
+
+	t.Run("generates a request ID when none is given", func(t *testing.T) {
+		got := getWithRequestID("")
+		if _, err := uuid.Parse(got); err != nil {
+			t.Errorf("expected generated uuid, got: %s", got)
+		}
+	})
+
+	t.Run("replaces request IDs that could break log lines", func(t *testing.T) {
+		got := getWithRequestID(`"} {"injected": true`)
+		if _, err := uuid.Parse(got); err != nil {
+			t.Errorf("expected generated uuid, got: %s", got)
+		}
+	})
+}
+
+func TestRequestLogging(t *testing.T) {
+	t.Run("writes an access log line without request bodies", func(t *testing.T) {
+		logs := &syncBuffer{}
+		repository := persistence.NewInMemorySignatureDeviceRepository()
+		signatureService := api.NewSignatureService(
+			persistence.NewInMemorySignatureDeviceRepositoryProvider(repository),
+		)
+		server := httptest.NewServer(api.NewServer(
+			"",
+			signatureService,
+			api.WithLogger(logging.New(logs, slog.LevelDebug)),
+		).HTTPHandler())
+		defer server.Close()
+
+		id := uuid.NewString()
+		readBody(t, sendJsonRequest(t, http.MethodPost, server.URL+"/api/v0/signature_devices", api.CreateSignatureDeviceRequest{
+			ID:        id,
+			Algorithm: "ECC",
+		}))
+		secretData := "receipt-4711-secret-amount"
+		readBody(t, sendJsonRequest(
+			t,
+			http.MethodPost,
+			fmt.Sprintf("%s/api/v0/signature_devices/%s/signatures", server.URL, id),
+			api.SignTransactionRequest{DataToBeSigned: secretData},
+		))
+
+		lines := logs.logLines(t)
+		if len(lines) != 2 {
+			t.Fatalf("expected 2 access log lines, got: %s", logs)
+		}
+		signLine := lines[1]
+		expected := map[string]any{
+			"msg":        "request served",
+			"level":      "INFO",
+			"method":     http.MethodPost,
+			"route":      "/api/v0/signature_devices/{deviceID}/signatures",
+			"status":     float64(http.StatusOK),
+			"request_id": testRequestID,
+		}
+		for key, value := range expected {
+			if signLine[key] != value {
+				t.Errorf("expected %s to be %v, got: %v", key, value, signLine[key])
+			}
+		}
+
+		if strings.Contains(logs.String(), secretData) {
+			t.Errorf("data to be signed must not be logged, got: %s", logs)
+		}
+		if strings.Contains(logs.String(), "PRIVATE") {
+			t.Errorf("private keys must not be logged, got: %s", logs)
+		}
+	})
+
+	t.Run("logs the underlying error of internal server errors", func(t *testing.T) {
+		logs := &syncBuffer{}
+		signatureService := api.NewSignatureService(
+			failingRepositoryProvider{err: errors.New("disk on fire")},
+		)
+		server := httptest.NewServer(api.NewServer(
+			"",
+			signatureService,
+			api.WithLogger(logging.New(logs, slog.LevelInfo)),
+		).HTTPHandler())
+		defer server.Close()
+
+		response := sendJsonRequest(t, http.MethodGet, server.URL+"/api/v0/signature_devices")
+
+		expectedStatusCode := http.StatusInternalServerError
+		if response.StatusCode != expectedStatusCode {
+			t.Errorf("expected status code: %d, got: %d", expectedStatusCode, response.StatusCode)
+		}
+		body := readBody(t, response)
+		expectedBody := `{"errors":["Internal Server Error"],"request_id":"test-request-id"}`
+		if body != expectedBody {
+			t.Errorf("expected: %s, got: %s", expectedBody, body)
+		}
+
+		lines := logs.logLines(t)
+		if len(lines) != 2 {
+			t.Fatalf("expected an error and an access log line, got: %s", logs)
+		}
+		if lines[0]["level"] != "ERROR" || lines[0]["error"] != "disk on fire" || lines[0]["request_id"] != testRequestID {
+			t.Errorf("expected error to be logged with request ID, got: %v", lines[0])
+		}
+	})
+}
@@ -0,0 +1,55 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/metrics"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// WithMetrics records HTTP metrics for every request and serves
+// all metrics on `/metrics`.
+// To collect metrics of domain operations, the metrics must also be
+// registered with domain.RegisterObserver.
+func WithMetrics(m *metrics.Metrics) ServerOption {
+	return func(s *Server) {
+		s.metrics = m
+	}
+}
+
+// instrument is a middleware recording the latency and status code
+// of every request by its route pattern.
+func (s *Server) instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		start := time.Now()
+		wrappedResponse := middleware.NewWrapResponseWriter(response, request.ProtoMajor)
+
+		next.ServeHTTP(wrappedResponse, request)
+
+		// use the pattern instead of the path, so that device IDs do not
+		// end up in the labels
+		route := chi.RouteContext(request.Context()).RoutePattern()
+		if route == "" {
+			route = "unmatched"
+		}
+		status := wrappedResponse.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		s.metrics.ObserveHTTPRequest(route, request.Method, status, time.Since(start))
+	})
+}
+
+// countDevices returns the number of signature devices by algorithm.
+func (s *SignatureService) countDevices() (map[string]int, error) {
+	var counts map[string]int
+	err := s.repositoryProvider.ReadTx(func(repository domain.SignatureDeviceRepository) error {
+		var err error
+		counts, err = repository.Count()
+		return err
+	})
+	return counts, err
+}
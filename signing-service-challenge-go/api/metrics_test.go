@@ -0,0 +1,70 @@
+package api_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/api"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/metrics"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/persistence"
+	"github.com/google/uuid"
+)
+
+func TestMetrics(t *testing.T) {
+	serviceMetrics := metrics.New()
+	unregister := domain.RegisterObserver(serviceMetrics)
+	defer unregister()
+
+	signatureService := api.NewSignatureService(
+		persistence.NewInMemorySignatureDeviceRepositoryProvider(
+			persistence.NewInMemorySignatureDeviceRepository(),
+		),
+	)
+	server := httptest.NewServer(api.NewServer("", signatureService, api.WithMetrics(serviceMetrics)).HTTPHandler())
+	defer server.Close()
+
+	id := uuid.NewString()
+	response := sendJsonRequest(t, http.MethodPost, server.URL+"/api/v0/signature_devices", api.CreateSignatureDeviceRequest{
+		ID:        id,
+		Algorithm: "ECC",
+	})
+	readBody(t, response)
+	for i := 0; i < 2; i++ {
+		response = sendJsonRequest(
+			t,
+			http.MethodPost,
+			fmt.Sprintf("%s/api/v0/signature_devices/%s/signatures", server.URL, id),
+			api.SignTransactionRequest{DataToBeSigned: "some-data"},
+		)
+		readBody(t, response)
+	}
+	response = sendJsonRequest(t, http.MethodGet, server.URL+"/api/v0/signature_devices/"+uuid.NewString())
+	readBody(t, response)
+
+	response = sendJsonRequest(t, http.MethodGet, server.URL+"/metrics")
+	if response.StatusCode != http.StatusOK {
+		t.Errorf("expected status code: %d, got: %d", http.StatusOK, response.StatusCode)
+	}
+	body := readBody(t, response)
+
+	expectedLines := []string{
+		`signing_service_http_requests_total{method="POST",route="/api/v0/signature_devices",status="201"} 1`,
+		`signing_service_http_requests_total{method="POST",route="/api/v0/signature_devices/{deviceID}/signatures",status="200"} 2`,
+		`signing_service_http_requests_total{method="GET",route="/api/v0/signature_devices/{deviceID}",status="404"} 1`,
+		`signing_service_http_request_duration_seconds_count{method="POST",route="/api/v0/signature_devices/{deviceID}/signatures",status="200"} 2`,
+		`signing_service_signatures_total{algorithm="ECC"} 2`,
+		`signing_service_signing_duration_seconds_count{algorithm="ECC"} 2`,
+		`signing_service_key_generation_duration_seconds_count{algorithm="ECC"} 1`,
+		`signing_service_write_tx_lock_wait_seconds_count 3`,
+		`signing_service_signature_devices{algorithm="ECC"} 1`,
+	}
+	for _, line := range expectedLines {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("expected metrics to contain:\n%s\ngot:\n%s", line, body)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package api
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/ratelimit"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+// WithRateLimits limits the requests per client and the signatures per
+// device. The limits can be changed at runtime via the admin API.
+// Without this option, nothing is limited until limits are set via the
+// admin API.
+func WithRateLimits(clients, devices *ratelimit.Limiter) ServerOption {
+	return func(s *Server) {
+		s.clientLimiter = clients
+		s.deviceLimiter = devices
+	}
+}
+
+// ClientKey identifies the client of a request for rate limiting, in order
+// of preference by:
+//   - the subject of its verified client certificate, e.g. "cert:CN=till-1"
+//   - its IP address, e.g. "ip:192.0.2.1"
+//
+// Headers are not verified, so a client could choose a new key with every
+// request; they are never used.
+func ClientKey(request *http.Request) string {
+	if request.TLS != nil && len(request.TLS.VerifiedChains) > 0 {
+		return "cert:" + request.TLS.VerifiedChains[0][0].Subject.String()
+	}
+
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		host = request.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// limitClients is a middleware rejecting requests of clients that
+// exceeded their limit.
+func (s *Server) limitClients(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if allowed, retryAfter := s.clientLimiter.Allow(ClientKey(request)); !allowed {
+			writeRateLimitExceeded(response, retryAfter, "rate limit of client exceeded")
+			return
+		}
+		next.ServeHTTP(response, request)
+	})
+}
+
+// limitDevices is a middleware rejecting requests for the device in the
+// `deviceID` URL parameter when the device exceeded its limit, so that
+// a single device cannot occupy the write lock for everyone else.
+func (s *Server) limitDevices(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		// normalize, so that differently cased IDs share a bucket
+		deviceKey := chi.URLParam(request, "deviceID")
+		if deviceID, err := uuid.Parse(deviceKey); err == nil {
+			deviceKey = deviceID.String()
+		}
+
+		if allowed, retryAfter := s.deviceLimiter.Allow(deviceKey); !allowed {
+			writeRateLimitExceeded(response, retryAfter, "rate limit of signature device exceeded")
+			return
+		}
+		next.ServeHTTP(response, request)
+	})
+}
+
+// writeRateLimitExceeded responds with 429 Too Many Requests.
+// Retry-After is given in whole seconds, rounded up.
+func writeRateLimitExceeded(response http.ResponseWriter, retryAfter time.Duration, message string) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	response.Header().Set("Retry-After", strconv.Itoa(seconds))
+	WriteErrorResponse(response, http.StatusTooManyRequests, []string{message})
+}
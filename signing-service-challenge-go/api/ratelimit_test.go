@@ -0,0 +1,203 @@
+package api_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/api"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/crypto"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/persistence"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/ratelimit"
+	"github.com/google/uuid"
+)
+
+// fakeClock only moves when advanced by the test.
+type fakeClock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// newRateLimitedServer starts a server with two ECC devices.
+func newRateLimitedServer(t *testing.T, clientLimits, deviceLimits ratelimit.Limits, options ...api.ServerOption) (*fakeClock, string, []uuid.UUID) {
+	t.Helper()
+
+	repository := persistence.NewInMemorySignatureDeviceRepository()
+	deviceIDs := []uuid.UUID{uuid.New(), uuid.New()}
+	for _, id := range deviceIDs {
+		device, err := domain.BuildSignatureDevice(id, crypto.ECCGenerator{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := repository.Create(device); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	clock := newFakeClock()
+	options = append(options, api.WithRateLimits(
+		ratelimit.NewLimiter(clock, clientLimits),
+		ratelimit.NewLimiter(clock, deviceLimits),
+	))
+	server := httptest.NewServer(api.NewServer(
+		"",
+		api.NewSignatureService(persistence.NewInMemorySignatureDeviceRepositoryProvider(repository)),
+		options...,
+	).HTTPHandler())
+	t.Cleanup(server.Close)
+
+	return clock, server.URL, deviceIDs
+}
+
+func sign(t *testing.T, serverURL string, deviceID uuid.UUID) *http.Response {
+	t.Helper()
+
+	response := sendJsonRequest(
+		t,
+		http.MethodPost,
+		fmt.Sprintf("%s/api/v0/signature_devices/%s/signatures", serverURL, deviceID),
+		api.SignTransactionRequest{DataToBeSigned: "some-data"},
+	)
+	readBody(t, response)
+	return response
+}
+
+func TestRateLimits(t *testing.T) {
+	t.Run("limits the signatures per device", func(t *testing.T) {
+		clock, serverURL, deviceIDs := newRateLimitedServer(
+			t,
+			ratelimit.Limits{},
+			ratelimit.Limits{Default: ratelimit.Limit{Rate: 0.5, Burst: 2}},
+		)
+
+		for i := 0; i < 2; i++ {
+			if response := sign(t, serverURL, deviceIDs[0]); response.StatusCode != http.StatusOK {
+				t.Fatalf("expected signature %d to be allowed, got: %d", i, response.StatusCode)
+			}
+		}
+
+		response := sendJsonRequest(
+			t,
+			http.MethodPost,
+			fmt.Sprintf("%s/api/v0/signature_devices/%s/signatures", serverURL, deviceIDs[0]),
+			api.SignTransactionRequest{DataToBeSigned: "some-data"},
+		)
+		if response.StatusCode != http.StatusTooManyRequests {
+			t.Errorf("expected status code: %d, got: %d", http.StatusTooManyRequests, response.StatusCode)
+		}
+		if retryAfter := response.Header.Get("Retry-After"); retryAfter != "2" {
+			t.Errorf("expected Retry-After: 2, got: %s", retryAfter)
+		}
+		body := readBody(t, response)
+		expectedBody := `{"errors":["rate limit of signature device exceeded"],"request_id":"test-request-id"}`
+		if body != expectedBody {
+			t.Errorf("expected: %s, got: %s", expectedBody, body)
+		}
+
+		if response := sign(t, serverURL, deviceIDs[1]); response.StatusCode != http.StatusOK {
+			t.Errorf("expected other device to be unaffected, got: %d", response.StatusCode)
+		}
+
+		clock.Advance(2 * time.Second)
+		if response := sign(t, serverURL, deviceIDs[0]); response.StatusCode != http.StatusOK {
+			t.Errorf("expected signature after the refill to be allowed, got: %d", response.StatusCode)
+		}
+	})
+
+	t.Run("limits the requests per client", func(t *testing.T) {
+		_, serverURL, deviceIDs := newRateLimitedServer(
+			t,
+			ratelimit.Limits{
+				Default: ratelimit.Limit{Rate: 1, Burst: 1},
+			},
+			ratelimit.Limits{},
+		)
+
+		if response := sign(t, serverURL, deviceIDs[0]); response.StatusCode != http.StatusOK {
+			t.Fatalf("expected first request to be allowed, got: %d", response.StatusCode)
+		}
+		// the client limit spans all devices and endpoints
+		if response := sign(t, serverURL, deviceIDs[1]); response.StatusCode != http.StatusTooManyRequests {
+			t.Errorf("expected status code: %d, got: %d", http.StatusTooManyRequests, response.StatusCode)
+		}
+		response := sendJsonRequest(t, http.MethodGet, serverURL+"/api/v0/signature_devices")
+		readBody(t, response)
+		if response.StatusCode != http.StatusTooManyRequests {
+			t.Errorf("expected status code: %d, got: %d", http.StatusTooManyRequests, response.StatusCode)
+		}
+
+		// health checks must keep working for load balancers
+		response = sendJsonRequest(t, http.MethodGet, serverURL+"/readyz")
+		readBody(t, response)
+		if response.StatusCode != http.StatusOK {
+			t.Errorf("expected health check to be unlimited, got: %d", response.StatusCode)
+		}
+	})
+
+	t.Run("does not limit clients by their API credential", func(t *testing.T) {
+		_, serverURL, _ := newRateLimitedServer(
+			t,
+			ratelimit.Limits{Default: ratelimit.Limit{Rate: 1, Burst: 1}},
+			ratelimit.Limits{},
+		)
+
+		list := func(apiKey string) int {
+			request, err := http.NewRequest(http.MethodGet, serverURL+"/api/v0/signature_devices", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			request.Header.Set("X-API-Key", apiKey)
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			readBody(t, response)
+			return response.StatusCode
+		}
+
+		if status := list("till-1-key"); status != http.StatusOK {
+			t.Fatalf("expected first request to be allowed, got: %d", status)
+		}
+		if status := list("till-1-key"); status != http.StatusTooManyRequests {
+			t.Errorf("expected second request to be limited, got: %d", status)
+		}
+		// unverified, so it cannot be used to get a new limit
+		if status := list("till-2-key"); status != http.StatusTooManyRequests {
+			t.Errorf("expected request with another credential to be limited, got: %d", status)
+		}
+	})
+}
+
+func TestClientKey(t *testing.T) {
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	request.RemoteAddr = "192.0.2.1:1234"
+	if key := api.ClientKey(request); key != "ip:192.0.2.1" {
+		t.Errorf("expected ip:192.0.2.1, got: %s", key)
+	}
+
+	request.Header.Set("Authorization", "Bearer secret")
+	request.Header.Set("X-API-Key", "secret")
+	if key := api.ClientKey(request); key != "ip:192.0.2.1" {
+		t.Errorf("expected the credential to be ignored, got: %s", key)
+	}
+}
@@ -1,9 +1,19 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
 	"net/http"
+	"time"
 
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/ca"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/logging"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/metrics"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/ratelimit"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/webhooks"
 	"github.com/go-chi/chi/v5"
 )
 
@@ -14,77 +24,256 @@ type Response struct {
 
 // ErrorResponse is the generic error API response container.
 type ErrorResponse struct {
-	Errors []string `json:"errors"`
+	Errors    []string `json:"errors"`
+	RequestID string   `json:"request_id,omitempty"`
 }
 
 // Server manages HTTP requests and dispatches them to the appropriate services.
 type Server struct {
 	listenAddress    string
 	signatureService SignatureService
+	tlsOptions       *TLSOptions
+	readTimeout      time.Duration
+	writeTimeout     time.Duration
+	idleTimeout      time.Duration
+	metrics          *metrics.Metrics
+	logger           *slog.Logger
+	clientLimiter    *ratelimit.Limiter
+	deviceLimiter    *ratelimit.Limiter
+	adminToken       string
+	webhooks         *webhooks.Dispatcher
+	backupKey        []byte
+	transferKey      []byte
+	authority        *ca.Authority
+	selfTests        *selfTestCache
+	httpServer       *http.Server
+}
+
+// ServerOption configures optional behaviour of a Server.
+type ServerOption func(*Server)
+
+// WithTimeouts sets the read, write and idle timeouts of the underlying
+// http.Server. A zero value means no timeout.
+func WithTimeouts(read, write, idle time.Duration) ServerOption {
+	return func(s *Server) {
+		s.readTimeout = read
+		s.writeTimeout = write
+		s.idleTimeout = idle
+	}
 }
 
 // NewServer is a factory to instantiate a new Server.
 func NewServer(
 	listenAddress string,
 	signatureService SignatureService,
+	options ...ServerOption,
 ) *Server {
-	return &Server{
+	server := &Server{
 		listenAddress:    listenAddress,
 		signatureService: signatureService,
+		selfTests:        &selfTestCache{},
+	}
+	for _, option := range options {
+		option(server)
+	}
+	if server.logger == nil {
+		server.logger = logging.Discard()
+	}
+	if server.clientLimiter == nil {
+		server.clientLimiter = ratelimit.NewLimiter(ratelimit.SystemClock, ratelimit.Limits{})
+	}
+	if server.deviceLimiter == nil {
+		server.deviceLimiter = ratelimit.NewLimiter(ratelimit.SystemClock, ratelimit.Limits{})
+	}
+	if server.metrics != nil {
+		server.metrics.RegisterDeviceCount(server.signatureService.countDevices)
+	}
+
+	server.httpServer = &http.Server{
+		Addr:         listenAddress,
+		Handler:      server.HTTPHandler(),
+		ReadTimeout:  server.readTimeout,
+		WriteTimeout: server.writeTimeout,
+		IdleTimeout:  server.idleTimeout,
+		// e.g. TLS handshake errors
+		ErrorLog: slog.NewLogLogger(server.logger.Handler(), slog.LevelWarn),
 	}
+
+	return server
 }
 
 // Register all HandlerFuncs for routes
 func (s *Server) HTTPHandler() http.Handler {
 	mux := chi.NewMux()
+	mux.Use(s.trace, s.assignRequestID, s.logRequests)
+	if s.metrics != nil {
+		mux.Use(s.instrument)
+		mux.Method(http.MethodGet, "/metrics", s.metrics.Handler())
+	}
 	mux.Get("/api/v0/health", http.HandlerFunc(s.Health))
-	mux.Post("/api/v0/signature_devices", http.HandlerFunc(s.signatureService.CreateSignatureDevice))
-	mux.Post("/api/v0/signature_devices/{deviceID}/signatures", http.HandlerFunc(s.signatureService.SignTransaction))
-	mux.Get("/api/v0/signature_devices/{deviceID}", http.HandlerFunc(s.signatureService.FindSignatureDevice))
-	mux.Get("/api/v0/signature_devices", http.HandlerFunc(s.signatureService.ListSignatureDevice))
+	mux.Get("/livez", http.HandlerFunc(s.Livez))
+	mux.Get("/readyz", http.HandlerFunc(s.Readyz))
+	mux.Group(func(mux chi.Router) {
+		mux.Use(s.limitClients)
+		mux.Post("/api/v0/signature_devices", http.HandlerFunc(s.signatureService.CreateSignatureDevice))
+		mux.With(s.authorizeDevice, s.limitDevices).Post("/api/v0/signature_devices/{deviceID}/signatures", http.HandlerFunc(s.signatureService.SignTransaction))
+		mux.With(s.authorizeDevice).Post("/api/v0/signature_devices/{deviceID}/deactivate", http.HandlerFunc(s.signatureService.DeactivateSignatureDevice))
+		mux.Get("/api/v0/signature_devices/{deviceID}", http.HandlerFunc(s.signatureService.FindSignatureDevice))
+		mux.Get("/api/v0/signature_devices/{deviceID}/public_key", http.HandlerFunc(s.signatureService.FindPublicKey))
+		mux.Get("/api/v0/signature_devices", http.HandlerFunc(s.signatureService.ListSignatureDevice))
+		mux.Get("/api/v0/jobs/{jobID}", http.HandlerFunc(s.FindJob))
+		mux.With(s.authorizeDevice).Post("/api/v0/signature_devices/{deviceID}/csr", http.HandlerFunc(s.signatureService.CreateCertificateRequest))
+		mux.With(s.authorizeDevice).Put("/api/v0/signature_devices/{deviceID}/certificate", http.HandlerFunc(s.signatureService.StoreCertificateChain))
+		mux.Get("/api/v0/signature_devices/{deviceID}/certificate", http.HandlerFunc(s.FindCertificate))
+		if s.authority != nil {
+			mux.Get("/api/v0/ca/crl", http.HandlerFunc(s.GetCRL))
+		}
+		if s.signatureService.events != nil {
+			mux.With(s.authorizeDevice).Get("/api/v0/signature_devices/{deviceID}/signatures/stream", http.HandlerFunc(s.signatureService.StreamDeviceEvents))
+			mux.Get("/api/v0/signature_devices/stream", http.HandlerFunc(s.StreamEvents))
+		}
+	})
+	if s.adminToken != "" {
+		mux.Route("/admin", func(mux chi.Router) {
+			mux.Use(s.requireAdmin)
+			mux.Get("/rate_limits", http.HandlerFunc(s.GetRateLimits))
+			mux.Put("/rate_limits", http.HandlerFunc(s.UpdateRateLimits))
+			if s.webhooks != nil {
+				mux.Post("/webhooks", http.HandlerFunc(s.CreateWebhook))
+				mux.Get("/webhooks", http.HandlerFunc(s.ListWebhooks))
+				mux.Get("/webhooks/{webhookID}", http.HandlerFunc(s.FindWebhook))
+				mux.Put("/webhooks/{webhookID}", http.HandlerFunc(s.UpdateWebhook))
+				mux.Delete("/webhooks/{webhookID}", http.HandlerFunc(s.DeleteWebhook))
+				mux.Get("/webhooks/{webhookID}/deliveries", http.HandlerFunc(s.ListWebhookDeliveries))
+			}
+			if len(s.backupKey) > 0 {
+				mux.Get("/backup", http.HandlerFunc(s.CreateBackup))
+				mux.Post("/restore", http.HandlerFunc(s.RestoreBackup))
+			}
+			if len(s.transferKey) > 0 {
+				mux.Get("/export", http.HandlerFunc(s.ExportDevices))
+				mux.Post("/import", http.HandlerFunc(s.ImportDevices))
+			}
+		})
+	}
 	return mux
 }
 
+// Run listens on the configured address and serves requests until Shutdown is called.
 func (s *Server) Run() error {
-	return http.ListenAndServe(s.listenAddress, s.HTTPHandler())
+	listener, err := net.Listen("tcp", s.listenAddress)
+	if err != nil {
+		return err
+	}
+	return s.Serve(listener)
+}
+
+// Serve serves requests on the given listener until Shutdown is called.
+// It returns nil when the server was shut down.
+func (s *Server) Serve(listener net.Listener) error {
+	var err error
+	if s.tlsOptions != nil {
+		reloader, loadErr := newCertificateReloader(*s.tlsOptions, s.logger)
+		if loadErr != nil {
+			listener.Close()
+			return loadErr
+		}
+		s.httpServer.TLSConfig = reloader.tlsConfig()
+		// the certificates are provided by the TLSConfig
+		err = s.httpServer.ServeTLS(listener, "", "")
+	} else {
+		err = s.httpServer.Serve(listener)
+	}
+
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
 }
 
-// WriteInternalError writes a default internal error message as an HTTP response.
-func WriteInternalError(w http.ResponseWriter) {
-	w.WriteHeader(http.StatusInternalServerError)
-	w.Write([]byte(http.StatusText(http.StatusInternalServerError)))
+// Shutdown stops accepting new connections and waits for in-flight requests
+// (e.g. signatures inside WriteTx) to complete, or for ctx to expire.
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.httpServer.Shutdown(ctx)
+}
+
+// WriteInternalError logs the underlying error and writes a default
+// internal error message as an HTTP response.
+func WriteInternalError(w http.ResponseWriter, r *http.Request, err error) {
+	logging.FromContext(r.Context()).LogAttrs(
+		r.Context(),
+		slog.LevelError,
+		"internal server error",
+		slog.String("error", err.Error()),
+	)
+
+	WriteErrorResponse(w, http.StatusInternalServerError, []string{
+		http.StatusText(http.StatusInternalServerError),
+	})
+}
+
+// requestError is an error caused by the request, which is shown to the
+// client, unlike internal errors.
+type requestError struct {
+	status  int
+	message string
+}
+
+func (e requestError) Error() string {
+	return e.message
+}
+
+var (
+	errDeviceNotFound = requestError{http.StatusNotFound, "signature device not found"}
+	errDuplicateID    = requestError{http.StatusBadRequest, "duplicate id"}
+	// signing with a deactivated device conflicts with its state
+	errDeviceDeactivated = requestError{http.StatusConflict, "signature device is deactivated"}
+)
+
+// writeError writes the message of request errors, and a default internal
+// error message for all other errors.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	var reqErr requestError
+	if errors.As(err, &reqErr) {
+		WriteErrorResponse(w, reqErr.status, []string{reqErr.message})
+		return
+	}
+	WriteInternalError(w, r, err)
 }
 
 // WriteErrorResponse takes an HTTP status code and a slice of errors
 // and writes those as an HTTP error response in a structured format.
+// The ID of the request is included, so that clients can refer to it.
 func WriteErrorResponse(w http.ResponseWriter, code int, errors []string) {
-	w.WriteHeader(code)
-
 	errorResponse := ErrorResponse{
-		Errors: errors,
+		Errors:    errors,
+		RequestID: w.Header().Get(RequestIDHeader),
 	}
 
-	bytes, err := json.Marshal(errorResponse)
-	if err != nil {
-		WriteInternalError(w)
-	}
+	// marshaling a slice of strings cannot fail
+	bytes, _ := json.Marshal(errorResponse)
 
+	w.WriteHeader(code)
 	w.Write(bytes)
 }
 
 // WriteAPIResponse takes an HTTP status code and a generic data struct
 // and writes those as an HTTP response in a structured format.
-func WriteAPIResponse(w http.ResponseWriter, code int, data interface{}) {
-	w.WriteHeader(code)
-
+func WriteAPIResponse(w http.ResponseWriter, r *http.Request, code int, data interface{}) {
 	response := Response{
 		Data: data,
 	}
 
+	_, span := tracer().Start(r.Context(), "encode response")
 	bytes, err := json.MarshalIndent(response, "", "  ")
+	span.End()
 	if err != nil {
-		WriteInternalError(w)
+		WriteErrorResponse(w, http.StatusInternalServerError, []string{
+			http.StatusText(http.StatusInternalServerError),
+		})
+		return
 	}
 
+	w.WriteHeader(code)
 	w.Write(bytes)
 }
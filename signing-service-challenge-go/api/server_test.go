@@ -0,0 +1,148 @@
+package api_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/api"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/crypto"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/persistence"
+	"github.com/google/uuid"
+)
+
+// slowKeyPair makes signatures take long enough to still be in-flight
+// when the shutdown is triggered.
+type slowKeyPair struct {
+	domain.KeyPair
+	delay time.Duration
+}
+
+func (keyPair slowKeyPair) Sign(dataToBeSigned []byte) ([]byte, error) {
+	time.Sleep(keyPair.delay)
+	return keyPair.KeyPair.Sign(dataToBeSigned)
+}
+
+func TestServerShutdown(t *testing.T) {
+	keyPair, err := crypto.ECCGenerator{}.Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	device := domain.SignatureDevice{
+		ID:      uuid.New(),
+		KeyPair: slowKeyPair{KeyPair: keyPair, delay: 5 * time.Millisecond},
+	}
+	repository := persistence.NewInMemorySignatureDeviceRepository()
+	if err := repository.Create(device); err != nil {
+		t.Fatal(err)
+	}
+	provider := persistence.NewInMemorySignatureDeviceRepositoryProvider(repository)
+
+	server := api.NewServer(
+		"",
+		api.NewSignatureService(provider),
+		api.WithTimeouts(5*time.Second, 5*time.Second, 5*time.Second),
+	)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.Serve(listener)
+	}()
+
+	url := fmt.Sprintf("http://%s/api/v0/signature_devices/%s/signatures", listener.Addr(), device.ID)
+	requestCount := 50
+	firstResponse := make(chan struct{})
+	var once sync.Once
+	var mutex sync.Mutex
+	counters := []int{}
+
+	var wg sync.WaitGroup
+	for i := 0; i < requestCount; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			response, err := http.Post(url, "application/json", strings.NewReader(`{"data_to_be_signed":"some-data"}`))
+			if err != nil {
+				// refused because the server is shutting down
+				return
+			}
+			defer response.Body.Close()
+			if response.StatusCode != http.StatusOK {
+				t.Errorf("expected status code: %d, got: %d", http.StatusOK, response.StatusCode)
+				return
+			}
+
+			body := struct {
+				Data api.SignTransactionResponse `json:"data"`
+			}{}
+			if err := json.NewDecoder(response.Body).Decode(&body); err != nil {
+				t.Errorf("unexpected response body format: %s", err)
+				return
+			}
+			counter, err := strconv.Atoi(strings.SplitN(body.Data.SignedData, "_", 2)[0])
+			if err != nil {
+				t.Errorf("unexpected signed data: %s", body.Data.SignedData)
+				return
+			}
+
+			mutex.Lock()
+			counters = append(counters, counter)
+			mutex.Unlock()
+			once.Do(func() { close(firstResponse) })
+		}()
+	}
+
+	// shut down while the remaining signatures are still queued
+	<-firstResponse
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatalf("shutdown did not complete: %s", err)
+	}
+	if err := provider.Close(); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	if err := <-serveErr; err != nil {
+		t.Errorf("expected serve to return nil after shutdown, got: %s", err)
+	}
+
+	// every signature that was committed must have been delivered to a client
+	persistedDevice, _, err := repository.Find(device.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int(persistedDevice.SignatureCounter) != len(counters) {
+		t.Errorf("expected signature counter %d to match the %d delivered signatures", persistedDevice.SignatureCounter, len(counters))
+	}
+	seen := map[int]bool{}
+	for _, counter := range counters {
+		if seen[counter] {
+			t.Errorf("counter %d was used twice", counter)
+		}
+		seen[counter] = true
+	}
+	for counter := 0; counter < len(counters); counter++ {
+		if !seen[counter] {
+			t.Errorf("counter %d is missing", counter)
+		}
+	}
+
+	// the closed provider must reject further transactions
+	err = provider.ReadTx(func(domain.SignatureDeviceRepository) error { return nil })
+	if err != domain.ErrRepositoryProviderClosed {
+		t.Errorf("expected ErrRepositoryProviderClosed, got: %v", err)
+	}
+}
@@ -0,0 +1,201 @@
+package api
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// TLSOptions configure how the server serves HTTPS.
+type TLSOptions struct {
+	CertFile string
+	KeyFile  string
+	// PEM bundle of the CAs that client certificates must be issued by.
+	// Only used when ClientAuth verifies client certificates.
+	ClientCAFile string
+	ClientAuth   tls.ClientAuthType
+	// How often the files are checked for changes. The check happens
+	// lazily during the TLS handshake, 0 checks on every handshake.
+	ReloadInterval time.Duration
+	// Maps the subject of a verified client certificate to the IDs of the
+	// devices it may sign with, "*" allows every device.
+	// When empty, every client may sign with every device.
+	ClientDeviceBindings map[string][]string
+}
+
+// WithTLS makes the server serve HTTPS.
+func WithTLS(options TLSOptions) ServerOption {
+	return func(s *Server) {
+		s.tlsOptions = &options
+	}
+}
+
+// certificateReloader keeps the server certificate and the client CAs
+// in sync with the files they were loaded from.
+type certificateReloader struct {
+	options TLSOptions
+	logger  *slog.Logger
+
+	mutex       sync.Mutex
+	lastCheck   time.Time
+	modTimes    map[string]time.Time
+	certificate *tls.Certificate
+	clientCAs   *x509.CertPool
+}
+
+func newCertificateReloader(options TLSOptions, logger *slog.Logger) (*certificateReloader, error) {
+	reloader := &certificateReloader{
+		options:  options,
+		logger:   logger,
+		modTimes: map[string]time.Time{},
+	}
+
+	if err := reloader.load(); err != nil {
+		return nil, err
+	}
+
+	return reloader, nil
+}
+
+func (r *certificateReloader) files() []string {
+	files := []string{r.options.CertFile, r.options.KeyFile}
+	if r.options.ClientCAFile != "" {
+		files = append(files, r.options.ClientCAFile)
+	}
+	return files
+}
+
+// load reads all files, and only replaces the current certificates
+// when every file could be parsed.
+func (r *certificateReloader) load() error {
+	modTimes := map[string]time.Time{}
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		modTimes[file] = info.ModTime()
+	}
+
+	certificate, err := tls.LoadX509KeyPair(r.options.CertFile, r.options.KeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+
+	var clientCAs *x509.CertPool
+	if r.options.ClientCAFile != "" {
+		bundle, err := os.ReadFile(r.options.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(bundle) {
+			return errors.New("client CA file does not contain any PEM encoded certificate")
+		}
+	}
+
+	r.certificate = &certificate
+	r.clientCAs = clientCAs
+	r.modTimes = modTimes
+	return nil
+}
+
+func (r *certificateReloader) changed() bool {
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			// e.g. while the file is being replaced, keep serving the current one
+			continue
+		}
+		if !info.ModTime().Equal(r.modTimes[file]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *certificateReloader) current() (*tls.Certificate, *x509.CertPool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if time.Since(r.lastCheck) >= r.options.ReloadInterval {
+		r.lastCheck = time.Now()
+		if r.changed() {
+			// a broken update is ignored, the files are checked again
+			// after the next interval
+			if err := r.load(); err != nil {
+				r.logger.Warn("failed to reload TLS certificates", slog.String("error", err.Error()))
+			} else {
+				r.logger.Info("reloaded TLS certificates")
+			}
+		}
+	}
+
+	return r.certificate, r.clientCAs
+}
+
+// tlsConfig builds a tls.Config that picks up certificate changes
+// for every new connection.
+func (r *certificateReloader) tlsConfig() *tls.Config {
+	base := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ClientAuth: r.options.ClientAuth,
+	}
+
+	config := base.Clone()
+	config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		certificate, clientCAs := r.current()
+
+		connectionConfig := base.Clone()
+		connectionConfig.Certificates = []tls.Certificate{*certificate}
+		connectionConfig.ClientCAs = clientCAs
+		return connectionConfig, nil
+	}
+	return config
+}
+
+var (
+	errClientCertificateRequired = requestError{http.StatusUnauthorized, "client certificate required"}
+	errDeviceNotAllowed          = requestError{http.StatusForbidden, "client certificate is not allowed to use this signature device"}
+)
+
+// authorizeDevice rejects requests whose client certificate is not bound
+// to the device in the `deviceID` URL parameter.
+func (s *Server) authorizeDevice(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if err := s.checkDeviceBinding(request, chi.URLParam(request, "deviceID")); err != nil {
+			writeError(response, request, err)
+			return
+		}
+		next.ServeHTTP(response, request)
+	})
+}
+
+// checkDeviceBinding returns errClientCertificateRequired or
+// errDeviceNotAllowed when the client certificate of the request is not
+// bound to the device. Without bindings, every device is allowed.
+func (s *Server) checkDeviceBinding(request *http.Request, deviceID string) error {
+	if s.tlsOptions == nil || len(s.tlsOptions.ClientDeviceBindings) == 0 {
+		return nil
+	}
+	if request.TLS == nil || len(request.TLS.VerifiedChains) == 0 {
+		return errClientCertificateRequired
+	}
+
+	subject := request.TLS.VerifiedChains[0][0].Subject.String()
+	for _, allowedDeviceID := range s.tlsOptions.ClientDeviceBindings[subject] {
+		if allowedDeviceID == "*" || strings.EqualFold(allowedDeviceID, deviceID) {
+			return nil
+		}
+	}
+	return errDeviceNotAllowed
+}
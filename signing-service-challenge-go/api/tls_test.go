@@ -0,0 +1,430 @@
+package api_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/api"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/crypto"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/events"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/jobs"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/logging"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/outbox"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/persistence"
+	"github.com/google/uuid"
+)
+
+type testCertificate struct {
+	certificate *x509.Certificate
+	privateKey  *ecdsa.PrivateKey
+}
+
+func (c testCertificate) certificatePEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.certificate.Raw})
+}
+
+func (c testCertificate) privateKeyPEM(t *testing.T) []byte {
+	t.Helper()
+
+	der, err := x509.MarshalPKCS8PrivateKey(c.privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+}
+
+func (c testCertificate) tlsCertificate() tls.Certificate {
+	return tls.Certificate{
+		Certificate: [][]byte{c.certificate.Raw},
+		PrivateKey:  c.privateKey,
+	}
+}
+
+// issueCertificate creates a certificate from template, signed by issuer,
+// or self-signed when issuer is nil.
+func issueCertificate(t *testing.T, template *x509.Certificate, issuer *testCertificate) testCertificate {
+	t.Helper()
+
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serialNumber, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = serialNumber
+	template.NotBefore = time.Now().Add(-time.Minute)
+	template.NotAfter = time.Now().Add(time.Hour)
+
+	parent, signer := template, privateKey
+	if issuer != nil {
+		parent, signer = issuer.certificate, issuer.privateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &privateKey.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return testCertificate{certificate: certificate, privateKey: privateKey}
+}
+
+func issueCA(t *testing.T, commonName string) testCertificate {
+	t.Helper()
+
+	return issueCertificate(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: commonName},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+}
+
+func issueServerCertificate(t *testing.T, ca testCertificate) testCertificate {
+	t.Helper()
+
+	return issueCertificate(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "signing-service"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+	}, &ca)
+}
+
+func issueClientCertificate(t *testing.T, ca testCertificate, commonName string) testCertificate {
+	t.Helper()
+
+	return issueCertificate(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: commonName, Organization: []string{"Shop"}},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+	}, &ca)
+}
+
+func writeTestFile(t *testing.T, path string, content []byte) {
+	t.Helper()
+
+	if err := os.WriteFile(path, content, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type tlsTestSetup struct {
+	dir      string
+	serverCA testCertificate
+	clientCA testCertificate
+	options  api.TLSOptions
+}
+
+func newTLSTestSetup(t *testing.T) tlsTestSetup {
+	t.Helper()
+
+	setup := tlsTestSetup{
+		dir:      t.TempDir(),
+		serverCA: issueCA(t, "server ca"),
+		clientCA: issueCA(t, "client ca"),
+	}
+	setup.options = api.TLSOptions{
+		CertFile:     filepath.Join(setup.dir, "server.pem"),
+		KeyFile:      filepath.Join(setup.dir, "server-key.pem"),
+		ClientCAFile: filepath.Join(setup.dir, "client-ca.pem"),
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	setup.writeServerCertificate(t, issueServerCertificate(t, setup.serverCA))
+	writeTestFile(t, setup.options.ClientCAFile, setup.clientCA.certificatePEM())
+
+	return setup
+}
+
+func (setup tlsTestSetup) writeServerCertificate(t *testing.T, certificate testCertificate) {
+	t.Helper()
+
+	writeTestFile(t, setup.options.CertFile, certificate.certificatePEM())
+	writeTestFile(t, setup.options.KeyFile, certificate.privateKeyPEM(t))
+}
+
+func (setup tlsTestSetup) client(clientCertificate *testCertificate) *http.Client {
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(setup.serverCA.certificate)
+	config := &tls.Config{RootCAs: rootCAs}
+	if clientCertificate != nil {
+		config.Certificates = []tls.Certificate{clientCertificate.tlsCertificate()}
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{TLSClientConfig: config, DisableKeepAlives: true},
+	}
+}
+
+// startTLSServer serves the server on a random local port and returns its base URL.
+func startTLSServer(t *testing.T, server *api.Server) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Shutdown(context.Background()) })
+
+	return "https://" + listener.Addr().String()
+}
+
+func TestTLS(t *testing.T) {
+	t.Run("requires a client certificate issued by the client CA", func(t *testing.T) {
+		setup := newTLSTestSetup(t)
+		signatureService := api.NewSignatureService(
+			persistence.NewInMemorySignatureDeviceRepositoryProvider(
+				persistence.NewInMemorySignatureDeviceRepository(),
+			),
+		)
+		url := startTLSServer(t, api.NewServer("", signatureService, api.WithTLS(setup.options))) + "/api/v0/health"
+
+		_, err := setup.client(nil).Get(url)
+		if err == nil {
+			t.Error("expected the handshake to fail without client certificate")
+		}
+
+		unknownCA := issueCA(t, "unknown ca")
+		untrustedClient := issueClientCertificate(t, unknownCA, "till-1")
+		_, err = setup.client(&untrustedClient).Get(url)
+		if err == nil {
+			t.Error("expected the handshake to fail with a certificate of an unknown CA")
+		}
+
+		trustedClient := issueClientCertificate(t, setup.clientCA, "till-1")
+		response, err := setup.client(&trustedClient).Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response.StatusCode != http.StatusOK {
+			t.Errorf("expected status code: %d, got: %d", http.StatusOK, response.StatusCode)
+		}
+	})
+
+	t.Run("reloads the server certificate when the files change", func(t *testing.T) {
+		setup := newTLSTestSetup(t)
+		setup.options.ClientAuth = tls.NoClientCert
+		setup.options.ClientCAFile = ""
+		signatureService := api.NewSignatureService(
+			persistence.NewInMemorySignatureDeviceRepositoryProvider(
+				persistence.NewInMemorySignatureDeviceRepository(),
+			),
+		)
+		url := startTLSServer(t, api.NewServer("", signatureService, api.WithTLS(setup.options))) + "/api/v0/health"
+
+		servedSerialNumber := func() *big.Int {
+			response, err := setup.client(nil).Get(url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer response.Body.Close()
+			return response.TLS.PeerCertificates[0].SerialNumber
+		}
+
+		before := servedSerialNumber()
+
+		renewed := issueServerCertificate(t, setup.serverCA)
+		setup.writeServerCertificate(t, renewed)
+		// make sure the modification time differs on file systems with a coarse resolution
+		future := time.Now().Add(time.Minute)
+		for _, file := range []string{setup.options.CertFile, setup.options.KeyFile} {
+			if err := os.Chtimes(file, future, future); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		after := servedSerialNumber()
+		if after.Cmp(before) == 0 {
+			t.Error("expected the renewed certificate to be served")
+		}
+		if after.Cmp(renewed.certificate.SerialNumber) != 0 {
+			t.Errorf("expected serial number %s, got %s", renewed.certificate.SerialNumber, after)
+		}
+	})
+
+	t.Run("only signs with devices bound to the client certificate", func(t *testing.T) {
+		boundDevice, err := domain.BuildSignatureDevice(uuid.New(), crypto.ECCGenerator{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		otherDevice, err := domain.BuildSignatureDevice(uuid.New(), crypto.ECCGenerator{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		repository := persistence.NewInMemorySignatureDeviceRepository()
+		for _, device := range []domain.SignatureDevice{boundDevice, otherDevice} {
+			if err := repository.Create(device); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		setup := newTLSTestSetup(t)
+		till := issueClientCertificate(t, setup.clientCA, "till-1")
+		backOffice := issueClientCertificate(t, setup.clientCA, "back-office")
+		setup.options.ClientDeviceBindings = map[string][]string{
+			till.certificate.Subject.String():       {boundDevice.ID.String()},
+			backOffice.certificate.Subject.String(): {"*"},
+		}
+		signatureService := api.NewSignatureService(
+			persistence.NewInMemorySignatureDeviceRepositoryProvider(repository),
+		)
+		baseURL := startTLSServer(t, api.NewServer("", signatureService, api.WithTLS(setup.options)))
+
+		sign := func(client *http.Client, deviceID uuid.UUID) int {
+			response, err := client.Post(
+				fmt.Sprintf("%s/api/v0/signature_devices/%s/signatures", baseURL, deviceID),
+				"application/json",
+				strings.NewReader(`{"data_to_be_signed":"some-data"}`),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			response.Body.Close()
+			return response.StatusCode
+		}
+
+		if code := sign(setup.client(&till), boundDevice.ID); code != http.StatusOK {
+			t.Errorf("expected bound device to be usable, got status code: %d", code)
+		}
+		if code := sign(setup.client(&till), otherDevice.ID); code != http.StatusForbidden {
+			t.Errorf("expected status code: %d, got: %d", http.StatusForbidden, code)
+		}
+		if code := sign(setup.client(&backOffice), otherDevice.ID); code != http.StatusOK {
+			t.Errorf("expected wildcard binding to allow every device, got status code: %d", code)
+		}
+	})
+
+	t.Run("only streams events of devices bound to the client certificate", func(t *testing.T) {
+		repository := persistence.NewInMemorySignatureDeviceRepository()
+		boundDeviceID := createDevice(t, repository)
+		otherDeviceID := createDevice(t, repository)
+
+		setup := newTLSTestSetup(t)
+		till := issueClientCertificate(t, setup.clientCA, "till-1")
+		backOffice := issueClientCertificate(t, setup.clientCA, "back-office")
+		setup.options.ClientDeviceBindings = map[string][]string{
+			till.certificate.Subject.String():       {boundDeviceID.String()},
+			backOffice.certificate.Subject.String(): {"*"},
+		}
+		bus := events.NewBus(events.Options{History: 100})
+		outboxDispatcher := outbox.NewDispatcher(
+			persistence.NewInMemorySignatureDeviceRepositoryProvider(repository),
+			[]domain.EventPublisher{bus},
+			outbox.Options{PollInterval: time.Second, BatchSize: 100},
+			logging.Discard(),
+		)
+		t.Cleanup(func() { outboxDispatcher.Close(context.Background()) })
+		signatureService := api.NewSignatureService(outboxDispatcher.Provider(), api.WithEvents(bus))
+		baseURL := startTLSServer(t, api.NewServer("", signatureService, api.WithTLS(setup.options)))
+		// registered after the server, so that the streams end first
+		t.Cleanup(bus.Close)
+
+		response, err := setup.client(&till).Get(fmt.Sprintf("%s/api/v0/signature_devices/%s/signatures/stream", baseURL, otherDeviceID))
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		if response.StatusCode != http.StatusForbidden {
+			t.Errorf("expected status code: %d, got: %d", http.StatusForbidden, response.StatusCode)
+		}
+
+		stream := openStreamWith(t, setup.client(&till), baseURL+"/api/v0/signature_devices/stream", "")
+		for _, deviceID := range []uuid.UUID{otherDeviceID, boundDeviceID} {
+			response, err := setup.client(&backOffice).Post(
+				fmt.Sprintf("%s/api/v0/signature_devices/%s/signatures", baseURL, deviceID),
+				"application/json",
+				strings.NewReader(`{"data_to_be_signed":"some-data"}`),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			response.Body.Close()
+		}
+
+		if event := stream.next(t); event.data.DeviceID != boundDeviceID.String() {
+			t.Errorf("expected only events of the bound device, got: %+v", event)
+		}
+	})
+
+	t.Run("only returns jobs of devices bound to the client certificate", func(t *testing.T) {
+		boundDevice, err := domain.BuildSignatureDevice(uuid.New(), crypto.ECCGenerator{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		otherDevice, err := domain.BuildSignatureDevice(uuid.New(), crypto.ECCGenerator{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		repository := persistence.NewInMemorySignatureDeviceRepository()
+		for _, device := range []domain.SignatureDevice{boundDevice, otherDevice} {
+			if err := repository.Create(device); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		setup := newTLSTestSetup(t)
+		till1 := issueClientCertificate(t, setup.clientCA, "till-1")
+		till2 := issueClientCertificate(t, setup.clientCA, "till-2")
+		setup.options.ClientDeviceBindings = map[string][]string{
+			till1.certificate.Subject.String(): {boundDevice.ID.String()},
+			till2.certificate.Subject.String(): {otherDevice.ID.String()},
+		}
+		queue := jobs.NewQueue(jobs.Options{Workers: 1, QueueSize: 10, Retention: time.Hour})
+		t.Cleanup(func() { queue.Close(context.Background()) })
+		signatureService := api.NewSignatureService(
+			persistence.NewInMemorySignatureDeviceRepositoryProvider(repository),
+			api.WithJobs(queue),
+		)
+		baseURL := startTLSServer(t, api.NewServer("", signatureService, api.WithTLS(setup.options)))
+
+		response, err := setup.client(&till1).Post(
+			fmt.Sprintf("%s/api/v0/signature_devices/%s/signatures?async=true", baseURL, boundDevice.ID),
+			"application/json",
+			strings.NewReader(`{"data_to_be_signed":"some-data"}`),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		if response.StatusCode != http.StatusAccepted {
+			t.Fatalf("expected status code: %d, got: %d", http.StatusAccepted, response.StatusCode)
+		}
+		jobURL := baseURL + response.Header.Get("Location")
+
+		findJob := func(client *http.Client) int {
+			response, err := client.Get(jobURL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			response.Body.Close()
+			return response.StatusCode
+		}
+		if code := findJob(setup.client(&till1)); code != http.StatusOK {
+			t.Errorf("expected job of bound device to be returned, got status code: %d", code)
+		}
+		if code := findJob(setup.client(&till2)); code != http.StatusForbidden {
+			t.Errorf("expected status code: %d, got: %d", http.StatusForbidden, code)
+		}
+	})
+}
@@ -0,0 +1,55 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func tracer() trace.Tracer {
+	return otel.Tracer("github.com/fiskaly/coding-challenges/signing-service-challenge/api")
+}
+
+// trace is a middleware creating a server span for every request.
+// The span continues the trace of the client when the request carries
+// trace context headers (e.g. W3C `traceparent`) understood by the
+// globally installed propagator.
+// Without an installed TracerProvider, the spans are not recorded.
+func (s *Server) trace(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(request.Context(), propagation.HeaderCarrier(request.Header))
+		ctx, span := tracer().Start(
+			ctx,
+			request.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", request.Method),
+				attribute.String("url.path", request.URL.Path),
+			),
+		)
+		defer span.End()
+		wrappedResponse := middleware.NewWrapResponseWriter(response, request.ProtoMajor)
+
+		next.ServeHTTP(wrappedResponse, request.WithContext(ctx))
+
+		// the route is only known once chi has routed the request
+		if route := chi.RouteContext(request.Context()).RoutePattern(); route != "" {
+			span.SetName(request.Method + " " + route)
+			span.SetAttributes(attribute.String("http.route", route))
+		}
+		status := wrappedResponse.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		span.SetAttributes(attribute.Int("http.response.status_code", status))
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	})
+}
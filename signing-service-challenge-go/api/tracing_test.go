@@ -0,0 +1,154 @@
+package api_test
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/api"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/crypto"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/logging"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/persistence"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/tracing"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// recordSpans installs a TracerProvider recording every finished span
+// until the end of the test.
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+
+	previousTracerProvider := otel.GetTracerProvider()
+	previousPropagator := otel.GetTextMapPropagator()
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	tracing.InstallPropagator()
+	t.Cleanup(func() {
+		otel.SetTracerProvider(previousTracerProvider)
+		otel.SetTextMapPropagator(previousPropagator)
+	})
+
+	return recorder
+}
+
+func TestTracing(t *testing.T) {
+	t.Run("traces a signature from the HTTP request down to the key pair", func(t *testing.T) {
+		recorder := recordSpans(t)
+		logs := &syncBuffer{}
+
+		id := uuid.New()
+		device, err := domain.BuildSignatureDevice(id, crypto.ECCGenerator{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		repository := persistence.NewInMemorySignatureDeviceRepository()
+		if err := repository.Create(device); err != nil {
+			t.Fatal(err)
+		}
+		signatureService := api.NewSignatureService(
+			persistence.NewInMemorySignatureDeviceRepositoryProvider(repository),
+		)
+		server := httptest.NewServer(api.NewServer(
+			"",
+			signatureService,
+			api.WithLogger(logging.New(logs, slog.LevelInfo)),
+		).HTTPHandler())
+		defer server.Close()
+
+		request, err := http.NewRequest(
+			http.MethodPost,
+			fmt.Sprintf("%s/api/v0/signature_devices/%s/signatures", server.URL, id),
+			bytes.NewReader([]byte(`{"data_to_be_signed":"some-data"}`)),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		clientTraceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+		clientSpanID := "00f067aa0ba902b7"
+		request.Header.Set("traceparent", fmt.Sprintf("00-%s-%s-01", clientTraceID, clientSpanID))
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		readBody(t, response)
+		if response.StatusCode != http.StatusOK {
+			t.Fatalf("expected status code: %d, got: %d", http.StatusOK, response.StatusCode)
+		}
+
+		spans := map[string]sdktrace.ReadOnlySpan{}
+		for _, span := range recorder.Ended() {
+			spans[span.Name()] = span
+			if traceID := span.SpanContext().TraceID().String(); traceID != clientTraceID {
+				t.Errorf("expected span %s to continue trace %s, got: %s", span.Name(), clientTraceID, traceID)
+			}
+		}
+
+		// span name -> name of the parent span
+		expectedParents := map[string]string{
+			"SignTransaction": "POST /api/v0/signature_devices/{deviceID}/signatures",
+			"SignatureDeviceRepositoryProvider.WriteTx":      "SignTransaction",
+			"SignatureDeviceRepositoryProvider.WriteTx lock": "SignatureDeviceRepositoryProvider.WriteTx",
+			"SignatureDeviceRepository.Find":                 "SignatureDeviceRepositoryProvider.WriteTx",
+			"KeyPair.Sign":                                   "SignatureDeviceRepositoryProvider.WriteTx",
+			"SignatureDeviceRepository.MarkSignatureCreated": "SignatureDeviceRepositoryProvider.WriteTx",
+			"encode response":                                "POST /api/v0/signature_devices/{deviceID}/signatures",
+		}
+		for name, parentName := range expectedParents {
+			span, ok := spans[name]
+			if !ok {
+				t.Errorf("expected span %s, got: %v", name, spans)
+				continue
+			}
+			parent, ok := spans[parentName]
+			if !ok {
+				t.Errorf("expected span %s", parentName)
+				continue
+			}
+			if span.Parent().SpanID() != parent.SpanContext().SpanID() {
+				t.Errorf("expected parent of %s to be %s", name, parentName)
+			}
+		}
+
+		serverSpan := spans["POST /api/v0/signature_devices/{deviceID}/signatures"]
+		if serverSpan != nil && serverSpan.Parent().SpanID().String() != clientSpanID {
+			t.Errorf("expected server span to be a child of the client span, got parent: %s", serverSpan.Parent().SpanID())
+		}
+
+		if !strings.Contains(logs.String(), `"trace_id":"`+clientTraceID+`"`) {
+			t.Errorf("expected log lines to contain the trace ID, got: %s", logs)
+		}
+	})
+
+	t.Run("marks failed requests", func(t *testing.T) {
+		recorder := recordSpans(t)
+
+		signatureService := api.NewSignatureService(
+			failingRepositoryProvider{err: fmt.Errorf("disk on fire")},
+		)
+		server := httptest.NewServer(api.NewServer("", signatureService).HTTPHandler())
+		defer server.Close()
+
+		readBody(t, sendJsonRequest(t, http.MethodGet, server.URL+"/api/v0/signature_devices"))
+
+		for _, span := range recorder.Ended() {
+			switch span.Name() {
+			case "GET /api/v0/signature_devices", "SignatureDeviceRepositoryProvider.ReadTx":
+				if span.Status().Code != codes.Error {
+					t.Errorf("expected span %s to have an error status, got: %s", span.Name(), span.Status().Code)
+				}
+			}
+		}
+		if len(recorder.Ended()) != 2 {
+			t.Errorf("expected 2 spans, got: %d", len(recorder.Ended()))
+		}
+	})
+}
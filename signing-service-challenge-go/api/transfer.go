@@ -0,0 +1,96 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/transfer"
+	"github.com/google/uuid"
+)
+
+// maxImportSize limits the exports accepted by ImportDevices.
+const maxImportSize = 256 << 20
+
+// WithTransfers enables the export and import of devices between
+// instances via the admin API under `/admin/export` and `/admin/import`.
+// The private keys are wrapped by the transport key, see
+// transfer.KeySize.
+func WithTransfers(key []byte) ServerOption {
+	return func(s *Server) {
+		s.transferKey = key
+	}
+}
+
+type ImportDevicesResponse struct {
+	// IDs of the imported devices
+	Imported []string `json:"imported"`
+}
+
+// ExportDevices writes the devices of the `device_id` query parameters,
+// or all devices when there are none, as JSON lines.
+func (s *Server) ExportDevices(response http.ResponseWriter, request *http.Request) {
+	deviceIDs := []uuid.UUID{}
+	problems := []string{}
+	for _, value := range request.URL.Query()["device_id"] {
+		id, err := uuid.Parse(value)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("device_id %q is not a valid uuid", value))
+			continue
+		}
+		deviceIDs = append(deviceIDs, id)
+	}
+	if len(problems) > 0 {
+		WriteErrorResponse(response, http.StatusBadRequest, problems)
+		return
+	}
+
+	export, err := transfer.Export(s.signatureService.repositoryProvider, s.transferKey, deviceIDs)
+	if errors.Is(err, transfer.ErrDeviceNotFound) {
+		WriteErrorResponse(response, http.StatusNotFound, []string{err.Error()})
+		return
+	}
+	if err != nil {
+		WriteInternalError(response, request, err)
+		return
+	}
+
+	response.Header().Set("Content-Type", "application/x-ndjson")
+	response.Header().Set("Content-Disposition", `attachment; filename="signature_devices.jsonl"`)
+	response.WriteHeader(http.StatusOK)
+	response.Write(export)
+}
+
+// ImportDevices creates the devices exported by another instance. It
+// responds with 409 Conflict, and imports nothing, when devices with the
+// same IDs exist already.
+func (s *Server) ImportDevices(response http.ResponseWriter, request *http.Request) {
+	imported, err := transfer.Import(
+		s.signatureService.repositoryProvider,
+		s.transferKey,
+		http.MaxBytesReader(response, request.Body, maxImportSize),
+	)
+	var invalidExportError transfer.InvalidExportError
+	var collisionError transfer.CollisionError
+	switch {
+	case errors.As(err, &invalidExportError):
+		WriteErrorResponse(response, http.StatusBadRequest, invalidExportError.Problems)
+		return
+	case errors.As(err, &collisionError):
+		problems := []string{}
+		for _, id := range collisionError.DeviceIDs {
+			problems = append(problems, fmt.Sprintf("signature device %s already exists", id))
+		}
+		WriteErrorResponse(response, http.StatusConflict, problems)
+		return
+	case err != nil:
+		WriteInternalError(response, request, err)
+		return
+	}
+
+	ids := []string{}
+	for _, id := range imported {
+		ids = append(ids, id.String())
+	}
+	WriteAPIResponse(response, request, http.StatusCreated, ImportDevicesResponse{Imported: ids})
+}
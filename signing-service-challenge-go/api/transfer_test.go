@@ -0,0 +1,164 @@
+package api_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/api"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/persistence"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/ratelimit"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/uuid"
+)
+
+var testTransferKey = bytes.Repeat([]byte{7}, 32)
+
+func importDevices(t *testing.T, serverURL string, export string) (*http.Response, string) {
+	t.Helper()
+
+	request, err := http.NewRequest(http.MethodPost, serverURL+"/admin/import", strings.NewReader(export))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set(api.RequestIDHeader, testRequestID)
+	request.Header.Set("Authorization", "Bearer "+testAdminToken)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response, readBody(t, response)
+}
+
+func TestAdminTransfer(t *testing.T) {
+	newSourceServer := func(t *testing.T) (string, []uuid.UUID) {
+		_, serverURL, deviceIDs := newRateLimitedServer(
+			t,
+			ratelimit.Limits{},
+			ratelimit.Limits{},
+			api.WithAdminToken(testAdminToken),
+			api.WithTransfers(testTransferKey),
+		)
+		return serverURL, deviceIDs
+	}
+
+	t.Run("is not served without a transport key", func(t *testing.T) {
+		_, serverURL, _ := newRateLimitedServer(t, ratelimit.Limits{}, ratelimit.Limits{}, api.WithAdminToken(testAdminToken))
+
+		response := sendAdminRequest(t, http.MethodGet, serverURL+"/admin/export", testAdminToken, nil)
+		readBody(t, response)
+		if response.StatusCode != http.StatusNotFound {
+			t.Errorf("expected status code: %d, got: %d", http.StatusNotFound, response.StatusCode)
+		}
+	})
+
+	t.Run("moves a device to another server", func(t *testing.T) {
+		serverURL, deviceIDs := newSourceServer(t)
+		sign(t, serverURL, deviceIDs[0])
+
+		response := sendAdminRequest(t, http.MethodGet, serverURL+"/admin/export?device_id="+deviceIDs[0].String(), testAdminToken, nil)
+		export := readBody(t, response)
+		if response.StatusCode != http.StatusOK {
+			t.Fatalf("expected status code: %d, got: %d, body: %s", http.StatusOK, response.StatusCode, export)
+		}
+		if contentType := response.Header.Get("Content-Type"); contentType != "application/x-ndjson" {
+			t.Errorf("expected JSON lines, got: %s", contentType)
+		}
+
+		target := httptest.NewServer(api.NewServer(
+			"",
+			api.NewSignatureService(persistence.NewInMemorySignatureDeviceRepositoryProvider(
+				persistence.NewInMemorySignatureDeviceRepository(),
+			)),
+			api.WithAdminToken(testAdminToken),
+			api.WithTransfers(testTransferKey),
+		).HTTPHandler())
+		t.Cleanup(target.Close)
+
+		response, body := importDevices(t, target.URL, export)
+		if response.StatusCode != http.StatusCreated {
+			t.Fatalf("expected status code: %d, got: %d, body: %s", http.StatusCreated, response.StatusCode, body)
+		}
+		var importResponse struct {
+			Data api.ImportDevicesResponse `json:"data"`
+		}
+		if err := json.Unmarshal([]byte(body), &importResponse); err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(importResponse.Data.Imported, []string{deviceIDs[0].String()}); diff != "" {
+			t.Errorf("unexpected diff: %s", diff)
+		}
+
+		// the counter continues on the target
+		response = sendJsonRequest(
+			t,
+			http.MethodPost,
+			fmt.Sprintf("%s/api/v0/signature_devices/%s/signatures", target.URL, deviceIDs[0]),
+			api.SignTransactionRequest{DataToBeSigned: "some-data"},
+		)
+		var signResponse struct {
+			Data api.SignTransactionResponse `json:"data"`
+		}
+		if err := json.Unmarshal([]byte(readBody(t, response)), &signResponse); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(signResponse.Data.SignedData, "1_some-data_") {
+			t.Errorf("expected the second signature of the device, got: %s", signResponse.Data.SignedData)
+		}
+
+		response, body = importDevices(t, target.URL, export)
+		if response.StatusCode != http.StatusConflict {
+			t.Errorf("expected status code: %d, got: %d", http.StatusConflict, response.StatusCode)
+		}
+		expectedBody := fmt.Sprintf(
+			`{"errors":["signature device %s already exists"],"request_id":"test-request-id"}`,
+			deviceIDs[0],
+		)
+		if body != expectedBody {
+			t.Errorf("expected: %s, got: %s", expectedBody, body)
+		}
+	})
+
+	t.Run("rejects unknown and invalid device ids", func(t *testing.T) {
+		serverURL, _ := newSourceServer(t)
+		unknownID := uuid.New()
+
+		response := sendAdminRequest(t, http.MethodGet, serverURL+"/admin/export?device_id=not-a-uuid", testAdminToken, nil)
+		body := readBody(t, response)
+		if response.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected status code: %d, got: %d", http.StatusBadRequest, response.StatusCode)
+		}
+		expectedBody := `{"errors":["device_id \"not-a-uuid\" is not a valid uuid"],"request_id":"test-request-id"}`
+		if body != expectedBody {
+			t.Errorf("expected: %s, got: %s", expectedBody, body)
+		}
+
+		response = sendAdminRequest(t, http.MethodGet, serverURL+"/admin/export?device_id="+unknownID.String(), testAdminToken, nil)
+		body = readBody(t, response)
+		if response.StatusCode != http.StatusNotFound {
+			t.Errorf("expected status code: %d, got: %d", http.StatusNotFound, response.StatusCode)
+		}
+		expectedBody = fmt.Sprintf(`{"errors":["signature device not found: %s"],"request_id":"test-request-id"}`, unknownID)
+		if body != expectedBody {
+			t.Errorf("expected: %s, got: %s", expectedBody, body)
+		}
+	})
+
+	t.Run("rejects invalid exports", func(t *testing.T) {
+		serverURL, _ := newSourceServer(t)
+
+		response, body := importDevices(t, serverURL, "{}\n")
+
+		if response.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected status code: %d, got: %d", http.StatusBadRequest, response.StatusCode)
+		}
+		expectedBody := `{"errors":["line 1: id is not a valid uuid"],"request_id":"test-request-id"}`
+		if body != expectedBody {
+			t.Errorf("expected: %s, got: %s", expectedBody, body)
+		}
+	})
+}
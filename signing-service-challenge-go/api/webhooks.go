@@ -0,0 +1,269 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/webhooks"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+// WithWebhooks enables the management of webhooks via the admin API
+// under `/admin/webhooks`. The caller must close the dispatcher on shutdown.
+func WithWebhooks(dispatcher *webhooks.Dispatcher) ServerOption {
+	return func(s *Server) {
+		s.webhooks = dispatcher
+	}
+}
+
+type WebhookRequest struct {
+	URL string `json:"url"`
+	// HMAC key of the signature header. On creation, a random secret is
+	// generated when empty; on update, the secret is kept when empty.
+	Secret string `json:"secret"`
+	// empty to receive all event types
+	EventTypes []domain.EventType `json:"event_types"`
+}
+
+type CreateWebhookRequest = WebhookRequest
+
+type UpdateWebhookRequest = WebhookRequest
+
+type WebhookResponse struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+	// only returned on creation
+	Secret     string             `json:"secret,omitempty"`
+	EventTypes []domain.EventType `json:"event_types"`
+	CreatedAt  time.Time          `json:"created_at"`
+}
+
+func newWebhookResponse(webhook webhooks.Webhook) WebhookResponse {
+	eventTypes := webhook.EventTypes
+	if eventTypes == nil {
+		eventTypes = []domain.EventType{}
+	}
+	return WebhookResponse{
+		ID:         webhook.ID.String(),
+		URL:        webhook.URL,
+		EventTypes: eventTypes,
+		CreatedAt:  webhook.CreatedAt.UTC(),
+	}
+}
+
+type AttemptResponse struct {
+	Time time.Time `json:"time"`
+	// omitted when no response was received
+	StatusCode int    `json:"status_code,omitempty"`
+	Error      string `json:"error,omitempty"`
+	DurationMs int64  `json:"duration_ms"`
+}
+
+type DeliveryResponse struct {
+	ID        string                  `json:"id"`
+	EventType domain.EventType        `json:"event_type"`
+	Status    webhooks.DeliveryStatus `json:"status"`
+	Attempts  []AttemptResponse       `json:"attempts"`
+	CreatedAt time.Time               `json:"created_at"`
+}
+
+type ListWebhookDeliveriesResponse = []DeliveryResponse
+
+// decodeWebhookRequest decodes and validates the request body.
+// It writes an error response and returns ok: false when it is invalid.
+func decodeWebhookRequest(response http.ResponseWriter, request *http.Request) (WebhookRequest, bool) {
+	var requestBody WebhookRequest
+	decoder := json.NewDecoder(request.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&requestBody); err != nil {
+		WriteErrorResponse(response, http.StatusBadRequest, []string{
+			"invalid json",
+		})
+		return WebhookRequest{}, false
+	}
+
+	problems := []string{}
+	receiverURL, err := url.Parse(requestBody.URL)
+	if err != nil || (receiverURL.Scheme != "http" && receiverURL.Scheme != "https") || receiverURL.Host == "" {
+		problems = append(problems, "url must be an absolute http or https URL")
+	}
+	for _, eventType := range requestBody.EventTypes {
+		known := false
+		for _, knownType := range domain.EventTypes {
+			known = known || eventType == knownType
+		}
+		if !known {
+			problems = append(problems, fmt.Sprintf("event_types: %q is not a known event type", eventType))
+		}
+	}
+	if len(problems) > 0 {
+		WriteErrorResponse(response, http.StatusBadRequest, problems)
+		return WebhookRequest{}, false
+	}
+
+	return requestBody, true
+}
+
+// parseWebhookID reads the `webhookID` URL parameter.
+// It writes an error response and returns ok: false when it is invalid.
+func parseWebhookID(response http.ResponseWriter, request *http.Request) (uuid.UUID, bool) {
+	webhookID, err := uuid.Parse(chi.URLParam(request, "webhookID"))
+	if err != nil {
+		WriteErrorResponse(response, http.StatusBadRequest, []string{
+			"id is not a valid uuid",
+		})
+		return uuid.Nil, false
+	}
+	return webhookID, true
+}
+
+func writeWebhookNotFound(response http.ResponseWriter) {
+	WriteErrorResponse(response, http.StatusNotFound, []string{
+		"webhook not found",
+	})
+}
+
+// CreateWebhook registers a webhook receiving the events from now on.
+// The secret is only returned in this response.
+func (s *Server) CreateWebhook(response http.ResponseWriter, request *http.Request) {
+	requestBody, ok := decodeWebhookRequest(response, request)
+	if !ok {
+		return
+	}
+
+	webhook, err := s.webhooks.Create(webhooks.Webhook{
+		URL:        requestBody.URL,
+		Secret:     requestBody.Secret,
+		EventTypes: requestBody.EventTypes,
+	})
+	if err != nil {
+		WriteInternalError(response, request, err)
+		return
+	}
+
+	responseBody := newWebhookResponse(webhook)
+	responseBody.Secret = webhook.Secret
+	WriteAPIResponse(response, request, http.StatusCreated, responseBody)
+}
+
+type ListWebhooksResponse = []WebhookResponse
+
+func (s *Server) ListWebhooks(response http.ResponseWriter, request *http.Request) {
+	all := s.webhooks.List()
+	sort.Slice(all, func(a, b int) bool {
+		if !all[a].CreatedAt.Equal(all[b].CreatedAt) {
+			return all[a].CreatedAt.Before(all[b].CreatedAt)
+		}
+		return all[a].ID.String() < all[b].ID.String()
+	})
+
+	responseBody := ListWebhooksResponse{}
+	for _, webhook := range all {
+		responseBody = append(responseBody, newWebhookResponse(webhook))
+	}
+	WriteAPIResponse(response, request, http.StatusOK, responseBody)
+}
+
+func (s *Server) FindWebhook(response http.ResponseWriter, request *http.Request) {
+	webhookID, ok := parseWebhookID(response, request)
+	if !ok {
+		return
+	}
+
+	webhook, found := s.webhooks.Get(webhookID)
+	if !found {
+		writeWebhookNotFound(response)
+		return
+	}
+	WriteAPIResponse(response, request, http.StatusOK, newWebhookResponse(webhook))
+}
+
+// UpdateWebhook replaces the URL and event types of a webhook, and its
+// secret when given.
+func (s *Server) UpdateWebhook(response http.ResponseWriter, request *http.Request) {
+	webhookID, ok := parseWebhookID(response, request)
+	if !ok {
+		return
+	}
+	requestBody, ok := decodeWebhookRequest(response, request)
+	if !ok {
+		return
+	}
+
+	webhook, found, err := s.webhooks.Update(webhooks.Webhook{
+		ID:         webhookID,
+		URL:        requestBody.URL,
+		Secret:     requestBody.Secret,
+		EventTypes: requestBody.EventTypes,
+	})
+	if err != nil {
+		WriteInternalError(response, request, err)
+		return
+	}
+	if !found {
+		writeWebhookNotFound(response)
+		return
+	}
+	WriteAPIResponse(response, request, http.StatusOK, newWebhookResponse(webhook))
+}
+
+// DeleteWebhook removes a webhook, dropping its pending deliveries.
+func (s *Server) DeleteWebhook(response http.ResponseWriter, request *http.Request) {
+	webhookID, ok := parseWebhookID(response, request)
+	if !ok {
+		return
+	}
+
+	deleted, err := s.webhooks.Delete(webhookID)
+	if err != nil {
+		WriteInternalError(response, request, err)
+		return
+	}
+	if !deleted {
+		writeWebhookNotFound(response)
+		return
+	}
+	response.WriteHeader(http.StatusNoContent)
+}
+
+// ListWebhookDeliveries returns the most recent deliveries of a webhook,
+// newest first.
+func (s *Server) ListWebhookDeliveries(response http.ResponseWriter, request *http.Request) {
+	webhookID, ok := parseWebhookID(response, request)
+	if !ok {
+		return
+	}
+
+	deliveries, found := s.webhooks.Deliveries(webhookID)
+	if !found {
+		writeWebhookNotFound(response)
+		return
+	}
+
+	responseBody := ListWebhookDeliveriesResponse{}
+	for _, delivery := range deliveries {
+		attempts := []AttemptResponse{}
+		for _, attempt := range delivery.Attempts {
+			attempts = append(attempts, AttemptResponse{
+				Time:       attempt.Time.UTC(),
+				StatusCode: attempt.StatusCode,
+				Error:      attempt.Error,
+				DurationMs: attempt.Duration.Milliseconds(),
+			})
+		}
+		responseBody = append(responseBody, DeliveryResponse{
+			ID:        delivery.ID.String(),
+			EventType: delivery.EventType,
+			Status:    delivery.Status,
+			Attempts:  attempts,
+			CreatedAt: delivery.CreatedAt.UTC(),
+		})
+	}
+	WriteAPIResponse(response, request, http.StatusOK, responseBody)
+}
@@ -0,0 +1,217 @@
+package api_test
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/api"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/events"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/logging"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/outbox"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/persistence"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/webhooks"
+	"github.com/google/uuid"
+)
+
+func newWebhooksTestServer(t *testing.T) string {
+	t.Helper()
+
+	provider := persistence.NewInMemorySignatureDeviceRepositoryProvider(persistence.NewInMemorySignatureDeviceRepository())
+	bus := events.NewBus(events.Options{})
+	dispatcher, err := webhooks.NewDispatcher(provider, &http.Client{}, webhooks.Options{
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     time.Millisecond,
+		Timeout:        time.Second,
+		LogSize:        10,
+		QueueSize:      10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dispatcher.Close(context.Background()) })
+
+	outboxDispatcher := outbox.NewDispatcher(
+		provider,
+		[]domain.EventPublisher{bus, dispatcher},
+		outbox.Options{PollInterval: time.Second, BatchSize: 100},
+		logging.Discard(),
+	)
+	t.Cleanup(func() { outboxDispatcher.Close(context.Background()) })
+
+	signatureService := api.NewSignatureService(
+		outboxDispatcher.Provider(),
+		api.WithEvents(bus),
+	)
+	server := httptest.NewServer(api.NewServer(
+		"",
+		signatureService,
+		api.WithAdminToken(testAdminToken),
+		api.WithWebhooks(dispatcher),
+	).HTTPHandler())
+	t.Cleanup(server.Close)
+
+	return server.URL
+}
+
+func decodeData(t *testing.T, response *http.Response, data any) {
+	t.Helper()
+
+	defer response.Body.Close()
+	responseBody := struct {
+		Data any `json:"data"`
+	}{Data: data}
+	if err := json.NewDecoder(response.Body).Decode(&responseBody); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+	t.Run("delivers signed events to the receiver", func(t *testing.T) {
+		received := make(chan *http.Request, 10)
+		receivedBodies := make(chan []byte, 10)
+		receiver := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+			body, _ := io.ReadAll(request.Body)
+			received <- request
+			receivedBodies <- body
+		}))
+		defer receiver.Close()
+		serverURL := newWebhooksTestServer(t)
+
+		response := sendAdminRequest(t, http.MethodPost, serverURL+"/admin/webhooks", testAdminToken, api.CreateWebhookRequest{
+			URL:        receiver.URL,
+			Secret:     "shared-secret",
+			EventTypes: []domain.EventType{domain.EventSignatureCreated},
+		})
+		if response.StatusCode != http.StatusCreated {
+			t.Fatalf("expected status code: %d, got: %d", http.StatusCreated, response.StatusCode)
+		}
+		var webhook api.WebhookResponse
+		decodeData(t, response, &webhook)
+		if webhook.Secret != "shared-secret" {
+			t.Errorf("expected the secret to be returned on creation, got: %q", webhook.Secret)
+		}
+
+		deviceID := uuid.New()
+		response = sendJsonRequest(t, http.MethodPost, serverURL+"/api/v0/signature_devices", api.CreateSignatureDeviceRequest{
+			ID:        deviceID.String(),
+			Algorithm: "ECC",
+		})
+		readBody(t, response)
+		signData(t, serverURL, deviceID, "some-data")
+
+		var request *http.Request
+		var body []byte
+		select {
+		case request = <-received:
+			body = <-receivedBodies
+		case <-time.After(5 * time.Second):
+			t.Fatal("no webhook received")
+		}
+		if !hmac.Equal([]byte(request.Header.Get(webhooks.SignatureHeader)), []byte(webhooks.Sign("shared-secret", body))) {
+			t.Error("expected a valid signature header")
+		}
+		var payload webhooks.Payload
+		if err := json.Unmarshal(body, &payload); err != nil {
+			t.Fatal(err)
+		}
+		if payload.Type != domain.EventSignatureCreated || payload.Data.DeviceID != deviceID.String() || payload.Data.SignatureCounter != 1 {
+			t.Errorf("unexpected payload: %+v", payload)
+		}
+
+		// the device creation was not subscribed to
+		select {
+		case request := <-received:
+			t.Errorf("unexpected webhook: %s", request.Header.Get(webhooks.EventTypeHeader))
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		var deliveries api.ListWebhookDeliveriesResponse
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			response = sendAdminRequest(t, http.MethodGet, serverURL+"/admin/webhooks/"+webhook.ID+"/deliveries", testAdminToken, nil)
+			decodeData(t, response, &deliveries)
+			if len(deliveries) == 1 && deliveries[0].Status != webhooks.DeliveryPending {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		if len(deliveries) != 1 || deliveries[0].ID != payload.ID || deliveries[0].Status != webhooks.DeliverySucceeded {
+			t.Errorf("expected a succeeded delivery in the log, got: %+v", deliveries)
+		}
+	})
+
+	t.Run("manages webhooks", func(t *testing.T) {
+		serverURL := newWebhooksTestServer(t)
+
+		response := sendAdminRequest(t, http.MethodPost, serverURL+"/admin/webhooks", testAdminToken, api.CreateWebhookRequest{
+			URL: "https://erp.example.com/hooks",
+		})
+		var created api.WebhookResponse
+		decodeData(t, response, &created)
+		if len(created.Secret) == 0 {
+			t.Error("expected a generated secret")
+		}
+
+		response = sendAdminRequest(t, http.MethodPut, serverURL+"/admin/webhooks/"+created.ID, testAdminToken, api.UpdateWebhookRequest{
+			URL:        "https://erp.example.com/v2/hooks",
+			EventTypes: []domain.EventType{domain.EventDeviceCreated},
+		})
+		var updated api.WebhookResponse
+		decodeData(t, response, &updated)
+		if response.StatusCode != http.StatusOK || updated.URL != "https://erp.example.com/v2/hooks" || updated.Secret != "" {
+			t.Errorf("unexpected update: %d %+v", response.StatusCode, updated)
+		}
+
+		response = sendAdminRequest(t, http.MethodGet, serverURL+"/admin/webhooks", testAdminToken, nil)
+		var listed api.ListWebhooksResponse
+		decodeData(t, response, &listed)
+		if len(listed) != 1 || listed[0].ID != created.ID || len(listed[0].EventTypes) != 1 {
+			t.Errorf("unexpected webhooks: %+v", listed)
+		}
+
+		response = sendAdminRequest(t, http.MethodDelete, serverURL+"/admin/webhooks/"+created.ID, testAdminToken, nil)
+		readBody(t, response)
+		if response.StatusCode != http.StatusNoContent {
+			t.Errorf("expected status code: %d, got: %d", http.StatusNoContent, response.StatusCode)
+		}
+
+		response = sendAdminRequest(t, http.MethodGet, serverURL+"/admin/webhooks/"+created.ID, testAdminToken, nil)
+		body := readBody(t, response)
+		expectedBody := `{"errors":["webhook not found"],"request_id":"test-request-id"}`
+		if response.StatusCode != http.StatusNotFound || body != expectedBody {
+			t.Errorf("expected: %s, got: %d %s", expectedBody, response.StatusCode, body)
+		}
+	})
+
+	t.Run("validates webhooks", func(t *testing.T) {
+		serverURL := newWebhooksTestServer(t)
+
+		response := sendAdminRequest(t, http.MethodPost, serverURL+"/admin/webhooks", testAdminToken, api.CreateWebhookRequest{
+			URL:        "ftp://erp.example.com",
+			EventTypes: []domain.EventType{"signature.deleted"},
+		})
+		body := readBody(t, response)
+		expectedBody := `{"errors":["url must be an absolute http or https URL","event_types: \"signature.deleted\" is not a known event type"],"request_id":"test-request-id"}`
+		if response.StatusCode != http.StatusBadRequest || body != expectedBody {
+			t.Errorf("expected: %s, got: %d %s", expectedBody, response.StatusCode, body)
+		}
+	})
+
+	t.Run("requires the admin token", func(t *testing.T) {
+		serverURL := newWebhooksTestServer(t)
+
+		response := sendAdminRequest(t, http.MethodGet, serverURL+"/admin/webhooks", "", nil)
+		readBody(t, response)
+		if response.StatusCode != http.StatusUnauthorized {
+			t.Errorf("expected status code: %d, got: %d", http.StatusUnauthorized, response.StatusCode)
+		}
+	})
+}
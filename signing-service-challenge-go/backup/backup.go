@@ -0,0 +1,246 @@
+package backup
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/crypto"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
+	"github.com/google/uuid"
+)
+
+// Version of the archives written by Create. Restore reads all versions up
+// to this one.
+const Version = 1
+
+// KeySize is the size of the AES-256 keys encrypting the archives.
+const KeySize = crypto.AEADKeySize
+
+// An archive is
+//
+//	| magic | version: uint16 big endian | nonce | AES-256-GCM ciphertext |
+//
+// where the plaintext is the JSON encoded content. The magic and version
+// are authenticated together with the ciphertext, so that they cannot be
+// changed.
+const (
+	magic      = "SIGNING-SERVICE-BACKUP"
+	headerSize = len(magic) + 2
+)
+
+// ErrInvalidArchive is returned when an archive cannot be read, e.g.
+// because it was encrypted with another key or has been changed.
+var ErrInvalidArchive = errors.New("invalid backup archive")
+
+// Rollback is a device whose signature counter would be set back by
+// restoring a backup.
+type Rollback struct {
+	DeviceID      uuid.UUID
+	StoreCounter  uint
+	BackupCounter uint
+}
+
+// RollbackError is returned by Restore when the backup is behind the
+// store. Nothing is restored then: signatures with the same counter
+// would be created again.
+type RollbackError struct {
+	Rollbacks []Rollback
+}
+
+func (e RollbackError) Error() string {
+	return fmt.Sprintf("backup would roll back the signature counters of %d devices", len(e.Rollbacks))
+}
+
+// Result counts the devices of a restored backup.
+type Result struct {
+	// devices missing in the store, or behind the backup
+	Restored int
+	// devices with the same signature counter in the store, which are kept
+	Unchanged int
+}
+
+// content is the plaintext of an archive.
+type content struct {
+	Version   int              `json:"version"`
+	CreatedAt time.Time        `json:"created_at"`
+	Devices   []archivedDevice `json:"devices"`
+}
+
+type archivedDevice struct {
+	ID        uuid.UUID `json:"id"`
+	Algorithm string    `json:"algorithm"`
+	// PEM encoded by the marshaler of the algorithm
+	PrivateKey       string              `json:"private_key"`
+	Label            string              `json:"label"`
+	Status           domain.DeviceStatus `json:"status"`
+	LastSignature    string              `json:"last_signature"`
+	SignatureCounter uint                `json:"signature_counter"`
+	// PEM encoded, empty for devices without certificate chain
+	CertificateChain string `json:"certificate_chain,omitempty"`
+}
+
+// Create returns an archive of all devices, encrypted with the key. The
+// devices are read in a single transaction, so that the archive is
+// consistent.
+func Create(provider domain.SignatureDeviceRepositoryProvider, key []byte) ([]byte, error) {
+	aead, err := crypto.NewAEAD("backup key", key)
+	if err != nil {
+		return nil, err
+	}
+
+	var devices []domain.SignatureDevice
+	err = provider.ReadTx(func(repository domain.SignatureDeviceRepository) error {
+		var err error
+		devices, err = repository.List()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext := content{
+		Version:   Version,
+		CreatedAt: time.Now().UTC(),
+		Devices:   []archivedDevice{},
+	}
+	for _, device := range devices {
+		privateKey, err := crypto.EncodePrivateKey(device.KeyPair)
+		if err != nil {
+			return nil, fmt.Errorf("could not encode key pair of device %s: %w", device.ID, err)
+		}
+		plaintext.Devices = append(plaintext.Devices, archivedDevice{
+			ID:               device.ID,
+			Algorithm:        device.KeyPair.AlgorithmName(),
+			PrivateKey:       string(privateKey),
+			Label:            device.Label,
+			Status:           device.Status,
+			LastSignature:    device.LastSignature,
+			SignatureCounter: device.SignatureCounter,
+			CertificateChain: string(crypto.EncodeCertificateChain(device.CertificateChain)),
+		})
+	}
+	encoded, err := json.Marshal(plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	header := binary.BigEndian.AppendUint16([]byte(magic), Version)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	archive := append(header, nonce...)
+	return aead.Seal(archive, nonce, encoded, header), nil
+}
+
+// open decrypts the archive and decodes its devices.
+func open(archive []byte, key []byte) ([]domain.SignatureDevice, error) {
+	aead, err := crypto.NewAEAD("backup key", key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(archive) < headerSize+aead.NonceSize() || !bytes.HasPrefix(archive, []byte(magic)) {
+		return nil, fmt.Errorf("%w: not a backup archive", ErrInvalidArchive)
+	}
+	header := archive[:headerSize]
+	if version := binary.BigEndian.Uint16(header[len(magic):]); version < 1 || version > Version {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidArchive, version)
+	}
+	nonce := archive[headerSize : headerSize+aead.NonceSize()]
+	encoded, err := aead.Open(nil, nonce, archive[headerSize+aead.NonceSize():], header)
+	if err != nil {
+		return nil, fmt.Errorf("%w: wrong key or changed archive", ErrInvalidArchive)
+	}
+
+	var plaintext content
+	if err := json.Unmarshal(encoded, &plaintext); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidArchive, err)
+	}
+	devices := []domain.SignatureDevice{}
+	for _, archived := range plaintext.Devices {
+		keyPair, err := crypto.DecodePrivateKey(archived.Algorithm, []byte(archived.PrivateKey))
+		if err != nil {
+			return nil, fmt.Errorf("%w: could not decode key pair of device %s: %s", ErrInvalidArchive, archived.ID, err)
+		}
+		var chain [][]byte
+		if archived.CertificateChain != "" {
+			chain, err = crypto.DecodeCertificateChain([]byte(archived.CertificateChain))
+			if err != nil {
+				return nil, fmt.Errorf("%w: could not decode certificate chain of device %s: %s", ErrInvalidArchive, archived.ID, err)
+			}
+		}
+		devices = append(devices, domain.SignatureDevice{
+			ID:               archived.ID,
+			KeyPair:          keyPair,
+			Label:            archived.Label,
+			Status:           archived.Status,
+			LastSignature:    archived.LastSignature,
+			SignatureCounter: archived.SignatureCounter,
+			CertificateChain: chain,
+		})
+	}
+	return devices, nil
+}
+
+// Restore writes the devices of the archive, encrypted with the key, to
+// the store in a single transaction. Devices with the same signature
+// counter in the store are kept. When any device of the store is ahead of
+// the backup, a RollbackError is returned and nothing is restored.
+// Devices deactivated in the store stay deactivated.
+func Restore(provider domain.SignatureDeviceRepositoryProvider, archive []byte, key []byte) (Result, error) {
+	devices, err := open(archive, key)
+	if err != nil {
+		return Result{}, err
+	}
+
+	var result Result
+	err = provider.WriteTx(func(repository domain.SignatureDeviceRepository) error {
+		result = Result{}
+		rollbacks := []Rollback{}
+		restore := []domain.SignatureDevice{}
+		for _, device := range devices {
+			stored, found, err := repository.Find(device.ID)
+			if err != nil {
+				return err
+			}
+			switch {
+			case !found:
+				restore = append(restore, device)
+			case stored.SignatureCounter > device.SignatureCounter:
+				rollbacks = append(rollbacks, Rollback{
+					DeviceID:      device.ID,
+					StoreCounter:  stored.SignatureCounter,
+					BackupCounter: device.SignatureCounter,
+				})
+			case stored.SignatureCounter == device.SignatureCounter:
+				result.Unchanged++
+			default:
+				if stored.Status == domain.DeviceStatusDeactivated {
+					device.Status = domain.DeviceStatusDeactivated
+				}
+				restore = append(restore, device)
+			}
+		}
+		if len(rollbacks) > 0 {
+			return RollbackError{Rollbacks: rollbacks}
+		}
+
+		for _, device := range restore {
+			if err := repository.Restore(device); err != nil {
+				return err
+			}
+		}
+		result.Restored = len(restore)
+		return nil
+	})
+	if err != nil {
+		return Result{}, err
+	}
+	return result, nil
+}
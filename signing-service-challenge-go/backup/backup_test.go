@@ -0,0 +1,249 @@
+package backup
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"testing"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/crypto"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/persistence"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/uuid"
+)
+
+func newKey(t *testing.T) []byte {
+	t.Helper()
+
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func newProvider() domain.SignatureDeviceRepositoryProvider {
+	return persistence.NewInMemorySignatureDeviceRepositoryProvider(
+		persistence.NewInMemorySignatureDeviceRepository(),
+	)
+}
+
+func createDevice(t *testing.T, provider domain.SignatureDeviceRepositoryProvider, generator domain.KeyPairGenerator) uuid.UUID {
+	t.Helper()
+
+	device, err := domain.BuildSignatureDevice(uuid.New(), generator, "my key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = provider.WriteTx(func(repository domain.SignatureDeviceRepository) error {
+		return repository.Create(device)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return device.ID
+}
+
+func sign(t *testing.T, provider domain.SignatureDeviceRepositoryProvider, id uuid.UUID) (signature string, signedData string) {
+	t.Helper()
+
+	_, signature, signedData, err := domain.SignTransaction(context.Background(), id, provider, "data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signature, signedData
+}
+
+func find(t *testing.T, provider domain.SignatureDeviceRepositoryProvider, id uuid.UUID) domain.SignatureDevice {
+	t.Helper()
+
+	var device domain.SignatureDevice
+	var found bool
+	err := provider.ReadTx(func(repository domain.SignatureDeviceRepository) error {
+		var err error
+		device, found, err = repository.Find(id)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found {
+		t.Fatalf("expected device %s to be found", id)
+	}
+	return device
+}
+
+func decodeSignature(t *testing.T, signature string) []byte {
+	t.Helper()
+
+	decoded, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return decoded
+}
+
+func createBackup(t *testing.T, provider domain.SignatureDeviceRepositoryProvider, key []byte) []byte {
+	t.Helper()
+
+	archive, err := Create(provider, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return archive
+}
+
+func TestBackup(t *testing.T) {
+	t.Run("restores the devices with keys and counters", func(t *testing.T) {
+		key := newKey(t)
+		provider := newProvider()
+		ids := []uuid.UUID{
+			createDevice(t, provider, crypto.RSAGenerator{}),
+			createDevice(t, provider, crypto.ECCGenerator{}),
+		}
+		lastSignature, _ := sign(t, provider, ids[1])
+		archive := createBackup(t, provider, key)
+
+		restored := newProvider()
+		result, err := Restore(restored, archive, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff(result, Result{Restored: 2}); diff != "" {
+			t.Errorf("unexpected diff: %s", diff)
+		}
+		for _, id := range ids {
+			expected := find(t, provider, id)
+			got := find(t, restored, id)
+			expectedPublicKey, _ := expected.KeyPair.EncodedPublicKey()
+			gotPublicKey, _ := got.KeyPair.EncodedPublicKey()
+			if gotPublicKey != expectedPublicKey {
+				t.Errorf("expected the key pair of device %s to be restored", id)
+			}
+			expected.KeyPair, got.KeyPair = nil, nil
+			if diff := cmp.Diff(got, expected); diff != "" {
+				t.Errorf("unexpected diff: %s", diff)
+			}
+		}
+
+		// the restored device continues the chain of signatures
+		signature, signedData := sign(t, restored, ids[1])
+		if signedData != "1_data_"+lastSignature {
+			t.Errorf("expected signed data to continue after the backup, got: %s", signedData)
+		}
+		if err := find(t, restored, ids[1]).KeyPair.(*crypto.ECCKeyPair).Verify([]byte(signedData), decodeSignature(t, signature)); err != nil {
+			t.Errorf("expected signature of the restored key to be valid: %s", err)
+		}
+	})
+
+	t.Run("moves devices behind the backup forward and keeps the others", func(t *testing.T) {
+		key := newKey(t)
+		provider := newProvider()
+		ids := []uuid.UUID{
+			createDevice(t, provider, crypto.ECCGenerator{}),
+			createDevice(t, provider, crypto.ECCGenerator{}),
+		}
+		older := createBackup(t, provider, key)
+		lastSignature, _ := sign(t, provider, ids[0])
+		newer := createBackup(t, provider, key)
+
+		restored := newProvider()
+		if _, err := Restore(restored, older, key); err != nil {
+			t.Fatal(err)
+		}
+		err := restored.WriteTx(func(repository domain.SignatureDeviceRepository) error {
+			return repository.Deactivate(ids[0])
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := Restore(restored, newer, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff(result, Result{Restored: 1, Unchanged: 1}); diff != "" {
+			t.Errorf("unexpected diff: %s", diff)
+		}
+		device := find(t, restored, ids[0])
+		if device.SignatureCounter != 1 || device.LastSignature != lastSignature {
+			t.Errorf("expected counter 1 and the last signature, got: %d, %s", device.SignatureCounter, device.LastSignature)
+		}
+		if device.Status != domain.DeviceStatusDeactivated {
+			t.Errorf("expected device to stay deactivated, got: %s", device.Status)
+		}
+	})
+
+	t.Run("refuses to roll back signature counters", func(t *testing.T) {
+		key := newKey(t)
+		provider := newProvider()
+		ahead := createDevice(t, provider, crypto.ECCGenerator{})
+		missing := createDevice(t, provider, crypto.ECCGenerator{})
+		archive := createBackup(t, provider, key)
+
+		// a store in which only the first device exists, with a signature
+		// created after the backup
+		store := newProvider()
+		device := find(t, provider, ahead)
+		err := store.WriteTx(func(repository domain.SignatureDeviceRepository) error {
+			return repository.Create(device)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sign(t, store, ahead)
+
+		_, err = Restore(store, archive, key)
+
+		var rollbackError RollbackError
+		if !errors.As(err, &rollbackError) {
+			t.Fatalf("expected RollbackError, got: %v", err)
+		}
+		expected := []Rollback{{DeviceID: ahead, StoreCounter: 1, BackupCounter: 0}}
+		if diff := cmp.Diff(rollbackError.Rollbacks, expected); diff != "" {
+			t.Errorf("unexpected diff: %s", diff)
+		}
+		if counter := find(t, store, ahead).SignatureCounter; counter != 1 {
+			t.Errorf("expected counter 1 to be kept, got: %d", counter)
+		}
+		err = store.ReadTx(func(repository domain.SignatureDeviceRepository) error {
+			if _, found, _ := repository.Find(missing); found {
+				t.Error("expected nothing to be restored")
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("rejects archives it cannot read", func(t *testing.T) {
+		key := newKey(t)
+		provider := newProvider()
+		createDevice(t, provider, crypto.ECCGenerator{})
+		archive := createBackup(t, provider, key)
+
+		changedVersion := append([]byte{}, archive...)
+		changedVersion[headerSize-1] = 0
+		changedCiphertext := append([]byte{}, archive...)
+		changedCiphertext[len(changedCiphertext)-1] ^= 0xff
+
+		for name, test := range map[string]struct {
+			archive []byte
+			key     []byte
+		}{
+			"wrong key":          {archive, newKey(t)},
+			"changed version":    {changedVersion, key},
+			"changed ciphertext": {changedCiphertext, key},
+			"no archive":         {[]byte("not a backup"), key},
+		} {
+			_, err := Restore(newProvider(), test.archive, test.key)
+			if !errors.Is(err, ErrInvalidArchive) {
+				t.Errorf("%s: expected ErrInvalidArchive, got: %v", name, err)
+			}
+		}
+	})
+}
@@ -0,0 +1,519 @@
+package ca
+
+import (
+	"bytes"
+	"context"
+	stdcrypto "crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/crypto"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
+	"github.com/google/uuid"
+)
+
+// Files in the directory of an Authority. An existing key and certificate,
+// e.g. of an intermediate CA of a customer's PKI, can be placed there
+// before the first start; otherwise a self-signed CA is created.
+const (
+	KeyFile          = "ca.key"
+	CertificateFile  = "ca.crt"
+	CertificatesFile = "certificates.jsonl"
+)
+
+const (
+	caValidity = 10 * 365 * 24 * time.Hour
+	// CRLs are reissued after half of their validity
+	crlValidity = 24 * time.Hour
+	// certificates are valid from slightly before they are issued, to
+	// tolerate verifiers with clocks running late
+	clockSkew = 5 * time.Minute
+)
+
+// ErrDeactivated is returned by Issue for devices that are deactivated
+// already, as their certificate would be revoked right away.
+var ErrDeactivated = errors.New("signature device is deactivated")
+
+type Options struct {
+	// how long the certificates of devices are valid
+	CertificateValidity time.Duration
+}
+
+// issued is a certificate issued for a device.
+type issued struct {
+	DeviceID uuid.UUID
+	// DER encoded
+	Certificate []byte
+	// nil until the device is deactivated
+	RevokedAt *time.Time
+}
+
+// record is a line of the CertificatesFile, which is only appended to:
+// either a certificate issued for a device, or the revocation of it.
+type record struct {
+	DeviceID    uuid.UUID  `json:"device_id"`
+	Certificate []byte     `json:"certificate,omitempty"`
+	RevokedAt   *time.Time `json:"revoked_at,omitempty"`
+}
+
+// Authority is an internal certificate authority issuing X.509
+// certificates for the public keys of signature devices, one per device,
+// and revoking them when the device is deactivated. The CA key pair and
+// the issued certificates are kept in a directory.
+type Authority struct {
+	dir         string
+	options     Options
+	certificate *x509.Certificate
+	signer      stdcrypto.Signer
+
+	mutex  sync.Mutex
+	issued map[uuid.UUID]*issued
+	// cached until it expires or a certificate is revoked
+	crl         []byte
+	crlUpdateAt time.Time
+}
+
+// Open loads the CA key pair and the issued certificates from the
+// directory. The directory and a self-signed CA are created when they do
+// not exist.
+func Open(dir string, options Options) (*Authority, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	a := &Authority{
+		dir:     dir,
+		options: options,
+		issued:  map[uuid.UUID]*issued{},
+	}
+
+	keyPEM, keyErr := os.ReadFile(filepath.Join(dir, KeyFile))
+	certificatePEM, certificateErr := os.ReadFile(filepath.Join(dir, CertificateFile))
+	switch {
+	case errors.Is(keyErr, fs.ErrNotExist) && errors.Is(certificateErr, fs.ErrNotExist):
+		if err := a.create(); err != nil {
+			return nil, fmt.Errorf("could not create the CA: %w", err)
+		}
+	case keyErr != nil:
+		return nil, keyErr
+	case certificateErr != nil:
+		return nil, certificateErr
+	default:
+		if err := a.load(keyPEM, certificatePEM); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := a.replay(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// replay applies the records of the CertificatesFile. A last record that
+// was not written completely, when the process stopped while appending
+// it, is removed.
+func (a *Authority) replay() error {
+	path := filepath.Join(a.dir, CertificatesFile)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	complete := bytes.LastIndexByte(data, '\n') + 1
+	if complete < len(data) {
+		if err := os.Truncate(path, int64(complete)); err != nil {
+			return err
+		}
+	}
+	for number, line := range bytes.Split(data[:complete], []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		var r record
+		if err := json.Unmarshal(line, &r); err != nil {
+			return fmt.Errorf("invalid %s, line %d: %w", CertificatesFile, number+1, err)
+		}
+		if r.Certificate != nil {
+			a.issued[r.DeviceID] = &issued{DeviceID: r.DeviceID, Certificate: r.Certificate}
+		}
+		if i, found := a.issued[r.DeviceID]; found && r.RevokedAt != nil {
+			i.RevokedAt = r.RevokedAt
+		}
+	}
+	return nil
+}
+
+// create generates a self-signed CA and writes its key pair.
+func (a *Authority) create() error {
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serialNumber, err := newSerialNumber()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               pkix.Name{CommonName: "Signing Service CA"},
+		NotBefore:             now.Add(-clockSkew),
+		NotAfter:              now.Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := writeFile(filepath.Join(a.dir, KeyFile), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})); err != nil {
+		return err
+	}
+	if err := writeFile(filepath.Join(a.dir, CertificateFile), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})); err != nil {
+		return err
+	}
+	a.certificate, err = x509.ParseCertificate(der)
+	a.signer = key
+	return err
+}
+
+// load reads a PKCS#8 private key and the CA certificate of its public
+// key.
+func (a *Authority) load(keyPEM, certificatePEM []byte) error {
+	keyBlock, _ := pem.Decode(keyPEM)
+	if keyBlock == nil {
+		return fmt.Errorf("%s is not PEM encoded", KeyFile)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return fmt.Errorf("%s: %w", KeyFile, err)
+	}
+	signer, ok := key.(stdcrypto.Signer)
+	if !ok {
+		return fmt.Errorf("%s: unsupported private key", KeyFile)
+	}
+
+	certificateBlock, _ := pem.Decode(certificatePEM)
+	if certificateBlock == nil {
+		return fmt.Errorf("%s is not PEM encoded", CertificateFile)
+	}
+	certificate, err := x509.ParseCertificate(certificateBlock.Bytes)
+	if err != nil {
+		return fmt.Errorf("%s: %w", CertificateFile, err)
+	}
+	if !certificate.IsCA {
+		return fmt.Errorf("%s is not a CA certificate", CertificateFile)
+	}
+	public, ok := certificate.PublicKey.(interface {
+		Equal(stdcrypto.PublicKey) bool
+	})
+	if !ok || !public.Equal(signer.Public()) {
+		return fmt.Errorf("%s does not belong to %s", CertificateFile, KeyFile)
+	}
+
+	a.certificate = certificate
+	a.signer = signer
+	return nil
+}
+
+// writeFile replaces the file atomically, so that it is never left
+// half-written.
+func writeFile(path string, data []byte) error {
+	temporary, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temporary.Name())
+
+	if _, err := temporary.Write(data); err != nil {
+		temporary.Close()
+		return err
+	}
+	if err := temporary.Sync(); err != nil {
+		temporary.Close()
+		return err
+	}
+	if err := temporary.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temporary.Name(), path)
+}
+
+// append writes the record to the end of the CertificatesFile, so that
+// issuing a certificate does not rewrite the ones issued before. The
+// caller must hold the mutex.
+func (a *Authority) append(r record) error {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(filepath.Join(a.dir, CertificatesFile), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	size, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		// later records must not be appended to a partial one
+		file.Truncate(size)
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// newSerialNumber returns a random, positive serial number of up to 128
+// bits.
+func newSerialNumber() (*big.Int, error) {
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	return serialNumber.Add(serialNumber, big.NewInt(1)), nil
+}
+
+// Certificate returns the DER encoded certificate of the CA.
+func (a *Authority) Certificate() []byte {
+	return a.certificate.Raw
+}
+
+// Find returns the DER encoded certificate issued for the device.
+func (a *Authority) Find(deviceID uuid.UUID) ([]byte, bool) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	i, found := a.issued[deviceID]
+	if !found {
+		return nil, false
+	}
+	return i.Certificate, true
+}
+
+// Issue returns the DER encoded certificate of the device, and issues it
+// first when the device has none yet. The subject holds the device ID as
+// serial number and the label, or the ID when there is none, as common
+// name. The certificate of a deactivated device is revoked, in case the
+// event of the deactivation was missed.
+func (a *Authority) Issue(device domain.SignatureDevice) ([]byte, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if i, found := a.issued[device.ID]; found {
+		if device.Status == domain.DeviceStatusDeactivated {
+			if err := a.revoke(i, time.Now()); err != nil {
+				return nil, err
+			}
+		}
+		return i.Certificate, nil
+	}
+	if device.Status == domain.DeviceStatusDeactivated {
+		return nil, ErrDeactivated
+	}
+
+	public, err := crypto.PublicKey(device.KeyPair)
+	if err != nil {
+		return nil, err
+	}
+	serialNumber, err := newSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+	commonName := device.Label
+	if commonName == "" {
+		commonName = device.ID.String()
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			CommonName:   commonName,
+			SerialNumber: device.ID.String(),
+		},
+		NotBefore:             now.Add(-clockSkew),
+		NotAfter:              now.Add(a.options.CertificateValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, a.certificate, public, a.signer)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := a.append(record{DeviceID: device.ID, Certificate: der}); err != nil {
+		return nil, err
+	}
+	a.issued[device.ID] = &issued{DeviceID: device.ID, Certificate: der}
+	return der, nil
+}
+
+// Revoke revokes the certificate of the device as of the time, e.g. when
+// it was deactivated. Devices without certificate, or with a revoked one,
+// are left as they are.
+func (a *Authority) Revoke(deviceID uuid.UUID, at time.Time) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	i, found := a.issued[deviceID]
+	if !found {
+		return nil
+	}
+	return a.revoke(i, at)
+}
+
+// revoke revokes the certificate unless it is revoked already. The caller
+// must hold the mutex.
+func (a *Authority) revoke(i *issued, at time.Time) error {
+	if i.RevokedAt != nil {
+		return nil
+	}
+
+	if err := a.append(record{DeviceID: i.DeviceID, RevokedAt: &at}); err != nil {
+		return err
+	}
+	i.RevokedAt = &at
+	a.crl = nil
+	return nil
+}
+
+// CRL returns the DER encoded certificate revocation list of the revoked
+// certificates. Before a new CRL is created, the certificates of devices
+// deactivated in the store are revoked, in case the events of their
+// deactivation were missed. Reading the store is bounded by the caching
+// of the CRL that way.
+func (a *Authority) CRL(ctx context.Context, provider domain.SignatureDeviceRepositoryProvider) ([]byte, error) {
+	if crl, ok := a.cachedCRL(time.Now()); ok {
+		return crl, nil
+	}
+
+	if err := a.revokeDeactivated(ctx, provider); err != nil {
+		return nil, err
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	now := time.Now()
+	// another request may have created one in the meantime
+	if a.crl != nil && now.Before(a.crlUpdateAt) {
+		return a.crl, nil
+	}
+
+	entries := []x509.RevocationListEntry{}
+	for _, i := range a.issued {
+		if i.RevokedAt == nil {
+			continue
+		}
+		certificate, err := x509.ParseCertificate(i.Certificate)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, x509.RevocationListEntry{
+			SerialNumber:   certificate.SerialNumber,
+			RevocationTime: *i.RevokedAt,
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].RevocationTime.Before(entries[j].RevocationTime)
+	})
+
+	crl, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		// increases with every CRL, also across restarts
+		Number:                    big.NewInt(now.UnixNano()),
+		ThisUpdate:                now,
+		NextUpdate:                now.Add(crlValidity),
+		RevokedCertificateEntries: entries,
+	}, a.certificate, a.signer)
+	if err != nil {
+		return nil, err
+	}
+
+	a.crl = crl
+	a.crlUpdateAt = now.Add(crlValidity / 2)
+	return crl, nil
+}
+
+// cachedCRL returns the last CRL, unless it is due to be updated.
+func (a *Authority) cachedCRL(now time.Time) ([]byte, bool) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.crl != nil && now.Before(a.crlUpdateAt) {
+		return a.crl, true
+	}
+	return nil, false
+}
+
+// revokeDeactivated revokes the certificates of deactivated devices that
+// are not revoked yet. The store is read without holding the mutex.
+func (a *Authority) revokeDeactivated(ctx context.Context, provider domain.SignatureDeviceRepositoryProvider) error {
+	a.mutex.Lock()
+	unrevoked := []uuid.UUID{}
+	for deviceID, i := range a.issued {
+		if i.RevokedAt == nil {
+			unrevoked = append(unrevoked, deviceID)
+		}
+	}
+	a.mutex.Unlock()
+	if len(unrevoked) == 0 {
+		return nil
+	}
+
+	deactivated := []uuid.UUID{}
+	err := domain.ReadTx(ctx, provider, func(ctx context.Context, repository domain.SignatureDeviceRepository) error {
+		for _, deviceID := range unrevoked {
+			device, found, err := repository.Find(deviceID)
+			if err != nil {
+				return err
+			}
+			if found && device.Status == domain.DeviceStatusDeactivated {
+				deactivated = append(deactivated, deviceID)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, deviceID := range deactivated {
+		if err := a.Revoke(deviceID, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
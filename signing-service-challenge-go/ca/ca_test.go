@@ -0,0 +1,317 @@
+package ca
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/crypto"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/events"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/persistence"
+	"github.com/google/uuid"
+)
+
+var testOptions = Options{CertificateValidity: 24 * time.Hour}
+
+func newDevice(t *testing.T, generator domain.KeyPairGenerator, label string) domain.SignatureDevice {
+	t.Helper()
+
+	device, err := domain.BuildSignatureDevice(uuid.New(), generator, label)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return device
+}
+
+func open(t *testing.T, dir string) *Authority {
+	t.Helper()
+
+	authority, err := Open(dir, testOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return authority
+}
+
+// verify checks that the certificate is issued by the authority.
+func verify(t *testing.T, authority *Authority, der []byte) *x509.Certificate {
+	t.Helper()
+
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := x509.ParseCertificate(authority.Certificate())
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+	_, err = certificate.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}})
+	if err != nil {
+		t.Errorf("expected the certificate to be issued by the CA, got: %s", err)
+	}
+	return certificate
+}
+
+func newProvider() domain.SignatureDeviceRepositoryProvider {
+	return persistence.NewInMemorySignatureDeviceRepositoryProvider(persistence.NewInMemorySignatureDeviceRepository())
+}
+
+func revokedSerialNumbers(t *testing.T, authority *Authority, provider domain.SignatureDeviceRepositoryProvider) []string {
+	t.Helper()
+
+	der, err := authority.CRL(context.Background(), provider)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crl, err := x509.ParseRevocationList(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := crl.CheckSignatureFrom(verify(t, authority, authority.Certificate())); err != nil {
+		t.Errorf("expected the CRL to be signed by the CA, got: %s", err)
+	}
+	serialNumbers := []string{}
+	for _, entry := range crl.RevokedCertificateEntries {
+		serialNumbers = append(serialNumbers, entry.SerialNumber.String())
+	}
+	return serialNumbers
+}
+
+func TestAuthority(t *testing.T) {
+	t.Run("issues a certificate per device", func(t *testing.T) {
+		authority := open(t, t.TempDir())
+
+		for _, generator := range []domain.KeyPairGenerator{crypto.RSAGenerator{}, crypto.ECCGenerator{}} {
+			device := newDevice(t, generator, "till-1")
+			der, err := authority.Issue(device)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			certificate := verify(t, authority, der)
+			if certificate.Subject.SerialNumber != device.ID.String() || certificate.Subject.CommonName != "till-1" {
+				t.Errorf("expected the device ID and label in the subject, got: %s", certificate.Subject)
+			}
+			expected, _ := crypto.MarshalPublicKey(device.KeyPair)
+			if string(certificate.RawSubjectPublicKeyInfo) != string(expected) {
+				t.Error("expected the certificate of the public key of the device")
+			}
+
+			again, err := authority.Issue(device)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(again) != string(der) {
+				t.Error("expected the same certificate to be returned again")
+			}
+		}
+	})
+
+	t.Run("does not issue certificates of deactivated devices", func(t *testing.T) {
+		authority := open(t, t.TempDir())
+		device := newDevice(t, crypto.ECCGenerator{}, "")
+		device.Status = domain.DeviceStatusDeactivated
+
+		if _, err := authority.Issue(device); !errors.Is(err, ErrDeactivated) {
+			t.Errorf("expected ErrDeactivated, got: %v", err)
+		}
+	})
+
+	t.Run("lists revoked certificates in the CRL", func(t *testing.T) {
+		authority := open(t, t.TempDir())
+		revoked := newDevice(t, crypto.ECCGenerator{}, "")
+		active := newDevice(t, crypto.ECCGenerator{}, "")
+		revokedDER, _ := authority.Issue(revoked)
+		authority.Issue(active)
+
+		if serialNumbers := revokedSerialNumbers(t, authority, newProvider()); len(serialNumbers) != 0 {
+			t.Errorf("expected no revoked certificates, got: %v", serialNumbers)
+		}
+
+		if err := authority.Revoke(revoked.ID, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+		certificate, _ := x509.ParseCertificate(revokedDER)
+		serialNumbers := revokedSerialNumbers(t, authority, newProvider())
+		if len(serialNumbers) != 1 || serialNumbers[0] != certificate.SerialNumber.String() {
+			t.Errorf("expected serial number %s to be revoked, got: %v", certificate.SerialNumber, serialNumbers)
+		}
+	})
+
+	t.Run("revokes the certificates of deactivated devices when issuing", func(t *testing.T) {
+		authority := open(t, t.TempDir())
+		device := newDevice(t, crypto.ECCGenerator{}, "")
+		der, _ := authority.Issue(device)
+
+		// as if the event of the deactivation was missed
+		device.Status = domain.DeviceStatusDeactivated
+		if issued, err := authority.Issue(device); err != nil || string(issued) != string(der) {
+			t.Errorf("expected the certificate of the device, got: %v", err)
+		}
+		certificate, _ := x509.ParseCertificate(der)
+		serialNumbers := revokedSerialNumbers(t, authority, newProvider())
+		if len(serialNumbers) != 1 || serialNumbers[0] != certificate.SerialNumber.String() {
+			t.Errorf("expected serial number %s to be revoked, got: %v", certificate.SerialNumber, serialNumbers)
+		}
+	})
+
+	t.Run("revokes the certificates of devices deactivated in the store when updating the CRL", func(t *testing.T) {
+		authority := open(t, t.TempDir())
+		provider := newProvider()
+		device, err := domain.CreateSignatureDevice(context.Background(), uuid.New(), provider, crypto.ECCGenerator{}, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		der, _ := authority.Issue(device)
+		if serialNumbers := revokedSerialNumbers(t, authority, provider); len(serialNumbers) != 0 {
+			t.Errorf("expected no revoked certificates, got: %v", serialNumbers)
+		}
+
+		// the event of the deactivation is never delivered
+		if _, _, err := domain.DeactivateSignatureDevice(context.Background(), device.ID, provider); err != nil {
+			t.Fatal(err)
+		}
+
+		// the store is only read when the cached CRL is updated
+		if serialNumbers := revokedSerialNumbers(t, authority, provider); len(serialNumbers) != 0 {
+			t.Errorf("expected the cached CRL, got: %v", serialNumbers)
+		}
+		authority.mutex.Lock()
+		authority.crlUpdateAt = time.Now()
+		authority.mutex.Unlock()
+
+		certificate, _ := x509.ParseCertificate(der)
+		serialNumbers := revokedSerialNumbers(t, authority, provider)
+		if len(serialNumbers) != 1 || serialNumbers[0] != certificate.SerialNumber.String() {
+			t.Errorf("expected serial number %s to be revoked, got: %v", certificate.SerialNumber, serialNumbers)
+		}
+	})
+
+	t.Run("keeps the CA and the certificates across restarts", func(t *testing.T) {
+		dir := t.TempDir()
+		authority := open(t, dir)
+		device := newDevice(t, crypto.ECCGenerator{}, "")
+		der, _ := authority.Issue(device)
+		if err := authority.Revoke(device.ID, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+
+		reopened := open(t, dir)
+
+		if string(reopened.Certificate()) != string(authority.Certificate()) {
+			t.Error("expected the same CA certificate")
+		}
+		if found, _ := reopened.Find(device.ID); string(found) != string(der) {
+			t.Error("expected the certificate of the device")
+		}
+		if serialNumbers := revokedSerialNumbers(t, reopened, newProvider()); len(serialNumbers) != 1 {
+			t.Errorf("expected the certificate to stay revoked, got: %v", serialNumbers)
+		}
+	})
+
+	t.Run("appends a record for every certificate and revocation", func(t *testing.T) {
+		dir := t.TempDir()
+		authority := open(t, dir)
+		if _, err := authority.Issue(newDevice(t, crypto.ECCGenerator{}, "")); err != nil {
+			t.Fatal(err)
+		}
+		device := newDevice(t, crypto.ECCGenerator{}, "")
+		if _, err := authority.Issue(device); err != nil {
+			t.Fatal(err)
+		}
+		before, err := os.ReadFile(filepath.Join(dir, CertificatesFile))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := authority.Revoke(device.ID, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+
+		after, err := os.ReadFile(filepath.Join(dir, CertificatesFile))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(string(after), string(before)) {
+			t.Error("expected the earlier records to be kept as they are")
+		}
+		if lines := strings.Count(string(after), "\n"); lines != 3 {
+			t.Errorf("expected 3 records, got: %d", lines)
+		}
+
+		// a record the process was stopping while appending it
+		file, err := os.OpenFile(filepath.Join(dir, CertificatesFile), os.O_WRONLY|os.O_APPEND, 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.WriteString(`{"device_id":`)
+		file.Close()
+
+		reopened := open(t, dir)
+		if _, found := reopened.Find(device.ID); !found {
+			t.Error("expected the certificate of the device")
+		}
+		if _, err := reopened.Issue(newDevice(t, crypto.ECCGenerator{}, "")); err != nil {
+			t.Fatal(err)
+		}
+		if certificates := len(open(t, dir).issued); certificates != 3 {
+			t.Errorf("expected the records after the partial one to be read, got %d certificates", certificates)
+		}
+	})
+
+	t.Run("rejects a certificate of another key", func(t *testing.T) {
+		dir := t.TempDir()
+		open(t, dir)
+		other := t.TempDir()
+		open(t, other)
+		certificate, err := os.ReadFile(filepath.Join(other, CertificateFile))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, CertificateFile), certificate, 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := Open(dir, testOptions); err == nil {
+			t.Error("expected error")
+		}
+	})
+}
+
+func TestIssuer(t *testing.T) {
+	authority := open(t, t.TempDir())
+	provider := newProvider()
+	bus := events.NewBus(events.Options{Buffer: 10})
+	issuer := NewIssuer(authority, provider, bus, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	defer issuer.Close(context.Background())
+
+	device, err := domain.CreateSignatureDevice(context.Background(), uuid.New(), provider, crypto.ECCGenerator{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bus.Publish(domain.Event{ID: uuid.New(), Type: domain.EventDeviceCreated, Device: device})
+	bus.Publish(domain.Event{ID: uuid.New(), Type: domain.EventDeviceDeactivated, Device: device, Time: time.Now()})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(revokedSerialNumbers(t, authority, provider)) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the certificate of the device to be issued and revoked")
+		}
+		authority.mutex.Lock()
+		authority.crl = nil
+		authority.mutex.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, found := authority.Find(device.ID); !found {
+		t.Error("expected the certificate of the device")
+	}
+}
@@ -0,0 +1,106 @@
+package ca
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/events"
+)
+
+// Issuer issues the certificates of created devices, and revokes the
+// certificates of deactivated devices, as their events are published.
+// Devices missed, e.g. because their events were published while the
+// service was down, get their certificates on demand, see Authority.Issue,
+// and have them revoked by Authority.Issue and Authority.CRL.
+type Issuer struct {
+	authority *Authority
+	provider  domain.SignatureDeviceRepositoryProvider
+	logger    *slog.Logger
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewIssuer starts following the events published on the bus, until Close
+// is called.
+func NewIssuer(
+	authority *Authority,
+	provider domain.SignatureDeviceRepositoryProvider,
+	bus *events.Bus,
+	logger *slog.Logger,
+) *Issuer {
+	ctx, cancel := context.WithCancel(context.Background())
+	i := &Issuer{
+		authority: authority,
+		provider:  provider,
+		logger:    logger,
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+
+	follower := bus.Follow(deviceChanges)
+	i.wg.Add(1)
+	go func() {
+		defer i.wg.Done()
+		follower.Run(ctx, func(message events.Message) { i.handle(message.Event) })
+	}()
+	return i
+}
+
+func deviceChanges(message events.Message) bool {
+	return message.Event.Type == domain.EventDeviceCreated || message.Event.Type == domain.EventDeviceDeactivated
+}
+
+func (i *Issuer) handle(event domain.Event) {
+	switch event.Type {
+	case domain.EventDeviceCreated:
+		// events do not contain the key pair
+		var device domain.SignatureDevice
+		var found bool
+		err := domain.ReadTx(i.ctx, i.provider, func(ctx context.Context, repository domain.SignatureDeviceRepository) error {
+			var err error
+			device, found, err = repository.Find(event.Device.ID)
+			return err
+		})
+		if err == nil && found {
+			_, err = i.authority.Issue(device)
+		}
+		if err != nil {
+			i.logger.Warn(
+				"could not issue the certificate of a signature device",
+				slog.String("device_id", event.Device.ID.String()),
+				slog.String("error", err.Error()),
+			)
+		}
+	case domain.EventDeviceDeactivated:
+		if err := i.authority.Revoke(event.Device.ID, event.Time); err != nil {
+			i.logger.Warn(
+				"could not revoke the certificate of a signature device",
+				slog.String("device_id", event.Device.ID.String()),
+				slog.String("error", err.Error()),
+			)
+		}
+	}
+}
+
+// Close stops following the events, and waits for the event being
+// handled, or until the context is done.
+func (i *Issuer) Close(ctx context.Context) error {
+	i.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		i.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
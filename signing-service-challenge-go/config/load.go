@@ -0,0 +1,219 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const EnvPrefix = "SIGNING_SERVICE_"
+
+// setting describes a single value that can be overridden by an environment
+// variable and a command-line flag.
+type setting struct {
+	flag  string
+	usage string
+	apply func(config *Config, value string) error
+}
+
+// The environment variable of a setting is derived from its flag name,
+// e.g. `--storage-dsn` becomes `SIGNING_SERVICE_STORAGE_DSN`.
+func (s setting) env() string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(s.flag, "-", "_"))
+}
+
+func stringSetting(name, usage string, field func(*Config) *string) setting {
+	return setting{
+		flag:  name,
+		usage: usage,
+		apply: func(config *Config, value string) error {
+			*field(config) = value
+			return nil
+		},
+	}
+}
+
+func durationSetting(name, usage string, field func(*Config) *Duration) setting {
+	return setting{
+		flag:  name,
+		usage: usage,
+		apply: func(config *Config, value string) error {
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return err
+			}
+			*field(config) = Duration(d)
+			return nil
+		},
+	}
+}
+
+func floatSetting(name, usage string, field func(*Config) *float64) setting {
+	return setting{
+		flag:  name,
+		usage: usage,
+		apply: func(config *Config, value string) error {
+			f, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return err
+			}
+			*field(config) = f
+			return nil
+		},
+	}
+}
+
+func intSetting(name, usage string, field func(*Config) *int) setting {
+	return setting{
+		flag:  name,
+		usage: usage,
+		apply: func(config *Config, value string) error {
+			i, err := strconv.Atoi(value)
+			if err != nil {
+				return err
+			}
+			*field(config) = i
+			return nil
+		},
+	}
+}
+
+// listSetting reads a comma separated list, ignoring empty entries.
+func listSetting(name, usage string, field func(*Config) *[]string) setting {
+	return setting{
+		flag:  name,
+		usage: usage,
+		apply: func(config *Config, value string) error {
+			list := []string{}
+			for _, entry := range strings.Split(value, ",") {
+				if entry = strings.TrimSpace(entry); entry != "" {
+					list = append(list, entry)
+				}
+			}
+			*field(config) = list
+			return nil
+		},
+	}
+}
+
+var settings = []setting{
+	stringSetting("listen-address", "address the HTTP server listens on", func(c *Config) *string { return &c.ListenAddress }),
+	stringSetting("tls-cert-file", "PEM encoded certificate served over HTTPS", func(c *Config) *string { return &c.TLS.CertFile }),
+	stringSetting("tls-key-file", "PEM encoded private key of the TLS certificate", func(c *Config) *string { return &c.TLS.KeyFile }),
+	stringSetting("tls-client-ca-file", "PEM bundle of CAs that issue client certificates", func(c *Config) *string { return &c.TLS.ClientCAFile }),
+	stringSetting("tls-client-auth", "client certificate authentication: none, verify_if_given or require", func(c *Config) *string { return &c.TLS.ClientAuth }),
+	durationSetting("tls-reload-interval", "how often the certificate files are checked for changes", func(c *Config) *Duration { return &c.TLS.ReloadInterval }),
+	stringSetting("storage-backend", "storage backend for signature devices", func(c *Config) *string { return &c.Storage.Backend }),
+	stringSetting("storage-dsn", "data source name of the storage backend", func(c *Config) *string { return &c.Storage.DSN }),
+	intSetting("storage-snapshot-interval", "number of log records after which the file storage backend compacts its log, 0 to never compact", func(c *Config) *int { return &c.Storage.SnapshotInterval }),
+	stringSetting("storage-key", "base64 encoded AES-256 key encrypting the private keys in the files of the file storage backend, which holds them as plain PEM when empty", func(c *Config) *string { return &c.Storage.Key }),
+	listSetting("algorithms", "comma separated list of algorithms allowed for new signature devices", func(c *Config) *[]string { return &c.Algorithms }),
+	intSetting("key-policy-min-rsa-bits", "minimum size of RSA keys provided for new signature devices", func(c *Config) *int { return &c.KeyPolicy.MinRSABits }),
+	listSetting("key-policy-ecc-curves", "comma separated list of curves allowed for ECDSA keys provided for new signature devices", func(c *Config) *[]string { return &c.KeyPolicy.ECCCurves }),
+	durationSetting("read-timeout", "maximum duration for reading a request", func(c *Config) *Duration { return &c.Timeouts.Read }),
+	durationSetting("write-timeout", "maximum duration for writing a response", func(c *Config) *Duration { return &c.Timeouts.Write }),
+	durationSetting("idle-timeout", "maximum duration a keep-alive connection stays idle", func(c *Config) *Duration { return &c.Timeouts.Idle }),
+	durationSetting("shutdown-timeout", "maximum duration to wait for in-flight requests on shutdown", func(c *Config) *Duration { return &c.Timeouts.Shutdown }),
+	stringSetting("log-level", "one of debug, info, warn, error", func(c *Config) *string { return &c.LogLevel }),
+	stringSetting("tracing-exporter", "where spans are exported to: none, stdout or otlp", func(c *Config) *string { return &c.Tracing.Exporter }),
+	stringSetting("tracing-endpoint", "OTLP/HTTP endpoint spans are exported to, e.g. http://localhost:4318", func(c *Config) *string { return &c.Tracing.Endpoint }),
+	floatSetting("rate-limit-client-rate", "requests per second allowed per client, 0 for unlimited", func(c *Config) *float64 { return &c.RateLimits.Clients.Default.Rate }),
+	intSetting("rate-limit-client-burst", "burst of requests allowed per client", func(c *Config) *int { return &c.RateLimits.Clients.Default.Burst }),
+	floatSetting("rate-limit-device-rate", "signatures per second allowed per device, 0 for unlimited", func(c *Config) *float64 { return &c.RateLimits.Devices.Default.Rate }),
+	intSetting("rate-limit-device-burst", "burst of signatures allowed per device", func(c *Config) *int { return &c.RateLimits.Devices.Default.Burst }),
+	intSetting("job-workers", "number of asynchronous requests processed concurrently", func(c *Config) *int { return &c.Jobs.Workers }),
+	intSetting("job-queue-size", "asynchronous requests waiting per worker before new ones are rejected", func(c *Config) *int { return &c.Jobs.QueueSize }),
+	durationSetting("job-retention", "how long the results of asynchronous requests can be retrieved", func(c *Config) *Duration { return &c.Jobs.Retention }),
+	intSetting("event-history", "number of recent events kept for clients resuming a stream", func(c *Config) *int { return &c.Events.History }),
+	durationSetting("outbox-poll-interval", "how often the outbox is checked for events not published yet", func(c *Config) *Duration { return &c.Outbox.PollInterval }),
+	intSetting("outbox-batch-size", "number of events published from the outbox per transaction", func(c *Config) *int { return &c.Outbox.BatchSize }),
+	intSetting("webhook-max-attempts", "attempts per webhook delivery, including the first one", func(c *Config) *int { return &c.Webhooks.MaxAttempts }),
+	durationSetting("webhook-initial-backoff", "wait before retrying a webhook delivery for the first time, doubled for every further retry", func(c *Config) *Duration { return &c.Webhooks.InitialBackoff }),
+	durationSetting("webhook-max-backoff", "maximum wait between attempts of a webhook delivery", func(c *Config) *Duration { return &c.Webhooks.MaxBackoff }),
+	durationSetting("webhook-timeout", "timeout of a single attempt of a webhook delivery", func(c *Config) *Duration { return &c.Webhooks.Timeout }),
+	intSetting("webhook-log-size", "number of deliveries kept per webhook in the delivery log", func(c *Config) *int { return &c.Webhooks.LogSize }),
+	intSetting("webhook-queue-size", "unfinished deliveries per webhook read from the storage at a time", func(c *Config) *int { return &c.Webhooks.QueueSize }),
+	stringSetting("admin-token", "bearer token of the admin API, which is disabled when empty", func(c *Config) *string { return &c.Admin.Token }),
+	stringSetting("backup-key", "base64 encoded AES-256 key encrypting backups, which are disabled when empty", func(c *Config) *string { return &c.Backup.Key }),
+	stringSetting("transfer-key", "base64 encoded AES-256 transport key wrapping the private keys of exported devices, export and import are disabled when empty", func(c *Config) *string { return &c.Transfer.Key }),
+	stringSetting("ca-dir", "directory of the key pair of the CA issuing device certificates, created when it does not exist, certificates are disabled when empty", func(c *Config) *string { return &c.CA.Dir }),
+	durationSetting("ca-certificate-validity", "how long the certificates of devices are valid", func(c *Config) *Duration { return &c.CA.CertificateValidity }),
+}
+
+// Options are command-line flags that are not part of the Config itself.
+type Options struct {
+	ConfigFile  string
+	PrintConfig bool
+	// files to write a backup to, or restore it from, instead of serving
+	BackupFile  string
+	RestoreFile string
+}
+
+// Load builds the effective configuration by applying, in increasing order
+// of precedence: the defaults, the config file, environment variables
+// and command-line flags.
+// lookupEnv is usually os.LookupEnv.
+func Load(
+	args []string,
+	lookupEnv func(string) (string, bool),
+	output io.Writer,
+) (Config, Options, error) {
+	var options Options
+
+	flagSet := flag.NewFlagSet("signing-service", flag.ContinueOnError)
+	flagSet.SetOutput(output)
+	flagSet.StringVar(&options.ConfigFile, "config", "", "path to a YAML or JSON config file (env: "+EnvPrefix+"CONFIG)")
+	flagSet.BoolVar(&options.PrintConfig, "print-config", false, "print the effective configuration with secrets redacted and exit")
+	flagSet.StringVar(&options.BackupFile, "backup", "", "write an encrypted backup of the storage to the file and exit")
+	flagSet.StringVar(&options.RestoreFile, "restore", "", "restore the encrypted backup in the file into the storage and exit")
+
+	flagValues := map[string]*string{}
+	for _, s := range settings {
+		flagValues[s.flag] = flagSet.String(s.flag, "", fmt.Sprintf("%s (env: %s)", s.usage, s.env()))
+	}
+
+	if err := flagSet.Parse(args); err != nil {
+		return Config{}, options, err
+	}
+
+	if options.ConfigFile == "" {
+		options.ConfigFile, _ = lookupEnv(EnvPrefix + "CONFIG")
+	}
+
+	config := Default()
+	if options.ConfigFile != "" {
+		if err := ReadFile(options.ConfigFile, &config); err != nil {
+			return Config{}, options, err
+		}
+	}
+
+	for _, s := range settings {
+		value, ok := lookupEnv(s.env())
+		if !ok {
+			continue
+		}
+		if err := s.apply(&config, value); err != nil {
+			return Config{}, options, fmt.Errorf("invalid value for %s: %w", s.env(), err)
+		}
+	}
+
+	// only apply flags that were explicitly passed, so that their empty
+	// defaults do not override the other sources
+	setFlags := map[string]bool{}
+	flagSet.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = true
+	})
+	for _, s := range settings {
+		if !setFlags[s.flag] {
+			continue
+		}
+		if err := s.apply(&config, *flagValues[s.flag]); err != nil {
+			return Config{}, options, fmt.Errorf("invalid value for --%s: %w", s.flag, err)
+		}
+	}
+
+	return config, options, config.Validate()
+}
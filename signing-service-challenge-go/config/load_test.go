@@ -0,0 +1,491 @@
+package config
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func envFrom(values map[string]string) func(string) (string, bool) {
+	return func(key string) (string, bool) {
+		value, ok := values[key]
+		return value, ok
+	}
+}
+
+func writeFile(t *testing.T, name string, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	t.Run("returns the defaults when nothing is configured", func(t *testing.T) {
+		got, options, err := Load(nil, envFrom(nil), io.Discard)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(got, Default()); diff != "" {
+			t.Errorf("unexpected diff: %s", diff)
+		}
+		if options.PrintConfig {
+			t.Error("expected print config to be false")
+		}
+	})
+
+	t.Run("reads a yaml config file", func(t *testing.T) {
+		path := writeFile(t, "config.yaml", `
+listen_address: "127.0.0.1:9000"
+storage:
+  backend: memory
+algorithms: [RSA]
+timeouts:
+  read: 3s
+log_level: debug
+`)
+
+		got, _, err := Load([]string{"--config", path}, envFrom(nil), io.Discard)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := Default()
+		expected.ListenAddress = "127.0.0.1:9000"
+		expected.Algorithms = []string{"RSA"}
+		expected.Timeouts.Read = Duration(3 * time.Second)
+		expected.LogLevel = "debug"
+		if diff := cmp.Diff(got, expected); diff != "" {
+			t.Errorf("unexpected diff: %s", diff)
+		}
+	})
+
+	t.Run("reads a json config file given by environment variable", func(t *testing.T) {
+		path := writeFile(t, "config.json", `{"listen_address": ":9001", "timeouts": {"idle": "1m"}}`)
+
+		got, _, err := Load(nil, envFrom(map[string]string{"SIGNING_SERVICE_CONFIG": path}), io.Discard)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.ListenAddress != ":9001" {
+			t.Errorf("expected listen address :9001, got %s", got.ListenAddress)
+		}
+		if got.Timeouts.Idle != Duration(time.Minute) {
+			t.Errorf("expected idle timeout 1m, got %s", time.Duration(got.Timeouts.Idle))
+		}
+	})
+
+	t.Run("rejects unknown fields in the config file", func(t *testing.T) {
+		path := writeFile(t, "config.yaml", "listen_adress: \":9000\"\n")
+
+		_, _, err := Load([]string{"--config", path}, envFrom(nil), io.Discard)
+		if err == nil {
+			t.Error("expected error")
+		}
+	})
+
+	t.Run("environment variables override the config file, flags override both", func(t *testing.T) {
+		path := writeFile(t, "config.yaml", `
+listen_address: ":9000"
+log_level: debug
+algorithms: [RSA]
+`)
+		env := envFrom(map[string]string{
+			"SIGNING_SERVICE_LISTEN_ADDRESS": ":9001",
+			"SIGNING_SERVICE_LOG_LEVEL":      "warn",
+		})
+		args := []string{"--config", path, "--log-level", "error", "--algorithms", "ECC, RSA"}
+
+		got, _, err := Load(args, env, io.Discard)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.ListenAddress != ":9001" {
+			t.Errorf("expected listen address from env, got %s", got.ListenAddress)
+		}
+		if got.LogLevel != "error" {
+			t.Errorf("expected log level from flag, got %s", got.LogLevel)
+		}
+		if diff := cmp.Diff(got.Algorithms, []string{"ECC", "RSA"}); diff != "" {
+			t.Errorf("unexpected diff: %s", diff)
+		}
+	})
+
+	t.Run("returns a validation error listing all invalid values", func(t *testing.T) {
+		env := envFrom(map[string]string{
+			"SIGNING_SERVICE_STORAGE_BACKEND": "floppy",
+		})
+		args := []string{"--algorithms", "DSA", "--log-level", "verbose", "--tls-cert-file", "cert.pem"}
+
+		_, _, err := Load(args, env, io.Discard)
+
+		var validationError ValidationError
+		if !errors.As(err, &validationError) {
+			t.Fatalf("expected validation error, got: %v", err)
+		}
+		if len(validationError.Problems) != 4 {
+			t.Errorf("expected 4 problems, got: %s", validationError)
+		}
+	})
+
+	t.Run("requires a directory for the file storage backend", func(t *testing.T) {
+		env := envFrom(map[string]string{
+			"SIGNING_SERVICE_STORAGE_BACKEND": "file",
+		})
+
+		_, _, err := Load([]string{"--storage-snapshot-interval", "-1"}, env, io.Discard)
+
+		var validationError ValidationError
+		if !errors.As(err, &validationError) {
+			t.Fatalf("expected validation error, got: %v", err)
+		}
+		expected := []string{
+			"storage.dsn must be the directory of the log when storage.backend is file",
+			"storage.snapshot_interval must not be negative",
+		}
+		if diff := cmp.Diff(validationError.Problems, expected); diff != "" {
+			t.Errorf("unexpected diff: %s", diff)
+		}
+
+		config, _, err := Load([]string{"--storage-dsn", "/var/lib/signing-service"}, env, io.Discard)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if config.Storage.Backend != StorageBackendFile {
+			t.Errorf("expected file backend, got: %s", config.Storage.Backend)
+		}
+	})
+
+	t.Run("requires a database file for the bolt storage backend", func(t *testing.T) {
+		_, _, err := Load([]string{"--storage-backend", "bolt"}, envFrom(nil), io.Discard)
+
+		var validationError ValidationError
+		if !errors.As(err, &validationError) {
+			t.Fatalf("expected validation error, got: %v", err)
+		}
+		expected := []string{
+			"storage.dsn must be the database file when storage.backend is bolt",
+		}
+		if diff := cmp.Diff(validationError.Problems, expected); diff != "" {
+			t.Errorf("unexpected diff: %s", diff)
+		}
+	})
+
+	t.Run("requires a connection string for the postgres storage backend", func(t *testing.T) {
+		_, _, err := Load([]string{"--storage-backend", "postgres"}, envFrom(nil), io.Discard)
+
+		var validationError ValidationError
+		if !errors.As(err, &validationError) {
+			t.Fatalf("expected validation error, got: %v", err)
+		}
+		expected := []string{
+			"storage.dsn must be the connection string when storage.backend is postgres",
+		}
+		if diff := cmp.Diff(validationError.Problems, expected); diff != "" {
+			t.Errorf("unexpected diff: %s", diff)
+		}
+	})
+
+	t.Run("validates the storage key", func(t *testing.T) {
+		_, _, err := Load([]string{"--storage-key", "c2hvcnQ="}, envFrom(nil), io.Discard)
+
+		var validationError ValidationError
+		if !errors.As(err, &validationError) {
+			t.Fatalf("expected validation error, got: %v", err)
+		}
+		expected := []string{
+			"storage.key must be a base64 encoded 32 byte key",
+			"storage.key is only supported when storage.backend is file",
+		}
+		if diff := cmp.Diff(validationError.Problems, expected); diff != "" {
+			t.Errorf("unexpected diff: %s", diff)
+		}
+
+		key := "AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8="
+		config, _, err := Load([]string{"--storage-backend", "file", "--storage-dsn", "data", "--storage-key", key}, envFrom(nil), io.Discard)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if config.Storage.Key != key {
+			t.Errorf("expected the key, got: %s", config.Storage.Key)
+		}
+	})
+
+	t.Run("validates the backup key", func(t *testing.T) {
+		_, _, err := Load([]string{"--backup-key", "c2hvcnQ="}, envFrom(nil), io.Discard)
+
+		var validationError ValidationError
+		if !errors.As(err, &validationError) {
+			t.Fatalf("expected validation error, got: %v", err)
+		}
+		expected := []string{
+			"backup.key must be a base64 encoded 32 byte key",
+		}
+		if diff := cmp.Diff(validationError.Problems, expected); diff != "" {
+			t.Errorf("unexpected diff: %s", diff)
+		}
+
+		key := "AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8="
+		config, options, err := Load([]string{"--backup-key", key, "--backup", "devices.backup"}, envFrom(nil), io.Discard)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if config.Backup.Key != key || options.BackupFile != "devices.backup" {
+			t.Errorf("expected the key and backup file, got: %s, %s", config.Backup.Key, options.BackupFile)
+		}
+	})
+
+	t.Run("validates the transfer key", func(t *testing.T) {
+		env := envFrom(map[string]string{
+			"SIGNING_SERVICE_TRANSFER_KEY": "not base64",
+		})
+
+		_, _, err := Load(nil, env, io.Discard)
+
+		var validationError ValidationError
+		if !errors.As(err, &validationError) {
+			t.Fatalf("expected validation error, got: %v", err)
+		}
+		expected := []string{
+			"transfer.key must be a base64 encoded 32 byte key",
+		}
+		if diff := cmp.Diff(validationError.Problems, expected); diff != "" {
+			t.Errorf("unexpected diff: %s", diff)
+		}
+	})
+
+	t.Run("validates the certificate authority", func(t *testing.T) {
+		args := []string{"--ca-dir", "ca", "--ca-certificate-validity", "0s"}
+
+		_, _, err := Load(args, envFrom(nil), io.Discard)
+
+		var validationError ValidationError
+		if !errors.As(err, &validationError) {
+			t.Fatalf("expected validation error, got: %v", err)
+		}
+		expected := []string{
+			"ca.certificate_validity must be positive",
+		}
+		if diff := cmp.Diff(validationError.Problems, expected); diff != "" {
+			t.Errorf("unexpected diff: %s", diff)
+		}
+	})
+
+	t.Run("validates the key policy", func(t *testing.T) {
+		args := []string{"--key-policy-min-rsa-bits", "-1", "--key-policy-ecc-curves", "P-256, secp256k1"}
+
+		_, _, err := Load(args, envFrom(nil), io.Discard)
+
+		var validationError ValidationError
+		if !errors.As(err, &validationError) {
+			t.Fatalf("expected validation error, got: %v", err)
+		}
+		expected := []string{
+			"key_policy.min_rsa_bits must not be negative",
+			`key_policy.ecc_curves: "secp256k1" is not supported`,
+		}
+		if diff := cmp.Diff(validationError.Problems, expected); diff != "" {
+			t.Errorf("unexpected diff: %s", diff)
+		}
+
+		env := envFrom(map[string]string{
+			"SIGNING_SERVICE_KEY_POLICY_MIN_RSA_BITS": "3072",
+			"SIGNING_SERVICE_KEY_POLICY_ECC_CURVES":   "P-384",
+		})
+		config, _, err := Load(nil, env, io.Discard)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectedPolicy := KeyPolicyConfig{MinRSABits: 3072, ECCCurves: []string{"P-384"}}
+		if diff := cmp.Diff(config.KeyPolicy, expectedPolicy); diff != "" {
+			t.Errorf("unexpected diff: %s", diff)
+		}
+	})
+
+	t.Run("validates the client certificate settings", func(t *testing.T) {
+		path := writeFile(t, "config.yaml", `
+tls:
+  client_auth: require
+  client_device_bindings:
+    "CN=till-1": ["not-a-uuid", "*"]
+`)
+
+		_, _, err := Load([]string{"--config", path}, envFrom(nil), io.Discard)
+
+		var validationError ValidationError
+		if !errors.As(err, &validationError) {
+			t.Fatalf("expected validation error, got: %v", err)
+		}
+		expected := []string{
+			"tls.client_ca_file is required when tls.client_auth is enabled",
+			`tls.client_device_bindings["CN=till-1"]: "not-a-uuid" is not a valid uuid`,
+		}
+		if diff := cmp.Diff(validationError.Problems, expected); diff != "" {
+			t.Errorf("unexpected diff: %s", diff)
+		}
+	})
+
+	t.Run("requires an endpoint for the otlp tracing exporter", func(t *testing.T) {
+		env := envFrom(map[string]string{
+			"SIGNING_SERVICE_TRACING_EXPORTER": "otlp",
+		})
+
+		_, _, err := Load(nil, env, io.Discard)
+
+		var validationError ValidationError
+		if !errors.As(err, &validationError) {
+			t.Fatalf("expected validation error, got: %v", err)
+		}
+		expected := []string{
+			`tracing.endpoint "" must be an http or https URL when tracing.exporter is otlp`,
+		}
+		if diff := cmp.Diff(validationError.Problems, expected); diff != "" {
+			t.Errorf("unexpected diff: %s", diff)
+		}
+
+		config, _, err := Load([]string{"--tracing-endpoint", "http://localhost:4318"}, env, io.Discard)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if config.Tracing.Exporter != TracingExporterOTLP {
+			t.Errorf("expected otlp exporter, got: %s", config.Tracing.Exporter)
+		}
+	})
+
+	t.Run("reads rate limits", func(t *testing.T) {
+		path := writeFile(t, "config.yaml", `
+rate_limits:
+  clients:
+    default: {rate: 10, burst: 20}
+    overrides:
+      "cert:CN=till-1": {rate: 50, burst: 100}
+  devices:
+    overrides:
+      "not-a-uuid": {rate: -1}
+`)
+		args := []string{"--config", path, "--rate-limit-device-rate", "2.5", "--rate-limit-device-burst", "5"}
+
+		_, _, err := Load(args, envFrom(nil), io.Discard)
+
+		var validationError ValidationError
+		if !errors.As(err, &validationError) {
+			t.Fatalf("expected validation error, got: %v", err)
+		}
+		expected := []string{
+			`rate_limits.devices.overrides["not-a-uuid"].rate must not be negative`,
+			`rate_limits.devices.overrides: "not-a-uuid" is not a valid uuid`,
+		}
+		if diff := cmp.Diff(validationError.Problems, expected); diff != "" {
+			t.Errorf("unexpected diff: %s", diff)
+		}
+
+		path = writeFile(t, "config.yaml", `
+rate_limits:
+  clients:
+    default: {rate: 10, burst: 20}
+`)
+		args[1] = path
+		config, _, err := Load(args, envFrom(nil), io.Discard)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectedRateLimits := RateLimitsConfig{
+			Clients: RateLimitConfig{Default: RateLimit{Rate: 10, Burst: 20}},
+			Devices: RateLimitConfig{Default: RateLimit{Rate: 2.5, Burst: 5}},
+		}
+		if diff := cmp.Diff(config.RateLimits, expectedRateLimits); diff != "" {
+			t.Errorf("unexpected diff: %s", diff)
+		}
+	})
+
+	t.Run("validates the job settings", func(t *testing.T) {
+		env := envFrom(map[string]string{
+			"SIGNING_SERVICE_JOB_WORKERS":    "0",
+			"SIGNING_SERVICE_JOB_QUEUE_SIZE": "-1",
+		})
+
+		_, _, err := Load([]string{"--job-retention", "0s"}, env, io.Discard)
+
+		var validationError ValidationError
+		if !errors.As(err, &validationError) {
+			t.Fatalf("expected validation error, got: %v", err)
+		}
+		expected := []string{
+			"jobs.workers must be at least 1",
+			"jobs.queue_size must be at least 1",
+			"jobs.retention must be positive",
+		}
+		if diff := cmp.Diff(validationError.Problems, expected); diff != "" {
+			t.Errorf("unexpected diff: %s", diff)
+		}
+	})
+
+	t.Run("validates the outbox settings", func(t *testing.T) {
+		env := envFrom(map[string]string{
+			"SIGNING_SERVICE_OUTBOX_POLL_INTERVAL": "0s",
+		})
+
+		_, _, err := Load([]string{"--outbox-batch-size", "0"}, env, io.Discard)
+
+		var validationError ValidationError
+		if !errors.As(err, &validationError) {
+			t.Fatalf("expected validation error, got: %v", err)
+		}
+		expected := []string{
+			"outbox.poll_interval must be positive",
+			"outbox.batch_size must be at least 1",
+		}
+		if diff := cmp.Diff(validationError.Problems, expected); diff != "" {
+			t.Errorf("unexpected diff: %s", diff)
+		}
+	})
+
+	t.Run("validates the webhook settings", func(t *testing.T) {
+		args := []string{
+			"--webhook-max-attempts", "0", "--webhook-initial-backoff", "1m", "--webhook-max-backoff", "30s",
+			"--webhook-log-size", "0", "--webhook-queue-size", "0",
+		}
+
+		_, _, err := Load(args, envFrom(nil), io.Discard)
+
+		var validationError ValidationError
+		if !errors.As(err, &validationError) {
+			t.Fatalf("expected validation error, got: %v", err)
+		}
+		expected := []string{
+			"webhooks.max_attempts must be at least 1",
+			"webhooks.max_backoff must not be less than webhooks.initial_backoff",
+			"webhooks.log_size must be at least 1",
+			"webhooks.queue_size must be at least 1",
+		}
+		if diff := cmp.Diff(validationError.Problems, expected); diff != "" {
+			t.Errorf("unexpected diff: %s", diff)
+		}
+	})
+
+	t.Run("returns an error for an unparsable duration", func(t *testing.T) {
+		_, _, err := Load([]string{"--read-timeout", "soon"}, envFrom(nil), io.Discard)
+		if err == nil || !strings.Contains(err.Error(), "--read-timeout") {
+			t.Errorf("expected error mentioning the flag, got: %v", err)
+		}
+	})
+
+	t.Run("parses --print-config", func(t *testing.T) {
+		_, options, err := Load([]string{"--print-config"}, envFrom(nil), io.Discard)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !options.PrintConfig {
+			t.Error("expected print config to be true")
+		}
+	})
+}
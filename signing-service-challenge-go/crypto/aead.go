@@ -0,0 +1,23 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+)
+
+// AEADKeySize is the size of the AES-256 keys accepted by NewAEAD.
+const AEADKeySize = 32
+
+// NewAEAD returns AES-256-GCM with the key. name describes the key in the
+// error of keys of the wrong size.
+func NewAEAD(name string, key []byte) (cipher.AEAD, error) {
+	if len(key) != AEADKeySize {
+		return nil, fmt.Errorf("%s must be %d bytes, got: %d", name, AEADKeySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
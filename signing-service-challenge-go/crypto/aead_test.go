@@ -0,0 +1,24 @@
+package crypto
+
+import "testing"
+
+func TestNewAEAD(t *testing.T) {
+	t.Run("seals and opens with a key of AEADKeySize", func(t *testing.T) {
+		aead, err := NewAEAD("test key", make([]byte, AEADKeySize))
+		if err != nil {
+			t.Fatal(err)
+		}
+		nonce := make([]byte, aead.NonceSize())
+		opened, err := aead.Open(nil, nonce, aead.Seal(nil, nonce, []byte("secret"), nil), nil)
+		if err != nil || string(opened) != "secret" {
+			t.Errorf("expected the plaintext, got: %q, %v", opened, err)
+		}
+	})
+
+	t.Run("rejects keys of other sizes", func(t *testing.T) {
+		_, err := NewAEAD("test key", make([]byte, 16))
+		if err == nil || err.Error() != "test key must be 32 bytes, got: 16" {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+}
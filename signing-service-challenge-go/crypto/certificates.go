@@ -0,0 +1,169 @@
+package crypto
+
+import (
+	"bytes"
+	stdcrypto "crypto"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
+)
+
+var (
+	oidSHA384            = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidMGF1              = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 8}
+	oidSignatureRSAPSS   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 10}
+	oidSignatureECDSA384 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 3}
+)
+
+// algorithmIdentifier is implemented by the key pairs of all supported
+// algorithms. It describes the signatures Sign creates, as X.509
+// AlgorithmIdentifier.
+type algorithmIdentifier interface {
+	signatureAlgorithm() (pkix.AlgorithmIdentifier, error)
+}
+
+// certificationRequestInfo is the signed part of a PKCS#10 certificate
+// signing request, see RFC 2986.
+type certificationRequestInfo struct {
+	Version   int
+	Subject   asn1.RawValue
+	PublicKey asn1.RawValue
+	// [0] IMPLICIT SET OF Attribute, always empty
+	Attributes asn1.RawValue
+}
+
+type certificationRequest struct {
+	Info               asn1.RawValue
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          asn1.BitString
+}
+
+// CreateCertificateRequest returns a PEM encoded PKCS#10 certificate
+// signing request for the public key of the key pair, signed with Sign of
+// the key pair, so that an external CA can issue a certificate for it.
+//
+// RSA requests are signed with RSASSA-PSS using the largest salt the key
+// allows, as all signatures of RSA devices; some CAs only accept a salt of
+// the length of the hash.
+func CreateCertificateRequest(keyPair domain.KeyPair, subject pkix.Name) ([]byte, error) {
+	identifier, ok := keyPair.(algorithmIdentifier)
+	if !ok {
+		return nil, fmt.Errorf("certificate requests of algorithm %s are not supported", keyPair.AlgorithmName())
+	}
+	signatureAlgorithm, err := identifier.signatureAlgorithm()
+	if err != nil {
+		return nil, err
+	}
+	publicKey, err := MarshalPublicKey(keyPair)
+	if err != nil {
+		return nil, err
+	}
+	subjectDER, err := asn1.Marshal(subject.ToRDNSequence())
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := asn1.Marshal(certificationRequestInfo{
+		Subject:    asn1.RawValue{FullBytes: subjectDER},
+		PublicKey:  asn1.RawValue{FullBytes: publicKey},
+		Attributes: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true},
+	})
+	if err != nil {
+		return nil, err
+	}
+	signature, err := keyPair.Sign(info)
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := asn1.Marshal(certificationRequest{
+		Info:               asn1.RawValue{FullBytes: info},
+		SignatureAlgorithm: signatureAlgorithm,
+		Signature:          asn1.BitString{Bytes: signature, BitLength: 8 * len(signature)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: request}), nil
+}
+
+// EncodeCertificateChain returns the DER encoded certificates as PEM
+// blocks, in the same order.
+func EncodeCertificateChain(chain [][]byte) []byte {
+	encoded := []byte{}
+	for _, certificate := range chain {
+		encoded = append(encoded, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate})...)
+	}
+	return encoded
+}
+
+// DecodeCertificateChain returns the DER encoded certificates of the PEM
+// blocks. Anything else than `CERTIFICATE` blocks is rejected.
+func DecodeCertificateChain(encoded []byte) ([][]byte, error) {
+	chain := [][]byte{}
+	rest := encoded
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			return nil, fmt.Errorf("unexpected PEM block of type %s", block.Type)
+		}
+		if _, err := x509.ParseCertificate(block.Bytes); err != nil {
+			return nil, fmt.Errorf("certificate %d: %w", len(chain)+1, err)
+		}
+		chain = append(chain, block.Bytes)
+	}
+	if len(bytes.TrimSpace(rest)) > 0 {
+		return nil, errors.New("unexpected data after the last PEM block")
+	}
+	return chain, nil
+}
+
+// VerifyCertificateChain checks that the first certificate is one of the
+// public key of the key pair, that every certificate is issued by the one
+// following it, and that all of them are valid at the time. The chain
+// does not need to end with a root certificate.
+func VerifyCertificateChain(keyPair domain.KeyPair, chain [][]byte, at time.Time) error {
+	if len(chain) == 0 {
+		return errors.New("certificate chain is empty")
+	}
+
+	certificates := []*x509.Certificate{}
+	for i, der := range chain {
+		certificate, err := x509.ParseCertificate(der)
+		if err != nil {
+			return fmt.Errorf("certificate %d: %w", i+1, err)
+		}
+		if at.Before(certificate.NotBefore) || at.After(certificate.NotAfter) {
+			return fmt.Errorf("certificate %d is not valid at %s", i+1, at.UTC().Format(time.RFC3339))
+		}
+		certificates = append(certificates, certificate)
+	}
+
+	public, err := PublicKey(keyPair)
+	if err != nil {
+		return err
+	}
+	leafPublic, ok := certificates[0].PublicKey.(interface {
+		Equal(stdcrypto.PublicKey) bool
+	})
+	if !ok || !leafPublic.Equal(public) {
+		return errors.New("certificate 1 is not issued for the public key of the device")
+	}
+
+	for i := 0; i < len(certificates)-1; i++ {
+		if err := certificates[i].CheckSignatureFrom(certificates[i+1]); err != nil {
+			return fmt.Errorf("certificate %d is not issued by certificate %d: %w", i+1, i+2, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package crypto
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
+)
+
+func TestCreateCertificateRequest(t *testing.T) {
+	rsaKeyPair, err := RSAGenerator{}.generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	eccKeyPair, err := ECCGenerator{}.generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		keyPair            domain.KeyPair
+		signatureAlgorithm asn1.ObjectIdentifier
+	}{
+		{rsaKeyPair, oidSignatureRSAPSS},
+		{eccKeyPair, oidSignatureECDSA384},
+	} {
+		t.Run(test.keyPair.AlgorithmName(), func(t *testing.T) {
+			encoded, err := CreateCertificateRequest(test.keyPair, pkix.Name{CommonName: "till 1"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			block, _ := pem.Decode(encoded)
+			if block == nil || block.Type != "CERTIFICATE REQUEST" {
+				t.Fatalf("expected a PEM block of type CERTIFICATE REQUEST, got: %s", encoded)
+			}
+			csr, err := x509.ParseCertificateRequest(block.Bytes)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// x509 only recognizes PSS with a salt of the length of the
+			// hash, see the RSA subtest below
+			var request certificationRequest
+			if _, err := asn1.Unmarshal(block.Bytes, &request); err != nil {
+				t.Fatal(err)
+			}
+			if !request.SignatureAlgorithm.Algorithm.Equal(test.signatureAlgorithm) {
+				t.Errorf("expected signature algorithm: %s, got: %s", test.signatureAlgorithm, request.SignatureAlgorithm.Algorithm)
+			}
+			if csr.Subject.CommonName != "till 1" {
+				t.Errorf("expected common name: till 1, got: %s", csr.Subject.CommonName)
+			}
+			expected, _ := MarshalPublicKey(test.keyPair)
+			if string(csr.RawSubjectPublicKeyInfo) != string(expected) {
+				t.Error("expected the public key of the key pair")
+			}
+			if err := test.keyPair.(verifier).Verify(csr.RawTBSCertificateRequest, csr.Signature); err != nil {
+				t.Errorf("expected a valid signature, got: %s", err)
+			}
+		})
+	}
+
+	t.Run("RSA salt length", func(t *testing.T) {
+		encoded, err := CreateCertificateRequest(rsaKeyPair, pkix.Name{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		block, _ := pem.Decode(encoded)
+		var request certificationRequest
+		if _, err := asn1.Unmarshal(block.Bytes, &request); err != nil {
+			t.Fatal(err)
+		}
+		var parameters pssParameters
+		if _, err := asn1.Unmarshal(request.SignatureAlgorithm.Parameters.FullBytes, &parameters); err != nil {
+			t.Fatal(err)
+		}
+		// the largest salt of a 2048 bit key and SHA-384: 256 - 48 - 2
+		if parameters.SaltLength != 206 {
+			t.Errorf("expected salt length: 206, got: %d", parameters.SaltLength)
+		}
+		if !parameters.Hash.Algorithm.Equal(oidSHA384) || !parameters.MGF.Algorithm.Equal(oidMGF1) {
+			t.Errorf("expected SHA-384 and MGF1, got: %s, %s", parameters.Hash.Algorithm, parameters.MGF.Algorithm)
+		}
+	})
+}
+
+func TestVerifyCertificateChain(t *testing.T) {
+	keyPair, err := ECCGenerator{}.generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(caDER)
+	issue := func(publicKey any, notAfter time.Time) []byte {
+		der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			NotBefore:    now.Add(-time.Hour),
+			NotAfter:     notAfter,
+		}, ca, publicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return der
+	}
+	leaf := issue(keyPair.Public, now.Add(time.Hour))
+
+	for _, test := range []struct {
+		name     string
+		chain    [][]byte
+		expected string
+	}{
+		{"accepts the certificate with the CA", [][]byte{leaf, caDER}, ""},
+		{"accepts the certificate alone", [][]byte{leaf}, ""},
+		{"rejects empty chains", [][]byte{}, "certificate chain is empty"},
+		{"rejects certificates of other keys", [][]byte{issue(&caKey.PublicKey, now.Add(time.Hour)), caDER}, "certificate 1 is not issued for the public key of the device"},
+		{"rejects expired certificates", [][]byte{issue(keyPair.Public, now.Add(-time.Minute)), caDER}, "certificate 1 is not valid at " + now.UTC().Format(time.RFC3339)},
+		{"rejects chains in the wrong order", [][]byte{leaf, leaf}, "certificate 1 is not issued by certificate 2: x509: invalid signature: parent certificate cannot sign this kind of certificate"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			err := VerifyCertificateChain(keyPair, test.chain, now)
+			if test.expected == "" && err != nil {
+				t.Errorf("expected no error, got: %s", err)
+			}
+			if test.expected != "" && (err == nil || err.Error() != test.expected) {
+				t.Errorf("expected error: %s, got: %v", test.expected, err)
+			}
+		})
+	}
+}
+
+func TestDecodeCertificateChain(t *testing.T) {
+	if _, err := DecodeCertificateChain([]byte("-----BEGIN PUBLIC KEY-----\nAAAA\n-----END PUBLIC KEY-----\n")); err == nil || err.Error() != "unexpected PEM block of type PUBLIC KEY" {
+		t.Errorf("expected the public key to be rejected, got: %v", err)
+	}
+
+	chain, err := DecodeCertificateChain(nil)
+	if err != nil || len(chain) != 0 {
+		t.Errorf("expected an empty chain, got: %v, %v", chain, err)
+	}
+}
@@ -0,0 +1,203 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+	"sort"
+	"time"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
+)
+
+var (
+	oidData          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidSignedData    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidContentType   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidMessageDigest = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidSigningTime   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 5}
+)
+
+// The structures of a CMS SignedData, see RFC 5652. Choices and tagged
+// fields are raw values, so that they are encoded as given.
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,tag:0"`
+}
+
+type signedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	EncapContentInfo encapsulatedContentInfo
+	// [0] IMPLICIT SET OF Certificate
+	Certificates asn1.RawValue `asn1:"optional,tag:0"`
+	SignerInfos  []signerInfo  `asn1:"set"`
+}
+
+// encapsulatedContentInfo has no content, as the signatures are detached.
+type encapsulatedContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+}
+
+type signerInfo struct {
+	Version int
+	// issuerAndSerialNumber, or [0] IMPLICIT SubjectKeyIdentifier
+	SignerIdentifier asn1.RawValue
+	DigestAlgorithm  pkix.AlgorithmIdentifier
+	// [0] IMPLICIT SET OF Attribute
+	SignedAttributes   asn1.RawValue `asn1:"optional,tag:0"`
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          []byte
+}
+
+type issuerAndSerialNumber struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+type attribute struct {
+	Type   asn1.ObjectIdentifier
+	Values []asn1.RawValue `asn1:"set"`
+}
+
+type subjectPublicKeyInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	PublicKey asn1.BitString
+}
+
+// SignCMS returns the content signed by the key pair as detached CMS
+// SignedData, ASN.1 DER encoded, e.g. for archiving.
+//
+// The signature is a new one over the signed attributes, not the one of
+// Sign over the content: the signed attributes are the content type, the
+// message digest of the content and the signing time, see RFC 5652,
+// section 5.4. With a certificate chain, starting with the certificate of
+// the device, the signer is identified by its certificate and the chain is
+// included; otherwise by the key identifier of its public key.
+func SignCMS(keyPair domain.KeyPair, content []byte, signingTime time.Time, chain [][]byte) ([]byte, error) {
+	identifier, ok := keyPair.(algorithmIdentifier)
+	if !ok {
+		return nil, fmt.Errorf("CMS of algorithm %s are not supported", keyPair.AlgorithmName())
+	}
+	signatureAlgorithm, err := identifier.signatureAlgorithm()
+	if err != nil {
+		return nil, err
+	}
+	digestAlgorithm := pkix.AlgorithmIdentifier{Algorithm: oidSHA384}
+
+	signer := signerInfo{
+		DigestAlgorithm:    digestAlgorithm,
+		SignatureAlgorithm: signatureAlgorithm,
+	}
+	signed := signedData{
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{digestAlgorithm},
+		EncapContentInfo: encapsulatedContentInfo{ContentType: oidData},
+	}
+	if len(chain) > 0 {
+		certificate, err := x509.ParseCertificate(chain[0])
+		if err != nil {
+			return nil, err
+		}
+		signer.Version = 1
+		signer.SignerIdentifier.FullBytes, err = asn1.Marshal(issuerAndSerialNumber{
+			Issuer:       asn1.RawValue{FullBytes: certificate.RawIssuer},
+			SerialNumber: certificate.SerialNumber,
+		})
+		if err != nil {
+			return nil, err
+		}
+		signed.Version = 1
+		signed.Certificates = asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true}
+		for _, certificate := range chain {
+			signed.Certificates.Bytes = append(signed.Certificates.Bytes, certificate...)
+		}
+	} else {
+		keyIdentifier, err := subjectKeyIdentifier(keyPair)
+		if err != nil {
+			return nil, err
+		}
+		signer.Version = 3
+		signer.SignerIdentifier = asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, Bytes: keyIdentifier}
+		signed.Version = 3
+	}
+
+	digest, err := ComputeHashDigest(content)
+	if err != nil {
+		return nil, err
+	}
+	attributes, err := encodeAttributes([]attributeValue{
+		{oidContentType, oidData},
+		{oidMessageDigest, digest},
+		{oidSigningTime, signingTime.UTC()},
+	})
+	if err != nil {
+		return nil, err
+	}
+	// signed as SET OF, and included as [0] IMPLICIT
+	signingInput, err := asn1.Marshal(asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: attributes})
+	if err != nil {
+		return nil, err
+	}
+	signer.Signature, err = keyPair.Sign(signingInput)
+	if err != nil {
+		return nil, err
+	}
+	signer.SignedAttributes = asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: attributes}
+	signed.SignerInfos = []signerInfo{signer}
+
+	encoded, err := asn1.Marshal(signed)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(contentInfo{
+		ContentType: oidSignedData,
+		// tagged explicitly here, as asn1 does not tag raw values
+		Content: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: encoded},
+	})
+}
+
+// attributeValue is an attribute with a single value, to be encoded.
+type attributeValue struct {
+	Type  asn1.ObjectIdentifier
+	Value any
+}
+
+// encodeAttributes returns the content of a DER encoded SET OF Attribute,
+// which DER orders by the encodings of the attributes.
+func encodeAttributes(values []attributeValue) ([]byte, error) {
+	encoded := [][]byte{}
+	for _, value := range values {
+		encodedValue, err := asn1.Marshal(value.Value)
+		if err != nil {
+			return nil, err
+		}
+		a, err := asn1.Marshal(attribute{Type: value.Type, Values: []asn1.RawValue{{FullBytes: encodedValue}}})
+		if err != nil {
+			return nil, err
+		}
+		encoded = append(encoded, a)
+	}
+	sort.Slice(encoded, func(i, j int) bool {
+		return bytes.Compare(encoded[i], encoded[j]) < 0
+	})
+	return bytes.Join(encoded, nil), nil
+}
+
+// subjectKeyIdentifier returns the SHA-1 hash of the public key, as
+// described in RFC 5280, section 4.2.1.2.
+func subjectKeyIdentifier(keyPair domain.KeyPair) ([]byte, error) {
+	encoded, err := MarshalPublicKey(keyPair)
+	if err != nil {
+		return nil, err
+	}
+	var info subjectPublicKeyInfo
+	if _, err := asn1.Unmarshal(encoded, &info); err != nil {
+		return nil, err
+	}
+	keyIdentifier := sha1.Sum(info.PublicKey.Bytes)
+	return keyIdentifier[:], nil
+}
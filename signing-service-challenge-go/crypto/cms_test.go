@@ -0,0 +1,202 @@
+package crypto
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
+)
+
+// decodeCMS decodes a detached SignedData with a single signer, as an
+// archiving tool would.
+func decodeCMS(t *testing.T, encoded []byte) (signedData, signerInfo) {
+	t.Helper()
+
+	var info contentInfo
+	if rest, err := asn1.Unmarshal(encoded, &info); err != nil || len(rest) > 0 {
+		t.Fatalf("invalid ContentInfo: %v", err)
+	}
+	if !info.ContentType.Equal(oidSignedData) {
+		t.Fatalf("expected content type SignedData, got: %s", info.ContentType)
+	}
+	// asn1 keeps the explicit tag of raw values
+	var signed signedData
+	if rest, err := asn1.Unmarshal(info.Content.Bytes, &signed); err != nil || len(rest) > 0 {
+		t.Fatalf("invalid SignedData: %v", err)
+	}
+	if !signed.EncapContentInfo.ContentType.Equal(oidData) {
+		t.Errorf("expected content type data, got: %s", signed.EncapContentInfo.ContentType)
+	}
+	if len(signed.SignerInfos) != 1 {
+		t.Fatalf("expected a single signer, got: %d", len(signed.SignerInfos))
+	}
+	return signed, signed.SignerInfos[0]
+}
+
+// decodeSignedAttributes returns the signed attributes re-encoded as the
+// SET OF they are signed as, and checks their content type and message
+// digest.
+func decodeSignedAttributes(t *testing.T, signer signerInfo, content []byte) ([]byte, time.Time) {
+	t.Helper()
+
+	var signingTime time.Time
+	var digest []byte
+	var contentType asn1.ObjectIdentifier
+	rest := signer.SignedAttributes.Bytes
+	for len(rest) > 0 {
+		var a attribute
+		var err error
+		rest, err = asn1.Unmarshal(rest, &a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(a.Values) != 1 {
+			t.Fatalf("expected a single value of attribute %s, got: %d", a.Type, len(a.Values))
+		}
+		var value any
+		switch {
+		case a.Type.Equal(oidContentType):
+			value = &contentType
+		case a.Type.Equal(oidMessageDigest):
+			value = &digest
+		case a.Type.Equal(oidSigningTime):
+			value = &signingTime
+		default:
+			t.Fatalf("unexpected attribute: %s", a.Type)
+		}
+		if _, err := asn1.Unmarshal(a.Values[0].FullBytes, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !contentType.Equal(oidData) {
+		t.Errorf("expected content type data, got: %s", contentType)
+	}
+	expectedDigest := sha512.Sum384(content)
+	if string(digest) != string(expectedDigest[:]) {
+		t.Error("expected the SHA-384 digest of the content")
+	}
+
+	signed, err := asn1.Marshal(asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: signer.SignedAttributes.Bytes})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed, signingTime
+}
+
+func TestSignCMS(t *testing.T) {
+	rsaKeyPair, err := RSAGenerator{}.generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	eccKeyPair, err := ECCGenerator{}.generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := []byte("0_some-data_ZGV2aWNl")
+	signingTime := time.Date(2026, 10, 18, 12, 30, 0, 0, time.UTC)
+
+	for _, test := range []struct {
+		keyPair            domain.KeyPair
+		signatureAlgorithm asn1.ObjectIdentifier
+	}{
+		{rsaKeyPair, oidSignatureRSAPSS},
+		{eccKeyPair, oidSignatureECDSA384},
+	} {
+		t.Run(test.keyPair.AlgorithmName(), func(t *testing.T) {
+			encoded, err := SignCMS(test.keyPair, content, signingTime, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			signed, signer := decodeCMS(t, encoded)
+			if signed.Version != 3 || signer.Version != 3 {
+				t.Errorf("expected version 3 for a signer identified by key, got: %d, %d", signed.Version, signer.Version)
+			}
+			expectedKeyIdentifier, _ := subjectKeyIdentifier(test.keyPair)
+			if signer.SignerIdentifier.Class != asn1.ClassContextSpecific || string(signer.SignerIdentifier.Bytes) != string(expectedKeyIdentifier) {
+				t.Error("expected the subject key identifier of the public key")
+			}
+			if !signer.DigestAlgorithm.Algorithm.Equal(oidSHA384) {
+				t.Errorf("expected digest algorithm SHA-384, got: %s", signer.DigestAlgorithm.Algorithm)
+			}
+			if !signer.SignatureAlgorithm.Algorithm.Equal(test.signatureAlgorithm) {
+				t.Errorf("expected signature algorithm: %s, got: %s", test.signatureAlgorithm, signer.SignatureAlgorithm.Algorithm)
+			}
+			if len(signed.Certificates.Bytes) != 0 {
+				t.Error("expected no certificates")
+			}
+			signedAttributes, got := decodeSignedAttributes(t, signer, content)
+			if !got.Equal(signingTime) {
+				t.Errorf("expected signing time: %s, got: %s", signingTime, got)
+			}
+			if err := test.keyPair.(verifier).Verify(signedAttributes, signer.Signature); err != nil {
+				t.Errorf("expected the signature to verify the signed attributes, got: %s", err)
+			}
+		})
+	}
+
+	t.Run("includes the certificate chain", func(t *testing.T) {
+		caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		caTemplate := &x509.Certificate{
+			SerialNumber:          big.NewInt(1),
+			Subject:               pkix.Name{CommonName: "CA"},
+			NotBefore:             signingTime.Add(-time.Hour),
+			NotAfter:              signingTime.Add(time.Hour),
+			KeyUsage:              x509.KeyUsageCertSign,
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+		}
+		caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ca, _ := x509.ParseCertificate(caDER)
+		deviceDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+			SerialNumber: big.NewInt(4242),
+			Subject:      pkix.Name{CommonName: "device"},
+			NotBefore:    signingTime.Add(-time.Hour),
+			NotAfter:     signingTime.Add(time.Hour),
+		}, ca, eccKeyPair.Public, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encoded, err := SignCMS(eccKeyPair, content, signingTime, [][]byte{deviceDER, caDER})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		signed, signer := decodeCMS(t, encoded)
+		if signed.Version != 1 || signer.Version != 1 {
+			t.Errorf("expected version 1 for a signer identified by certificate, got: %d, %d", signed.Version, signer.Version)
+		}
+		certificates, err := x509.ParseCertificates(signed.Certificates.Bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(certificates) != 2 {
+			t.Fatalf("expected the device and the CA certificate, got: %d certificates", len(certificates))
+		}
+		var sid issuerAndSerialNumber
+		if _, err := asn1.Unmarshal(signer.SignerIdentifier.FullBytes, &sid); err != nil {
+			t.Fatal(err)
+		}
+		if string(sid.Issuer.FullBytes) != string(certificates[0].RawIssuer) || sid.SerialNumber.Cmp(certificates[0].SerialNumber) != 0 {
+			t.Error("expected the signer to be identified by the device certificate")
+		}
+		signedAttributes, _ := decodeSignedAttributes(t, signer, content)
+		if err := certificates[0].CheckSignature(x509.ECDSAWithSHA384, signedAttributes, signer.Signature); err != nil {
+			t.Errorf("expected the certificate to verify the signed attributes, got: %s", err)
+		}
+	})
+}
@@ -1,10 +1,16 @@
 package crypto
 
 import (
+	stdcrypto "crypto"
 	"crypto/ecdsa"
 	"crypto/rand"
 	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/pem"
+	"errors"
+	"fmt"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
 )
 
 // ECCKeyPair is a DTO that holds ECC private and public keys.
@@ -26,12 +32,70 @@ func (keyPair ECCKeyPair) Sign(dataToBeSigned []byte) ([]byte, error) {
 	return keyPair.Private.Sign(rand.Reader, digest, nil)
 }
 
+// Verify checks a signature created by Sign.
+func (keyPair ECCKeyPair) Verify(signedData, signature []byte) error {
+	digest, err := ComputeHashDigest(signedData)
+	if err != nil {
+		return err
+	}
+
+	if !ecdsa.VerifyASN1(keyPair.Public, digest, signature) {
+		return errors.New("ecdsa: verification error")
+	}
+	return nil
+}
+
+// signatureAlgorithm describes the signatures of Sign: ECDSA with
+// HashFunction.
+func (keyPair ECCKeyPair) signatureAlgorithm() (pkix.AlgorithmIdentifier, error) {
+	return pkix.AlgorithmIdentifier{Algorithm: oidSignatureECDSA384}, nil
+}
+
+// eccJWSAlgorithms are the JWS algorithms of the curves, see RFC 7518.
+var eccJWSAlgorithms = map[string]struct {
+	name string
+	hash stdcrypto.Hash
+}{
+	"P-256": {"ES256", stdcrypto.SHA256},
+	"P-384": {"ES384", stdcrypto.SHA384},
+	"P-521": {"ES512", stdcrypto.SHA512},
+}
+
+func (keyPair ECCKeyPair) jwsAlgorithm() (string, error) {
+	curve := keyPair.Public.Curve.Params().Name
+	algorithm, ok := eccJWSAlgorithms[curve]
+	if !ok {
+		return "", fmt.Errorf("JWS does not support ECDSA keys of curve %s", curve)
+	}
+	return algorithm.name, nil
+}
+
+// signJWS hashes with the hash function of the curve, and returns R and S
+// with the size of the curve concatenated, instead of ASN.1 encoded.
+func (keyPair ECCKeyPair) signJWS(signingInput []byte) ([]byte, error) {
+	curve := keyPair.Public.Curve.Params()
+	algorithm, ok := eccJWSAlgorithms[curve.Name]
+	if !ok {
+		return nil, fmt.Errorf("JWS does not support ECDSA keys of curve %s", curve.Name)
+	}
+	hash := algorithm.hash.New()
+	hash.Write(signingInput)
+
+	r, s, err := ecdsa.Sign(rand.Reader, keyPair.Private, hash.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	size := (curve.BitSize + 7) / 8
+	return append(r.FillBytes(make([]byte, size)), s.FillBytes(make([]byte, size))...), nil
+}
+
 func (keyPair ECCKeyPair) EncodedPublicKey() (string, error) {
-	public, _, err := ECCMarshaler{}.Encode(keyPair)
+	public, _, err := ECCMarshaler{}.Marshal(keyPair)
 	return string(public), err
 }
 
-// ECCMarshaler can encode and decode an ECC key pair.
+// ECCMarshaler can encode and decode an ECC key pair. It is the
+// KeyPairMarshaler of the ECC algorithm.
 type ECCMarshaler struct{}
 
 // NewECCMarshaler creates a new ECCMarshaler.
@@ -39,10 +103,15 @@ func NewECCMarshaler() ECCMarshaler {
 	return ECCMarshaler{}
 }
 
-// Encode takes an ECCKeyPair and encodes it to be written on disk.
-// It returns the public and the private key as a byte slice.
-func (m ECCMarshaler) Encode(keyPair ECCKeyPair) (encodedPublicKey, encodedPrivateKey []byte, err error) {
-	privateKeyBytes, err := x509.MarshalECPrivateKey(keyPair.Private)
+func (m ECCMarshaler) AlgorithmName() string {
+	return ECCAlgorithmName
+}
+
+// Marshal takes an ECCKeyPair and encodes it to be written on disk.
+// It returns the public key as PKIX and the private key as PKCS#8, in
+// PEM blocks of the standard `PUBLIC KEY` and `PRIVATE KEY` types.
+func (m ECCMarshaler) Marshal(keyPair ECCKeyPair) (encodedPublicKey, encodedPrivateKey []byte, err error) {
+	privateKeyBytes, err := x509.MarshalPKCS8PrivateKey(keyPair.Private)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -53,24 +122,36 @@ func (m ECCMarshaler) Encode(keyPair ECCKeyPair) (encodedPublicKey, encodedPriva
 	}
 
 	encodedPrivate := pem.EncodeToMemory(&pem.Block{
-		Type:  "PRIVATE_KEY",
+		Type:  "PRIVATE KEY",
 		Bytes: privateKeyBytes,
 	})
 
 	encodedPublic := pem.EncodeToMemory(&pem.Block{
-		Type:  "PUBLIC_KEY",
+		Type:  "PUBLIC KEY",
 		Bytes: publicKeyBytes,
 	})
 
 	return encodedPublic, encodedPrivate, nil
 }
 
-// Decode assembles an ECCKeyPair from an encoded private key.
-func (m ECCMarshaler) Decode(privateKeyBytes []byte) (*ECCKeyPair, error) {
+// Unmarshal assembles an ECCKeyPair from an encoded private key, in the
+// SEC 1 or the PKCS#8 format. The type of the PEM block is ignored, so
+// that keys stored with the former `PRIVATE_KEY` type are still read.
+func (m ECCMarshaler) Unmarshal(privateKeyBytes []byte) (*ECCKeyPair, error) {
 	block, _ := pem.Decode(privateKeyBytes)
+	if block == nil {
+		return nil, errors.New("private key is not PEM encoded")
+	}
 	privateKey, err := x509.ParseECPrivateKey(block.Bytes)
 	if err != nil {
-		return nil, err
+		parsed, pkcs8Err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if pkcs8Err != nil {
+			return nil, errors.New("private key is neither an ECDSA SEC 1 nor a PKCS#8 key")
+		}
+		var ok bool
+		if privateKey, ok = parsed.(*ecdsa.PrivateKey); !ok {
+			return nil, errors.New("private key is not an ECDSA key")
+		}
 	}
 
 	return &ECCKeyPair{
@@ -78,3 +159,20 @@ func (m ECCMarshaler) Decode(privateKeyBytes []byte) (*ECCKeyPair, error) {
 		Public:  &privateKey.PublicKey,
 	}, nil
 }
+
+func (m ECCMarshaler) MarshalPrivateKey(keyPair domain.KeyPair) ([]byte, error) {
+	eccKeyPair, ok := keyPair.(*ECCKeyPair)
+	if !ok {
+		return nil, fmt.Errorf("%T is not an ECC key pair", keyPair)
+	}
+	if eccKeyPair.Private == nil {
+		return nil, errors.New("ECC key pair has no private key")
+	}
+	_, private, err := m.Marshal(*eccKeyPair)
+	return private, err
+}
+
+// convert the return type to `domain.KeyPair`
+func (m ECCMarshaler) UnmarshalPrivateKey(encodedPrivateKey []byte) (domain.KeyPair, error) {
+	return m.Unmarshal(encodedPrivateKey)
+}
@@ -0,0 +1,138 @@
+package crypto
+
+import (
+	stdcrypto "crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
+)
+
+// PublicKeyFormat is an encoding of public keys offered by the API.
+type PublicKeyFormat string
+
+const (
+	// PKIX (SubjectPublicKeyInfo) in a PEM block of type `PUBLIC KEY`
+	PublicKeyFormatPEM PublicKeyFormat = "pem"
+	// PKIX (SubjectPublicKeyInfo) as base64 encoded DER
+	PublicKeyFormatDER PublicKeyFormat = "der"
+	// JSON Web Key, see RFC 7517
+	PublicKeyFormatJWK PublicKeyFormat = "jwk"
+)
+
+// PublicKeyFormats are all supported public key formats.
+var PublicKeyFormats = []PublicKeyFormat{
+	PublicKeyFormatPEM,
+	PublicKeyFormatDER,
+	PublicKeyFormatJWK,
+}
+
+// JWK is a public key as JSON Web Key. Only the members of the key type
+// are set: `n` and `e` for RSA, `crv`, `x` and `y` for EC keys.
+type JWK struct {
+	KeyType string `json:"kty"`
+	Curve   string `json:"crv,omitempty"`
+	X       string `json:"x,omitempty"`
+	Y       string `json:"y,omitempty"`
+	N       string `json:"n,omitempty"`
+	E       string `json:"e,omitempty"`
+}
+
+// PublicKey returns the public key of a key pair of a supported algorithm,
+// e.g. to issue a certificate for it.
+func PublicKey(keyPair domain.KeyPair) (stdcrypto.PublicKey, error) {
+	switch keyPair := keyPair.(type) {
+	case *RSAKeyPair:
+		return keyPair.Public, nil
+	case *ECCKeyPair:
+		return keyPair.Public, nil
+	default:
+		return nil, fmt.Errorf("public keys of algorithm %s are not supported", keyPair.AlgorithmName())
+	}
+}
+
+// MarshalPublicKey returns the public key of a key pair as PKIX, ASN.1 DER
+// encoded.
+func MarshalPublicKey(keyPair domain.KeyPair) ([]byte, error) {
+	public, err := PublicKey(keyPair)
+	if err != nil {
+		return nil, err
+	}
+	return x509.MarshalPKIXPublicKey(public)
+}
+
+// DecodePublicKey parses a PEM encoded public key, in the PKIX or the RSA
+// PKCS#1 format. Like for private keys, the type of the PEM block is
+// ignored, so that keys encoded with the former `RSA_PUBLIC_KEY` and
+// `PUBLIC_KEY` types are still read.
+func DecodePublicKey(encodedPublicKey []byte) (stdcrypto.PublicKey, error) {
+	block, _ := pem.Decode(encodedPublicKey)
+	if block == nil {
+		return nil, errors.New("public key is not PEM encoded")
+	}
+	if public, err := x509.ParsePKIXPublicKey(block.Bytes); err == nil {
+		return public, nil
+	}
+	if public, err := x509.ParsePKCS1PublicKey(block.Bytes); err == nil {
+		return public, nil
+	}
+	return nil, errors.New("public key is neither a PKIX nor an RSA PKCS#1 key")
+}
+
+// PublicKeyJWK returns the public key of a key pair as JSON Web Key.
+func PublicKeyJWK(keyPair domain.KeyPair) (JWK, error) {
+	public, err := PublicKey(keyPair)
+	if err != nil {
+		return JWK{}, err
+	}
+
+	encode := base64.RawURLEncoding.EncodeToString
+	switch public := public.(type) {
+	case *rsa.PublicKey:
+		return JWK{
+			KeyType: "RSA",
+			N:       encode(public.N.Bytes()),
+			E:       encode(big.NewInt(int64(public.E)).Bytes()),
+		}, nil
+	case *ecdsa.PublicKey:
+		// the coordinates have the full size of the curve, see RFC 7518
+		size := (public.Curve.Params().BitSize + 7) / 8
+		return JWK{
+			KeyType: "EC",
+			Curve:   public.Curve.Params().Name,
+			X:       encode(public.X.FillBytes(make([]byte, size))),
+			Y:       encode(public.Y.FillBytes(make([]byte, size))),
+		}, nil
+	default:
+		return JWK{}, fmt.Errorf("public keys of algorithm %s cannot be encoded", keyPair.AlgorithmName())
+	}
+}
+
+// EncodePublicKey returns the public key of a key pair in the format: a
+// PEM string, a base64 encoded DER string, or a JWK.
+func EncodePublicKey(keyPair domain.KeyPair, format PublicKeyFormat) (any, error) {
+	switch format {
+	case PublicKeyFormatPEM:
+		der, err := MarshalPublicKey(keyPair)
+		if err != nil {
+			return nil, err
+		}
+		return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})), nil
+	case PublicKeyFormatDER:
+		der, err := MarshalPublicKey(keyPair)
+		if err != nil {
+			return nil, err
+		}
+		return base64.StdEncoding.EncodeToString(der), nil
+	case PublicKeyFormatJWK:
+		return PublicKeyJWK(keyPair)
+	default:
+		return nil, fmt.Errorf("public key format %q is not supported", format)
+	}
+}
@@ -0,0 +1,94 @@
+package crypto
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"math/big"
+	"testing"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
+)
+
+func decodeBase64URL(t *testing.T, s string) *big.Int {
+	t.Helper()
+
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return new(big.Int).SetBytes(b)
+}
+
+func TestEncodePublicKey(t *testing.T) {
+	rsaKeyPair, err := RSAGenerator{}.generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	eccKeyPair, err := ECCGenerator{}.generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, keyPair := range []domain.KeyPair{rsaKeyPair, eccKeyPair} {
+		t.Run(keyPair.AlgorithmName(), func(t *testing.T) {
+			encoded, err := EncodePublicKey(keyPair, PublicKeyFormatPEM)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected, _ := keyPair.EncodedPublicKey()
+			if encoded != expected {
+				t.Errorf("expected the PEM encoded public key, got: %v", encoded)
+			}
+
+			encoded, err = EncodePublicKey(keyPair, PublicKeyFormatDER)
+			if err != nil {
+				t.Fatal(err)
+			}
+			der, err := base64.StdEncoding.DecodeString(encoded.(string))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := x509.ParsePKIXPublicKey(der); err != nil {
+				t.Errorf("expected PKIX DER, got: %s", err)
+			}
+		})
+	}
+
+	t.Run("RSA JWK", func(t *testing.T) {
+		encoded, err := EncodePublicKey(rsaKeyPair, PublicKeyFormatJWK)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		jwk := encoded.(JWK)
+		public := rsa.PublicKey{N: decodeBase64URL(t, jwk.N), E: int(decodeBase64URL(t, jwk.E).Int64())}
+		if jwk.KeyType != "RSA" || !public.Equal(rsaKeyPair.Public) {
+			t.Errorf("expected the RSA public key, got: %+v", jwk)
+		}
+	})
+
+	t.Run("EC JWK", func(t *testing.T) {
+		encoded, err := EncodePublicKey(eccKeyPair, PublicKeyFormatJWK)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		jwk := encoded.(JWK)
+		public := ecdsa.PublicKey{Curve: eccKeyPair.Public.Curve, X: decodeBase64URL(t, jwk.X), Y: decodeBase64URL(t, jwk.Y)}
+		if jwk.KeyType != "EC" || jwk.Curve != "P-384" || !public.Equal(eccKeyPair.Public) {
+			t.Errorf("expected the EC public key, got: %+v", jwk)
+		}
+		// coordinates are padded to the size of the curve
+		if len(jwk.X) != 64 || len(jwk.Y) != 64 {
+			t.Errorf("expected 48 byte coordinates, got: %s, %s", jwk.X, jwk.Y)
+		}
+	})
+
+	t.Run("fails for unsupported formats", func(t *testing.T) {
+		if _, err := EncodePublicKey(eccKeyPair, "xml"); err == nil {
+			t.Error("expected error")
+		}
+	})
+}
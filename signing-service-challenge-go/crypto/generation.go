@@ -9,6 +9,11 @@ import (
 	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
 )
 
+// RSAKeyBits is the size of generated RSA keys. PS384, the JWS algorithm
+// of RSA keys, requires at least 784 bits, and crypto/rsa rejects keys of
+// less than 1024 bits since Go 1.24.
+const RSAKeyBits = 2048
+
 // RSAGenerator generates a RSA key pair.
 type RSAGenerator struct{}
 
@@ -23,8 +28,7 @@ func (g RSAGenerator) Generate() (domain.KeyPair, error) {
 
 // Generate generates a new RSAKeyPair.
 func (g RSAGenerator) generate() (*RSAKeyPair, error) {
-	// Security has been ignored for the sake of simplicity.
-	key, err := rsa.GenerateKey(rand.Reader, 512)
+	key, err := rsa.GenerateKey(rand.Reader, RSAKeyBits)
 	if err != nil {
 		return nil, err
 	}
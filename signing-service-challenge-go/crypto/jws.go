@@ -0,0 +1,60 @@
+package crypto
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
+)
+
+// JWSHeader is the protected header of the JWS of a signature.
+type JWSHeader struct {
+	// set by SignJWS according to the key pair
+	Algorithm string `json:"alg"`
+	// the ID of the signature device
+	KeyID string `json:"kid"`
+	// the counter the secured data was signed with
+	SignatureCounter uint `json:"signature_counter"`
+}
+
+// jwsSigner is implemented by the key pairs of all supported algorithms.
+// Unlike Sign, signJWS follows the JWS algorithm, e.g. in the hash
+// function and the encoding of the signature, see RFC 7518.
+type jwsSigner interface {
+	jwsAlgorithm() (string, error)
+	signJWS(signingInput []byte) ([]byte, error)
+}
+
+// JWSAlgorithm returns the JWS algorithm of the key pair, or why it cannot
+// create JWS.
+func JWSAlgorithm(keyPair domain.KeyPair) (string, error) {
+	signer, ok := keyPair.(jwsSigner)
+	if !ok {
+		return "", fmt.Errorf("JWS of algorithm %s are not supported", keyPair.AlgorithmName())
+	}
+	return signer.jwsAlgorithm()
+}
+
+// SignJWS returns the payload signed by the key pair as JWS in compact
+// serialization. The signature is a new one over the JWS signing input,
+// not the one of Sign over the payload.
+func SignJWS(keyPair domain.KeyPair, header JWSHeader, payload []byte) (string, error) {
+	algorithm, err := JWSAlgorithm(keyPair)
+	if err != nil {
+		return "", err
+	}
+	header.Algorithm = algorithm
+	encodedHeader, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+
+	encode := base64.RawURLEncoding.EncodeToString
+	signingInput := encode(encodedHeader) + "." + encode(payload)
+	signature, err := keyPair.(jwsSigner).signJWS([]byte(signingInput))
+	if err != nil {
+		return "", err
+	}
+	return signingInput + "." + encode(signature), nil
+}
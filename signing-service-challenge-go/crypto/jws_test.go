@@ -0,0 +1,130 @@
+package crypto
+
+import (
+	stdcrypto "crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
+)
+
+// verifyJWS checks a compact JWS with the public key as a JOSE library
+// would, and returns its header and payload.
+func verifyJWS(t *testing.T, jws string, public stdcrypto.PublicKey) (JWSHeader, string) {
+	t.Helper()
+
+	parts := strings.Split(jws, ".")
+	if len(parts) != 3 {
+		t.Fatalf("expected three parts, got: %s", jws)
+	}
+	decode := func(part string) []byte {
+		decoded, err := base64.RawURLEncoding.DecodeString(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return decoded
+	}
+	var header JWSHeader
+	if err := json.Unmarshal(decode(parts[0]), &header); err != nil {
+		t.Fatal(err)
+	}
+	signingInput := []byte(parts[0] + "." + parts[1])
+	signature := decode(parts[2])
+
+	hashes := map[string]stdcrypto.Hash{
+		"PS384": stdcrypto.SHA384,
+		"ES256": stdcrypto.SHA256,
+		"ES384": stdcrypto.SHA384,
+		"ES512": stdcrypto.SHA512,
+	}
+	hash := hashes[header.Algorithm].New()
+	hash.Write(signingInput)
+	digest := hash.Sum(nil)
+
+	switch public := public.(type) {
+	case *rsa.PublicKey:
+		options := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}
+		if err := rsa.VerifyPSS(public, stdcrypto.SHA384, digest, signature, options); err != nil {
+			t.Errorf("expected a valid signature, got: %s", err)
+		}
+	case *ecdsa.PublicKey:
+		size := len(signature) / 2
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(public, digest, r, s) {
+			t.Error("expected a valid signature")
+		}
+	}
+	return header, string(decode(parts[1]))
+}
+
+func TestSignJWS(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPairs := map[string]domain.KeyPair{
+		"PS384": &RSAKeyPair{Public: &rsaKey.PublicKey, Private: rsaKey},
+	}
+	for algorithm, curve := range map[string]elliptic.Curve{
+		"ES256": elliptic.P256(),
+		"ES384": elliptic.P384(),
+		"ES512": elliptic.P521(),
+	} {
+		key, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyPairs[algorithm] = &ECCKeyPair{Public: &key.PublicKey, Private: key}
+	}
+
+	for algorithm, keyPair := range keyPairs {
+		t.Run(algorithm, func(t *testing.T) {
+			jws, err := SignJWS(keyPair, JWSHeader{KeyID: "device", SignatureCounter: 3}, []byte("3_data_c2lnbmF0dXJl"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			public, _ := PublicKey(keyPair)
+			header, payload := verifyJWS(t, jws, public)
+			expected := JWSHeader{Algorithm: algorithm, KeyID: "device", SignatureCounter: 3}
+			if header != expected {
+				t.Errorf("expected header: %+v, got: %+v", expected, header)
+			}
+			if payload != "3_data_c2lnbmF0dXJl" {
+				t.Errorf("expected the payload, got: %s", payload)
+			}
+		})
+	}
+
+	t.Run("rejects RSA keys too small for PS384", func(t *testing.T) {
+		key, err := rsa.GenerateKey(rand.Reader, 512)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = SignJWS(&RSAKeyPair{Private: key, Public: &key.PublicKey}, JWSHeader{}, []byte("data"))
+		if err == nil || err.Error() != "RSA keys of 512 bits are too small for PS384" {
+			t.Errorf("expected the key to be rejected, got: %v", err)
+		}
+	})
+
+	t.Run("rejects curves without JWS algorithm", func(t *testing.T) {
+		key, err := ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = JWSAlgorithm(&ECCKeyPair{Public: &key.PublicKey, Private: key})
+		if err == nil || err.Error() != "JWS does not support ECDSA keys of curve P-224" {
+			t.Errorf("expected the key to be rejected, got: %v", err)
+		}
+	})
+}
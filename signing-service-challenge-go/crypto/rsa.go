@@ -4,7 +4,13 @@ import (
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
 	"encoding/pem"
+	"errors"
+	"fmt"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
 )
 
 // RSAKeyPair is a DTO that holds RSA private and public keys.
@@ -32,12 +38,77 @@ func (keyPair RSAKeyPair) Sign(dataToBeSigned []byte) (signature []byte, err err
 	)
 }
 
+// Verify checks a signature created by Sign.
+func (keyPair RSAKeyPair) Verify(signedData, signature []byte) error {
+	digest, err := ComputeHashDigest(signedData)
+	if err != nil {
+		return err
+	}
+
+	return rsa.VerifyPSS(keyPair.Public, HashFunction, digest, signature, nil)
+}
+
+// pssParameters are the RSASSA-PSS-params of RFC 4055.
+type pssParameters struct {
+	Hash       pkix.AlgorithmIdentifier `asn1:"explicit,tag:0"`
+	MGF        pkix.AlgorithmIdentifier `asn1:"explicit,tag:1"`
+	SaltLength int                      `asn1:"explicit,tag:2"`
+}
+
+// signatureAlgorithm describes the signatures of Sign: RSASSA-PSS with
+// HashFunction, and the largest salt the key allows, which rsa.SignPSS
+// uses without options.
+func (keyPair RSAKeyPair) signatureAlgorithm() (pkix.AlgorithmIdentifier, error) {
+	hash := pkix.AlgorithmIdentifier{Algorithm: oidSHA384, Parameters: asn1.NullRawValue}
+	hashParameters, err := asn1.Marshal(hash)
+	if err != nil {
+		return pkix.AlgorithmIdentifier{}, err
+	}
+	parameters, err := asn1.Marshal(pssParameters{
+		Hash:       hash,
+		MGF:        pkix.AlgorithmIdentifier{Algorithm: oidMGF1, Parameters: asn1.RawValue{FullBytes: hashParameters}},
+		SaltLength: (keyPair.Public.N.BitLen()-1+7)/8 - 2 - HashFunction.Size(),
+	})
+	if err != nil {
+		return pkix.AlgorithmIdentifier{}, err
+	}
+	return pkix.AlgorithmIdentifier{
+		Algorithm:  oidSignatureRSAPSS,
+		Parameters: asn1.RawValue{FullBytes: parameters},
+	}, nil
+}
+
+// jwsAlgorithm is PS384, which requires a salt of the length of the hash,
+// unlike Sign.
+func (keyPair RSAKeyPair) jwsAlgorithm() (string, error) {
+	if size := keyPair.Public.Size(); size < 2*HashFunction.Size()+2 {
+		return "", fmt.Errorf("RSA keys of %d bits are too small for PS384", keyPair.Public.N.BitLen())
+	}
+	return "PS384", nil
+}
+
+func (keyPair RSAKeyPair) signJWS(signingInput []byte) ([]byte, error) {
+	digest, err := ComputeHashDigest(signingInput)
+	if err != nil {
+		return nil, err
+	}
+
+	return rsa.SignPSS(
+		rand.Reader,
+		keyPair.Private,
+		HashFunction,
+		digest,
+		&rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash},
+	)
+}
+
 func (keyPair RSAKeyPair) EncodedPublicKey() (string, error) {
 	public, _, err := RSAMarshaler{}.Marshal(keyPair)
 	return string(public), err
 }
 
-// RSAMarshaler can encode and decode an RSA key pair.
+// RSAMarshaler can encode and decode an RSA key pair. It is the
+// KeyPairMarshaler of the RSA algorithm.
 type RSAMarshaler struct{}
 
 // NewRSAMarshaler creates a new RSAMarshaler.
@@ -45,31 +116,56 @@ func NewRSAMarshaler() RSAMarshaler {
 	return RSAMarshaler{}
 }
 
+func (m RSAMarshaler) AlgorithmName() string {
+	return RSAAlgorithmName
+}
+
 // Marshal takes an RSAKeyPair and encodes it to be written on disk.
-// It returns the public and the private key as a byte slice.
+// It returns the public key as PKIX and the private key as PKCS#8, in
+// PEM blocks of the standard `PUBLIC KEY` and `PRIVATE KEY` types.
 func (m RSAMarshaler) Marshal(keyPair RSAKeyPair) (encodedPublicKey, encodedPrivateKey []byte, err error) {
-	privateKeyBytes := x509.MarshalPKCS1PrivateKey(keyPair.Private)
-	publicKeyBytes := x509.MarshalPKCS1PublicKey(keyPair.Public)
+	privateKeyBytes, err := x509.MarshalPKCS8PrivateKey(keyPair.Private)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	publicKeyBytes, err := x509.MarshalPKIXPublicKey(keyPair.Public)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	encodedPrivate := pem.EncodeToMemory(&pem.Block{
-		Type:  "RSA_PRIVATE_KEY",
+		Type:  "PRIVATE KEY",
 		Bytes: privateKeyBytes,
 	})
 
 	encodedPublic := pem.EncodeToMemory(&pem.Block{
-		Type:  "RSA_PUBLIC_KEY",
+		Type:  "PUBLIC KEY",
 		Bytes: publicKeyBytes,
 	})
 
 	return encodedPublic, encodedPrivate, nil
 }
 
-// Unmarshal takes an encoded RSA private key and transforms it into a rsa.PrivateKey.
+// Unmarshal takes an encoded RSA private key, in the PKCS#1 or the PKCS#8
+// format, and transforms it into a rsa.PrivateKey. The type of the PEM
+// block is ignored, so that keys stored with the former `RSA_PRIVATE_KEY`
+// type are still read.
 func (m RSAMarshaler) Unmarshal(privateKeyBytes []byte) (*RSAKeyPair, error) {
 	block, _ := pem.Decode(privateKeyBytes)
+	if block == nil {
+		return nil, errors.New("private key is not PEM encoded")
+	}
 	privateKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
 	if err != nil {
-		return nil, err
+		parsed, pkcs8Err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if pkcs8Err != nil {
+			return nil, errors.New("private key is neither an RSA PKCS#1 nor a PKCS#8 key")
+		}
+		var ok bool
+		if privateKey, ok = parsed.(*rsa.PrivateKey); !ok {
+			return nil, errors.New("private key is not an RSA key")
+		}
 	}
 
 	return &RSAKeyPair{
@@ -77,3 +173,20 @@ func (m RSAMarshaler) Unmarshal(privateKeyBytes []byte) (*RSAKeyPair, error) {
 		Public:  &privateKey.PublicKey,
 	}, nil
 }
+
+func (m RSAMarshaler) MarshalPrivateKey(keyPair domain.KeyPair) ([]byte, error) {
+	rsaKeyPair, ok := keyPair.(*RSAKeyPair)
+	if !ok {
+		return nil, fmt.Errorf("%T is not an RSA key pair", keyPair)
+	}
+	if rsaKeyPair.Private == nil {
+		return nil, errors.New("RSA key pair has no private key")
+	}
+	_, private, err := m.Marshal(*rsaKeyPair)
+	return private, err
+}
+
+// convert the return type to `domain.KeyPair`
+func (m RSAMarshaler) UnmarshalPrivateKey(encodedPrivateKey []byte) (domain.KeyPair, error) {
+	return m.Unmarshal(encodedPrivateKey)
+}
@@ -4,11 +4,12 @@ import (
 	stdcrypto "crypto"
 )
 
-// At the current RSA key size (512 bits), SHA512 causes a
-// `message too long for RSA key size` error from `rsa.SignPSS`
+// With the RSA key size generated before RSAKeyBits (512 bits), SHA512
+// causes a `message too long for RSA key size` error from `rsa.SignPSS`
 // ref: https://github.com/golang/go/blob/d7df7f4fa01f1b445d835fc908c54448a63c68fb/src/crypto/rsa/pss.go#L304-L308
 // Therefore use the next biggest hash function, as a bigger hash
-// makes collisions less likely.
+// makes collisions less likely. It is kept, so that the signatures of
+// devices with such keys can still be verified the same way.
 const HashFunction = stdcrypto.SHA384
 
 func ComputeHashDigest(b []byte) ([]byte, error) {
@@ -1,23 +1,178 @@
 package crypto
 
-import "github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
+import (
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
+)
 
 const (
 	ECCAlgorithmName = "ECC"
 	RSAAlgorithmName = "RSA"
 )
 
-var supportedGenerators = []domain.KeyPairGenerator{
-	ECCGenerator{},
-	RSAGenerator{},
+// KeyPairMarshaler serializes the key pairs of an algorithm, so that any
+// repository can store them without knowing the algorithm.
+type KeyPairMarshaler interface {
+	AlgorithmName() string
+	// MarshalPrivateKey encodes the private key of a key pair of the
+	// algorithm, from which UnmarshalPrivateKey assembles the key pair.
+	MarshalPrivateKey(keyPair domain.KeyPair) ([]byte, error)
+	UnmarshalPrivateKey(encodedPrivateKey []byte) (domain.KeyPair, error)
+}
+
+// supportedAlgorithm registers the generator of an algorithm together
+// with the marshaler of its key pairs. Supporting a new algorithm only
+// takes a new entry in supportedGenerators.
+type supportedAlgorithm struct {
+	generator domain.KeyPairGenerator
+	marshaler KeyPairMarshaler
+}
+
+var supportedGenerators = []supportedAlgorithm{
+	{ECCGenerator{}, ECCMarshaler{}},
+	{RSAGenerator{}, RSAMarshaler{}},
+}
+
+func findAlgorithm(algorithmName string) (supportedAlgorithm, bool) {
+	for _, algorithm := range supportedGenerators {
+		if algorithm.generator.AlgorithmName() == algorithmName {
+			return algorithm, true
+		}
+	}
+
+	return supportedAlgorithm{}, false
 }
 
 func FindKeyPairGenerator(algorithmName string) (domain.KeyPairGenerator, bool) {
-	for _, generator := range supportedGenerators {
-		if generator.AlgorithmName() == algorithmName {
-			return generator, true
+	algorithm, found := findAlgorithm(algorithmName)
+	return algorithm.generator, found
+}
+
+// FindKeyPairMarshaler returns the marshaler of the key pairs of an
+// algorithm.
+func FindKeyPairMarshaler(algorithmName string) (KeyPairMarshaler, bool) {
+	algorithm, found := findAlgorithm(algorithmName)
+	return algorithm.marshaler, found
+}
+
+// SupportedAlgorithmNames returns the names of all supported algorithms.
+func SupportedAlgorithmNames() []string {
+	names := []string{}
+	for _, algorithm := range supportedGenerators {
+		names = append(names, algorithm.generator.AlgorithmName())
+	}
+	return names
+}
+
+// verifier is implemented by the key pairs of all supported algorithms.
+type verifier interface {
+	Verify(signedData, signature []byte) error
+}
+
+const selfTestData = "signing-service self-test"
+
+// SelfTest generates a key pair of the algorithm, signs and verifies
+// a fixed message with it, to detect a broken algorithm before it is used
+// for real signatures.
+func SelfTest(algorithmName string) error {
+	generator, found := FindKeyPairGenerator(algorithmName)
+	if !found {
+		return fmt.Errorf("algorithm %s is not supported", algorithmName)
+	}
+
+	keyPair, err := generator.Generate()
+	if err != nil {
+		return fmt.Errorf("key pair generation failed: %w", err)
+	}
+	signature, err := keyPair.Sign([]byte(selfTestData))
+	if err != nil {
+		return fmt.Errorf("signing failed: %w", err)
+	}
+
+	v, ok := keyPair.(verifier)
+	if !ok {
+		return fmt.Errorf("key pair of algorithm %s cannot verify signatures", algorithmName)
+	}
+	if err := v.Verify([]byte(selfTestData), signature); err != nil {
+		return fmt.Errorf("verification failed: %w", err)
+	}
+	return nil
+}
+
+// EncodePrivateKey encodes the private key of a key pair of a supported
+// algorithm with the marshaler of the algorithm, e.g. to store it.
+func EncodePrivateKey(keyPair domain.KeyPair) ([]byte, error) {
+	if keyPair == nil {
+		return nil, errors.New("key pair is missing")
+	}
+	marshaler, found := FindKeyPairMarshaler(keyPair.AlgorithmName())
+	if !found {
+		return nil, fmt.Errorf("key pairs of algorithm %s cannot be encoded", keyPair.AlgorithmName())
+	}
+	return marshaler.MarshalPrivateKey(keyPair)
+}
+
+// DecodePrivateKey assembles the key pair of the algorithm from a private
+// key encoded by EncodePrivateKey.
+func DecodePrivateKey(algorithmName string, encodedPrivateKey []byte) (domain.KeyPair, error) {
+	marshaler, found := FindKeyPairMarshaler(algorithmName)
+	if !found {
+		return nil, fmt.Errorf("algorithm %s is not supported", algorithmName)
+	}
+	return marshaler.UnmarshalPrivateKey(encodedPrivateKey)
+}
+
+// ParsePrivateKey detects the algorithm of a PEM encoded private key, e.g.
+// one issued by a customer's PKI, and assembles its key pair. RSA keys are
+// accepted in the PKCS#1 or PKCS#8 format, ECDSA keys in the SEC 1 or
+// PKCS#8 format.
+func ParsePrivateKey(encodedPrivateKey []byte) (domain.KeyPair, error) {
+	if block, _ := pem.Decode(encodedPrivateKey); block == nil {
+		return nil, errors.New("private key is not PEM encoded")
+	}
+	for _, algorithm := range supportedGenerators {
+		if keyPair, err := algorithm.marshaler.UnmarshalPrivateKey(encodedPrivateKey); err == nil {
+			return keyPair, nil
 		}
 	}
+	return nil, fmt.Errorf("private key is not a key of the algorithms %s", strings.Join(SupportedAlgorithmNames(), ", "))
+}
 
-	return nil, false
+// KeyPolicy is the minimum strength of private keys provided for
+// signature devices. The zero value accepts every key.
+type KeyPolicy struct {
+	// minimum size of the modulus of RSA keys, in bits
+	MinRSABits int
+	// names of the allowed curves of ECDSA keys, e.g. P-256; every curve
+	// is allowed when empty
+	ECCCurves []string
+}
+
+// Check returns an error describing why the key pair is too weak for the
+// policy.
+func (p KeyPolicy) Check(keyPair domain.KeyPair) error {
+	switch keyPair := keyPair.(type) {
+	case *RSAKeyPair:
+		if bits := keyPair.Public.N.BitLen(); bits < p.MinRSABits {
+			return fmt.Errorf("RSA keys must have at least %d bits, got: %d", p.MinRSABits, bits)
+		}
+		return nil
+	case *ECCKeyPair:
+		if len(p.ECCCurves) == 0 {
+			return nil
+		}
+		curve := keyPair.Public.Curve.Params().Name
+		for _, allowed := range p.ECCCurves {
+			if allowed == curve {
+				return nil
+			}
+		}
+		return fmt.Errorf("ECDSA keys must use one of the curves %s, got: %s", strings.Join(p.ECCCurves, ", "), curve)
+	default:
+		return fmt.Errorf("key pairs of algorithm %s are not supported", keyPair.AlgorithmName())
+	}
 }
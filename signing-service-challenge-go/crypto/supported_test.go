@@ -1,6 +1,17 @@
 package crypto
 
-import "testing"
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
+)
 
 func TestFindKeyPairGenerator(t *testing.T) {
 	t.Run("returns found: false when generator does not exist", func(t *testing.T) {
@@ -22,3 +33,183 @@ func TestFindKeyPairGenerator(t *testing.T) {
 		}
 	})
 }
+
+func TestSelfTest(t *testing.T) {
+	for _, algorithmName := range SupportedAlgorithmNames() {
+		t.Run(algorithmName, func(t *testing.T) {
+			if err := SelfTest(algorithmName); err != nil {
+				t.Errorf("expected self-test to pass, got: %s", err)
+			}
+		})
+	}
+
+	t.Run("fails for unsupported algorithms", func(t *testing.T) {
+		if err := SelfTest("INVALID"); err == nil {
+			t.Error("expected error")
+		}
+	})
+}
+
+func TestEncodePrivateKey(t *testing.T) {
+	for _, algorithmName := range SupportedAlgorithmNames() {
+		t.Run(algorithmName, func(t *testing.T) {
+			generator, _ := FindKeyPairGenerator(algorithmName)
+			keyPair, err := generator.Generate()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			encoded, err := EncodePrivateKey(keyPair)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded, err := DecodePrivateKey(algorithmName, encoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			signature, err := decoded.Sign([]byte("some-data"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := keyPair.(verifier).Verify([]byte("some-data"), signature); err != nil {
+				t.Errorf("expected the decoded key pair to sign like the original, got: %s", err)
+			}
+		})
+	}
+
+	t.Run("returns an error for data that is not PEM encoded", func(t *testing.T) {
+		_, err := DecodePrivateKey(ECCAlgorithmName, []byte("not a key"))
+		if err == nil {
+			t.Error("expected error")
+		}
+	})
+
+	t.Run("returns an error for incomplete key pairs", func(t *testing.T) {
+		for _, keyPair := range []domain.KeyPair{nil, &RSAKeyPair{}, &ECCKeyPair{}} {
+			if _, err := EncodePrivateKey(keyPair); err == nil {
+				t.Errorf("expected error for %#v", keyPair)
+			}
+		}
+	})
+
+	t.Run("returns an error for key pairs of another algorithm", func(t *testing.T) {
+		keyPair, err := ECCGenerator{}.Generate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := (RSAMarshaler{}).MarshalPrivateKey(keyPair); err == nil {
+			t.Error("expected error")
+		}
+	})
+}
+
+func encodePKCS8(t *testing.T, privateKey any) []byte {
+	t.Helper()
+
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+}
+
+func TestParsePrivateKey(t *testing.T) {
+	rsaKeyPair, err := RSAGenerator{}.generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	eccKeyPair, err := ECCGenerator{}.generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPKCS1 := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKeyPair.Private)})
+	eccDER, err := x509.MarshalECPrivateKey(eccKeyPair.Private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eccSEC1 := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: eccDER})
+
+	tests := []struct {
+		name              string
+		encoded           []byte
+		expectedAlgorithm string
+		expectedPublicKey func() (string, error)
+	}{
+		{"RSA PKCS#1", rsaPKCS1, RSAAlgorithmName, rsaKeyPair.EncodedPublicKey},
+		{"RSA PKCS#8", encodePKCS8(t, rsaKeyPair.Private), RSAAlgorithmName, rsaKeyPair.EncodedPublicKey},
+		{"ECC SEC 1", eccSEC1, ECCAlgorithmName, eccKeyPair.EncodedPublicKey},
+		{"ECC PKCS#8", encodePKCS8(t, eccKeyPair.Private), ECCAlgorithmName, eccKeyPair.EncodedPublicKey},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			keyPair, err := ParsePrivateKey(test.encoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if keyPair.AlgorithmName() != test.expectedAlgorithm {
+				t.Errorf("expected algorithm %s, got: %s", test.expectedAlgorithm, keyPair.AlgorithmName())
+			}
+			expected, _ := test.expectedPublicKey()
+			got, _ := keyPair.EncodedPublicKey()
+			if got != expected {
+				t.Errorf("expected public key:\n%s\ngot:\n%s", expected, got)
+			}
+		})
+	}
+
+	t.Run("rejects unsupported keys", func(t *testing.T) {
+		_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, encoded := range [][]byte{[]byte("not a key"), encodePKCS8(t, ed25519Key)} {
+			if _, err := ParsePrivateKey(encoded); err == nil {
+				t.Errorf("expected error for %q", encoded)
+			}
+		}
+	})
+}
+
+func TestKeyPolicy(t *testing.T) {
+	policy := KeyPolicy{MinRSABits: 1024, ECCCurves: []string{"P-256", "P-384"}}
+
+	t.Run("accepts keys of the policy", func(t *testing.T) {
+		rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		eccKeyPair, err := ECCGenerator{}.generate()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, keyPair := range []domain.KeyPair{&RSAKeyPair{Private: rsaKey, Public: &rsaKey.PublicKey}, eccKeyPair} {
+			if err := policy.Check(keyPair); err != nil {
+				t.Errorf("expected %s key to be accepted, got: %s", keyPair.AlgorithmName(), err)
+			}
+		}
+	})
+
+	t.Run("rejects weak keys", func(t *testing.T) {
+		rsaKey, err := rsa.GenerateKey(rand.Reader, 512)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rsaKeyPair := &RSAKeyPair{Private: rsaKey, Public: &rsaKey.PublicKey}
+		eccKey, err := ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = policy.Check(rsaKeyPair)
+		if expected := "RSA keys must have at least 1024 bits, got: 512"; err == nil || err.Error() != expected {
+			t.Errorf("expected: %s, got: %v", expected, err)
+		}
+		err = policy.Check(&ECCKeyPair{Private: eccKey, Public: &eccKey.PublicKey})
+		if expected := "ECDSA keys must use one of the curves P-256, P-384, got: P-224"; err == nil || err.Error() != expected {
+			t.Errorf("expected: %s, got: %v", expected, err)
+		}
+	})
+}
@@ -1,8 +1,10 @@
 package domain
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"time"
 
 	"github.com/google/uuid"
 )
@@ -18,15 +20,42 @@ type KeyPairGenerator interface {
 	Generate() (KeyPair, error)
 }
 
+// ProvidedKeyPair is a KeyPairGenerator returning a key pair provided by
+// the customer, e.g. one issued by their own PKI, instead of generating one.
+type ProvidedKeyPair struct {
+	KeyPair KeyPair
+}
+
+func (p ProvidedKeyPair) AlgorithmName() string {
+	return p.KeyPair.AlgorithmName()
+}
+
+func (p ProvidedKeyPair) Generate() (KeyPair, error) {
+	return p.KeyPair, nil
+}
+
+type DeviceStatus string
+
+const (
+	DeviceStatusActive DeviceStatus = "active"
+	// deactivated devices cannot create signatures anymore,
+	// and cannot be activated again
+	DeviceStatusDeactivated DeviceStatus = "deactivated"
+)
+
 type SignatureDevice struct {
 	ID      uuid.UUID
 	KeyPair KeyPair
 	// (optional) user provided string to be displayed in the UI
-	Label string
+	Label  string
+	Status DeviceStatus
 	// track the base64 encoded last signature created with this device
 	LastSignature string
 	// track how many signatures have been created with this device
 	SignatureCounter uint
+	// (optional) DER encoded certificates of an external CA, starting with
+	// the one of the public key, as uploaded for this device
+	CertificateChain [][]byte
 }
 
 func (device SignatureDevice) Sign(dataToBeSigned string) ([]byte, error) {
@@ -34,15 +63,23 @@ func (device SignatureDevice) Sign(dataToBeSigned string) ([]byte, error) {
 }
 
 func BuildSignatureDevice(id uuid.UUID, generator KeyPairGenerator, label ...string) (SignatureDevice, error) {
+	start := time.Now()
 	keyPair, err := generator.Generate()
 	if err != nil {
 		err = errors.New(fmt.Sprintf("key pair generation failed: %s", err.Error()))
 		return SignatureDevice{}, err
 	}
+	duration := time.Since(start)
+	if _, provided := generator.(ProvidedKeyPair); !provided {
+		notifyObservers(func(o Observer) {
+			o.KeyPairGenerated(generator.AlgorithmName(), duration)
+		})
+	}
 
 	device := SignatureDevice{
 		ID:      id,
 		KeyPair: keyPair,
+		Status:  DeviceStatusActive,
 	}
 
 	if len(label) > 0 {
@@ -52,6 +89,111 @@ func BuildSignatureDevice(id uuid.UUID, generator KeyPairGenerator, label ...str
 	return device, nil
 }
 
+// ErrDuplicateDevice is returned when creating a device with an ID that
+// is already taken.
+var ErrDuplicateDevice = errors.New("duplicate id")
+
+// CreateSignatureDevice builds a new signature device and stores it,
+// together with an EventDeviceCreated in the outbox.
+func CreateSignatureDevice(
+	ctx context.Context,
+	id uuid.UUID,
+	repositoryProvider SignatureDeviceRepositoryProvider,
+	generator KeyPairGenerator,
+	label string,
+) (device SignatureDevice, err error) {
+	err = WriteTx(ctx, repositoryProvider, func(ctx context.Context, repository SignatureDeviceRepository) error {
+		_, ok, err := repository.Find(id)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return ErrDuplicateDevice
+		}
+
+		device, err = BuildSignatureDevice(id, generator, label)
+		if err != nil {
+			return err
+		}
+
+		err = repository.Create(device)
+		if err != nil {
+			return err
+		}
+
+		return repository.AddToOutbox(newEvent(EventDeviceCreated, device))
+	})
+	if err != nil {
+		return SignatureDevice{}, err
+	}
+
+	return device, nil
+}
+
+// DeactivateSignatureDevice deactivates the device, so that it cannot
+// create signatures anymore, and adds an EventDeviceDeactivated to the
+// outbox. Deactivating a deactivated device does nothing.
+func DeactivateSignatureDevice(
+	ctx context.Context,
+	deviceID uuid.UUID,
+	repositoryProvider SignatureDeviceRepositoryProvider,
+) (device SignatureDevice, deviceFound bool, err error) {
+	err = WriteTx(ctx, repositoryProvider, func(ctx context.Context, repository SignatureDeviceRepository) error {
+		device, deviceFound, err = repository.Find(deviceID)
+		if err != nil || !deviceFound {
+			return err
+		}
+		if device.Status == DeviceStatusDeactivated {
+			return nil
+		}
+
+		err = repository.Deactivate(deviceID)
+		if err != nil {
+			return errors.New(fmt.Sprintf("failed to update signature device: %s", err))
+		}
+		device.Status = DeviceStatusDeactivated
+
+		return repository.AddToOutbox(newEvent(EventDeviceDeactivated, device))
+	})
+	if err != nil {
+		return SignatureDevice{}, false, err
+	}
+
+	return device, deviceFound, nil
+}
+
+// StoreCertificateChain stores the certificate chain with the device,
+// after verify accepted it for the key pair of the device. Chains cannot
+// be stored for deactivated devices.
+func StoreCertificateChain(
+	ctx context.Context,
+	deviceID uuid.UUID,
+	repositoryProvider SignatureDeviceRepositoryProvider,
+	chain [][]byte,
+	verify func(KeyPair) error,
+) (device SignatureDevice, deviceFound bool, err error) {
+	err = WriteTx(ctx, repositoryProvider, func(ctx context.Context, repository SignatureDeviceRepository) error {
+		device, deviceFound, err = repository.Find(deviceID)
+		if err != nil || !deviceFound {
+			return err
+		}
+		if device.Status == DeviceStatusDeactivated {
+			return ErrDeviceDeactivated
+		}
+		if err := verify(device.KeyPair); err != nil {
+			return err
+		}
+
+		device.CertificateChain = chain
+		return repository.StoreCertificateChain(deviceID, chain)
+	})
+	if err != nil {
+		return SignatureDevice{}, false, err
+	}
+
+	return device, deviceFound, nil
+}
+
 // WARNING:
 // All operations must be executed inside WriteTx() or ReadTx(),
 // as Go maps are not safe for concurrent use.
@@ -60,13 +202,52 @@ func BuildSignatureDevice(id uuid.UUID, generator KeyPairGenerator, label ...str
 // Instead, expose the `SignatureDeviceRepositoryProvider`, which ensures
 // that every operation will be executed inside a transaction.
 type SignatureDeviceRepository interface {
+	// Fails with an error wrapping ErrDuplicateDevice when the ID is taken
 	Create(device SignatureDevice) error
 	// Increment the signatureCounter, and update the lastSignature
 	MarkSignatureCreated(deviceID uuid.UUID, newSignature string) error
+	// Set the status to DeviceStatusDeactivated
+	Deactivate(deviceID uuid.UUID) error
+	// Replace the certificate chain of the device
+	StoreCertificateChain(deviceID uuid.UUID, chain [][]byte) error
+	// Create the device, or replace the stored one with the same ID,
+	// e.g. when restoring a backup
+	Restore(device SignatureDevice) error
+	// Append the event to the outbox, to be published once the
+	// transaction is committed. Durable implementations must store it
+	// atomically with the other writes of the transaction.
+	AddToOutbox(event Event) error
+	// Return up to limit events of the outbox, in the order they were added.
+	// Storages shared by several processes may claim the events listed in
+	// write transactions for a while, and skip the events claimed by others.
+	ListOutbox(limit int) ([]Event, error)
+	// Remove the published events from the outbox, ignoring unknown IDs
+	RemoveFromOutbox(eventIDs []uuid.UUID) error
+	// Create the webhook, or replace the stored one with the same ID
+	SaveWebhook(webhook Webhook) error
+	// Remove the webhook and its deliveries, ignoring unknown IDs
+	DeleteWebhook(id uuid.UUID) error
+	// Return all webhooks ordered by ID
+	ListWebhooks() ([]Webhook, error)
+	// Append the delivery to the unfinished deliveries of its webhook
+	AddWebhookDelivery(delivery WebhookDelivery) error
+	// Return up to limit unfinished deliveries of the webhook, in the
+	// order they were added
+	ListWebhookDeliveries(webhookID uuid.UUID, limit int) ([]WebhookDelivery, error)
+	// Remove the finished delivery, ignoring unknown IDs
+	RemoveWebhookDelivery(id uuid.UUID) error
 	Find(id uuid.UUID) (SignatureDevice, bool, error)
+	// Return all devices ordered by ID
 	List() ([]SignatureDevice, error)
+	// Return the number of devices by the name of their algorithm, without
+	// decoding their key pairs
+	Count() (map[string]int, error)
 }
 
+// ErrRepositoryProviderClosed is returned by transactions started after
+// the provider has been closed.
+var ErrRepositoryProviderClosed = errors.New("repository provider is closed")
+
 type SignatureDeviceRepositoryProvider interface {
 	WriteTx(func(SignatureDeviceRepository) error) error
 	ReadTx(func(SignatureDeviceRepository) error) error
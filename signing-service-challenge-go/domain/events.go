@@ -0,0 +1,55 @@
+package domain
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type EventType string
+
+const (
+	EventDeviceCreated     EventType = "device.created"
+	EventDeviceDeactivated EventType = "device.deactivated"
+	EventSignatureCreated  EventType = "signature.created"
+)
+
+// EventTypes are all types of events.
+var EventTypes = []EventType{EventDeviceCreated, EventDeviceDeactivated, EventSignatureCreated}
+
+// Event describes a change of a signature device made by a committed
+// write transaction.
+type Event struct {
+	// identifies the event when it is published more than once
+	ID   uuid.UUID
+	Type EventType
+	// the state of the device after the change, without its key pair
+	Device SignatureDevice
+	// only set for EventSignatureCreated. Events are stored and sent to
+	// webhooks, so they never carry the data of the customer.
+	Signature string
+	Time      time.Time
+}
+
+func newEvent(eventType EventType, device SignatureDevice) Event {
+	// events are stored, so they must not contain the private key
+	device.KeyPair = nil
+	return Event{
+		ID:     uuid.New(),
+		Type:   eventType,
+		Device: device,
+		Time:   time.Now(),
+	}
+}
+
+// EventPublisher receives the events of committed write transactions from
+// the outbox, e.g. to stream them to clients. An event may be published
+// more than once, with the same ID.
+// Implementations must be safe for concurrent use and must not wait for
+// the consumers of the events, e.g. the receivers of webhooks. They may
+// store the event in the repository before accepting it.
+type EventPublisher interface {
+	// Publish returns an error when the event is not accepted, e.g. because
+	// the publisher is closed. The event stays in the outbox then.
+	Publish(event Event) error
+}
@@ -0,0 +1,123 @@
+package domain_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/crypto"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/persistence"
+	"github.com/google/uuid"
+)
+
+func listOutbox(t *testing.T, provider domain.SignatureDeviceRepositoryProvider) []domain.Event {
+	t.Helper()
+
+	var events []domain.Event
+	err := provider.ReadTx(func(repository domain.SignatureDeviceRepository) error {
+		var err error
+		events, err = repository.ListOutbox(100)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return events
+}
+
+func TestEvents(t *testing.T) {
+	t.Run("adds the changes of a device to the outbox in commit order", func(t *testing.T) {
+		provider := persistence.NewInMemorySignatureDeviceRepositoryProvider(
+			persistence.NewInMemorySignatureDeviceRepository(),
+		)
+		id := uuid.New()
+
+		_, err := domain.CreateSignatureDevice(context.Background(), id, provider, crypto.ECCGenerator{}, "till-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, _, _, err := domain.SignTransaction(context.Background(), id, provider, "some-data")
+				if err != nil {
+					t.Error(err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		_, _, err = domain.DeactivateSignatureDevice(context.Background(), id, provider)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		events := listOutbox(t, provider)
+		if len(events) != 22 {
+			t.Fatalf("expected 22 events, got: %d", len(events))
+		}
+		if event := events[0]; event.Type != domain.EventDeviceCreated || event.Device.Label != "till-1" {
+			t.Errorf("expected device created event first, got: %+v", event)
+		}
+		for i, event := range events[1:21] {
+			if event.Type != domain.EventSignatureCreated || event.Device.SignatureCounter != uint(i+1) {
+				t.Errorf("expected signature %d, got: %s with counter %d", i+1, event.Type, event.Device.SignatureCounter)
+			}
+			if event.Device.LastSignature != event.Signature {
+				t.Error("expected the event to contain the updated device")
+			}
+		}
+		if event := events[21]; event.Type != domain.EventDeviceDeactivated || event.Device.Status != domain.DeviceStatusDeactivated {
+			t.Errorf("expected device deactivated event last, got: %+v", event)
+		}
+
+		ids := map[uuid.UUID]bool{}
+		for _, event := range events {
+			if event.Device.KeyPair != nil {
+				t.Error("expected events to not contain the key pair")
+			}
+			ids[event.ID] = true
+		}
+		if len(ids) != len(events) {
+			t.Error("expected every event to have its own ID")
+		}
+	})
+
+	t.Run("does not add failed changes", func(t *testing.T) {
+		provider := persistence.NewInMemorySignatureDeviceRepositoryProvider(
+			persistence.NewInMemorySignatureDeviceRepository(),
+		)
+		id := uuid.New()
+
+		_, err := domain.CreateSignatureDevice(context.Background(), id, provider, crypto.ECCGenerator{}, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = domain.DeactivateSignatureDevice(context.Background(), id, provider)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = domain.CreateSignatureDevice(context.Background(), id, provider, crypto.ECCGenerator{}, "")
+		if !errors.Is(err, domain.ErrDuplicateDevice) {
+			t.Errorf("expected duplicate device error, got: %v", err)
+		}
+		_, _, err = domain.DeactivateSignatureDevice(context.Background(), id, provider)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, _, err = domain.SignTransaction(context.Background(), id, provider, "some-data")
+		if !errors.Is(err, domain.ErrDeviceDeactivated) {
+			t.Errorf("expected deactivated device error, got: %v", err)
+		}
+
+		if events := listOutbox(t, provider); len(events) != 2 {
+			t.Errorf("expected only the creation and deactivation, got: %+v", events)
+		}
+	})
+}
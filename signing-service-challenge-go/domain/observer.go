@@ -0,0 +1,58 @@
+package domain
+
+import (
+	"sync"
+	"time"
+)
+
+// Observer is notified about the operations of the domain,
+// e.g. to collect metrics.
+// Implementations must be safe for concurrent use and must not block.
+type Observer interface {
+	KeyPairGenerated(algorithmName string, duration time.Duration)
+	// reported once the transaction using up the signature counter has
+	// been committed
+	SignatureCreated(algorithmName string, duration time.Duration)
+	// reported by SignatureDeviceRepositoryProvider implementations
+	// once the exclusive lock of WriteTx has been acquired
+	WriteTxLockAcquired(wait time.Duration)
+}
+
+var observers = struct {
+	sync.RWMutex
+	registered map[*Observer]Observer
+}{
+	registered: map[*Observer]Observer{},
+}
+
+// RegisterObserver adds an observer until the returned function is called.
+func RegisterObserver(observer Observer) (unregister func()) {
+	key := &observer
+
+	observers.Lock()
+	observers.registered[key] = observer
+	observers.Unlock()
+
+	return func() {
+		observers.Lock()
+		delete(observers.registered, key)
+		observers.Unlock()
+	}
+}
+
+func notifyObservers(notify func(Observer)) {
+	observers.RLock()
+	defer observers.RUnlock()
+
+	for _, observer := range observers.registered {
+		notify(observer)
+	}
+}
+
+// ObserveWriteTxLockAcquired is called by SignatureDeviceRepositoryProvider
+// implementations to report how long WriteTx waited for its lock.
+func ObserveWriteTxLockAcquired(wait time.Duration) {
+	notifyObservers(func(o Observer) {
+		o.WriteTxLockAcquired(wait)
+	})
+}
@@ -0,0 +1,48 @@
+package domain
+
+import (
+	"testing"
+	"time"
+)
+
+type recordingObserver struct {
+	generatedAlgorithms []string
+}
+
+func (o *recordingObserver) KeyPairGenerated(algorithmName string, duration time.Duration) {
+	o.generatedAlgorithms = append(o.generatedAlgorithms, algorithmName)
+}
+
+func (o *recordingObserver) SignatureCreated(algorithmName string, duration time.Duration) {}
+
+func (o *recordingObserver) WriteTxLockAcquired(wait time.Duration) {}
+
+func TestRegisterObserver(t *testing.T) {
+	observer := &recordingObserver{}
+	unregister := RegisterObserver(observer)
+
+	_, err := BuildSignatureDevice([16]byte{}, MockKeyPairGenerator{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(observer.generatedAlgorithms) != 1 {
+		t.Errorf("expected observer to be notified once, got %d notifications", len(observer.generatedAlgorithms))
+	}
+
+	_, err = BuildSignatureDevice([16]byte{}, ProvidedKeyPair{KeyPair: MockKeyPair{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(observer.generatedAlgorithms) != 1 {
+		t.Error("expected observer to not be notified of provided key pairs")
+	}
+
+	unregister()
+	_, err = BuildSignatureDevice([16]byte{}, MockKeyPairGenerator{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(observer.generatedAlgorithms) != 1 {
+		t.Error("expected observer to not be notified after unregistering")
+	}
+}
@@ -1,26 +1,50 @@
 package domain
 
 import (
+	"context"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
 )
 
+// ErrDeviceDeactivated is returned when signing with a deactivated device.
+var ErrDeviceDeactivated = errors.New("signature device is deactivated")
+
+// SignatureEncoder encodes the signed data in a further format, e.g. as
+// JWS. It is called with the device as it was before signing, within the
+// transaction that uses up the signature counter.
+type SignatureEncoder func(device SignatureDevice, signedData string) error
+
+// SignTransaction signs the data with the device, and stores the signature
+// together with an EventSignatureCreated in the outbox. When one of the
+// encoders fails, the transaction is rolled back, so that the signature
+// counter is not used up by a signature that is never returned.
 func SignTransaction(
+	ctx context.Context,
 	deviceID uuid.UUID,
 	repositoryProvider SignatureDeviceRepositoryProvider,
 	dataToBeSigned string,
+	encoders ...SignatureEncoder,
 ) (
 	deviceFound bool,
 	encodedSignature string,
 	signedData string,
 	err error,
 ) {
-	txErr := repositoryProvider.WriteTx(func(repository SignatureDeviceRepository) error {
+	ctx, span := tracer().Start(ctx, "SignTransaction")
+	span.SetAttributes(attribute.String("device.id", deviceID.String()))
+	defer func() { endSpan(span, err) }()
+
+	// reported once the transaction is committed
+	var algorithmName string
+	var signDuration time.Duration
+	txErr := WriteTx(ctx, repositoryProvider, func(ctx context.Context, repository SignatureDeviceRepository) error {
 		device, ok, err := repository.Find(deviceID)
 		if err != nil {
 			return err
@@ -30,25 +54,48 @@ func SignTransaction(
 			return nil
 		}
 		deviceFound = true
+		if device.Status == DeviceStatusDeactivated {
+			return ErrDeviceDeactivated
+		}
 
 		signedData = SecureDataToBeSigned(device, dataToBeSigned)
+		_, signSpan := tracer().Start(ctx, "KeyPair.Sign")
+		signSpan.SetAttributes(attribute.String("algorithm", device.KeyPair.AlgorithmName()))
+		start := time.Now()
 		signature, err := device.Sign(signedData)
+		signDuration = time.Since(start)
+		endSpan(signSpan, err)
 		if err != nil {
 			return errors.New(fmt.Sprintf("failed to sign transaction: %s", err))
 		}
+		algorithmName = device.KeyPair.AlgorithmName()
 		encodedSignature = base64.StdEncoding.EncodeToString(signature)
+		for _, encode := range encoders {
+			if err := encode(device, signedData); err != nil {
+				return err
+			}
+		}
 
 		err = repository.MarkSignatureCreated(device.ID, encodedSignature)
 		if err != nil {
 			return errors.New(fmt.Sprintf("failed to update signature device: %s", err))
 		}
+		device.SignatureCounter++
+		device.LastSignature = encodedSignature
 
-		return nil
+		event := newEvent(EventSignatureCreated, device)
+		event.Signature = encodedSignature
+		return repository.AddToOutbox(event)
 	})
 
 	if txErr != nil {
 		return false, "", "", txErr
 	}
+	if deviceFound {
+		notifyObservers(func(o Observer) {
+			o.SignatureCreated(algorithmName, signDuration)
+		})
+	}
 
 	return
 }
@@ -1,11 +1,15 @@
 package domain_test
 
 import (
+	"context"
 	"crypto/rsa"
 	"crypto/sha512"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/fiskaly/coding-challenges/signing-service-challenge/crypto"
 	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
@@ -13,6 +17,19 @@ import (
 	"github.com/google/uuid"
 )
 
+// signatureObserver counts the created signatures.
+type signatureObserver struct {
+	signatures atomic.Int64
+}
+
+func (o *signatureObserver) KeyPairGenerated(algorithmName string, duration time.Duration) {}
+
+func (o *signatureObserver) SignatureCreated(algorithmName string, duration time.Duration) {
+	o.signatures.Add(1)
+}
+
+func (o *signatureObserver) WriteTxLockAcquired(wait time.Duration) {}
+
 func TestSignTransaction(t *testing.T) {
 	t.Run("returns deviceFound: false when device with id does not exist", func(t *testing.T) {
 		dataToBeSigned := "some-transaction-data"
@@ -21,7 +38,7 @@ func TestSignTransaction(t *testing.T) {
 		)
 		deviceID := uuid.MustParse("121fe402-762a-411a-8eeb-9e6c3ca16886")
 
-		deviceFound, _, _, err := domain.SignTransaction(deviceID, provider, dataToBeSigned)
+		deviceFound, _, _, err := domain.SignTransaction(context.Background(), deviceID, provider, dataToBeSigned)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -44,6 +61,7 @@ func TestSignTransaction(t *testing.T) {
 		}
 
 		deviceFound, encodedSignature, signedData, err := domain.SignTransaction(
+			context.Background(),
 			deviceID,
 			persistence.NewInMemorySignatureDeviceRepositoryProvider(repository),
 			dataToBeSigned,
@@ -102,6 +120,58 @@ func TestSignTransaction(t *testing.T) {
 			t.Errorf("expected last signature to be updated to: %s, got %s", encodedSignature, device.LastSignature)
 		}
 	})
+
+	t.Run("does not use up the signature counter when an encoder fails", func(t *testing.T) {
+		repository := persistence.NewInMemorySignatureDeviceRepository()
+		deviceID := uuid.New()
+		device, err := domain.BuildSignatureDevice(deviceID, crypto.ECCGenerator{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := repository.Create(device); err != nil {
+			t.Fatal(err)
+		}
+		provider := persistence.NewInMemorySignatureDeviceRepositoryProvider(repository)
+
+		observer := &signatureObserver{}
+		unregister := domain.RegisterObserver(observer)
+		defer unregister()
+
+		encoderErr := errors.New("encoding failed")
+		var encodedCounter uint
+		var encodedData string
+		_, _, _, err = domain.SignTransaction(context.Background(), deviceID, provider, "data",
+			func(device domain.SignatureDevice, signedData string) error {
+				encodedCounter, encodedData = device.SignatureCounter, signedData
+				return encoderErr
+			},
+		)
+		if !errors.Is(err, encoderErr) {
+			t.Fatalf("expected the error of the encoder, got: %v", err)
+		}
+		expectedData := domain.SecureDataToBeSigned(device, "data")
+		if encodedCounter != 0 || encodedData != expectedData {
+			t.Errorf("expected the encoder to get the device before signing and the signed data, got: %d, %s", encodedCounter, encodedData)
+		}
+
+		device, _, err = repository.Find(deviceID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if device.SignatureCounter != 0 || device.LastSignature != "" {
+			t.Errorf("expected the device to be unchanged, got counter %d and last signature %q", device.SignatureCounter, device.LastSignature)
+		}
+		outbox, err := repository.ListOutbox(10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(outbox) != 0 {
+			t.Errorf("expected no event, got: %d", len(outbox))
+		}
+		if signatures := observer.signatures.Load(); signatures != 0 {
+			t.Errorf("expected the observer to not be notified of the rolled back signature, got %d notifications", signatures)
+		}
+	})
 }
 
 func TestSecureDataToBeSigned(t *testing.T) {
@@ -0,0 +1,193 @@
+package domain
+
+import (
+	"context"
+
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The tracer is resolved on every use, so that a TracerProvider
+// installed after startup (e.g. in tests) is picked up.
+func tracer() trace.Tracer {
+	return otel.Tracer("github.com/fiskaly/coding-challenges/signing-service-challenge/domain")
+}
+
+// endSpan records err, if any, on the span and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// WriteTx runs fn inside repositoryProvider.WriteTx and traces it.
+// The time spent waiting for the exclusive lock is recorded as a separate
+// span, and every repository call made by fn becomes a child span.
+func WriteTx(
+	ctx context.Context,
+	repositoryProvider SignatureDeviceRepositoryProvider,
+	fn func(context.Context, SignatureDeviceRepository) error,
+) (err error) {
+	ctx, span := tracer().Start(ctx, "SignatureDeviceRepositoryProvider.WriteTx")
+	defer func() { endSpan(span, err) }()
+
+	_, lockSpan := tracer().Start(ctx, "SignatureDeviceRepositoryProvider.WriteTx lock")
+	lockAcquired := false
+	defer func() {
+		// the transaction was rejected without acquiring the lock
+		if !lockAcquired {
+			lockSpan.End()
+		}
+	}()
+
+	return repositoryProvider.WriteTx(func(repository SignatureDeviceRepository) error {
+		lockAcquired = true
+		lockSpan.End()
+		return fn(ctx, tracedRepository{ctx: ctx, repository: repository})
+	})
+}
+
+// ReadTx runs fn inside repositoryProvider.ReadTx and traces it,
+// like WriteTx.
+func ReadTx(
+	ctx context.Context,
+	repositoryProvider SignatureDeviceRepositoryProvider,
+	fn func(context.Context, SignatureDeviceRepository) error,
+) (err error) {
+	ctx, span := tracer().Start(ctx, "SignatureDeviceRepositoryProvider.ReadTx")
+	defer func() { endSpan(span, err) }()
+
+	return repositoryProvider.ReadTx(func(repository SignatureDeviceRepository) error {
+		return fn(ctx, tracedRepository{ctx: ctx, repository: repository})
+	})
+}
+
+// tracedRepository creates a span for every call to the wrapped repository.
+type tracedRepository struct {
+	ctx        context.Context
+	repository SignatureDeviceRepository
+}
+
+func (r tracedRepository) start(name string, deviceID uuid.UUID) trace.Span {
+	_, span := tracer().Start(r.ctx, "SignatureDeviceRepository."+name)
+	if deviceID != uuid.Nil {
+		span.SetAttributes(attribute.String("device.id", deviceID.String()))
+	}
+	return span
+}
+
+func (r tracedRepository) Create(device SignatureDevice) (err error) {
+	span := r.start("Create", device.ID)
+	defer func() { endSpan(span, err) }()
+	return r.repository.Create(device)
+}
+
+func (r tracedRepository) MarkSignatureCreated(deviceID uuid.UUID, newSignature string) (err error) {
+	span := r.start("MarkSignatureCreated", deviceID)
+	defer func() { endSpan(span, err) }()
+	return r.repository.MarkSignatureCreated(deviceID, newSignature)
+}
+
+func (r tracedRepository) Deactivate(deviceID uuid.UUID) (err error) {
+	span := r.start("Deactivate", deviceID)
+	defer func() { endSpan(span, err) }()
+	return r.repository.Deactivate(deviceID)
+}
+
+func (r tracedRepository) StoreCertificateChain(deviceID uuid.UUID, chain [][]byte) (err error) {
+	span := r.start("StoreCertificateChain", deviceID)
+	defer func() { endSpan(span, err) }()
+	return r.repository.StoreCertificateChain(deviceID, chain)
+}
+
+func (r tracedRepository) Restore(device SignatureDevice) (err error) {
+	span := r.start("Restore", device.ID)
+	defer func() { endSpan(span, err) }()
+	return r.repository.Restore(device)
+}
+
+func (r tracedRepository) AddToOutbox(event Event) (err error) {
+	span := r.start("AddToOutbox", event.Device.ID)
+	defer func() { endSpan(span, err) }()
+	return r.repository.AddToOutbox(event)
+}
+
+func (r tracedRepository) ListOutbox(limit int) (events []Event, err error) {
+	span := r.start("ListOutbox", uuid.Nil)
+	defer func() {
+		span.SetAttributes(attribute.Int("outbox.events", len(events)))
+		endSpan(span, err)
+	}()
+	return r.repository.ListOutbox(limit)
+}
+
+func (r tracedRepository) RemoveFromOutbox(eventIDs []uuid.UUID) (err error) {
+	span := r.start("RemoveFromOutbox", uuid.Nil)
+	defer func() { endSpan(span, err) }()
+	return r.repository.RemoveFromOutbox(eventIDs)
+}
+
+func (r tracedRepository) SaveWebhook(webhook Webhook) (err error) {
+	span := r.start("SaveWebhook", uuid.Nil)
+	defer func() { endSpan(span, err) }()
+	return r.repository.SaveWebhook(webhook)
+}
+
+func (r tracedRepository) DeleteWebhook(id uuid.UUID) (err error) {
+	span := r.start("DeleteWebhook", uuid.Nil)
+	defer func() { endSpan(span, err) }()
+	return r.repository.DeleteWebhook(id)
+}
+
+func (r tracedRepository) ListWebhooks() (webhooks []Webhook, err error) {
+	span := r.start("ListWebhooks", uuid.Nil)
+	defer func() { endSpan(span, err) }()
+	return r.repository.ListWebhooks()
+}
+
+func (r tracedRepository) AddWebhookDelivery(delivery WebhookDelivery) (err error) {
+	span := r.start("AddWebhookDelivery", delivery.Event.Device.ID)
+	defer func() { endSpan(span, err) }()
+	return r.repository.AddWebhookDelivery(delivery)
+}
+
+func (r tracedRepository) ListWebhookDeliveries(webhookID uuid.UUID, limit int) (deliveries []WebhookDelivery, err error) {
+	span := r.start("ListWebhookDeliveries", uuid.Nil)
+	defer func() {
+		span.SetAttributes(attribute.Int("webhook.deliveries", len(deliveries)))
+		endSpan(span, err)
+	}()
+	return r.repository.ListWebhookDeliveries(webhookID, limit)
+}
+
+func (r tracedRepository) RemoveWebhookDelivery(id uuid.UUID) (err error) {
+	span := r.start("RemoveWebhookDelivery", uuid.Nil)
+	defer func() { endSpan(span, err) }()
+	return r.repository.RemoveWebhookDelivery(id)
+}
+
+func (r tracedRepository) Find(id uuid.UUID) (device SignatureDevice, found bool, err error) {
+	span := r.start("Find", id)
+	defer func() {
+		span.SetAttributes(attribute.Bool("device.found", found))
+		endSpan(span, err)
+	}()
+	return r.repository.Find(id)
+}
+
+func (r tracedRepository) List() (devices []SignatureDevice, err error) {
+	span := r.start("List", uuid.Nil)
+	defer func() { endSpan(span, err) }()
+	return r.repository.List()
+}
+
+func (r tracedRepository) Count() (counts map[string]int, err error) {
+	span := r.start("Count", uuid.Nil)
+	defer func() { endSpan(span, err) }()
+	return r.repository.Count()
+}
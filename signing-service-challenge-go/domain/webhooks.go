@@ -0,0 +1,41 @@
+package domain
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Webhook is a subscription of a receiver URL to events. Webhooks are
+// stored in the repository, so that they outlive the process.
+type Webhook struct {
+	ID     uuid.UUID
+	URL    string
+	Secret string
+	// empty to receive all event types
+	EventTypes []EventType
+	CreatedAt  time.Time
+}
+
+// Receives reports whether the webhook subscribed to the event type.
+func (w Webhook) Receives(eventType EventType) bool {
+	if len(w.EventTypes) == 0 {
+		return true
+	}
+	for _, t := range w.EventTypes {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookDelivery is a delivery of an event to a webhook that has not
+// finished yet. It stays in the repository until it succeeded or was
+// given up, so that it is retried by the next process.
+type WebhookDelivery struct {
+	ID        uuid.UUID
+	WebhookID uuid.UUID
+	Event     Event
+	CreatedAt time.Time
+}
@@ -0,0 +1,266 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
+	"github.com/google/uuid"
+)
+
+// Message is an event together with its position on the bus.
+type Message struct {
+	// increases by one with every published event, starting at 1.
+	// Sequence numbers start over when the process restarts.
+	Sequence uint64
+	domain.Event
+}
+
+type Options struct {
+	// number of recent messages kept, so that subscribers can catch up
+	// on messages they missed
+	History int
+	// number of messages buffered per subscriber, before a subscriber
+	// that does not keep up is dropped, DefaultBuffer when 0
+	Buffer int
+	// number of recent event IDs remembered to drop events that are
+	// published again, DefaultDeduplicate when 0
+	Deduplicate int
+}
+
+const (
+	DefaultBuffer      = 100
+	DefaultDeduplicate = 10000
+)
+
+var (
+	// ErrSlowSubscriber ends subscriptions whose buffer is full.
+	ErrSlowSubscriber = errors.New("subscriber did not keep up")
+	// ErrClosed ends all subscriptions when the bus is closed.
+	ErrClosed = errors.New("event bus is closed")
+)
+
+// Bus distributes the published events to all subscribers.
+// It implements domain.EventPublisher.
+// The bus is local to the process: with a storage shared by several
+// replicas, it receives only the events of the outbox that its replica
+// claimed, see persistence.PostgresSignatureDeviceRepositoryProvider.
+type Bus struct {
+	options Options
+
+	mutex       sync.Mutex
+	closed      bool
+	sequence    uint64
+	history     []Message
+	subscribers map[*Subscription]struct{}
+	// recently published event IDs, oldest first
+	published    []uuid.UUID
+	publishedIDs map[uuid.UUID]struct{}
+}
+
+func NewBus(options Options) *Bus {
+	if options.Buffer < 1 {
+		options.Buffer = DefaultBuffer
+	}
+	if options.Deduplicate < 1 {
+		options.Deduplicate = DefaultDeduplicate
+	}
+	return &Bus{
+		options:      options,
+		subscribers:  map[*Subscription]struct{}{},
+		publishedIDs: map[uuid.UUID]struct{}{},
+	}
+}
+
+// Publish never blocks: subscribers whose buffer is full are dropped.
+// Events whose ID was published recently are discarded. Events published
+// after Close are rejected with ErrClosed.
+func (b *Bus) Publish(event domain.Event) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.closed {
+		return ErrClosed
+	}
+	if b.isDuplicate(event.ID) {
+		return nil
+	}
+
+	b.sequence++
+	message := Message{Sequence: b.sequence, Event: event}
+
+	if b.options.History > 0 {
+		if len(b.history) == b.options.History {
+			// shift instead of reslicing, so that the array is reused
+			copy(b.history, b.history[1:])
+			b.history = b.history[:len(b.history)-1]
+		}
+		b.history = append(b.history, message)
+	}
+
+	for subscription := range b.subscribers {
+		if !subscription.filter(message) {
+			continue
+		}
+		select {
+		case subscription.messages <- message:
+		default:
+			b.drop(subscription, ErrSlowSubscriber)
+		}
+	}
+	return nil
+}
+
+// isDuplicate remembers the ID, and reports whether it was published
+// recently. Events without ID are never duplicates.
+// The caller must hold the mutex.
+func (b *Bus) isDuplicate(id uuid.UUID) bool {
+	if id == uuid.Nil {
+		return false
+	}
+	if _, ok := b.publishedIDs[id]; ok {
+		return true
+	}
+
+	if len(b.published) == b.options.Deduplicate {
+		delete(b.publishedIDs, b.published[0])
+		b.published = b.published[1:]
+	}
+	b.published = append(b.published, id)
+	b.publishedIDs[id] = struct{}{}
+	return false
+}
+
+// Subscribe returns a subscription to the messages published from now on
+// that match filter, and the messages in the history that match both
+// filter and replay, oldest first. Together they contain every matching
+// message exactly once. replay may be nil, to not replay anything.
+func (b *Bus) Subscribe(filter, replay func(Message) bool) (*Subscription, []Message) {
+	subscription := &Subscription{
+		bus:      b,
+		filter:   filter,
+		messages: make(chan Message, b.options.Buffer),
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.closed {
+		subscription.err = ErrClosed
+		close(subscription.messages)
+		return subscription, nil
+	}
+	b.subscribers[subscription] = struct{}{}
+
+	replayed := []Message{}
+	if replay != nil {
+		for _, message := range b.history {
+			if filter(message) && replay(message) {
+				replayed = append(replayed, message)
+			}
+		}
+	}
+	return subscription, replayed
+}
+
+// Close ends all subscriptions. Subscriptions made afterwards are
+// ended immediately.
+func (b *Bus) Close() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.closed = true
+	for subscription := range b.subscribers {
+		b.drop(subscription, ErrClosed)
+	}
+}
+
+// drop ends the subscription with err. The caller must hold the mutex.
+func (b *Bus) drop(subscription *Subscription, err error) {
+	if _, ok := b.subscribers[subscription]; ok {
+		delete(b.subscribers, subscription)
+		subscription.err = err
+		close(subscription.messages)
+	}
+}
+
+type Subscription struct {
+	bus      *Bus
+	filter   func(Message) bool
+	messages chan Message
+	// guarded by the mutex of the bus
+	err error
+}
+
+// Messages is closed when the subscription ends, either by Close, by
+// closing the bus, or because the subscriber did not keep up. In the
+// latter case, the subscriber can resubscribe and replay the messages
+// it missed from the history. See Err.
+func (s *Subscription) Messages() <-chan Message {
+	return s.messages
+}
+
+// Err returns why the subscription ended: ErrSlowSubscriber, ErrClosed,
+// or nil when it was ended by Close or has not ended yet.
+func (s *Subscription) Err() error {
+	s.bus.mutex.Lock()
+	defer s.bus.mutex.Unlock()
+
+	return s.err
+}
+
+// Close ends the subscription.
+func (s *Subscription) Close() {
+	s.bus.mutex.Lock()
+	defer s.bus.mutex.Unlock()
+
+	s.bus.drop(s, nil)
+}
+
+// Follower handles the messages matching a filter in order, and catches
+// up on the messages it missed when it did not keep up.
+type Follower struct {
+	bus          *Bus
+	filter       func(Message) bool
+	subscription *Subscription
+}
+
+// Follow subscribes to the messages published from now on that match
+// filter. They are handled by Run. Subscribing before Run, e.g. before
+// starting it in a goroutine, ensures that no later message is missed.
+func (b *Bus) Follow(filter func(Message) bool) *Follower {
+	subscription, _ := b.Subscribe(filter, nil)
+	return &Follower{bus: b, filter: filter, subscription: subscription}
+}
+
+// Run calls handle with every message until ctx is done or the bus is
+// closed. When handle does not keep up, the messages missed are replayed
+// from the history, as far as it still keeps them.
+func (f *Follower) Run(ctx context.Context, handle func(Message)) {
+	var lastSequence uint64
+	for {
+		select {
+		case <-ctx.Done():
+			f.subscription.Close()
+			return
+		case message, ok := <-f.subscription.Messages():
+			if ok {
+				lastSequence = message.Sequence
+				handle(message)
+				continue
+			}
+			if f.subscription.Err() != ErrSlowSubscriber {
+				return
+			}
+			var missed []Message
+			f.subscription, missed = f.bus.Subscribe(f.filter, func(message Message) bool {
+				return message.Sequence > lastSequence
+			})
+			for _, message := range missed {
+				lastSequence = message.Sequence
+				handle(message)
+			}
+		}
+	}
+}
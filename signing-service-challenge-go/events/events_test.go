@@ -0,0 +1,173 @@
+package events
+
+import (
+	"context"
+	"testing"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/uuid"
+)
+
+func all(Message) bool { return true }
+
+func publish(bus *Bus, deviceID uuid.UUID, count int) {
+	for i := 0; i < count; i++ {
+		bus.Publish(domain.Event{
+			Type:   domain.EventSignatureCreated,
+			Device: domain.SignatureDevice{ID: deviceID, SignatureCounter: uint(i + 1)},
+		})
+	}
+}
+
+func receive(t *testing.T, subscription *Subscription) []uint64 {
+	t.Helper()
+
+	sequences := []uint64{}
+	for {
+		select {
+		case message, ok := <-subscription.Messages():
+			if !ok {
+				return sequences
+			}
+			sequences = append(sequences, message.Sequence)
+		default:
+			return sequences
+		}
+	}
+}
+
+func sequences(messages []Message) []uint64 {
+	result := []uint64{}
+	for _, message := range messages {
+		result = append(result, message.Sequence)
+	}
+	return result
+}
+
+func TestBus(t *testing.T) {
+	t.Run("delivers matching messages to subscribers", func(t *testing.T) {
+		bus := NewBus(Options{Buffer: 10})
+		deviceID := uuid.New()
+
+		subscription, replayed := bus.Subscribe(func(m Message) bool { return m.Device.ID == deviceID }, nil)
+		defer subscription.Close()
+		if len(replayed) != 0 {
+			t.Errorf("expected nothing to be replayed, got: %v", replayed)
+		}
+
+		publish(bus, uuid.New(), 1)
+		publish(bus, deviceID, 2)
+
+		if diff := cmp.Diff(receive(t, subscription), []uint64{2, 3}); diff != "" {
+			t.Errorf("unexpected diff: %s", diff)
+		}
+	})
+
+	t.Run("replays the matching messages of the history", func(t *testing.T) {
+		bus := NewBus(Options{History: 3, Buffer: 10})
+		publish(bus, uuid.New(), 5)
+
+		subscription, replayed := bus.Subscribe(all, func(m Message) bool { return m.Sequence > 3 })
+		defer subscription.Close()
+		publish(bus, uuid.New(), 1)
+
+		if diff := cmp.Diff(sequences(replayed), []uint64{4, 5}); diff != "" {
+			t.Errorf("unexpected diff: %s", diff)
+		}
+		if diff := cmp.Diff(receive(t, subscription), []uint64{6}); diff != "" {
+			t.Errorf("unexpected diff: %s", diff)
+		}
+
+		// messages older than the history cannot be replayed
+		subscription, replayed = bus.Subscribe(all, all)
+		defer subscription.Close()
+		if diff := cmp.Diff(sequences(replayed), []uint64{4, 5, 6}); diff != "" {
+			t.Errorf("unexpected diff: %s", diff)
+		}
+	})
+
+	t.Run("drops events published again", func(t *testing.T) {
+		bus := NewBus(Options{Buffer: 10, Deduplicate: 2})
+		subscription, _ := bus.Subscribe(all, nil)
+		defer subscription.Close()
+
+		first, second, third := domain.Event{ID: uuid.New()}, domain.Event{ID: uuid.New()}, domain.Event{ID: uuid.New()}
+		for _, event := range []domain.Event{first, second, first, third, first} {
+			bus.Publish(event)
+		}
+
+		// the first event is forgotten once the third is published
+		if diff := cmp.Diff(receive(t, subscription), []uint64{1, 2, 3, 4}); diff != "" {
+			t.Errorf("unexpected diff: %s", diff)
+		}
+	})
+
+	t.Run("drops subscribers that do not keep up", func(t *testing.T) {
+		bus := NewBus(Options{Buffer: 2})
+		slow, _ := bus.Subscribe(all, nil)
+		publish(bus, uuid.New(), 2)
+
+		fast, _ := bus.Subscribe(all, nil)
+		defer fast.Close()
+		publish(bus, uuid.New(), 1)
+
+		if diff := cmp.Diff(receive(t, slow), []uint64{1, 2}); diff != "" {
+			t.Errorf("unexpected diff: %s", diff)
+		}
+		if _, ok := <-slow.Messages(); ok || slow.Err() != ErrSlowSubscriber {
+			t.Errorf("expected slow subscription to be ended, got: %v", slow.Err())
+		}
+		if diff := cmp.Diff(receive(t, fast), []uint64{3}); diff != "" {
+			t.Errorf("unexpected diff: %s", diff)
+		}
+	})
+
+	t.Run("ends all subscriptions when closed", func(t *testing.T) {
+		bus := NewBus(Options{Buffer: 10})
+		subscription, _ := bus.Subscribe(all, nil)
+
+		bus.Close()
+		if err := bus.Publish(domain.Event{ID: uuid.New()}); err != ErrClosed {
+			t.Errorf("expected events to be rejected, got: %v", err)
+		}
+		subscription.Close()
+
+		if _, ok := <-subscription.Messages(); ok || subscription.Err() != ErrClosed {
+			t.Errorf("expected subscription to be ended, got: %v", subscription.Err())
+		}
+		subscription, _ = bus.Subscribe(all, nil)
+		if _, ok := <-subscription.Messages(); ok || subscription.Err() != ErrClosed {
+			t.Errorf("expected subscription after close to be ended, got: %v", subscription.Err())
+		}
+	})
+	t.Run("followers catch up on the messages they missed", func(t *testing.T) {
+		bus := NewBus(Options{History: 10, Buffer: 1})
+		follower := bus.Follow(all)
+		// the follower does not keep up with the second message
+		publish(bus, uuid.New(), 3)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		handled := []uint64{}
+		follower.Run(ctx, func(m Message) {
+			handled = append(handled, m.Sequence)
+			if len(handled) == 3 {
+				cancel()
+			}
+		})
+
+		if diff := cmp.Diff(handled, []uint64{1, 2, 3}); diff != "" {
+			t.Errorf("unexpected diff: %s", diff)
+		}
+	})
+
+	t.Run("followers stop when the context is done", func(t *testing.T) {
+		bus := NewBus(Options{Buffer: 10})
+		follower := bus.Follow(all)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		follower.Run(ctx, func(Message) { t.Error("expected no message to be handled") })
+		publish(bus, uuid.New(), 1)
+	})
+}
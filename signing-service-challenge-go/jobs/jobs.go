@@ -0,0 +1,220 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type Status string
+
+const (
+	StatusPending   Status = "pending"
+	StatusSucceeded Status = "succeeded"
+	StatusFailed    Status = "failed"
+)
+
+var (
+	ErrQueueFull   = errors.New("job queue is full")
+	ErrQueueClosed = errors.New("job queue is closed")
+)
+
+// Func does the work of a job. The error message of a failed job is
+// shown to clients, so it must not contain internal details.
+type Func func(ctx context.Context) (result any, err error)
+
+// Job is a snapshot of the state of a submitted job.
+type Job struct {
+	ID uuid.UUID
+	// the key the job was submitted with, e.g. the ID of a device
+	Key    string
+	Status Status
+	// only set when the job succeeded
+	Result any
+	// only set when the job failed
+	Error      string
+	CreatedAt  time.Time
+	FinishedAt time.Time
+}
+
+type Options struct {
+	// number of jobs processed concurrently
+	Workers int
+	// number of jobs waiting per worker, before Submit fails with ErrQueueFull
+	QueueSize int
+	// how long finished jobs can be retrieved
+	Retention time.Duration
+}
+
+type queuedJob struct {
+	ctx context.Context
+	id  uuid.UUID
+	run Func
+}
+
+// Queue runs jobs on a fixed pool of workers.
+// Jobs submitted with the same key are always run by the same worker, in
+// the order they were submitted, e.g. so that the signatures of a device
+// get their counters in submission order.
+type Queue struct {
+	options Options
+	now     func() time.Time
+	workers []chan queuedJob
+	wg      sync.WaitGroup
+
+	mutex     sync.Mutex
+	closed    bool
+	jobs      map[uuid.UUID]*Job
+	lastSweep time.Time
+}
+
+func NewQueue(options Options) *Queue {
+	if options.Workers < 1 {
+		options.Workers = 1
+	}
+	// an unbuffered channel would reject jobs while all workers are busy
+	if options.QueueSize < 1 {
+		options.QueueSize = 1
+	}
+
+	q := &Queue{
+		options: options,
+		now:     time.Now,
+		workers: make([]chan queuedJob, options.Workers),
+		jobs:    map[uuid.UUID]*Job{},
+	}
+	for i := range q.workers {
+		q.workers[i] = make(chan queuedJob, options.QueueSize)
+		q.wg.Add(1)
+		go q.work(q.workers[i])
+	}
+	return q
+}
+
+func (q *Queue) work(queued <-chan queuedJob) {
+	defer q.wg.Done()
+	for job := range queued {
+		result, err := runSafely(job)
+
+		q.mutex.Lock()
+		j := q.jobs[job.id]
+		j.FinishedAt = q.now()
+		if err != nil {
+			j.Status = StatusFailed
+			j.Error = err.Error()
+		} else {
+			j.Status = StatusSucceeded
+			j.Result = result
+		}
+		q.mutex.Unlock()
+	}
+}
+
+// ErrPanicked is the error of jobs that panicked. The panic does not stop
+// the worker, so that later jobs are still processed.
+var ErrPanicked = errors.New("job failed unexpectedly")
+
+func runSafely(job queuedJob) (result any, err error) {
+	defer func() {
+		if recover() != nil {
+			result, err = nil, ErrPanicked
+		}
+	}()
+	return job.run(job.ctx)
+}
+
+func (q *Queue) worker(key string) chan queuedJob {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return q.workers[hash.Sum32()%uint32(len(q.workers))]
+}
+
+// Submit queues run behind all jobs previously submitted with the same key.
+// ctx is passed to run; it should not be canceled when the submitting
+// request ends, see context.WithoutCancel.
+func (q *Queue) Submit(ctx context.Context, key string, run Func) (Job, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.closed {
+		return Job{}, ErrQueueClosed
+	}
+	q.sweep()
+
+	job := &Job{
+		ID:        uuid.New(),
+		Key:       key,
+		Status:    StatusPending,
+		CreatedAt: q.now(),
+	}
+	select {
+	case q.worker(key) <- queuedJob{ctx: ctx, id: job.ID, run: run}:
+	default:
+		return Job{}, ErrQueueFull
+	}
+	q.jobs[job.ID] = job
+
+	return *job, nil
+}
+
+// Get returns the current state of the job.
+func (q *Queue) Get(id uuid.UUID) (Job, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	job, ok := q.jobs[id]
+	if !ok || q.expired(job) {
+		return Job{}, false
+	}
+	return *job, true
+}
+
+func (q *Queue) expired(job *Job) bool {
+	return job.Status != StatusPending && q.now().Sub(job.FinishedAt) > q.options.Retention
+}
+
+// sweep drops expired jobs, at most once per retention period.
+// The caller must hold the mutex.
+func (q *Queue) sweep() {
+	now := q.now()
+	if now.Sub(q.lastSweep) < q.options.Retention {
+		return
+	}
+	q.lastSweep = now
+
+	for id, job := range q.jobs {
+		if q.expired(job) {
+			delete(q.jobs, id)
+		}
+	}
+}
+
+// Close rejects new jobs and waits until all queued jobs are finished,
+// or until ctx expires.
+func (q *Queue) Close(ctx context.Context) error {
+	q.mutex.Lock()
+	if !q.closed {
+		q.closed = true
+		for _, worker := range q.workers {
+			close(worker)
+		}
+	}
+	q.mutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,196 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func waitForJob(t *testing.T, q *Queue, job Job) Job {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		current, ok := q.Get(job.ID)
+		if !ok {
+			t.Fatalf("job %s not found", job.ID)
+		}
+		if current.Status != StatusPending {
+			return current
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("job %s did not finish", job.ID)
+	return Job{}
+}
+
+func TestQueue(t *testing.T) {
+	t.Run("runs jobs of the same key in submission order", func(t *testing.T) {
+		q := NewQueue(Options{Workers: 4, QueueSize: 100, Retention: time.Hour})
+		defer q.Close(context.Background())
+
+		var mutex sync.Mutex
+		order := map[string][]int{}
+		for i := 0; i < 50; i++ {
+			for _, key := range []string{"device-1", "device-2", "device-3"} {
+				i, key := i, key
+				_, err := q.Submit(context.Background(), key, func(context.Context) (any, error) {
+					mutex.Lock()
+					defer mutex.Unlock()
+					order[key] = append(order[key], i)
+					return nil, nil
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		if err := q.Close(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		for key, got := range order {
+			if len(got) != 50 {
+				t.Fatalf("expected 50 jobs of %s, got: %d", key, len(got))
+			}
+			for i, value := range got {
+				if value != i {
+					t.Fatalf("expected jobs of %s in submission order, got: %v", key, got)
+				}
+			}
+		}
+	})
+
+	t.Run("records the result or error of jobs", func(t *testing.T) {
+		q := NewQueue(Options{Workers: 1, QueueSize: 10, Retention: time.Hour})
+		defer q.Close(context.Background())
+
+		succeeded, err := q.Submit(context.Background(), "key", func(context.Context) (any, error) {
+			return "result", nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		failed, err := q.Submit(context.Background(), "key", func(context.Context) (any, error) {
+			return nil, errors.New("signature device not found")
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		panicked, err := q.Submit(context.Background(), "key", func(context.Context) (any, error) {
+			panic("unexpected")
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if succeeded.Status != StatusPending {
+			t.Errorf("expected submitted job to be pending, got: %s", succeeded.Status)
+		}
+		if succeeded.Key != "key" {
+			t.Errorf("expected the key of the job, got: %s", succeeded.Key)
+		}
+		if job := waitForJob(t, q, succeeded); job.Status != StatusSucceeded || job.Result != "result" {
+			t.Errorf("expected succeeded job with result, got: %+v", job)
+		}
+		if job := waitForJob(t, q, failed); job.Status != StatusFailed || job.Error != "signature device not found" {
+			t.Errorf("expected failed job with error, got: %+v", job)
+		}
+		if job := waitForJob(t, q, panicked); job.Status != StatusFailed || job.Error != ErrPanicked.Error() {
+			t.Errorf("expected failed job after panic, got: %+v", job)
+		}
+	})
+
+	t.Run("rejects jobs when the queue is full", func(t *testing.T) {
+		q := NewQueue(Options{Workers: 1, QueueSize: 1, Retention: time.Hour})
+		release := make(chan struct{})
+		blocking := func(context.Context) (any, error) {
+			<-release
+			return nil, nil
+		}
+
+		// one running, one waiting
+		var err error
+		for i := 0; i < 3 && err == nil; i++ {
+			_, err = q.Submit(context.Background(), "key", blocking)
+			// give the worker time to pick up the first job
+			time.Sleep(10 * time.Millisecond)
+		}
+		if !errors.Is(err, ErrQueueFull) {
+			t.Errorf("expected ErrQueueFull, got: %v", err)
+		}
+
+		close(release)
+		if err := q.Close(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("finishes queued jobs on close and rejects new ones", func(t *testing.T) {
+		q := NewQueue(Options{Workers: 2, QueueSize: 100, Retention: time.Hour})
+
+		submitted := []Job{}
+		for i := 0; i < 20; i++ {
+			job, err := q.Submit(context.Background(), fmt.Sprint(i), func(context.Context) (any, error) {
+				time.Sleep(time.Millisecond)
+				return nil, nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			submitted = append(submitted, job)
+		}
+
+		if err := q.Close(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		for _, job := range submitted {
+			if current, _ := q.Get(job.ID); current.Status != StatusSucceeded {
+				t.Errorf("expected job to be finished on close, got: %s", current.Status)
+			}
+		}
+
+		if _, err := q.Submit(context.Background(), "key", nil); !errors.Is(err, ErrQueueClosed) {
+			t.Errorf("expected ErrQueueClosed, got: %v", err)
+		}
+	})
+
+	t.Run("forgets finished jobs after the retention", func(t *testing.T) {
+		q := NewQueue(Options{Workers: 1, QueueSize: 10, Retention: time.Minute})
+		defer q.Close(context.Background())
+		now := time.Now()
+		var mutex sync.Mutex
+		q.now = func() time.Time {
+			mutex.Lock()
+			defer mutex.Unlock()
+			return now
+		}
+
+		job, err := q.Submit(context.Background(), "key", func(context.Context) (any, error) {
+			return nil, nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		waitForJob(t, q, job)
+
+		mutex.Lock()
+		now = now.Add(2 * time.Minute)
+		mutex.Unlock()
+
+		if _, ok := q.Get(job.ID); ok {
+			t.Error("expected job to be expired")
+		}
+		// the next submission sweeps expired jobs
+		q.Submit(context.Background(), "key", func(context.Context) (any, error) { return nil, nil })
+		q.mutex.Lock()
+		_, kept := q.jobs[job.ID]
+		q.mutex.Unlock()
+		if kept {
+			t.Error("expected expired job to be dropped")
+		}
+	})
+}
@@ -0,0 +1,82 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// Attributes with these keys are never written, no matter at which level
+// or in which group they are logged.
+var sensitiveKeys = map[string]bool{
+	"private_key":       true,
+	"data_to_be_signed": true,
+	"signed_data":       true,
+	"authorization":     true,
+	"password":          true,
+}
+
+const redacted = "REDACTED"
+
+func redactSensitive(groups []string, attr slog.Attr) slog.Attr {
+	if sensitiveKeys[strings.ToLower(attr.Key)] {
+		return slog.String(attr.Key, redacted)
+	}
+	return attr
+}
+
+// ParseLevel converts one of debug, info, warn or error into a slog.Level.
+func ParseLevel(level string) (slog.Level, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return l, fmt.Errorf("invalid log level %q: %w", level, err)
+	}
+	return l, nil
+}
+
+// New creates a logger writing JSON lines to w.
+func New(w io.Writer, level slog.Level) *slog.Logger {
+	return slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{
+		Level:       level,
+		ReplaceAttr: redactSensitive,
+	}))
+}
+
+// Discard returns a logger that drops everything.
+func Discard() *slog.Logger {
+	return slog.New(slog.NewJSONHandler(io.Discard, &slog.HandlerOptions{Level: slog.LevelError + 1}))
+}
+
+type contextKey int
+
+const (
+	loggerKey contextKey = iota
+	requestIDKey
+)
+
+// NewContext returns a context carrying the logger.
+func NewContext(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey, logger)
+}
+
+// FromContext returns the logger of the context, or a logger that
+// drops everything when the context does not carry one.
+func FromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey).(*slog.Logger); ok {
+		return logger
+	}
+	return Discard()
+}
+
+// WithRequestID returns a context carrying the ID of the request being served.
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDKey, requestID)
+}
+
+// RequestID returns the ID of the request being served, or "".
+func RequestID(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDKey).(string)
+	return requestID
+}
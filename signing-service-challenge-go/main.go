@@ -1,28 +1,384 @@
 package main
 
 import (
-	"log"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/fiskaly/coding-challenges/signing-service-challenge/api"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/backup"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/ca"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/config"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/crypto"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/events"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/jobs"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/logging"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/metrics"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/outbox"
 	"github.com/fiskaly/coding-challenges/signing-service-challenge/persistence"
-)
-
-const (
-	ListenAddress = ":8080"
-	// TODO: add further configuration parameters here ...
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/ratelimit"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/tracing"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/version"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/webhooks"
+	"github.com/google/uuid"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 )
 
 func main() {
+	cfg, options, err := config.Load(os.Args[1:], os.LookupEnv, os.Stderr)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	// the level has already been validated
+	logLevel, _ := logging.ParseLevel(cfg.LogLevel)
+	logger := logging.New(os.Stderr, logLevel)
+	slog.SetDefault(logger)
+
+	if options.PrintConfig {
+		out, err := cfg.Redacted().Marshal()
+		if err != nil {
+			fatal(logger, "could not print config", err)
+		}
+		os.Stdout.Write(out)
+		return
+	}
+
+	repositoryProvider, err := newRepositoryProvider(cfg.Storage)
+	if err != nil {
+		fatal(logger, "could not open storage", err)
+	}
+
+	// validated by config.Validate
+	backupKey, _ := base64.StdEncoding.DecodeString(cfg.Backup.Key)
+	if options.BackupFile != "" || options.RestoreFile != "" {
+		if err := backupOrRestore(repositoryProvider, backupKey, options, logger); err != nil {
+			fatal(logger, "could not back up or restore storage", err)
+		}
+		if closer, ok := repositoryProvider.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				fatal(logger, "could not close storage", err)
+			}
+		}
+		return
+	}
+
+	tracerProvider, err := installTracing(context.Background(), cfg.Tracing)
+	if err != nil {
+		fatal(logger, "could not set up tracing", err)
+	}
+
+	serviceMetrics := metrics.New()
+	unregisterMetrics := domain.RegisterObserver(serviceMetrics)
+	defer unregisterMetrics()
+
+	serverOptions := []api.ServerOption{
+		api.WithLogger(logger),
+		api.WithMetrics(serviceMetrics),
+		api.WithTimeouts(
+			time.Duration(cfg.Timeouts.Read),
+			time.Duration(cfg.Timeouts.Write),
+			time.Duration(cfg.Timeouts.Idle),
+		),
+		api.WithRateLimits(
+			ratelimit.NewLimiter(ratelimit.SystemClock, rateLimits(cfg.RateLimits.Clients)),
+			ratelimit.NewLimiter(ratelimit.SystemClock, deviceRateLimits(cfg.RateLimits.Devices)),
+		),
+		api.WithAdminToken(cfg.Admin.Token),
+	}
+	if len(backupKey) > 0 {
+		serverOptions = append(serverOptions, api.WithBackups(backupKey))
+	}
+	// validated by config.Validate
+	if transferKey, _ := base64.StdEncoding.DecodeString(cfg.Transfer.Key); len(transferKey) > 0 {
+		serverOptions = append(serverOptions, api.WithTransfers(transferKey))
+	}
+	if cfg.TLS.Enabled() {
+		serverOptions = append(serverOptions, api.WithTLS(api.TLSOptions{
+			CertFile:             cfg.TLS.CertFile,
+			KeyFile:              cfg.TLS.KeyFile,
+			ClientCAFile:         cfg.TLS.ClientCAFile,
+			ClientAuth:           clientAuthTypes[cfg.TLS.ClientAuth],
+			ReloadInterval:       time.Duration(cfg.TLS.ReloadInterval),
+			ClientDeviceBindings: cfg.TLS.ClientDeviceBindings,
+		}))
+	}
+
+	jobQueue := jobs.NewQueue(jobs.Options{
+		Workers:   cfg.Jobs.Workers,
+		QueueSize: cfg.Jobs.QueueSize,
+		Retention: time.Duration(cfg.Jobs.Retention),
+	})
+
+	eventBus := events.NewBus(events.Options{History: cfg.Events.History})
+	// webhooks and their unfinished deliveries are kept in the storage
+	webhookDispatcher, err := webhooks.NewDispatcher(repositoryProvider, &http.Client{}, webhooks.Options{
+		MaxAttempts:    cfg.Webhooks.MaxAttempts,
+		InitialBackoff: time.Duration(cfg.Webhooks.InitialBackoff),
+		MaxBackoff:     time.Duration(cfg.Webhooks.MaxBackoff),
+		Timeout:        time.Duration(cfg.Webhooks.Timeout),
+		LogSize:        cfg.Webhooks.LogSize,
+		QueueSize:      cfg.Webhooks.QueueSize,
+	})
+	if err != nil {
+		fatal(logger, "could not start webhook deliveries", err)
+	}
+	// events are stored in the outbox by the transactions changing devices,
+	// and published from there, also the ones left by a previous process
+	outboxDispatcher := outbox.NewDispatcher(
+		repositoryProvider,
+		[]domain.EventPublisher{eventBus, webhookDispatcher},
+		outbox.Options{
+			PollInterval: time.Duration(cfg.Outbox.PollInterval),
+			BatchSize:    cfg.Outbox.BatchSize,
+		},
+		logger,
+	)
+	serverOptions = append(serverOptions, api.WithWebhooks(webhookDispatcher))
+
+	var certificateIssuer *ca.Issuer
+	if cfg.CA.Dir != "" {
+		authority, err := ca.Open(cfg.CA.Dir, ca.Options{
+			CertificateValidity: time.Duration(cfg.CA.CertificateValidity),
+		})
+		if err != nil {
+			fatal(logger, "could not open the certificate authority", err)
+		}
+		certificateIssuer = ca.NewIssuer(authority, repositoryProvider, eventBus, logger)
+		serverOptions = append(serverOptions, api.WithCertificateAuthority(authority))
+	}
+
 	server := api.NewServer(
-		ListenAddress,
+		cfg.ListenAddress,
 		api.NewSignatureService(
-			persistence.NewInMemorySignatureDeviceRepositoryProvider(
-				persistence.NewInMemorySignatureDeviceRepository(),
-			),
+			outboxDispatcher.Provider(),
+			api.WithAllowedAlgorithms(cfg.Algorithms...),
+			api.WithKeyPolicy(crypto.KeyPolicy{
+				MinRSABits: cfg.KeyPolicy.MinRSABits,
+				ECCCurves:  cfg.KeyPolicy.ECCCurves,
+			}),
+			api.WithJobs(jobQueue),
+			api.WithEvents(eventBus),
 		),
+		serverOptions...,
+	)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	serverErrors := make(chan error, 1)
+	go func() {
+		serverErrors <- server.Run()
+	}()
+
+	logger.Info(
+		"server started",
+		slog.String("version", version.Version),
+		slog.String("revision", version.Revision()),
+		slog.String("listen_address", cfg.ListenAddress),
+		slog.Bool("tls", cfg.TLS.Enabled()),
+		slog.String("storage_backend", cfg.Storage.Backend),
+		slog.String("tracing_exporter", cfg.Tracing.Exporter),
 	)
 
-	if err := server.Run(); err != nil {
-		log.Fatal("Could not start server on ", ListenAddress)
+	select {
+	case err := <-serverErrors:
+		fatal(logger, "could not start server", err)
+	case <-ctx.Done():
+	}
+	// a second signal terminates immediately
+	stop()
+	logger.Info("shutting down")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.Timeouts.Shutdown))
+	defer cancel()
+
+	// events not published yet stay in the outbox for the next process
+	if err := outboxDispatcher.Close(shutdownCtx); err != nil {
+		logger.Warn("could not stop publishing the outbox", slog.String("error", err.Error()))
+	}
+	// end the event streams, which would keep the shutdown waiting
+	eventBus.Close()
+
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		logger.Warn("could not finish in-flight requests", slog.String("error", err.Error()))
+	}
+
+	// no new jobs can be submitted once the server is shut down
+	if err := jobQueue.Close(shutdownCtx); err != nil {
+		logger.Warn("could not finish pending jobs", slog.String("error", err.Error()))
+	}
+
+	// unfinished deliveries stay in the storage for the next process
+	if err := webhookDispatcher.Close(shutdownCtx); err != nil {
+		logger.Warn("could not stop webhook deliveries", slog.String("error", err.Error()))
+	}
+
+	// certificates of devices missed meanwhile are issued on demand
+	if certificateIssuer != nil {
+		if err := certificateIssuer.Close(shutdownCtx); err != nil {
+			logger.Warn("could not stop issuing certificates", slog.String("error", err.Error()))
+		}
+	}
+
+	// waits for transactions of requests that outlived the shutdown timeout
+	if closer, ok := repositoryProvider.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			fatal(logger, "could not close storage", err)
+		}
+	}
+	if tracerProvider != nil {
+		// flushes the spans of the last requests
+		if err := tracerProvider.Shutdown(shutdownCtx); err != nil {
+			logger.Warn("could not export remaining spans", slog.String("error", err.Error()))
+		}
+	}
+	logger.Info("shut down")
+}
+
+// backupOrRestore writes the backup file or restores the one given by the
+// options. The server must not run on the same storage at the same time,
+// unless the backend is shared by several processes, like postgres.
+func backupOrRestore(
+	repositoryProvider domain.SignatureDeviceRepositoryProvider,
+	key []byte,
+	options config.Options,
+	logger *slog.Logger,
+) error {
+	if len(key) == 0 {
+		return errors.New("backup.key is required")
+	}
+
+	if options.BackupFile != "" {
+		archive, err := backup.Create(repositoryProvider, key)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(options.BackupFile, archive, 0o600); err != nil {
+			return err
+		}
+		logger.Info("backup written", slog.String("file", options.BackupFile))
+	}
+
+	if options.RestoreFile != "" {
+		archive, err := os.ReadFile(options.RestoreFile)
+		if err != nil {
+			return err
+		}
+		result, err := backup.Restore(repositoryProvider, archive, key)
+		var rollbackError backup.RollbackError
+		if errors.As(err, &rollbackError) {
+			for _, rollback := range rollbackError.Rollbacks {
+				logger.Error(
+					"backup is behind the storage",
+					slog.String("device_id", rollback.DeviceID.String()),
+					slog.Uint64("storage_counter", uint64(rollback.StoreCounter)),
+					slog.Uint64("backup_counter", uint64(rollback.BackupCounter)),
+				)
+			}
+		}
+		if err != nil {
+			return err
+		}
+		logger.Info(
+			"backup restored",
+			slog.String("file", options.RestoreFile),
+			slog.Int("restored", result.Restored),
+			slog.Int("unchanged", result.Unchanged),
+		)
+	}
+	return nil
+}
+
+// fatal logs the error and exits, like log.Fatal.
+func fatal(logger *slog.Logger, message string, err error) {
+	logger.Error(message, slog.String("error", err.Error()))
+	os.Exit(1)
+}
+
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	config.ClientAuthNone:          tls.NoClientCert,
+	config.ClientAuthVerifyIfGiven: tls.VerifyClientCertIfGiven,
+	config.ClientAuthRequire:       tls.RequireAndVerifyClientCert,
+}
+
+func rateLimits(c config.RateLimitConfig) ratelimit.Limits {
+	limits := ratelimit.Limits{
+		Default:   ratelimit.Limit(c.Default),
+		Overrides: map[string]ratelimit.Limit{},
+	}
+	for key, limit := range c.Overrides {
+		limits.Overrides[key] = ratelimit.Limit(limit)
+	}
+	return limits
+}
+
+// deviceRateLimits normalizes the device IDs of the overrides,
+// as the server does for the IDs in request URLs.
+func deviceRateLimits(c config.RateLimitConfig) ratelimit.Limits {
+	limits := rateLimits(c)
+	overrides := map[string]ratelimit.Limit{}
+	for deviceID, limit := range limits.Overrides {
+		// validated by config.Validate
+		overrides[uuid.MustParse(deviceID).String()] = limit
+	}
+	limits.Overrides = overrides
+	return limits
+}
+
+// installTracing installs the configured span exporter.
+// It returns a nil TracerProvider when spans are not exported.
+func installTracing(ctx context.Context, tracingConfig config.TracingConfig) (*sdktrace.TracerProvider, error) {
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch tracingConfig.Exporter {
+	case config.TracingExporterNone:
+		// still continue the traces of clients in the logs
+		tracing.InstallPropagator()
+		return nil, nil
+	case config.TracingExporterStdout:
+		exporter, err = tracing.NewStdoutExporter(os.Stdout)
+	case config.TracingExporterOTLP:
+		exporter, err = tracing.NewOTLPExporter(ctx, tracingConfig.Endpoint)
+	default:
+		return nil, fmt.Errorf("unsupported tracing exporter: %s", tracingConfig.Exporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return tracing.Install(exporter), nil
+}
+
+func newRepositoryProvider(storage config.StorageConfig) (domain.SignatureDeviceRepositoryProvider, error) {
+	switch storage.Backend {
+	case config.StorageBackendMemory:
+		return persistence.NewInMemorySignatureDeviceRepositoryProvider(
+			persistence.NewInMemorySignatureDeviceRepository(),
+		), nil
+	case config.StorageBackendFile:
+		// validated by the config
+		key, _ := base64.StdEncoding.DecodeString(storage.Key)
+		return persistence.NewFileSignatureDeviceRepositoryProvider(storage.DSN, storage.SnapshotInterval, key)
+	case config.StorageBackendBolt:
+		return persistence.NewBoltSignatureDeviceRepositoryProvider(storage.DSN)
+	case config.StorageBackendPostgres:
+		return persistence.NewPostgresSignatureDeviceRepositoryProvider(context.Background(), storage.DSN)
+	default:
+		return nil, fmt.Errorf("unsupported storage backend: %s", storage.Backend)
 	}
 }
@@ -0,0 +1,137 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "signing_service"
+
+// DefaultBuckets are suited to latencies in seconds, from 1ms to 10s.
+var DefaultBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Metrics are the metrics exposed by the signing service.
+// It implements domain.Observer to be notified about domain operations.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	httpRequests          *prometheus.CounterVec
+	httpRequestDuration   *prometheus.HistogramVec
+	signatures            *prometheus.CounterVec
+	signingDuration       *prometheus.HistogramVec
+	keyGenerationDuration *prometheus.HistogramVec
+	writeTxLockWait       prometheus.Histogram
+}
+
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		httpRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "http_requests_total",
+			Help:      "Number of HTTP requests by route, method and status code.",
+		}, []string{"route", "method", "status"}),
+		httpRequestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "Latency of HTTP requests by route, method and status code.",
+			Buckets:   DefaultBuckets,
+		}, []string{"route", "method", "status"}),
+		signatures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "signatures_total",
+			Help:      "Number of signatures created by algorithm.",
+		}, []string{"algorithm"}),
+		signingDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "signing_duration_seconds",
+			Help:      "Latency of creating a signature by algorithm.",
+			Buckets:   DefaultBuckets,
+		}, []string{"algorithm"}),
+		keyGenerationDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "key_generation_duration_seconds",
+			Help:      "Latency of generating a key pair by algorithm.",
+			Buckets:   DefaultBuckets,
+		}, []string{"algorithm"}),
+		writeTxLockWait: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "write_tx_lock_wait_seconds",
+			Help:      "Time spent waiting for the lock of a write transaction.",
+			Buckets:   DefaultBuckets,
+		}),
+	}
+	m.registry.MustRegister(
+		m.httpRequests,
+		m.httpRequestDuration,
+		m.signatures,
+		m.signingDuration,
+		m.keyGenerationDuration,
+		m.writeTxLockWait,
+	)
+	return m
+}
+
+// deviceCount collects the number of signature devices by algorithm on
+// every scrape.
+type deviceCount struct {
+	desc  *prometheus.Desc
+	count func() (map[string]int, error)
+}
+
+func (c deviceCount) Describe(descs chan<- *prometheus.Desc) {
+	descs <- c.desc
+}
+
+func (c deviceCount) Collect(metrics chan<- prometheus.Metric) {
+	counts, err := c.count()
+	if err != nil {
+		// fails the scrape, instead of reporting no devices
+		metrics <- prometheus.NewInvalidMetric(c.desc, err)
+		return
+	}
+	for algorithm, count := range counts {
+		metrics <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(count), algorithm)
+	}
+}
+
+// RegisterDeviceCount reports the number of signature devices by algorithm,
+// as returned by count on every scrape.
+func (m *Metrics) RegisterDeviceCount(count func() (map[string]int, error)) {
+	m.registry.MustRegister(deviceCount{
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "signature_devices"),
+			"Number of signature devices by algorithm.",
+			[]string{"algorithm"},
+			nil,
+		),
+		count: count,
+	})
+}
+
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+func (m *Metrics) ObserveHTTPRequest(route, method string, status int, duration time.Duration) {
+	statusCode := strconv.Itoa(status)
+	m.httpRequests.WithLabelValues(route, method, statusCode).Inc()
+	m.httpRequestDuration.WithLabelValues(route, method, statusCode).Observe(duration.Seconds())
+}
+
+func (m *Metrics) KeyPairGenerated(algorithmName string, duration time.Duration) {
+	m.keyGenerationDuration.WithLabelValues(algorithmName).Observe(duration.Seconds())
+}
+
+func (m *Metrics) SignatureCreated(algorithmName string, duration time.Duration) {
+	m.signatures.WithLabelValues(algorithmName).Inc()
+	m.signingDuration.WithLabelValues(algorithmName).Observe(duration.Seconds())
+}
+
+func (m *Metrics) WriteTxLockAcquired(wait time.Duration) {
+	m.writeTxLockWait.Observe(wait.Seconds())
+}
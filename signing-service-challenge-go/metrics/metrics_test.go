@@ -0,0 +1,47 @@
+package metrics
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRegisterDeviceCount(t *testing.T) {
+	scrape := func(t *testing.T, m *Metrics) *httptest.ResponseRecorder {
+		t.Helper()
+		recorder := httptest.NewRecorder()
+		m.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		return recorder
+	}
+
+	t.Run("reports the number of devices by algorithm", func(t *testing.T) {
+		m := New()
+		m.RegisterDeviceCount(func() (map[string]int, error) {
+			return map[string]int{"RSA": 2, "ECC": 1}, nil
+		})
+
+		body := scrape(t, m).Body.String()
+		for _, line := range []string{
+			`signing_service_signature_devices{algorithm="ECC"} 1`,
+			`signing_service_signature_devices{algorithm="RSA"} 2`,
+		} {
+			if !strings.Contains(body, line+"\n") {
+				t.Errorf("expected metrics to contain:\n%s\ngot:\n%s", line, body)
+			}
+		}
+	})
+
+	t.Run("responds with an error when the devices cannot be counted", func(t *testing.T) {
+		m := New()
+		m.RegisterDeviceCount(func() (map[string]int, error) {
+			return nil, errors.New("storage unavailable")
+		})
+
+		recorder := scrape(t, m)
+		if recorder.Code != http.StatusInternalServerError {
+			t.Errorf("expected status code: %d, got: %d", http.StatusInternalServerError, recorder.Code)
+		}
+	})
+}
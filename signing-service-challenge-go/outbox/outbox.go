@@ -0,0 +1,184 @@
+package outbox
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
+	"github.com/google/uuid"
+)
+
+type Options struct {
+	// how often the outbox is checked without being notified, e.g. for
+	// events left behind by a previous process
+	PollInterval time.Duration
+	// number of events published per transaction removing them
+	BatchSize int
+}
+
+// Dispatcher publishes the events in the outbox of a repository to every
+// publisher, in the order they were added, and removes them once all
+// publishers accepted them.
+// Events are published at least once: when the process stops before they
+// are removed, the events are published again by the next process, with
+// the same IDs. With a storage shared by several processes, each event is
+// published by the dispatcher of the process that listed it first.
+type Dispatcher struct {
+	provider   domain.SignatureDeviceRepositoryProvider
+	publishers []domain.EventPublisher
+	options    Options
+	logger     *slog.Logger
+
+	wake   chan struct{}
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewDispatcher starts publishing the outbox of the provider until Close
+// is called. Write transactions must be made through Provider, so that
+// their events are published without waiting for the next poll.
+func NewDispatcher(
+	provider domain.SignatureDeviceRepositoryProvider,
+	publishers []domain.EventPublisher,
+	options Options,
+	logger *slog.Logger,
+) *Dispatcher {
+	if options.BatchSize < 1 {
+		options.BatchSize = 1
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &Dispatcher{
+		provider:   provider,
+		publishers: publishers,
+		options:    options,
+		logger:     logger,
+		wake:       make(chan struct{}, 1),
+		ctx:        ctx,
+		cancel:     cancel,
+		done:       make(chan struct{}),
+	}
+	go d.run()
+	return d
+}
+
+func (d *Dispatcher) run() {
+	defer close(d.done)
+
+	ticker := time.NewTicker(d.options.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		// the outbox may contain events of a previous process
+		if err := d.drain(); err != nil {
+			d.logger.Warn("could not publish events of the outbox", slog.String("error", err.Error()))
+		}
+
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-d.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// drain publishes batches of events, and removes the published ones,
+// until the outbox is empty.
+func (d *Dispatcher) drain() error {
+	for d.ctx.Err() == nil {
+		var events []domain.Event
+		// a write transaction, so that storages shared by several
+		// processes hand every event to one of them
+		err := d.provider.WriteTx(func(repository domain.SignatureDeviceRepository) error {
+			var err error
+			events, err = repository.ListOutbox(d.options.BatchSize)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if len(events) == 0 {
+			return nil
+		}
+
+		publishedIDs := []uuid.UUID{}
+		var publishErr error
+		for _, event := range events {
+			if publishErr = d.publish(event); publishErr != nil {
+				break
+			}
+			publishedIDs = append(publishedIDs, event.ID)
+		}
+
+		if len(publishedIDs) > 0 {
+			err = d.provider.WriteTx(func(repository domain.SignatureDeviceRepository) error {
+				return repository.RemoveFromOutbox(publishedIDs)
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if publishErr != nil {
+			return publishErr
+		}
+	}
+	return nil
+}
+
+// publish hands the event to every publisher. When one of them rejects it,
+// the event is published to all of them again later.
+func (d *Dispatcher) publish(event domain.Event) error {
+	for _, publisher := range d.publishers {
+		if err := publisher.Publish(event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Notify makes the dispatcher check the outbox now. It never blocks.
+func (d *Dispatcher) Notify() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+		// a check is pending already
+	}
+}
+
+// Provider returns the provider of the dispatcher, which notifies the
+// dispatcher after every committed write transaction.
+func (d *Dispatcher) Provider() domain.SignatureDeviceRepositoryProvider {
+	return notifyingProvider{d}
+}
+
+type notifyingProvider struct {
+	dispatcher *Dispatcher
+}
+
+func (p notifyingProvider) WriteTx(do func(domain.SignatureDeviceRepository) error) error {
+	err := p.dispatcher.provider.WriteTx(do)
+	if err == nil {
+		p.dispatcher.Notify()
+	}
+	return err
+}
+
+func (p notifyingProvider) ReadTx(do func(domain.SignatureDeviceRepository) error) error {
+	return p.dispatcher.provider.ReadTx(do)
+}
+
+// Close stops publishing, and waits until the current batch is published
+// or ctx expires. The remaining events stay in the outbox.
+func (d *Dispatcher) Close(ctx context.Context) error {
+	d.cancel()
+
+	select {
+	case <-d.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,180 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/logging"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/persistence"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/uuid"
+)
+
+type recordingPublisher chan domain.Event
+
+func (p recordingPublisher) Publish(event domain.Event) error {
+	p <- event
+	return nil
+}
+
+func (p recordingPublisher) receive(t *testing.T, count int) []uuid.UUID {
+	t.Helper()
+
+	ids := []uuid.UUID{}
+	for len(ids) < count {
+		select {
+		case event := <-p:
+			ids = append(ids, event.ID)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected %d events, got: %v", count, ids)
+		}
+	}
+	return ids
+}
+
+// failingProvider fails the next write transactions removing events from
+// the outbox.
+type failingProvider struct {
+	domain.SignatureDeviceRepositoryProvider
+	failures chan struct{}
+}
+
+func (p failingProvider) WriteTx(do func(domain.SignatureDeviceRepository) error) error {
+	return p.SignatureDeviceRepositoryProvider.WriteTx(func(repository domain.SignatureDeviceRepository) error {
+		return do(failingRepository{repository, p.failures})
+	})
+}
+
+type failingRepository struct {
+	domain.SignatureDeviceRepository
+	failures chan struct{}
+}
+
+func (r failingRepository) RemoveFromOutbox(eventIDs []uuid.UUID) error {
+	select {
+	case <-r.failures:
+		return errors.New("storage unavailable")
+	default:
+		return r.SignatureDeviceRepository.RemoveFromOutbox(eventIDs)
+	}
+}
+
+func addEvents(t *testing.T, provider domain.SignatureDeviceRepositoryProvider, count int) []uuid.UUID {
+	t.Helper()
+
+	ids := []uuid.UUID{}
+	err := provider.WriteTx(func(repository domain.SignatureDeviceRepository) error {
+		for i := 0; i < count; i++ {
+			event := domain.Event{ID: uuid.New(), Type: domain.EventSignatureCreated}
+			if err := repository.AddToOutbox(event); err != nil {
+				return err
+			}
+			ids = append(ids, event.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ids
+}
+
+func outboxSize(t *testing.T, provider domain.SignatureDeviceRepositoryProvider) int {
+	t.Helper()
+
+	var events []domain.Event
+	err := provider.ReadTx(func(repository domain.SignatureDeviceRepository) error {
+		var err error
+		events, err = repository.ListOutbox(100)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(events)
+}
+
+// closedPublisher rejects all events.
+type closedPublisher struct{}
+
+func (closedPublisher) Publish(domain.Event) error {
+	return errors.New("publisher is closed")
+}
+
+func newTestDispatcher(t *testing.T, provider domain.SignatureDeviceRepositoryProvider, publisher domain.EventPublisher, pollInterval time.Duration) *Dispatcher {
+	t.Helper()
+
+	dispatcher := NewDispatcher(provider, []domain.EventPublisher{publisher}, Options{PollInterval: pollInterval, BatchSize: 2}, logging.Discard())
+	t.Cleanup(func() { dispatcher.Close(context.Background()) })
+	return dispatcher
+}
+
+func TestDispatcher(t *testing.T) {
+	t.Run("publishes the events left in the outbox in order", func(t *testing.T) {
+		provider := persistence.NewInMemorySignatureDeviceRepositoryProvider(persistence.NewInMemorySignatureDeviceRepository())
+		expected := addEvents(t, provider, 5)
+		publisher := make(recordingPublisher, 10)
+
+		dispatcher := newTestDispatcher(t, provider, publisher, time.Hour)
+
+		if diff := cmp.Diff(publisher.receive(t, 5), expected); diff != "" {
+			t.Errorf("unexpected diff: %s", diff)
+		}
+		if err := dispatcher.Close(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if size := outboxSize(t, provider); size != 0 {
+			t.Errorf("expected the outbox to be empty, got %d events", size)
+		}
+	})
+
+	t.Run("publishes the events of write transactions of the provider without polling", func(t *testing.T) {
+		provider := persistence.NewInMemorySignatureDeviceRepositoryProvider(persistence.NewInMemorySignatureDeviceRepository())
+		publisher := make(recordingPublisher, 10)
+
+		dispatcher := newTestDispatcher(t, provider, publisher, time.Hour)
+		expected := addEvents(t, dispatcher.Provider(), 3)
+
+		if diff := cmp.Diff(publisher.receive(t, 3), expected); diff != "" {
+			t.Errorf("unexpected diff: %s", diff)
+		}
+	})
+
+	t.Run("publishes events again when they could not be removed", func(t *testing.T) {
+		provider := persistence.NewInMemorySignatureDeviceRepositoryProvider(persistence.NewInMemorySignatureDeviceRepository())
+		expected := addEvents(t, provider, 1)
+		failures := make(chan struct{}, 1)
+		failures <- struct{}{}
+		publisher := make(recordingPublisher, 10)
+
+		dispatcher := newTestDispatcher(t, failingProvider{provider, failures}, publisher, 10*time.Millisecond)
+
+		if diff := cmp.Diff(publisher.receive(t, 2), append(expected, expected...)); diff != "" {
+			t.Errorf("unexpected diff: %s", diff)
+		}
+		if err := dispatcher.Close(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if size := outboxSize(t, provider); size != 0 {
+			t.Errorf("expected the outbox to be empty, got %d events", size)
+		}
+	})
+
+	t.Run("keeps the events a publisher does not accept", func(t *testing.T) {
+		provider := persistence.NewInMemorySignatureDeviceRepositoryProvider(persistence.NewInMemorySignatureDeviceRepository())
+		addEvents(t, provider, 3)
+
+		dispatcher := newTestDispatcher(t, provider, closedPublisher{}, 10*time.Millisecond)
+		time.Sleep(50 * time.Millisecond)
+		if err := dispatcher.Close(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		if size := outboxSize(t, provider); size != 3 {
+			t.Errorf("expected the events to stay in the outbox, got %d events", size)
+		}
+	})
+}
@@ -0,0 +1,372 @@
+package persistence
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
+	"github.com/google/uuid"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// device ID -> encodedDevice, ordered by ID
+	devicesBucket = []byte("devices")
+	// sequence number -> encodedEvent, ordered as added
+	outboxBucket = []byte("outbox")
+	// event ID -> sequence number in outboxBucket
+	outboxIndexBucket = []byte("outbox_index")
+	// webhook ID -> encodedWebhook, ordered by ID
+	webhooksBucket = []byte("webhooks")
+	// webhook ID + sequence number -> encodedWebhookDelivery, ordered by
+	// webhook and as added
+	deliveriesBucket = []byte("webhook_deliveries")
+	// delivery ID -> key in deliveriesBucket
+	deliveriesIndexBucket = []byte("webhook_deliveries_index")
+)
+
+// BoltSignatureDeviceRepositoryProvider stores the devices in an embedded
+// bbolt database file, for single node deployments. Transactions are
+// bbolt transactions: writes are serialized and synced to disk before
+// WriteTx returns, reads run concurrently on a consistent view.
+type BoltSignatureDeviceRepositoryProvider struct {
+	db *bolt.DB
+}
+
+// NewBoltSignatureDeviceRepositoryProvider opens the database file at
+// path, creating it when it does not exist. Only one process may open
+// the file at a time.
+func NewBoltSignatureDeviceRepositoryProvider(path string) (*BoltSignatureDeviceRepositoryProvider, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("could not open %s: %w", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{
+			devicesBucket, outboxBucket, outboxIndexBucket,
+			webhooksBucket, deliveriesBucket, deliveriesIndexBucket,
+		} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltSignatureDeviceRepositoryProvider{db: db}, nil
+}
+
+// Use when any of the repository methods in do() write
+func (provider *BoltSignatureDeviceRepositoryProvider) WriteTx(do func(domain.SignatureDeviceRepository) error) error {
+	start := time.Now()
+	err := provider.db.Update(func(tx *bolt.Tx) error {
+		domain.ObserveWriteTxLockAcquired(time.Since(start))
+		return do(boltRepository{tx})
+	})
+	if errors.Is(err, bolt.ErrDatabaseNotOpen) {
+		return domain.ErrRepositoryProviderClosed
+	}
+	return err
+}
+
+// Use when none of the repository methods in do() write
+func (provider *BoltSignatureDeviceRepositoryProvider) ReadTx(do func(domain.SignatureDeviceRepository) error) error {
+	err := provider.db.View(func(tx *bolt.Tx) error {
+		return do(boltRepository{tx})
+	})
+	if errors.Is(err, bolt.ErrDatabaseNotOpen) {
+		return domain.ErrRepositoryProviderClosed
+	}
+	return err
+}
+
+// Close waits for running transactions to finish and rejects all later ones.
+func (provider *BoltSignatureDeviceRepositoryProvider) Close() error {
+	return provider.db.Close()
+}
+
+type boltRepository struct {
+	tx *bolt.Tx
+}
+
+func (repository boltRepository) putDevice(device domain.SignatureDevice) error {
+	encoded, err := encodeDevice(device)
+	if err != nil {
+		return err
+	}
+	value, err := json.Marshal(encoded)
+	if err != nil {
+		return err
+	}
+	return repository.tx.Bucket(devicesBucket).Put(device.ID[:], value)
+}
+
+func decodeDevice(value []byte) (domain.SignatureDevice, error) {
+	var encoded encodedDevice
+	if err := json.Unmarshal(value, &encoded); err != nil {
+		return domain.SignatureDevice{}, err
+	}
+	return encoded.decode()
+}
+
+func (repository boltRepository) Create(device domain.SignatureDevice) error {
+	if repository.tx.Bucket(devicesBucket).Get(device.ID[:]) != nil {
+		return fmt.Errorf("%w: %s", domain.ErrDuplicateDevice, device.ID)
+	}
+	return repository.putDevice(device)
+}
+
+// update applies change to the stored device with the ID.
+func (repository boltRepository) update(deviceID uuid.UUID, change func(*domain.SignatureDevice)) error {
+	device, found, err := repository.Find(deviceID)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return errors.New("cannot update signature device that does not exist")
+	}
+	change(&device)
+	return repository.putDevice(device)
+}
+
+func (repository boltRepository) MarkSignatureCreated(deviceID uuid.UUID, newSignature string) error {
+	return repository.update(deviceID, func(device *domain.SignatureDevice) {
+		device.SignatureCounter++
+		device.LastSignature = newSignature
+	})
+}
+
+func (repository boltRepository) Deactivate(deviceID uuid.UUID) error {
+	return repository.update(deviceID, func(device *domain.SignatureDevice) {
+		device.Status = domain.DeviceStatusDeactivated
+	})
+}
+
+func (repository boltRepository) StoreCertificateChain(deviceID uuid.UUID, chain [][]byte) error {
+	return repository.update(deviceID, func(device *domain.SignatureDevice) {
+		device.CertificateChain = chain
+	})
+}
+
+func (repository boltRepository) Restore(device domain.SignatureDevice) error {
+	return repository.putDevice(device)
+}
+
+func (repository boltRepository) AddToOutbox(event domain.Event) error {
+	encoded, err := encodeEvent(event)
+	if err != nil {
+		return err
+	}
+	value, err := json.Marshal(encoded)
+	if err != nil {
+		return err
+	}
+
+	outbox := repository.tx.Bucket(outboxBucket)
+	sequence, err := outbox.NextSequence()
+	if err != nil {
+		return err
+	}
+	key := binary.BigEndian.AppendUint64(nil, sequence)
+	if err := outbox.Put(key, value); err != nil {
+		return err
+	}
+	return repository.tx.Bucket(outboxIndexBucket).Put(event.ID[:], key)
+}
+
+func (repository boltRepository) ListOutbox(limit int) ([]domain.Event, error) {
+	events := []domain.Event{}
+	cursor := repository.tx.Bucket(outboxBucket).Cursor()
+	for key, value := cursor.First(); key != nil && len(events) < limit; key, value = cursor.Next() {
+		var encoded encodedEvent
+		if err := json.Unmarshal(value, &encoded); err != nil {
+			return nil, err
+		}
+		event, err := encoded.decode()
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+func (repository boltRepository) RemoveFromOutbox(eventIDs []uuid.UUID) error {
+	outbox := repository.tx.Bucket(outboxBucket)
+	index := repository.tx.Bucket(outboxIndexBucket)
+	for _, id := range eventIDs {
+		key := index.Get(id[:])
+		if key == nil {
+			continue
+		}
+		if err := outbox.Delete(key); err != nil {
+			return err
+		}
+		if err := index.Delete(id[:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (repository boltRepository) SaveWebhook(webhook domain.Webhook) error {
+	value, err := json.Marshal(encodeWebhook(webhook))
+	if err != nil {
+		return err
+	}
+	return repository.tx.Bucket(webhooksBucket).Put(webhook.ID[:], value)
+}
+
+func (repository boltRepository) DeleteWebhook(id uuid.UUID) error {
+	if err := repository.tx.Bucket(webhooksBucket).Delete(id[:]); err != nil {
+		return err
+	}
+
+	deliveries := repository.tx.Bucket(deliveriesBucket)
+	index := repository.tx.Bucket(deliveriesIndexBucket)
+	// keys are collected first, as deleting moves the cursor
+	keys := [][]byte{}
+	cursor := deliveries.Cursor()
+	for key, value := cursor.Seek(id[:]); key != nil && bytes.HasPrefix(key, id[:]); key, value = cursor.Next() {
+		var encoded encodedWebhookDelivery
+		if err := json.Unmarshal(value, &encoded); err != nil {
+			return err
+		}
+		if err := index.Delete(encoded.ID[:]); err != nil {
+			return err
+		}
+		keys = append(keys, append([]byte{}, key...))
+	}
+	for _, key := range keys {
+		if err := deliveries.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The webhooks are ordered by ID, as the keys of the bucket.
+func (repository boltRepository) ListWebhooks() ([]domain.Webhook, error) {
+	webhooks := []domain.Webhook{}
+	err := repository.tx.Bucket(webhooksBucket).ForEach(func(key, value []byte) error {
+		var encoded encodedWebhook
+		if err := json.Unmarshal(value, &encoded); err != nil {
+			return err
+		}
+		webhooks = append(webhooks, encoded.decode())
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return webhooks, nil
+}
+
+func (repository boltRepository) AddWebhookDelivery(delivery domain.WebhookDelivery) error {
+	encoded, err := encodeWebhookDelivery(delivery)
+	if err != nil {
+		return err
+	}
+	value, err := json.Marshal(encoded)
+	if err != nil {
+		return err
+	}
+
+	deliveries := repository.tx.Bucket(deliveriesBucket)
+	sequence, err := deliveries.NextSequence()
+	if err != nil {
+		return err
+	}
+	key := binary.BigEndian.AppendUint64(append([]byte{}, delivery.WebhookID[:]...), sequence)
+	if err := deliveries.Put(key, value); err != nil {
+		return err
+	}
+	return repository.tx.Bucket(deliveriesIndexBucket).Put(delivery.ID[:], key)
+}
+
+func (repository boltRepository) ListWebhookDeliveries(webhookID uuid.UUID, limit int) ([]domain.WebhookDelivery, error) {
+	deliveries := []domain.WebhookDelivery{}
+	cursor := repository.tx.Bucket(deliveriesBucket).Cursor()
+	for key, value := cursor.Seek(webhookID[:]); key != nil && bytes.HasPrefix(key, webhookID[:]) && len(deliveries) < limit; key, value = cursor.Next() {
+		var encoded encodedWebhookDelivery
+		if err := json.Unmarshal(value, &encoded); err != nil {
+			return nil, err
+		}
+		delivery, err := encoded.decode()
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, nil
+}
+
+func (repository boltRepository) RemoveWebhookDelivery(id uuid.UUID) error {
+	index := repository.tx.Bucket(deliveriesIndexBucket)
+	key := index.Get(id[:])
+	if key == nil {
+		return nil
+	}
+	if err := repository.tx.Bucket(deliveriesBucket).Delete(key); err != nil {
+		return err
+	}
+	return index.Delete(id[:])
+}
+
+func (repository boltRepository) Find(id uuid.UUID) (domain.SignatureDevice, bool, error) {
+	value := repository.tx.Bucket(devicesBucket).Get(id[:])
+	if value == nil {
+		return domain.SignatureDevice{}, false, nil
+	}
+
+	device, err := decodeDevice(value)
+	if err != nil {
+		return domain.SignatureDevice{}, false, err
+	}
+	return device, true, nil
+}
+
+// The devices are ordered by ID, as the keys of the bucket.
+func (repository boltRepository) List() ([]domain.SignatureDevice, error) {
+	allDevices := []domain.SignatureDevice{}
+	err := repository.tx.Bucket(devicesBucket).ForEach(func(key, value []byte) error {
+		device, err := decodeDevice(value)
+		if err != nil {
+			return err
+		}
+		allDevices = append(allDevices, device)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return allDevices, nil
+}
+
+// Only the algorithm of the devices is decoded, not their key pairs.
+func (repository boltRepository) Count() (map[string]int, error) {
+	counts := map[string]int{}
+	err := repository.tx.Bucket(devicesBucket).ForEach(func(key, value []byte) error {
+		var encoded struct {
+			Algorithm string `json:"algorithm"`
+		}
+		if err := json.Unmarshal(value, &encoded); err != nil {
+			return err
+		}
+		counts[encoded.Algorithm]++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
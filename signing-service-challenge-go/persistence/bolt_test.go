@@ -0,0 +1,88 @@
+package persistence
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/uuid"
+)
+
+func openBoltProvider(t *testing.T, path string) *BoltSignatureDeviceRepositoryProvider {
+	t.Helper()
+
+	provider, err := NewBoltSignatureDeviceRepositoryProvider(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { provider.Close() })
+	return provider
+}
+
+func TestBoltConformance(t *testing.T) {
+	testConformance(t, func(t *testing.T) domain.SignatureDeviceRepositoryProvider {
+		return openBoltProvider(t, filepath.Join(t.TempDir(), "devices.db"))
+	})
+}
+
+func TestBolt(t *testing.T) {
+	t.Run("keeps devices and the outbox when reopened", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "devices.db")
+		provider := openBoltProvider(t, path)
+		signDevices(t, provider, 3)
+		expectedDevices, expectedOutbox := state(t, provider)
+		if err := provider.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		devices, outbox := state(t, openBoltProvider(t, path))
+
+		if diff := cmp.Diff(comparableDevices(t, devices), comparableDevices(t, expectedDevices)); diff != "" {
+			t.Errorf("unexpected diff: %s", diff)
+		}
+		if diff := cmp.Diff(outbox, expectedOutbox); diff != "" {
+			t.Errorf("unexpected diff: %s", diff)
+		}
+	})
+
+	t.Run("discards the writes of failed transactions", func(t *testing.T) {
+		provider := openBoltProvider(t, filepath.Join(t.TempDir(), "devices.db"))
+		ids := signDevices(t, provider, 1)
+		expectedDevices, expectedOutbox := state(t, provider)
+
+		failure := errors.New("signing failed")
+		err := provider.WriteTx(func(repository domain.SignatureDeviceRepository) error {
+			if err := repository.MarkSignatureCreated(ids[0], "lost signature"); err != nil {
+				return err
+			}
+			if err := repository.AddToOutbox(domain.Event{ID: uuid.New()}); err != nil {
+				return err
+			}
+			return failure
+		})
+		if err != failure {
+			t.Errorf("expected the error of the transaction, got: %v", err)
+		}
+
+		devices, outbox := state(t, provider)
+		if diff := cmp.Diff(comparableDevices(t, devices), comparableDevices(t, expectedDevices)); diff != "" {
+			t.Errorf("unexpected diff: %s", diff)
+		}
+		if diff := cmp.Diff(outbox, expectedOutbox); diff != "" {
+			t.Errorf("unexpected diff: %s", diff)
+		}
+	})
+
+	t.Run("rejects writes in read transactions", func(t *testing.T) {
+		provider := openBoltProvider(t, filepath.Join(t.TempDir(), "devices.db"))
+
+		err := provider.ReadTx(func(repository domain.SignatureDeviceRepository) error {
+			return repository.Create(domain.SignatureDevice{ID: uuid.New()})
+		})
+		if err == nil {
+			t.Error("expected error")
+		}
+	})
+}
@@ -0,0 +1,569 @@
+package persistence
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"math/big"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/crypto"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/uuid"
+)
+
+// newTestCertificate returns a DER encoded self-signed certificate.
+func newTestCertificate(t *testing.T) []byte {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+// testConformance checks the behavior every implementation of
+// domain.SignatureDeviceRepositoryProvider must have. newProvider must
+// return an empty provider.
+func testConformance(t *testing.T, newProvider func(t *testing.T) domain.SignatureDeviceRepositoryProvider) {
+	writeTx := func(t *testing.T, provider domain.SignatureDeviceRepositoryProvider, do func(domain.SignatureDeviceRepository) error) {
+		t.Helper()
+		if err := provider.WriteTx(do); err != nil {
+			t.Fatal(err)
+		}
+	}
+	find := func(t *testing.T, provider domain.SignatureDeviceRepositoryProvider, id uuid.UUID) (device domain.SignatureDevice, found bool) {
+		t.Helper()
+		err := provider.ReadTx(func(repository domain.SignatureDeviceRepository) error {
+			var err error
+			device, found, err = repository.Find(id)
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return device, found
+	}
+
+	t.Run("creates and finds devices", func(t *testing.T) {
+		provider := newProvider(t)
+		device := domain.SignatureDevice{
+			ID:     uuid.New(),
+			Label:  "my rsa key",
+			Status: domain.DeviceStatusActive,
+		}
+
+		writeTx(t, provider, func(repository domain.SignatureDeviceRepository) error {
+			return repository.Create(device)
+		})
+
+		got, found := find(t, provider, device.ID)
+		if !found {
+			t.Fatal("expected device to be found")
+		}
+		if diff := cmp.Diff(got, device); diff != "" {
+			t.Errorf("unexpected diff: %s", diff)
+		}
+		if _, found := find(t, provider, uuid.New()); found {
+			t.Error("expected unknown device not to be found")
+		}
+	})
+
+	t.Run("does not create a device when id is not unique", func(t *testing.T) {
+		provider := newProvider(t)
+		device := domain.SignatureDevice{ID: uuid.New(), Label: "already existing"}
+		writeTx(t, provider, func(repository domain.SignatureDeviceRepository) error {
+			return repository.Create(device)
+		})
+
+		err := provider.WriteTx(func(repository domain.SignatureDeviceRepository) error {
+			return repository.Create(domain.SignatureDevice{ID: device.ID, Label: "duplicate"})
+		})
+		if err == nil {
+			t.Error("expected error")
+		}
+
+		got, _ := find(t, provider, device.ID)
+		if got.Label != "already existing" {
+			t.Errorf("expected existing device to be kept, got: %v", got)
+		}
+	})
+
+	t.Run("counts signatures and keeps the last one", func(t *testing.T) {
+		provider := newProvider(t)
+		device := domain.SignatureDevice{ID: uuid.New()}
+		writeTx(t, provider, func(repository domain.SignatureDeviceRepository) error {
+			return repository.Create(device)
+		})
+
+		for _, signature := range []string{"first", "second"} {
+			writeTx(t, provider, func(repository domain.SignatureDeviceRepository) error {
+				return repository.MarkSignatureCreated(device.ID, signature)
+			})
+		}
+
+		got, _ := find(t, provider, device.ID)
+		if got.SignatureCounter != 2 || got.LastSignature != "second" {
+			t.Errorf("expected counter 2 and last signature second, got: %d, %s", got.SignatureCounter, got.LastSignature)
+		}
+
+		err := provider.WriteTx(func(repository domain.SignatureDeviceRepository) error {
+			return repository.MarkSignatureCreated(uuid.New(), "signature")
+		})
+		if err == nil {
+			t.Error("expected error when updating non-existent device")
+		}
+	})
+
+	t.Run("deactivates devices", func(t *testing.T) {
+		provider := newProvider(t)
+		device := domain.SignatureDevice{ID: uuid.New(), Status: domain.DeviceStatusActive}
+		writeTx(t, provider, func(repository domain.SignatureDeviceRepository) error {
+			if err := repository.Create(device); err != nil {
+				return err
+			}
+			return repository.Deactivate(device.ID)
+		})
+
+		got, _ := find(t, provider, device.ID)
+		if got.Status != domain.DeviceStatusDeactivated {
+			t.Errorf("expected status deactivated, got: %s", got.Status)
+		}
+
+		err := provider.WriteTx(func(repository domain.SignatureDeviceRepository) error {
+			return repository.Deactivate(uuid.New())
+		})
+		if err == nil {
+			t.Error("expected error when updating non-existent device")
+		}
+	})
+
+	t.Run("stores certificate chains", func(t *testing.T) {
+		provider := newProvider(t)
+		device := domain.SignatureDevice{ID: uuid.New(), Status: domain.DeviceStatusActive}
+		chain := [][]byte{newTestCertificate(t), newTestCertificate(t)}
+		writeTx(t, provider, func(repository domain.SignatureDeviceRepository) error {
+			if err := repository.Create(device); err != nil {
+				return err
+			}
+			return repository.StoreCertificateChain(device.ID, chain)
+		})
+
+		got, _ := find(t, provider, device.ID)
+		if diff := cmp.Diff(chain, got.CertificateChain); diff != "" {
+			t.Errorf("unexpected diff: %s", diff)
+		}
+
+		err := provider.WriteTx(func(repository domain.SignatureDeviceRepository) error {
+			return repository.StoreCertificateChain(uuid.New(), chain)
+		})
+		if err == nil {
+			t.Error("expected error when updating non-existent device")
+		}
+	})
+
+	t.Run("restores devices", func(t *testing.T) {
+		provider := newProvider(t)
+		existing := domain.SignatureDevice{ID: uuid.New(), Label: "existing", Status: domain.DeviceStatusActive}
+		writeTx(t, provider, func(repository domain.SignatureDeviceRepository) error {
+			return repository.Create(existing)
+		})
+
+		restored := domain.SignatureDevice{
+			ID:               existing.ID,
+			Label:            "restored",
+			Status:           domain.DeviceStatusActive,
+			LastSignature:    "signature",
+			SignatureCounter: 5,
+		}
+		missing := domain.SignatureDevice{ID: uuid.New(), Label: "missing", Status: domain.DeviceStatusActive}
+		writeTx(t, provider, func(repository domain.SignatureDeviceRepository) error {
+			if err := repository.Restore(restored); err != nil {
+				return err
+			}
+			return repository.Restore(missing)
+		})
+
+		for _, expected := range []domain.SignatureDevice{restored, missing} {
+			got, found := find(t, provider, expected.ID)
+			if !found {
+				t.Fatalf("expected device %s to be found", expected.Label)
+			}
+			if diff := cmp.Diff(got, expected); diff != "" {
+				t.Errorf("unexpected diff: %s", diff)
+			}
+		}
+	})
+
+	t.Run("rejects duplicate ids", func(t *testing.T) {
+		provider := newProvider(t)
+		device := domain.SignatureDevice{ID: uuid.New()}
+		writeTx(t, provider, func(repository domain.SignatureDeviceRepository) error {
+			return repository.Create(device)
+		})
+
+		err := provider.WriteTx(func(repository domain.SignatureDeviceRepository) error {
+			return repository.Create(device)
+		})
+		if !errors.Is(err, domain.ErrDuplicateDevice) {
+			t.Errorf("expected ErrDuplicateDevice, got: %v", err)
+		}
+	})
+
+	t.Run("lists all devices ordered by id", func(t *testing.T) {
+		provider := newProvider(t)
+		expected := []uuid.UUID{}
+		for i := 0; i < 10; i++ {
+			device := domain.SignatureDevice{ID: uuid.New()}
+			expected = append(expected, device.ID)
+			writeTx(t, provider, func(repository domain.SignatureDeviceRepository) error {
+				return repository.Create(device)
+			})
+		}
+		writeTx(t, provider, func(repository domain.SignatureDeviceRepository) error {
+			return repository.MarkSignatureCreated(expected[0], "signature")
+		})
+
+		var devices []domain.SignatureDevice
+		err := provider.ReadTx(func(repository domain.SignatureDeviceRepository) error {
+			var err error
+			devices, err = repository.List()
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got := []uuid.UUID{}
+		for _, device := range devices {
+			got = append(got, device.ID)
+		}
+		sort.Slice(expected, func(a, b int) bool { return expected[a].String() < expected[b].String() })
+		if diff := cmp.Diff(got, expected); diff != "" {
+			t.Errorf("unexpected diff: %s", diff)
+		}
+	})
+
+	t.Run("counts devices by algorithm", func(t *testing.T) {
+		provider := newProvider(t)
+		devices := []domain.SignatureDevice{}
+		for _, generator := range []domain.KeyPairGenerator{crypto.ECCGenerator{}, crypto.ECCGenerator{}, crypto.RSAGenerator{}} {
+			device, err := domain.BuildSignatureDevice(uuid.New(), generator)
+			if err != nil {
+				t.Fatal(err)
+			}
+			devices = append(devices, device)
+		}
+		writeTx(t, provider, func(repository domain.SignatureDeviceRepository) error {
+			for _, device := range devices[:2] {
+				if err := repository.Create(device); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+
+		var counts map[string]int
+		writeTx(t, provider, func(repository domain.SignatureDeviceRepository) error {
+			if err := repository.Create(devices[2]); err != nil {
+				return err
+			}
+			// replaces an ECC device by an RSA one
+			restored := devices[2]
+			restored.ID = devices[1].ID
+			if err := repository.Restore(restored); err != nil {
+				return err
+			}
+			var err error
+			counts, err = repository.Count()
+			return err
+		})
+
+		expected := map[string]int{"ECC": 1, "RSA": 2}
+		if diff := cmp.Diff(counts, expected); diff != "" {
+			t.Errorf("unexpected diff: %s", diff)
+		}
+	})
+
+	t.Run("lists and removes outbox events in order", func(t *testing.T) {
+		provider := newProvider(t)
+		events := []domain.Event{}
+		for i := 0; i < 3; i++ {
+			event := domain.Event{ID: uuid.New(), Type: domain.EventSignatureCreated}
+			events = append(events, event)
+			writeTx(t, provider, func(repository domain.SignatureDeviceRepository) error {
+				return repository.AddToOutbox(event)
+			})
+		}
+
+		listOutbox := func(limit int) []uuid.UUID {
+			t.Helper()
+			ids := []uuid.UUID{}
+			err := provider.ReadTx(func(repository domain.SignatureDeviceRepository) error {
+				outbox, err := repository.ListOutbox(limit)
+				for _, event := range outbox {
+					ids = append(ids, event.ID)
+				}
+				return err
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return ids
+		}
+
+		if diff := cmp.Diff(listOutbox(2), []uuid.UUID{events[0].ID, events[1].ID}); diff != "" {
+			t.Errorf("expected the oldest events, diff: %s", diff)
+		}
+
+		writeTx(t, provider, func(repository domain.SignatureDeviceRepository) error {
+			return repository.RemoveFromOutbox([]uuid.UUID{events[0].ID, events[1].ID, uuid.New()})
+		})
+		if diff := cmp.Diff(listOutbox(10), []uuid.UUID{events[2].ID}); diff != "" {
+			t.Errorf("expected the removed events to be gone, diff: %s", diff)
+		}
+	})
+
+	listWebhooks := func(t *testing.T, provider domain.SignatureDeviceRepositoryProvider) []domain.Webhook {
+		t.Helper()
+		var webhooks []domain.Webhook
+		err := provider.ReadTx(func(repository domain.SignatureDeviceRepository) error {
+			var err error
+			webhooks, err = repository.ListWebhooks()
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return webhooks
+	}
+	listDeliveries := func(t *testing.T, provider domain.SignatureDeviceRepositoryProvider, webhookID uuid.UUID, limit int) []uuid.UUID {
+		t.Helper()
+		ids := []uuid.UUID{}
+		err := provider.ReadTx(func(repository domain.SignatureDeviceRepository) error {
+			deliveries, err := repository.ListWebhookDeliveries(webhookID, limit)
+			for _, delivery := range deliveries {
+				ids = append(ids, delivery.ID)
+			}
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ids
+	}
+
+	t.Run("saves, lists and deletes webhooks", func(t *testing.T) {
+		provider := newProvider(t)
+		webhooks := []domain.Webhook{
+			{
+				ID:         uuid.MustParse("00000000-0000-0000-0000-000000000002"),
+				URL:        "https://example.com/b",
+				Secret:     "secret",
+				EventTypes: []domain.EventType{domain.EventDeviceCreated},
+				CreatedAt:  time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+			},
+			{
+				ID:        uuid.MustParse("00000000-0000-0000-0000-000000000001"),
+				URL:       "https://example.com/a",
+				Secret:    "secret",
+				CreatedAt: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+			},
+		}
+		for _, webhook := range webhooks {
+			writeTx(t, provider, func(repository domain.SignatureDeviceRepository) error {
+				return repository.SaveWebhook(webhook)
+			})
+		}
+		updated := webhooks[0]
+		updated.URL = "https://example.com/c"
+		writeTx(t, provider, func(repository domain.SignatureDeviceRepository) error {
+			return repository.SaveWebhook(updated)
+		})
+
+		if diff := cmp.Diff(listWebhooks(t, provider), []domain.Webhook{webhooks[1], updated}); diff != "" {
+			t.Errorf("expected the webhooks ordered by id, diff: %s", diff)
+		}
+
+		writeTx(t, provider, func(repository domain.SignatureDeviceRepository) error {
+			if err := repository.DeleteWebhook(webhooks[1].ID); err != nil {
+				return err
+			}
+			return repository.DeleteWebhook(uuid.New())
+		})
+		if diff := cmp.Diff(listWebhooks(t, provider), []domain.Webhook{updated}); diff != "" {
+			t.Errorf("expected the deleted webhook to be gone, diff: %s", diff)
+		}
+	})
+
+	t.Run("lists and removes webhook deliveries in order", func(t *testing.T) {
+		provider := newProvider(t)
+		webhookIDs := []uuid.UUID{uuid.New(), uuid.New()}
+		deliveries := []domain.WebhookDelivery{}
+		for i := 0; i < 4; i++ {
+			delivery := domain.WebhookDelivery{
+				ID:        uuid.New(),
+				WebhookID: webhookIDs[i%2],
+				Event:     domain.Event{ID: uuid.New(), Type: domain.EventSignatureCreated},
+			}
+			deliveries = append(deliveries, delivery)
+			writeTx(t, provider, func(repository domain.SignatureDeviceRepository) error {
+				return repository.AddWebhookDelivery(delivery)
+			})
+		}
+
+		if diff := cmp.Diff(listDeliveries(t, provider, webhookIDs[0], 1), []uuid.UUID{deliveries[0].ID}); diff != "" {
+			t.Errorf("expected the oldest delivery of the webhook, diff: %s", diff)
+		}
+
+		writeTx(t, provider, func(repository domain.SignatureDeviceRepository) error {
+			if err := repository.RemoveWebhookDelivery(deliveries[0].ID); err != nil {
+				return err
+			}
+			return repository.RemoveWebhookDelivery(uuid.New())
+		})
+		if diff := cmp.Diff(listDeliveries(t, provider, webhookIDs[0], 10), []uuid.UUID{deliveries[2].ID}); diff != "" {
+			t.Errorf("expected the removed delivery to be gone, diff: %s", diff)
+		}
+
+		writeTx(t, provider, func(repository domain.SignatureDeviceRepository) error {
+			return repository.DeleteWebhook(webhookIDs[1])
+		})
+		if got := listDeliveries(t, provider, webhookIDs[1], 10); len(got) != 0 {
+			t.Errorf("expected the deliveries of the deleted webhook to be gone, got: %v", got)
+		}
+		if diff := cmp.Diff(listDeliveries(t, provider, webhookIDs[0], 10), []uuid.UUID{deliveries[2].ID}); diff != "" {
+			t.Errorf("expected the deliveries of other webhooks to stay, diff: %s", diff)
+		}
+	})
+
+	t.Run("rolls back failed writes of webhooks", func(t *testing.T) {
+		provider := newProvider(t)
+		webhook := domain.Webhook{ID: uuid.New(), URL: "https://example.com", Secret: "secret"}
+		delivery := domain.WebhookDelivery{ID: uuid.New(), WebhookID: webhook.ID}
+		writeTx(t, provider, func(repository domain.SignatureDeviceRepository) error {
+			if err := repository.SaveWebhook(webhook); err != nil {
+				return err
+			}
+			return repository.AddWebhookDelivery(delivery)
+		})
+
+		errFailed := errors.New("failed")
+		err := provider.WriteTx(func(repository domain.SignatureDeviceRepository) error {
+			if err := repository.SaveWebhook(domain.Webhook{ID: uuid.New(), URL: "https://example.com/new"}); err != nil {
+				return err
+			}
+			if err := repository.AddWebhookDelivery(domain.WebhookDelivery{ID: uuid.New(), WebhookID: webhook.ID}); err != nil {
+				return err
+			}
+			if err := repository.DeleteWebhook(webhook.ID); err != nil {
+				return err
+			}
+			return errFailed
+		})
+		if !errors.Is(err, errFailed) {
+			t.Fatalf("expected the error of the transaction, got: %v", err)
+		}
+
+		if diff := cmp.Diff(listWebhooks(t, provider), []domain.Webhook{webhook}); diff != "" {
+			t.Errorf("expected the webhooks to be unchanged, diff: %s", diff)
+		}
+		if diff := cmp.Diff(listDeliveries(t, provider, webhook.ID, 10), []uuid.UUID{delivery.ID}); diff != "" {
+			t.Errorf("expected the deliveries to be unchanged, diff: %s", diff)
+		}
+	})
+
+	t.Run("rolls back failed transactions", func(t *testing.T) {
+		provider := newProvider(t)
+		existing := domain.SignatureDevice{ID: uuid.New(), Label: "existing", Status: domain.DeviceStatusActive}
+		event := domain.Event{ID: uuid.New(), Type: domain.EventDeviceCreated}
+		writeTx(t, provider, func(repository domain.SignatureDeviceRepository) error {
+			if err := repository.Create(existing); err != nil {
+				return err
+			}
+			return repository.AddToOutbox(event)
+		})
+
+		created := domain.SignatureDevice{ID: uuid.New(), Status: domain.DeviceStatusActive}
+		errFailed := errors.New("failed")
+		err := provider.WriteTx(func(repository domain.SignatureDeviceRepository) error {
+			if err := repository.Create(created); err != nil {
+				return err
+			}
+			if err := repository.MarkSignatureCreated(existing.ID, "c2lnbmF0dXJl"); err != nil {
+				return err
+			}
+			if err := repository.Deactivate(existing.ID); err != nil {
+				return err
+			}
+			if err := repository.RemoveFromOutbox([]uuid.UUID{event.ID}); err != nil {
+				return err
+			}
+			if err := repository.AddToOutbox(domain.Event{ID: uuid.New(), Type: domain.EventSignatureCreated}); err != nil {
+				return err
+			}
+			return errFailed
+		})
+		if !errors.Is(err, errFailed) {
+			t.Fatalf("expected the error of the transaction, got: %v", err)
+		}
+
+		if _, found := find(t, provider, created.ID); found {
+			t.Error("expected the created device to be gone")
+		}
+		got, _ := find(t, provider, existing.ID)
+		if diff := cmp.Diff(got, existing); diff != "" {
+			t.Errorf("expected the device to be unchanged, diff: %s", diff)
+		}
+		var outbox []domain.Event
+		err = provider.ReadTx(func(repository domain.SignatureDeviceRepository) error {
+			var err error
+			outbox, err = repository.ListOutbox(10)
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(outbox) != 1 || outbox[0].ID != event.ID {
+			t.Errorf("expected the outbox to be unchanged, got: %v", outbox)
+		}
+	})
+
+	t.Run("rejects transactions once closed", func(t *testing.T) {
+		provider := newProvider(t)
+		closer, ok := provider.(io.Closer)
+		if !ok {
+			t.Skip("provider cannot be closed")
+		}
+
+		if err := closer.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		err := provider.WriteTx(func(domain.SignatureDeviceRepository) error { return nil })
+		if err != domain.ErrRepositoryProviderClosed {
+			t.Errorf("expected ErrRepositoryProviderClosed from WriteTx, got: %v", err)
+		}
+		err = provider.ReadTx(func(domain.SignatureDeviceRepository) error { return nil })
+		if err != domain.ErrRepositoryProviderClosed {
+			t.Errorf("expected ErrRepositoryProviderClosed from ReadTx, got: %v", err)
+		}
+	})
+}
@@ -0,0 +1,391 @@
+package persistence
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/crypto"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
+	"github.com/google/uuid"
+)
+
+// encodedDevice is the stored form of a domain.SignatureDevice.
+type encodedDevice struct {
+	ID uuid.UUID `json:"id"`
+	// empty for devices without key pair, e.g. the ones of events
+	Algorithm string `json:"algorithm,omitempty"`
+	// PEM encoded by the marshaler of the algorithm
+	PrivateKey string `json:"private_key,omitempty"`
+	// replaces PrivateKey when it is sealed, see seal
+	EncryptedPrivateKey string              `json:"encrypted_private_key,omitempty"`
+	Label               string              `json:"label"`
+	Status              domain.DeviceStatus `json:"status"`
+	LastSignature       string              `json:"last_signature"`
+	SignatureCounter    uint                `json:"signature_counter"`
+	// PEM encoded, empty for devices without certificate chain
+	CertificateChain string `json:"certificate_chain,omitempty"`
+}
+
+func encodeDevice(device domain.SignatureDevice) (encodedDevice, error) {
+	encoded := encodedDevice{
+		ID:               device.ID,
+		Label:            device.Label,
+		Status:           device.Status,
+		LastSignature:    device.LastSignature,
+		SignatureCounter: device.SignatureCounter,
+		CertificateChain: string(crypto.EncodeCertificateChain(device.CertificateChain)),
+	}
+	if device.KeyPair != nil {
+		privateKey, err := crypto.EncodePrivateKey(device.KeyPair)
+		if err != nil {
+			return encodedDevice{}, fmt.Errorf("could not encode key pair of device %s: %w", device.ID, err)
+		}
+		encoded.Algorithm = device.KeyPair.AlgorithmName()
+		encoded.PrivateKey = string(privateKey)
+	}
+	return encoded, nil
+}
+
+func (encoded encodedDevice) decode() (domain.SignatureDevice, error) {
+	device := domain.SignatureDevice{
+		ID:               encoded.ID,
+		Label:            encoded.Label,
+		Status:           encoded.Status,
+		LastSignature:    encoded.LastSignature,
+		SignatureCounter: encoded.SignatureCounter,
+	}
+	if encoded.Algorithm != "" {
+		keyPair, err := crypto.DecodePrivateKey(encoded.Algorithm, []byte(encoded.PrivateKey))
+		if err != nil {
+			return domain.SignatureDevice{}, fmt.Errorf("could not decode key pair of device %s: %w", encoded.ID, err)
+		}
+		device.KeyPair = keyPair
+	}
+	if encoded.CertificateChain != "" {
+		chain, err := crypto.DecodeCertificateChain([]byte(encoded.CertificateChain))
+		if err != nil {
+			return domain.SignatureDevice{}, fmt.Errorf("could not decode certificate chain of device %s: %w", encoded.ID, err)
+		}
+		device.CertificateChain = chain
+	}
+	return device, nil
+}
+
+// seal replaces the private key with the nonce and the private key
+// encrypted by aead, with the device ID as additional data, base64
+// encoded.
+func (encoded *encodedDevice) seal(aead cipher.AEAD) error {
+	if encoded.PrivateKey == "" {
+		return nil
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(encoded.PrivateKey), encoded.ID[:])
+	encoded.EncryptedPrivateKey = base64.StdEncoding.EncodeToString(sealed)
+	encoded.PrivateKey = ""
+	return nil
+}
+
+// open decrypts the private key sealed by seal. Private keys stored
+// before aead was configured are not sealed, and are left as they are.
+func (encoded *encodedDevice) open(aead cipher.AEAD) error {
+	if encoded.EncryptedPrivateKey == "" {
+		return nil
+	}
+	if aead == nil {
+		return fmt.Errorf("private key of device %s is encrypted, but no key is configured", encoded.ID)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encoded.EncryptedPrivateKey)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return fmt.Errorf("invalid encrypted private key of device %s", encoded.ID)
+	}
+	privateKey, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], encoded.ID[:])
+	if err != nil {
+		return fmt.Errorf("could not decrypt private key of device %s, the key may be wrong: %w", encoded.ID, err)
+	}
+	encoded.PrivateKey = string(privateKey)
+	encoded.EncryptedPrivateKey = ""
+	return nil
+}
+
+// encodedEvent is the stored form of a domain.Event.
+type encodedEvent struct {
+	ID        uuid.UUID        `json:"id"`
+	Type      domain.EventType `json:"type"`
+	Device    encodedDevice    `json:"device"`
+	Signature string           `json:"signature,omitempty"`
+	Time      time.Time        `json:"time"`
+}
+
+func encodeEvent(event domain.Event) (encodedEvent, error) {
+	device, err := encodeDevice(event.Device)
+	if err != nil {
+		return encodedEvent{}, err
+	}
+	return encodedEvent{
+		ID:        event.ID,
+		Type:      event.Type,
+		Device:    device,
+		Signature: event.Signature,
+		Time:      event.Time,
+	}, nil
+}
+
+func (encoded encodedEvent) decode() (domain.Event, error) {
+	device, err := encoded.Device.decode()
+	if err != nil {
+		return domain.Event{}, err
+	}
+	return domain.Event{
+		ID:        encoded.ID,
+		Type:      encoded.Type,
+		Device:    device,
+		Signature: encoded.Signature,
+		Time:      encoded.Time,
+	}, nil
+}
+
+// encodedWebhook is the stored form of a domain.Webhook.
+type encodedWebhook struct {
+	ID         uuid.UUID          `json:"id"`
+	URL        string             `json:"url"`
+	Secret     string             `json:"secret"`
+	EventTypes []domain.EventType `json:"event_types,omitempty"`
+	CreatedAt  time.Time          `json:"created_at"`
+}
+
+func encodeWebhook(webhook domain.Webhook) encodedWebhook {
+	return encodedWebhook{
+		ID:         webhook.ID,
+		URL:        webhook.URL,
+		Secret:     webhook.Secret,
+		EventTypes: webhook.EventTypes,
+		CreatedAt:  webhook.CreatedAt,
+	}
+}
+
+func (encoded encodedWebhook) decode() domain.Webhook {
+	return domain.Webhook{
+		ID:         encoded.ID,
+		URL:        encoded.URL,
+		Secret:     encoded.Secret,
+		EventTypes: encoded.EventTypes,
+		CreatedAt:  encoded.CreatedAt,
+	}
+}
+
+// encodedWebhookDelivery is the stored form of a domain.WebhookDelivery.
+type encodedWebhookDelivery struct {
+	ID        uuid.UUID    `json:"id"`
+	WebhookID uuid.UUID    `json:"webhook_id"`
+	Event     encodedEvent `json:"event"`
+	CreatedAt time.Time    `json:"created_at"`
+}
+
+func encodeWebhookDelivery(delivery domain.WebhookDelivery) (encodedWebhookDelivery, error) {
+	event, err := encodeEvent(delivery.Event)
+	if err != nil {
+		return encodedWebhookDelivery{}, err
+	}
+	return encodedWebhookDelivery{
+		ID:        delivery.ID,
+		WebhookID: delivery.WebhookID,
+		Event:     event,
+		CreatedAt: delivery.CreatedAt,
+	}, nil
+}
+
+func (encoded encodedWebhookDelivery) decode() (domain.WebhookDelivery, error) {
+	event, err := encoded.Event.decode()
+	if err != nil {
+		return domain.WebhookDelivery{}, err
+	}
+	return domain.WebhookDelivery{
+		ID:        encoded.ID,
+		WebhookID: encoded.WebhookID,
+		Event:     event,
+		CreatedAt: encoded.CreatedAt,
+	}, nil
+}
+
+// encodedRecord is the stored form of a Record.
+type encodedRecord struct {
+	Sequence  uint64         `json:"sequence"`
+	Type      RecordType     `json:"type"`
+	Time      time.Time      `json:"time"`
+	DeviceID  uuid.UUID      `json:"device_id"`
+	Device    *encodedDevice `json:"device,omitempty"`
+	Signature string         `json:"signature,omitempty"`
+	Event     *encodedEvent  `json:"event,omitempty"`
+	EventIDs  []uuid.UUID    `json:"event_ids,omitempty"`
+	// PEM encoded
+	CertificateChain string                  `json:"certificate_chain,omitempty"`
+	Webhook          *encodedWebhook         `json:"webhook,omitempty"`
+	WebhookID        *uuid.UUID              `json:"webhook_id,omitempty"`
+	Delivery         *encodedWebhookDelivery `json:"delivery,omitempty"`
+	DeliveryID       *uuid.UUID              `json:"delivery_id,omitempty"`
+}
+
+func encodeRecord(record Record) (encodedRecord, error) {
+	encoded := encodedRecord{
+		Sequence:  record.Sequence,
+		Type:      record.Type,
+		Time:      record.Time,
+		DeviceID:  record.DeviceID,
+		Signature: record.Signature,
+		EventIDs:  record.EventIDs,
+	}
+	switch record.Type {
+	case RecordCertificateChainStored:
+		encoded.CertificateChain = string(crypto.EncodeCertificateChain(record.CertificateChain))
+	case RecordDeviceCreated, RecordDeviceRestored:
+		device, err := encodeDevice(record.Device)
+		if err != nil {
+			return encodedRecord{}, err
+		}
+		encoded.Device = &device
+	case RecordOutboxEventAdded:
+		event, err := encodeEvent(record.Event)
+		if err != nil {
+			return encodedRecord{}, err
+		}
+		encoded.Event = &event
+	case RecordWebhookSaved:
+		webhook := encodeWebhook(record.Webhook)
+		encoded.Webhook = &webhook
+	case RecordWebhookDeleted:
+		encoded.WebhookID = &record.WebhookID
+	case RecordWebhookDeliveryRemoved:
+		encoded.DeliveryID = &record.DeliveryID
+	case RecordWebhookDeliveryAdded:
+		delivery, err := encodeWebhookDelivery(record.Delivery)
+		if err != nil {
+			return encodedRecord{}, err
+		}
+		encoded.Delivery = &delivery
+	}
+	return encoded, nil
+}
+
+func (encoded encodedRecord) decode() (Record, error) {
+	record := Record{
+		Sequence:  encoded.Sequence,
+		Type:      encoded.Type,
+		Time:      encoded.Time,
+		DeviceID:  encoded.DeviceID,
+		Signature: encoded.Signature,
+		EventIDs:  encoded.EventIDs,
+	}
+	var err error
+	if encoded.CertificateChain != "" {
+		record.CertificateChain, err = crypto.DecodeCertificateChain([]byte(encoded.CertificateChain))
+		if err != nil {
+			return Record{}, err
+		}
+	}
+	if encoded.Device != nil {
+		record.Device, err = encoded.Device.decode()
+		if err != nil {
+			return Record{}, err
+		}
+	}
+	if encoded.Event != nil {
+		record.Event, err = encoded.Event.decode()
+		if err != nil {
+			return Record{}, err
+		}
+	}
+	if encoded.Webhook != nil {
+		record.Webhook = encoded.Webhook.decode()
+	}
+	if encoded.WebhookID != nil {
+		record.WebhookID = *encoded.WebhookID
+	}
+	if encoded.DeliveryID != nil {
+		record.DeliveryID = *encoded.DeliveryID
+	}
+	if encoded.Delivery != nil {
+		record.Delivery, err = encoded.Delivery.decode()
+		if err != nil {
+			return Record{}, err
+		}
+	}
+	return record, nil
+}
+
+// encodedSnapshot is the stored form of a Snapshot.
+type encodedSnapshot struct {
+	Sequence uint64          `json:"sequence"`
+	Devices  []encodedDevice `json:"devices"`
+	Outbox   []encodedEvent  `json:"outbox"`
+	// missing in the snapshots of earlier versions
+	Webhooks          []encodedWebhook         `json:"webhooks,omitempty"`
+	WebhookDeliveries []encodedWebhookDelivery `json:"webhook_deliveries,omitempty"`
+}
+
+func encodeSnapshot(snapshot Snapshot) (encodedSnapshot, error) {
+	encoded := encodedSnapshot{
+		Sequence: snapshot.Sequence,
+		Devices:  []encodedDevice{},
+		Outbox:   []encodedEvent{},
+	}
+	for _, device := range snapshot.Devices {
+		encodedDevice, err := encodeDevice(device)
+		if err != nil {
+			return encodedSnapshot{}, err
+		}
+		encoded.Devices = append(encoded.Devices, encodedDevice)
+	}
+	for _, event := range snapshot.Outbox {
+		encodedEvent, err := encodeEvent(event)
+		if err != nil {
+			return encodedSnapshot{}, err
+		}
+		encoded.Outbox = append(encoded.Outbox, encodedEvent)
+	}
+	for _, webhook := range snapshot.Webhooks {
+		encoded.Webhooks = append(encoded.Webhooks, encodeWebhook(webhook))
+	}
+	for _, delivery := range snapshot.WebhookDeliveries {
+		encodedDelivery, err := encodeWebhookDelivery(delivery)
+		if err != nil {
+			return encodedSnapshot{}, err
+		}
+		encoded.WebhookDeliveries = append(encoded.WebhookDeliveries, encodedDelivery)
+	}
+	return encoded, nil
+}
+
+func (encoded encodedSnapshot) decode() (Snapshot, error) {
+	snapshot := Snapshot{Sequence: encoded.Sequence}
+	for _, encodedDevice := range encoded.Devices {
+		device, err := encodedDevice.decode()
+		if err != nil {
+			return Snapshot{}, err
+		}
+		snapshot.Devices = append(snapshot.Devices, device)
+	}
+	for _, encodedEvent := range encoded.Outbox {
+		event, err := encodedEvent.decode()
+		if err != nil {
+			return Snapshot{}, err
+		}
+		snapshot.Outbox = append(snapshot.Outbox, event)
+	}
+	for _, encodedWebhook := range encoded.Webhooks {
+		snapshot.Webhooks = append(snapshot.Webhooks, encodedWebhook.decode())
+	}
+	for _, encodedDelivery := range encoded.WebhookDeliveries {
+		delivery, err := encodedDelivery.decode()
+		if err != nil {
+			return Snapshot{}, err
+		}
+		snapshot.WebhookDeliveries = append(snapshot.WebhookDeliveries, delivery)
+	}
+	return snapshot, nil
+}
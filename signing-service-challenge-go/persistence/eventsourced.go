@@ -0,0 +1,625 @@
+package persistence
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
+	"github.com/google/uuid"
+)
+
+type RecordType string
+
+const (
+	RecordDeviceCreated          RecordType = "device_created"
+	RecordSignatureCreated       RecordType = "signature_created"
+	RecordDeviceDeactivated      RecordType = "device_deactivated"
+	RecordDeviceRestored         RecordType = "device_restored"
+	RecordOutboxEventAdded       RecordType = "outbox_event_added"
+	RecordOutboxEventsRemoved    RecordType = "outbox_events_removed"
+	RecordCertificateChainStored RecordType = "certificate_chain_stored"
+	RecordWebhookSaved           RecordType = "webhook_saved"
+	RecordWebhookDeleted         RecordType = "webhook_deleted"
+	RecordWebhookDeliveryAdded   RecordType = "webhook_delivery_added"
+	RecordWebhookDeliveryRemoved RecordType = "webhook_delivery_removed"
+)
+
+// Record is an entry of the event log, describing a single write of a
+// committed transaction. Records are never changed once appended.
+type Record struct {
+	// starts at 1 and has no gaps
+	Sequence uint64
+	Type     RecordType
+	Time     time.Time
+	DeviceID uuid.UUID
+	// only set for RecordDeviceCreated and RecordDeviceRestored
+	Device domain.SignatureDevice
+	// only set for RecordSignatureCreated
+	Signature string
+	// only set for RecordOutboxEventAdded
+	Event domain.Event
+	// only set for RecordOutboxEventsRemoved
+	EventIDs []uuid.UUID
+	// only set for RecordCertificateChainStored
+	CertificateChain [][]byte
+	// only set for RecordWebhookSaved
+	Webhook domain.Webhook
+	// only set for RecordWebhookDeleted
+	WebhookID uuid.UUID
+	// only set for RecordWebhookDeliveryAdded
+	Delivery domain.WebhookDelivery
+	// only set for RecordWebhookDeliveryRemoved
+	DeliveryID uuid.UUID
+}
+
+// Snapshot is the state of all devices, the outbox and the webhooks after
+// the record with Sequence was applied.
+type Snapshot struct {
+	Sequence uint64
+	Devices  []domain.SignatureDevice
+	Outbox   []domain.Event
+	Webhooks []domain.Webhook
+	// in the order they were added
+	WebhookDeliveries []domain.WebhookDelivery
+}
+
+// EventLog stores the records and snapshots of an
+// EventSourcedSignatureDeviceRepositoryProvider.
+type EventLog interface {
+	// Append the records of a transaction atomically, after the last one
+	Append(records []Record) error
+	// Call do for every record with a sequence greater than after, in order
+	Read(after uint64, do func(Record) error) error
+	SaveSnapshot(snapshot Snapshot) error
+	// Return the most recent snapshot, false when none was saved
+	LoadSnapshot() (Snapshot, bool, error)
+}
+
+// InMemoryEventLog keeps all records and the most recent snapshot in
+// memory.
+type InMemoryEventLog struct {
+	mutex    *sync.RWMutex
+	records  *[]Record
+	snapshot *Snapshot
+}
+
+func NewInMemoryEventLog() InMemoryEventLog {
+	return InMemoryEventLog{
+		mutex:    &sync.RWMutex{},
+		records:  &[]Record{},
+		snapshot: &Snapshot{},
+	}
+}
+
+func (log InMemoryEventLog) Append(records []Record) error {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+
+	last := uint64(len(*log.records))
+	for i, record := range records {
+		if record.Sequence != last+uint64(i)+1 {
+			return fmt.Errorf("record %d does not follow record %d", record.Sequence, last+uint64(i))
+		}
+	}
+	*log.records = append(*log.records, records...)
+	return nil
+}
+
+func (log InMemoryEventLog) Read(after uint64, do func(Record) error) error {
+	log.mutex.RLock()
+	// records are never changed, so the slice can be read without the lock
+	records := *log.records
+	log.mutex.RUnlock()
+
+	start := sort.Search(len(records), func(i int) bool {
+		return records[i].Sequence > after
+	})
+	for _, record := range records[start:] {
+		if err := do(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (log InMemoryEventLog) SaveSnapshot(snapshot Snapshot) error {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	*log.snapshot = snapshot
+	return nil
+}
+
+func (log InMemoryEventLog) LoadSnapshot() (Snapshot, bool, error) {
+	log.mutex.RLock()
+	defer log.mutex.RUnlock()
+	if log.snapshot.Sequence == 0 {
+		return Snapshot{}, false, nil
+	}
+	return *log.snapshot, true, nil
+}
+
+// EventSourcedSignatureDeviceRepositoryProvider appends every write to an
+// immutable event log. The current state of the devices is a projection
+// of the log, kept in memory and rebuilt from the most recent snapshot
+// and the records after it when the provider is created.
+// A transaction returning an error leaves neither records nor changes.
+type EventSourcedSignatureDeviceRepositoryProvider struct {
+	log EventLog
+	// records between snapshots, 0 to never save snapshots
+	snapshotInterval int
+
+	mutex *sync.RWMutex
+	// guarded by mutex
+	state         InMemorySignatureDeviceRepository
+	sequence      uint64
+	sinceSnapshot int
+	closed        bool
+}
+
+// NewEventSourcedSignatureDeviceRepositoryProvider rebuilds the state of
+// the devices from the log. A snapshot is saved every snapshotInterval
+// records, so that the next rebuild only has to replay the records after
+// it.
+func NewEventSourcedSignatureDeviceRepositoryProvider(log EventLog, snapshotInterval int) (*EventSourcedSignatureDeviceRepositoryProvider, error) {
+	provider := &EventSourcedSignatureDeviceRepositoryProvider{
+		log:              log,
+		snapshotInterval: snapshotInterval,
+		mutex:            &sync.RWMutex{},
+		state:            NewInMemorySignatureDeviceRepository(),
+	}
+
+	snapshot, found, err := log.LoadSnapshot()
+	if err != nil {
+		return nil, fmt.Errorf("could not load snapshot: %w", err)
+	}
+	if found {
+		for _, device := range snapshot.Devices {
+			if err := provider.state.Create(device); err != nil {
+				return nil, fmt.Errorf("invalid snapshot %d: %w", snapshot.Sequence, err)
+			}
+		}
+		*provider.state.outbox = append(*provider.state.outbox, snapshot.Outbox...)
+		for _, webhook := range snapshot.Webhooks {
+			provider.state.webhooks[webhook.ID] = webhook
+		}
+		*provider.state.deliveries = append(*provider.state.deliveries, snapshot.WebhookDeliveries...)
+		provider.sequence = snapshot.Sequence
+	}
+
+	err = log.Read(provider.sequence, func(record Record) error {
+		if record.Sequence != provider.sequence+1 {
+			return fmt.Errorf("record %d does not follow record %d", record.Sequence, provider.sequence)
+		}
+		if err := apply(provider.state, record); err != nil {
+			return fmt.Errorf("could not apply record %d: %w", record.Sequence, err)
+		}
+		provider.sequence = record.Sequence
+		provider.sinceSnapshot++
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not replay event log: %w", err)
+	}
+
+	return provider, nil
+}
+
+// apply changes the projection according to the record.
+func apply(state InMemorySignatureDeviceRepository, record Record) error {
+	switch record.Type {
+	case RecordDeviceCreated:
+		return state.Create(record.Device)
+	case RecordSignatureCreated:
+		return state.MarkSignatureCreated(record.DeviceID, record.Signature)
+	case RecordDeviceDeactivated:
+		return state.Deactivate(record.DeviceID)
+	case RecordCertificateChainStored:
+		return state.StoreCertificateChain(record.DeviceID, record.CertificateChain)
+	case RecordDeviceRestored:
+		return state.Restore(record.Device)
+	case RecordOutboxEventAdded:
+		return state.AddToOutbox(record.Event)
+	case RecordOutboxEventsRemoved:
+		return state.RemoveFromOutbox(record.EventIDs)
+	case RecordWebhookSaved:
+		return state.SaveWebhook(record.Webhook)
+	case RecordWebhookDeleted:
+		return state.DeleteWebhook(record.WebhookID)
+	case RecordWebhookDeliveryAdded:
+		return state.AddWebhookDelivery(record.Delivery)
+	case RecordWebhookDeliveryRemoved:
+		return state.RemoveWebhookDelivery(record.DeliveryID)
+	default:
+		return fmt.Errorf("unknown record type: %s", record.Type)
+	}
+}
+
+// Use when any of the repository methods in do() write
+func (provider *EventSourcedSignatureDeviceRepositoryProvider) WriteTx(do func(domain.SignatureDeviceRepository) error) error {
+	start := time.Now()
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+	domain.ObserveWriteTxLockAcquired(time.Since(start))
+
+	if provider.closed {
+		return domain.ErrRepositoryProviderClosed
+	}
+
+	tx := newEventSourcedTx(provider.state, false)
+	if err := do(tx); err != nil {
+		return err
+	}
+	if len(tx.records) == 0 {
+		return nil
+	}
+
+	for i := range tx.records {
+		tx.records[i].Sequence = provider.sequence + uint64(i) + 1
+	}
+	if err := provider.log.Append(tx.records); err != nil {
+		return fmt.Errorf("could not append to event log: %w", err)
+	}
+	for _, record := range tx.records {
+		// the transaction has validated the records already
+		if err := apply(provider.state, record); err != nil {
+			return fmt.Errorf("could not apply record %d: %w", record.Sequence, err)
+		}
+		provider.sequence = record.Sequence
+	}
+
+	provider.sinceSnapshot += len(tx.records)
+	if provider.snapshotInterval > 0 && provider.sinceSnapshot >= provider.snapshotInterval {
+		// the transaction is committed regardless, a failed snapshot is
+		// retried after the next one
+		if provider.saveSnapshot() == nil {
+			provider.sinceSnapshot = 0
+		}
+	}
+	return nil
+}
+
+func (provider *EventSourcedSignatureDeviceRepositoryProvider) saveSnapshot() error {
+	devices, err := provider.state.List()
+	if err != nil {
+		return err
+	}
+	webhooks, err := provider.state.ListWebhooks()
+	if err != nil {
+		return err
+	}
+	return provider.log.SaveSnapshot(Snapshot{
+		Sequence:          provider.sequence,
+		Devices:           devices,
+		Outbox:            append([]domain.Event{}, *provider.state.outbox...),
+		Webhooks:          webhooks,
+		WebhookDeliveries: append([]domain.WebhookDelivery{}, *provider.state.deliveries...),
+	})
+}
+
+// Use when none of the repository methods in do() write
+func (provider *EventSourcedSignatureDeviceRepositoryProvider) ReadTx(do func(domain.SignatureDeviceRepository) error) error {
+	provider.mutex.RLock()
+	defer provider.mutex.RUnlock()
+	if provider.closed {
+		return domain.ErrRepositoryProviderClosed
+	}
+	return do(newEventSourcedTx(provider.state, true))
+}
+
+// Close waits for running transactions to finish and rejects all later
+// ones. The log is closed as well when it is an io.Closer.
+func (provider *EventSourcedSignatureDeviceRepositoryProvider) Close() error {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+	if provider.closed {
+		return nil
+	}
+	provider.closed = true
+	if closer, ok := provider.log.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+var errWriteInReadTx = errors.New("cannot write in a read transaction")
+
+// eventSourcedTx records the writes of a transaction, and shows them to
+// the reads of the same transaction, without changing the projection.
+type eventSourcedTx struct {
+	state    InMemorySignatureDeviceRepository
+	readOnly bool
+	records  []Record
+
+	// the devices created or changed in the transaction
+	devices       map[uuid.UUID]domain.SignatureDevice
+	addedEvents   []domain.Event
+	removedEvents map[uuid.UUID]bool
+	// the webhooks saved in the transaction, nil for deleted ones
+	webhooks map[uuid.UUID]*domain.Webhook
+	// the deliveries added in the transaction and not removed again
+	addedDeliveries   []domain.WebhookDelivery
+	removedDeliveries map[uuid.UUID]bool
+}
+
+func newEventSourcedTx(state InMemorySignatureDeviceRepository, readOnly bool) *eventSourcedTx {
+	return &eventSourcedTx{
+		state:             state,
+		readOnly:          readOnly,
+		devices:           map[uuid.UUID]domain.SignatureDevice{},
+		removedEvents:     map[uuid.UUID]bool{},
+		webhooks:          map[uuid.UUID]*domain.Webhook{},
+		removedDeliveries: map[uuid.UUID]bool{},
+	}
+}
+
+func (tx *eventSourcedTx) record(record Record) error {
+	if tx.readOnly {
+		return errWriteInReadTx
+	}
+	record.Time = time.Now()
+	tx.records = append(tx.records, record)
+	return nil
+}
+
+func (tx *eventSourcedTx) Create(device domain.SignatureDevice) error {
+	_, found, err := tx.Find(device.ID)
+	if err != nil {
+		return err
+	}
+	if found {
+		return fmt.Errorf("%w: %s", domain.ErrDuplicateDevice, device.ID)
+	}
+
+	err = tx.record(Record{Type: RecordDeviceCreated, DeviceID: device.ID, Device: device})
+	if err != nil {
+		return err
+	}
+	tx.devices[device.ID] = device
+	return nil
+}
+
+func (tx *eventSourcedTx) MarkSignatureCreated(deviceID uuid.UUID, newSignature string) error {
+	device, found, err := tx.Find(deviceID)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return errors.New("cannot update signature device that does not exist")
+	}
+
+	err = tx.record(Record{Type: RecordSignatureCreated, DeviceID: deviceID, Signature: newSignature})
+	if err != nil {
+		return err
+	}
+	device.SignatureCounter++
+	device.LastSignature = newSignature
+	tx.devices[deviceID] = device
+	return nil
+}
+
+func (tx *eventSourcedTx) Deactivate(deviceID uuid.UUID) error {
+	device, found, err := tx.Find(deviceID)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return errors.New("cannot update signature device that does not exist")
+	}
+
+	err = tx.record(Record{Type: RecordDeviceDeactivated, DeviceID: deviceID})
+	if err != nil {
+		return err
+	}
+	device.Status = domain.DeviceStatusDeactivated
+	tx.devices[deviceID] = device
+	return nil
+}
+
+func (tx *eventSourcedTx) StoreCertificateChain(deviceID uuid.UUID, chain [][]byte) error {
+	device, found, err := tx.Find(deviceID)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return errors.New("cannot update signature device that does not exist")
+	}
+
+	err = tx.record(Record{Type: RecordCertificateChainStored, DeviceID: deviceID, CertificateChain: chain})
+	if err != nil {
+		return err
+	}
+	device.CertificateChain = chain
+	tx.devices[deviceID] = device
+	return nil
+}
+
+func (tx *eventSourcedTx) Restore(device domain.SignatureDevice) error {
+	err := tx.record(Record{Type: RecordDeviceRestored, DeviceID: device.ID, Device: device})
+	if err != nil {
+		return err
+	}
+	tx.devices[device.ID] = device
+	return nil
+}
+
+func (tx *eventSourcedTx) AddToOutbox(event domain.Event) error {
+	err := tx.record(Record{Type: RecordOutboxEventAdded, DeviceID: event.Device.ID, Event: event})
+	if err != nil {
+		return err
+	}
+	tx.addedEvents = append(tx.addedEvents, event)
+	return nil
+}
+
+func (tx *eventSourcedTx) ListOutbox(limit int) ([]domain.Event, error) {
+	committed, err := tx.state.ListOutbox(limit + len(tx.removedEvents))
+	if err != nil {
+		return nil, err
+	}
+
+	outbox := []domain.Event{}
+	for _, event := range append(committed, tx.addedEvents...) {
+		if len(outbox) == limit {
+			break
+		}
+		if !tx.removedEvents[event.ID] {
+			outbox = append(outbox, event)
+		}
+	}
+	return outbox, nil
+}
+
+func (tx *eventSourcedTx) RemoveFromOutbox(eventIDs []uuid.UUID) error {
+	err := tx.record(Record{Type: RecordOutboxEventsRemoved, EventIDs: append([]uuid.UUID{}, eventIDs...)})
+	if err != nil {
+		return err
+	}
+	for _, id := range eventIDs {
+		tx.removedEvents[id] = true
+	}
+	return nil
+}
+
+func (tx *eventSourcedTx) SaveWebhook(webhook domain.Webhook) error {
+	err := tx.record(Record{Type: RecordWebhookSaved, Webhook: webhook})
+	if err != nil {
+		return err
+	}
+	tx.webhooks[webhook.ID] = &webhook
+	return nil
+}
+
+func (tx *eventSourcedTx) DeleteWebhook(id uuid.UUID) error {
+	err := tx.record(Record{Type: RecordWebhookDeleted, WebhookID: id})
+	if err != nil {
+		return err
+	}
+	tx.webhooks[id] = nil
+
+	committed, err := tx.state.ListWebhookDeliveries(id, len(*tx.state.deliveries))
+	if err != nil {
+		return err
+	}
+	for _, delivery := range committed {
+		tx.removedDeliveries[delivery.ID] = true
+	}
+	remaining := []domain.WebhookDelivery{}
+	for _, delivery := range tx.addedDeliveries {
+		if delivery.WebhookID != id {
+			remaining = append(remaining, delivery)
+		}
+	}
+	tx.addedDeliveries = remaining
+	return nil
+}
+
+func (tx *eventSourcedTx) ListWebhooks() ([]domain.Webhook, error) {
+	committed, err := tx.state.ListWebhooks()
+	if err != nil {
+		return nil, err
+	}
+
+	webhooks := []domain.Webhook{}
+	for _, webhook := range committed {
+		if _, changed := tx.webhooks[webhook.ID]; !changed {
+			webhooks = append(webhooks, webhook)
+		}
+	}
+	for _, webhook := range tx.webhooks {
+		if webhook != nil {
+			webhooks = append(webhooks, *webhook)
+		}
+	}
+	sortWebhooksByID(webhooks)
+	return webhooks, nil
+}
+
+func (tx *eventSourcedTx) AddWebhookDelivery(delivery domain.WebhookDelivery) error {
+	err := tx.record(Record{Type: RecordWebhookDeliveryAdded, Delivery: delivery})
+	if err != nil {
+		return err
+	}
+	tx.addedDeliveries = append(tx.addedDeliveries, delivery)
+	return nil
+}
+
+func (tx *eventSourcedTx) ListWebhookDeliveries(webhookID uuid.UUID, limit int) ([]domain.WebhookDelivery, error) {
+	committed, err := tx.state.ListWebhookDeliveries(webhookID, limit+len(tx.removedDeliveries))
+	if err != nil {
+		return nil, err
+	}
+
+	deliveries := []domain.WebhookDelivery{}
+	for _, delivery := range append(committed, tx.addedDeliveries...) {
+		if len(deliveries) == limit {
+			break
+		}
+		if delivery.WebhookID == webhookID && !tx.removedDeliveries[delivery.ID] {
+			deliveries = append(deliveries, delivery)
+		}
+	}
+	return deliveries, nil
+}
+
+func (tx *eventSourcedTx) RemoveWebhookDelivery(id uuid.UUID) error {
+	err := tx.record(Record{Type: RecordWebhookDeliveryRemoved, DeliveryID: id})
+	if err != nil {
+		return err
+	}
+	tx.removedDeliveries[id] = true
+	return nil
+}
+
+func (tx *eventSourcedTx) Find(id uuid.UUID) (domain.SignatureDevice, bool, error) {
+	if device, ok := tx.devices[id]; ok {
+		return device, true, nil
+	}
+	return tx.state.Find(id)
+}
+
+func (tx *eventSourcedTx) List() ([]domain.SignatureDevice, error) {
+	committed, err := tx.state.List()
+	if err != nil {
+		return nil, err
+	}
+
+	allDevices := []domain.SignatureDevice{}
+	for _, device := range committed {
+		if _, changed := tx.devices[device.ID]; !changed {
+			allDevices = append(allDevices, device)
+		}
+	}
+	for _, device := range tx.devices {
+		allDevices = append(allDevices, device)
+	}
+	sortByID(allDevices)
+	return allDevices, nil
+}
+
+func (tx *eventSourcedTx) Count() (map[string]int, error) {
+	counts, err := tx.state.Count()
+	if err != nil {
+		return nil, err
+	}
+	// restored devices may replace ones of another algorithm
+	for id, device := range tx.devices {
+		committed, found, err := tx.state.Find(id)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			counts[algorithmName(committed)]--
+		}
+		counts[algorithmName(device)]++
+	}
+	for algorithm, count := range counts {
+		if count == 0 {
+			delete(counts, algorithm)
+		}
+	}
+	return counts, nil
+}
@@ -0,0 +1,275 @@
+package persistence
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/crypto"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/uuid"
+)
+
+func newEventSourcedProvider(t *testing.T, log EventLog, snapshotInterval int) *EventSourcedSignatureDeviceRepositoryProvider {
+	t.Helper()
+
+	provider, err := NewEventSourcedSignatureDeviceRepositoryProvider(log, snapshotInterval)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return provider
+}
+
+func readRecords(t *testing.T, log EventLog) []Record {
+	t.Helper()
+
+	records := []Record{}
+	err := log.Read(0, func(record Record) error {
+		records = append(records, record)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+// signDevices creates the devices and a signature for each of them, with
+// a device.created event in the outbox.
+func signDevices(t *testing.T, provider domain.SignatureDeviceRepositoryProvider, count int) []uuid.UUID {
+	t.Helper()
+
+	ids := []uuid.UUID{}
+	for i := 0; i < count; i++ {
+		device, err := domain.BuildSignatureDevice(uuid.New(), crypto.ECCGenerator{}, "my ecc key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, device.ID)
+
+		err = provider.WriteTx(func(repository domain.SignatureDeviceRepository) error {
+			if err := repository.Create(device); err != nil {
+				return err
+			}
+			if err := repository.AddToOutbox(domain.Event{ID: uuid.New(), Type: domain.EventDeviceCreated}); err != nil {
+				return err
+			}
+			return repository.MarkSignatureCreated(device.ID, "signature")
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return ids
+}
+
+// state returns all devices by ID and the outbox.
+func state(t *testing.T, provider domain.SignatureDeviceRepositoryProvider) (map[uuid.UUID]domain.SignatureDevice, []domain.Event) {
+	t.Helper()
+
+	devices := map[uuid.UUID]domain.SignatureDevice{}
+	var outbox []domain.Event
+	err := provider.ReadTx(func(repository domain.SignatureDeviceRepository) error {
+		all, err := repository.List()
+		if err != nil {
+			return err
+		}
+		for _, device := range all {
+			devices[device.ID] = device
+		}
+		outbox, err = repository.ListOutbox(1000)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return devices, outbox
+}
+
+func TestEventSourcedConformance(t *testing.T) {
+	testConformance(t, func(t *testing.T) domain.SignatureDeviceRepositoryProvider {
+		return newEventSourcedProvider(t, NewInMemoryEventLog(), 2)
+	})
+}
+
+func TestEventSourced(t *testing.T) {
+	t.Run("appends every write to the log", func(t *testing.T) {
+		log := NewInMemoryEventLog()
+		provider := newEventSourcedProvider(t, log, 0)
+		ids := signDevices(t, provider, 1)
+
+		err := provider.WriteTx(func(repository domain.SignatureDeviceRepository) error {
+			return repository.Deactivate(ids[0])
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got := []RecordType{}
+		for i, record := range readRecords(t, log) {
+			if record.Sequence != uint64(i+1) {
+				t.Errorf("expected sequence %d, got %d", i+1, record.Sequence)
+			}
+			if record.DeviceID != ids[0] && record.Type != RecordOutboxEventAdded {
+				t.Errorf("expected record of device %s, got: %v", ids[0], record)
+			}
+			got = append(got, record.Type)
+		}
+		expected := []RecordType{
+			RecordDeviceCreated,
+			RecordOutboxEventAdded,
+			RecordSignatureCreated,
+			RecordDeviceDeactivated,
+		}
+		if diff := cmp.Diff(got, expected); diff != "" {
+			t.Errorf("unexpected diff: %s", diff)
+		}
+	})
+
+	t.Run("rebuilds the state from the log", func(t *testing.T) {
+		log := NewInMemoryEventLog()
+		provider := newEventSourcedProvider(t, log, 0)
+		signDevices(t, provider, 3)
+		expectedDevices, expectedOutbox := state(t, provider)
+
+		devices, outbox := state(t, newEventSourcedProvider(t, log, 0))
+
+		if diff := cmp.Diff(devices, expectedDevices); diff != "" {
+			t.Errorf("unexpected diff: %s", diff)
+		}
+		if diff := cmp.Diff(outbox, expectedOutbox); diff != "" {
+			t.Errorf("unexpected diff: %s", diff)
+		}
+	})
+
+	t.Run("rebuilds the state from the latest snapshot and the records after it", func(t *testing.T) {
+		log := NewInMemoryEventLog()
+		provider := newEventSourcedProvider(t, log, 5)
+		ids := signDevices(t, provider, 3)
+		err := provider.WriteTx(func(repository domain.SignatureDeviceRepository) error {
+			return repository.MarkSignatureCreated(ids[0], "another signature")
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectedDevices, expectedOutbox := state(t, provider)
+
+		// signing a device writes 3 records, so the snapshot is saved
+		// after the second device, and 4 records follow it
+		snapshot, found, err := log.LoadSnapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !found || snapshot.Sequence != 6 {
+			t.Fatalf("expected a snapshot after record 6, got: %d", snapshot.Sequence)
+		}
+
+		rebuilt := newEventSourcedProvider(t, log, 5)
+		if rebuilt.sinceSnapshot != 4 {
+			t.Errorf("expected 4 records to be replayed, got: %d", rebuilt.sinceSnapshot)
+		}
+		devices, outbox := state(t, rebuilt)
+		if diff := cmp.Diff(devices, expectedDevices); diff != "" {
+			t.Errorf("unexpected diff: %s", diff)
+		}
+		if diff := cmp.Diff(outbox, expectedOutbox); diff != "" {
+			t.Errorf("unexpected diff: %s", diff)
+		}
+	})
+
+	t.Run("discards the writes of failed transactions", func(t *testing.T) {
+		log := NewInMemoryEventLog()
+		provider := newEventSourcedProvider(t, log, 0)
+		ids := signDevices(t, provider, 1)
+		expectedDevices, expectedOutbox := state(t, provider)
+		expectedRecords := readRecords(t, log)
+
+		failure := errors.New("signing failed")
+		err := provider.WriteTx(func(repository domain.SignatureDeviceRepository) error {
+			if err := repository.MarkSignatureCreated(ids[0], "lost signature"); err != nil {
+				return err
+			}
+			if err := repository.Create(domain.SignatureDevice{ID: uuid.New()}); err != nil {
+				return err
+			}
+			return failure
+		})
+		if err != failure {
+			t.Errorf("expected the error of the transaction, got: %v", err)
+		}
+
+		devices, outbox := state(t, provider)
+		if diff := cmp.Diff(devices, expectedDevices); diff != "" {
+			t.Errorf("unexpected diff: %s", diff)
+		}
+		if diff := cmp.Diff(outbox, expectedOutbox); diff != "" {
+			t.Errorf("unexpected diff: %s", diff)
+		}
+		if diff := cmp.Diff(readRecords(t, log), expectedRecords); diff != "" {
+			t.Errorf("unexpected diff: %s", diff)
+		}
+	})
+
+	t.Run("shows the writes of a transaction to its reads", func(t *testing.T) {
+		provider := newEventSourcedProvider(t, NewInMemoryEventLog(), 0)
+		ids := signDevices(t, provider, 1)
+
+		err := provider.WriteTx(func(repository domain.SignatureDeviceRepository) error {
+			if err := repository.MarkSignatureCreated(ids[0], "second signature"); err != nil {
+				return err
+			}
+			device, _, err := repository.Find(ids[0])
+			if err != nil {
+				return err
+			}
+			if device.SignatureCounter != 2 {
+				t.Errorf("expected counter 2, got: %d", device.SignatureCounter)
+			}
+
+			outbox, err := repository.ListOutbox(10)
+			if err != nil {
+				return err
+			}
+			if err := repository.RemoveFromOutbox([]uuid.UUID{outbox[0].ID}); err != nil {
+				return err
+			}
+			outbox, err = repository.ListOutbox(10)
+			if len(outbox) != 0 {
+				t.Errorf("expected the outbox to be empty, got: %v", outbox)
+			}
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("rejects writes in read transactions", func(t *testing.T) {
+		log := NewInMemoryEventLog()
+		provider := newEventSourcedProvider(t, log, 0)
+
+		err := provider.ReadTx(func(repository domain.SignatureDeviceRepository) error {
+			return repository.Create(domain.SignatureDevice{ID: uuid.New()})
+		})
+		if err != errWriteInReadTx {
+			t.Errorf("expected errWriteInReadTx, got: %v", err)
+		}
+		if records := readRecords(t, log); len(records) != 0 {
+			t.Errorf("expected no records, got: %v", records)
+		}
+	})
+
+	t.Run("refuses to rebuild from a log with gaps", func(t *testing.T) {
+		log := NewInMemoryEventLog()
+		err := log.Append([]Record{{Sequence: 2, Type: RecordDeviceCreated}})
+		if err == nil {
+			t.Fatal("expected the log to reject the record")
+		}
+
+		*log.records = append(*log.records, Record{Sequence: 2, Type: RecordDeviceCreated})
+		_, err = NewEventSourcedSignatureDeviceRepositoryProvider(log, 0)
+		if err == nil {
+			t.Error("expected error")
+		}
+	})
+}
@@ -1,9 +1,12 @@
 package persistence
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
 	"github.com/google/uuid"
@@ -12,39 +15,140 @@ import (
 type InMemorySignatureDeviceRepositoryProvider struct {
 	repository InMemorySignatureDeviceRepository
 	mutex      *sync.RWMutex
+	// guarded by mutex
+	closed *bool
 }
 
 // Use when any of the repository methods in do() write
 func (provider InMemorySignatureDeviceRepositoryProvider) WriteTx(do func(domain.SignatureDeviceRepository) error) error {
+	start := time.Now()
 	provider.mutex.Lock()
 	defer provider.mutex.Unlock()
-	return do(provider.repository)
+	domain.ObserveWriteTxLockAcquired(time.Since(start))
+
+	if *provider.closed {
+		return domain.ErrRepositoryProviderClosed
+	}
+	tx := provider.repository
+	tx.journal = &journal{
+		devices:    map[uuid.UUID]*domain.SignatureDevice{},
+		outbox:     *tx.outbox,
+		webhooks:   map[uuid.UUID]*domain.Webhook{},
+		deliveries: *tx.deliveries,
+	}
+	if err := do(tx); err != nil {
+		tx.rollback()
+		return err
+	}
+	return nil
 }
 
 // Use when none of the repository methods in do() write
 func (provider InMemorySignatureDeviceRepositoryProvider) ReadTx(do func(domain.SignatureDeviceRepository) error) error {
 	provider.mutex.RLock()
 	defer provider.mutex.RUnlock()
+	if *provider.closed {
+		return domain.ErrRepositoryProviderClosed
+	}
 	return do(provider.repository)
 }
 
+// Close waits for running transactions to finish and rejects all later ones.
+func (provider InMemorySignatureDeviceRepositoryProvider) Close() error {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+	*provider.closed = true
+	return nil
+}
+
 func NewInMemorySignatureDeviceRepositoryProvider(repository InMemorySignatureDeviceRepository) InMemorySignatureDeviceRepositoryProvider {
 	return InMemorySignatureDeviceRepositoryProvider{
 		repository: repository,
 		mutex:      &sync.RWMutex{},
+		closed:     new(bool),
 	}
 }
 
 type InMemorySignatureDeviceRepository struct {
 	devices map[uuid.UUID]domain.SignatureDevice
+	// a pointer, so that appending is visible to all copies
+	outbox   *[]domain.Event
+	webhooks map[uuid.UUID]domain.Webhook
+	// a pointer like outbox, in the order the deliveries were added
+	deliveries *[]domain.WebhookDelivery
+	// set within write transactions, to undo them when they fail
+	journal *journal
+}
+
+// journal holds the state before a write transaction.
+type journal struct {
+	// nil for devices missing before the transaction
+	devices map[uuid.UUID]*domain.SignatureDevice
+	outbox  []domain.Event
+	// nil for webhooks missing before the transaction
+	webhooks   map[uuid.UUID]*domain.Webhook
+	deliveries []domain.WebhookDelivery
+}
+
+// remember keeps the device with the ID as it was before the transaction.
+func (repository InMemorySignatureDeviceRepository) remember(id uuid.UUID) {
+	if repository.journal == nil {
+		return
+	}
+	if _, ok := repository.journal.devices[id]; ok {
+		return
+	}
+	if device, ok := repository.devices[id]; ok {
+		repository.journal.devices[id] = &device
+	} else {
+		repository.journal.devices[id] = nil
+	}
+}
+
+// rememberWebhook keeps the webhook with the ID as it was before the
+// transaction.
+func (repository InMemorySignatureDeviceRepository) rememberWebhook(id uuid.UUID) {
+	if repository.journal == nil {
+		return
+	}
+	if _, ok := repository.journal.webhooks[id]; ok {
+		return
+	}
+	if webhook, ok := repository.webhooks[id]; ok {
+		repository.journal.webhooks[id] = &webhook
+	} else {
+		repository.journal.webhooks[id] = nil
+	}
+}
+
+// rollback restores the state before the transaction. Appending to the
+// outbox or the deliveries does not change the remembered slices.
+func (repository InMemorySignatureDeviceRepository) rollback() {
+	for id, device := range repository.journal.devices {
+		if device == nil {
+			delete(repository.devices, id)
+		} else {
+			repository.devices[id] = *device
+		}
+	}
+	*repository.outbox = repository.journal.outbox
+	for id, webhook := range repository.journal.webhooks {
+		if webhook == nil {
+			delete(repository.webhooks, id)
+		} else {
+			repository.webhooks[id] = *webhook
+		}
+	}
+	*repository.deliveries = repository.journal.deliveries
 }
 
 func (repository InMemorySignatureDeviceRepository) Create(device domain.SignatureDevice) error {
 	_, ok := repository.devices[device.ID]
 	if ok {
-		return errors.New(fmt.Sprintf("duplicate id: %s", device.ID))
+		return fmt.Errorf("%w: %s", domain.ErrDuplicateDevice, device.ID)
 	}
 
+	repository.remember(device.ID)
 	repository.devices[device.ID] = device
 	return nil
 }
@@ -57,11 +161,128 @@ func (repository InMemorySignatureDeviceRepository) MarkSignatureCreated(deviceI
 
 	device.SignatureCounter++
 	device.LastSignature = newSignature
+	repository.remember(deviceID)
 	repository.devices[deviceID] = device
 
 	return nil
 }
 
+func (repository InMemorySignatureDeviceRepository) Deactivate(deviceID uuid.UUID) error {
+	device, ok := repository.devices[deviceID]
+	if !ok {
+		return errors.New("cannot update signature device that does not exist")
+	}
+	device.Status = domain.DeviceStatusDeactivated
+	repository.remember(deviceID)
+	repository.devices[deviceID] = device
+	return nil
+}
+
+func (repository InMemorySignatureDeviceRepository) StoreCertificateChain(deviceID uuid.UUID, chain [][]byte) error {
+	device, ok := repository.devices[deviceID]
+	if !ok {
+		return errors.New("cannot update signature device that does not exist")
+	}
+	device.CertificateChain = chain
+	repository.remember(deviceID)
+	repository.devices[deviceID] = device
+	return nil
+}
+
+func (repository InMemorySignatureDeviceRepository) Restore(device domain.SignatureDevice) error {
+	repository.remember(device.ID)
+	repository.devices[device.ID] = device
+	return nil
+}
+
+func (repository InMemorySignatureDeviceRepository) AddToOutbox(event domain.Event) error {
+	*repository.outbox = append(*repository.outbox, event)
+	return nil
+}
+
+func (repository InMemorySignatureDeviceRepository) ListOutbox(limit int) ([]domain.Event, error) {
+	outbox := *repository.outbox
+	if len(outbox) > limit {
+		outbox = outbox[:limit]
+	}
+	return append([]domain.Event{}, outbox...), nil
+}
+
+func (repository InMemorySignatureDeviceRepository) RemoveFromOutbox(eventIDs []uuid.UUID) error {
+	removed := map[uuid.UUID]bool{}
+	for _, id := range eventIDs {
+		removed[id] = true
+	}
+
+	remaining := []domain.Event{}
+	for _, event := range *repository.outbox {
+		if !removed[event.ID] {
+			remaining = append(remaining, event)
+		}
+	}
+	*repository.outbox = remaining
+	return nil
+}
+
+func (repository InMemorySignatureDeviceRepository) SaveWebhook(webhook domain.Webhook) error {
+	repository.rememberWebhook(webhook.ID)
+	repository.webhooks[webhook.ID] = webhook
+	return nil
+}
+
+func (repository InMemorySignatureDeviceRepository) DeleteWebhook(id uuid.UUID) error {
+	repository.rememberWebhook(id)
+	delete(repository.webhooks, id)
+
+	remaining := []domain.WebhookDelivery{}
+	for _, delivery := range *repository.deliveries {
+		if delivery.WebhookID != id {
+			remaining = append(remaining, delivery)
+		}
+	}
+	*repository.deliveries = remaining
+	return nil
+}
+
+// Go maps are not ordered, so the webhooks are sorted by ID.
+func (repository InMemorySignatureDeviceRepository) ListWebhooks() ([]domain.Webhook, error) {
+	webhooks := []domain.Webhook{}
+	for _, webhook := range repository.webhooks {
+		webhooks = append(webhooks, webhook)
+	}
+	sortWebhooksByID(webhooks)
+	return webhooks, nil
+}
+
+func (repository InMemorySignatureDeviceRepository) AddWebhookDelivery(delivery domain.WebhookDelivery) error {
+	*repository.deliveries = append(*repository.deliveries, delivery)
+	return nil
+}
+
+func (repository InMemorySignatureDeviceRepository) ListWebhookDeliveries(webhookID uuid.UUID, limit int) ([]domain.WebhookDelivery, error) {
+	deliveries := []domain.WebhookDelivery{}
+	for _, delivery := range *repository.deliveries {
+		if len(deliveries) == limit {
+			break
+		}
+		if delivery.WebhookID == webhookID {
+			deliveries = append(deliveries, delivery)
+		}
+	}
+	return deliveries, nil
+}
+
+func (repository InMemorySignatureDeviceRepository) RemoveWebhookDelivery(id uuid.UUID) error {
+	remaining := []domain.WebhookDelivery{}
+	for _, delivery := range *repository.deliveries {
+		if delivery.ID != id {
+			remaining = append(remaining, delivery)
+		}
+	}
+	*repository.deliveries = remaining
+	return nil
+}
+
 func (repository InMemorySignatureDeviceRepository) Find(id uuid.UUID) (domain.SignatureDevice, bool, error) {
 	device, ok := repository.devices[id]
 	if !ok {
@@ -71,11 +292,7 @@ func (repository InMemorySignatureDeviceRepository) Find(id uuid.UUID) (domain.S
 	return device, true, nil
 }
 
-// Order is not guaranteed
-// ref: https://go.dev/blog/maps
-// > When iterating over a map with a range loop, the iteration order is not specified and is not guaranteed
-// > to be the same from one iteration to the next. If you require a stable iteration order you must maintain
-// > a separate data structure that specifies that order.
+// Go maps are not ordered, so the devices are sorted by ID.
 func (repository InMemorySignatureDeviceRepository) List() ([]domain.SignatureDevice, error) {
 	allDevices := []domain.SignatureDevice{}
 
@@ -83,11 +300,44 @@ func (repository InMemorySignatureDeviceRepository) List() ([]domain.SignatureDe
 		allDevices = append(allDevices, device)
 	}
 
+	sortByID(allDevices)
 	return allDevices, nil
 }
 
+func (repository InMemorySignatureDeviceRepository) Count() (map[string]int, error) {
+	counts := map[string]int{}
+	for _, device := range repository.devices {
+		counts[algorithmName(device)]++
+	}
+	return counts, nil
+}
+
+// algorithmName returns the name of the algorithm of the device, empty for
+// devices without key pair.
+func algorithmName(device domain.SignatureDevice) string {
+	if device.KeyPair == nil {
+		return ""
+	}
+	return device.KeyPair.AlgorithmName()
+}
+
+func sortByID(devices []domain.SignatureDevice) {
+	sort.Slice(devices, func(a, b int) bool {
+		return bytes.Compare(devices[a].ID[:], devices[b].ID[:]) < 0
+	})
+}
+
+func sortWebhooksByID(webhooks []domain.Webhook) {
+	sort.Slice(webhooks, func(a, b int) bool {
+		return bytes.Compare(webhooks[a].ID[:], webhooks[b].ID[:]) < 0
+	})
+}
+
 func NewInMemorySignatureDeviceRepository() InMemorySignatureDeviceRepository {
 	return InMemorySignatureDeviceRepository{
-		devices: map[uuid.UUID]domain.SignatureDevice{},
+		devices:    map[uuid.UUID]domain.SignatureDevice{},
+		outbox:     &[]domain.Event{},
+		webhooks:   map[uuid.UUID]domain.Webhook{},
+		deliveries: &[]domain.WebhookDelivery{},
 	}
 }
@@ -1,6 +1,7 @@
 package persistence
 
 import (
+	"reflect"
 	"testing"
 
 	"github.com/fiskaly/coding-challenges/signing-service-challenge/crypto"
@@ -125,6 +126,68 @@ func TestMarkSignatureCreated(t *testing.T) {
 	})
 }
 
+func TestDeactivate(t *testing.T) {
+	t.Run("sets the status when device with id is found", func(t *testing.T) {
+		device := domain.SignatureDevice{
+			ID:     uuid.New(),
+			Label:  "my rsa key",
+			Status: domain.DeviceStatusActive,
+		}
+		repository := NewInMemorySignatureDeviceRepository()
+		repository.devices[device.ID] = device
+
+		err := repository.Deactivate(device.ID)
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+
+		got := repository.devices[device.ID]
+		if got.Status != domain.DeviceStatusDeactivated {
+			t.Errorf("expected status to be deactivated, got %s", got.Status)
+		}
+	})
+
+	t.Run("returns error when device with id is not found", func(t *testing.T) {
+		repository := NewInMemorySignatureDeviceRepository()
+		err := repository.Deactivate(uuid.New())
+		if err == nil {
+			t.Error("expected error when updating non-existent device")
+		}
+	})
+}
+
+func TestOutbox(t *testing.T) {
+	repository := NewInMemorySignatureDeviceRepository()
+	events := []domain.Event{}
+	for i := 0; i < 3; i++ {
+		event := domain.Event{ID: uuid.New(), Type: domain.EventSignatureCreated}
+		events = append(events, event)
+		if err := repository.AddToOutbox(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := repository.ListOutbox(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(got, events[:2]); diff != "" {
+		t.Errorf("expected the oldest events, diff: %s", diff)
+	}
+
+	err = repository.RemoveFromOutbox([]uuid.UUID{events[0].ID, events[1].ID, uuid.New()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = repository.ListOutbox(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(got, events[2:]); diff != "" {
+		t.Errorf("expected the removed events to be gone, diff: %s", diff)
+	}
+}
+
 func TestFind(t *testing.T) {
 	t.Run("returns the device when device with id exists", func(t *testing.T) {
 		device := domain.SignatureDevice{
@@ -195,10 +258,34 @@ func TestList(t *testing.T) {
 		t.Errorf("expected 2 devices, got %d", len(got))
 	}
 
-	if got[0] != rsaDevice && got[1] != rsaDevice {
+	if !reflect.DeepEqual(got[0], rsaDevice) && !reflect.DeepEqual(got[1], rsaDevice) {
 		t.Error("expected got to contain rsa device")
 	}
-	if got[0] != eccDevice && got[1] != eccDevice {
+	if !reflect.DeepEqual(got[0], eccDevice) && !reflect.DeepEqual(got[1], eccDevice) {
 		t.Error("expected got to contain ecc device")
 	}
 }
+
+func TestClose(t *testing.T) {
+	provider := NewInMemorySignatureDeviceRepositoryProvider(NewInMemorySignatureDeviceRepository())
+
+	err := provider.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = provider.WriteTx(func(domain.SignatureDeviceRepository) error { return nil })
+	if err != domain.ErrRepositoryProviderClosed {
+		t.Errorf("expected ErrRepositoryProviderClosed from WriteTx, got: %v", err)
+	}
+	err = provider.ReadTx(func(domain.SignatureDeviceRepository) error { return nil })
+	if err != domain.ErrRepositoryProviderClosed {
+		t.Errorf("expected ErrRepositoryProviderClosed from ReadTx, got: %v", err)
+	}
+}
+
+func TestInMemoryConformance(t *testing.T) {
+	testConformance(t, func(t *testing.T) domain.SignatureDeviceRepositoryProvider {
+		return NewInMemorySignatureDeviceRepositoryProvider(NewInMemorySignatureDeviceRepository())
+	})
+}
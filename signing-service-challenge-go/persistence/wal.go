@@ -0,0 +1,443 @@
+package persistence
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/crypto"
+)
+
+const (
+	walFileName      = "wal"
+	snapshotFileName = "snapshot"
+)
+
+// ErrCorruptLog is returned when a file of a FileEventLog contains an
+// invalid entry that is not the torn tail of an interrupted write.
+var ErrCorruptLog = errors.New("event log is corrupt")
+
+// Every entry is framed as
+//
+//	| payload length: uint32 | CRC-32C of the length: uint32 | CRC-32C of the payload: uint32 | payload |
+//
+// in big endian. The payload of a WAL entry is the JSON array of the
+// records of a transaction, so that transactions are replayed entirely
+// or not at all. The length has its own checksum, so that a corrupt
+// length is not mistaken for a payload cut short by a torn write.
+const entryHeaderSize = 12
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+func appendEntry(buffer []byte, payload []byte) []byte {
+	buffer = binary.BigEndian.AppendUint32(buffer, uint32(len(payload)))
+	buffer = binary.BigEndian.AppendUint32(buffer, crc32.Checksum(buffer[len(buffer)-4:], crc32c))
+	buffer = binary.BigEndian.AppendUint32(buffer, crc32.Checksum(payload, crc32c))
+	return append(buffer, payload...)
+}
+
+// parseEntries calls do for every entry of data, and returns the length
+// of the valid entries. What follows them is the torn tail of an
+// interrupted write, unless an error is returned.
+func parseEntries(data []byte, do func(payload []byte) error) (int, error) {
+	offset := 0
+	for offset < len(data) {
+		rest := data[offset:]
+		// zeroes are left by a torn write that extended the file
+		if len(rest) < entryHeaderSize || isZero(rest) {
+			return offset, nil
+		}
+		length := binary.BigEndian.Uint32(rest)
+		if crc32.Checksum(rest[:4], crc32c) != binary.BigEndian.Uint32(rest[4:]) {
+			return offset, fmt.Errorf("%w: invalid length at offset %d", ErrCorruptLog, offset)
+		}
+		// empty entries are never written
+		if length == 0 {
+			return offset, fmt.Errorf("%w: empty entry at offset %d", ErrCorruptLog, offset)
+		}
+		// the header was written, but not the whole payload
+		if uint64(length) > uint64(len(rest)-entryHeaderSize) {
+			return offset, nil
+		}
+
+		checksum := binary.BigEndian.Uint32(rest[8:])
+		end := entryHeaderSize + int(length)
+		payload := rest[entryHeaderSize:end]
+		if crc32.Checksum(payload, crc32c) != checksum {
+			if end == len(rest) {
+				return offset, nil
+			}
+			return offset, fmt.Errorf("%w: invalid checksum at offset %d", ErrCorruptLog, offset)
+		}
+		if err := do(payload); err != nil {
+			return offset, err
+		}
+		offset += end
+	}
+	return offset, nil
+}
+
+func isZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// FileEventLog is an EventLog for devices without a database. Every
+// transaction is appended to a write-ahead log file and synced to disk
+// before Append returns. Saving a snapshot compacts the log: the snapshot
+// replaces the records before it, so these cannot be read anymore.
+// Only one process may open the directory at a time.
+//
+// The private keys of the devices are encrypted in both files when the
+// log is opened with a key. Without one, the directory holds them as
+// plain PEM, and must be protected like the keys themselves.
+type FileEventLog struct {
+	dir string
+	// nil when the private keys are not encrypted
+	aead cipher.AEAD
+
+	mutex sync.Mutex
+	// guarded by mutex
+	wal      *os.File
+	size     int64
+	sequence uint64
+}
+
+// OpenFileEventLog opens the log in dir, creating it when it does not
+// exist. The torn tail of a write interrupted by a crash is truncated;
+// it belongs to a transaction that was never committed.
+// The private keys written are encrypted with key, an AES-256 key, unless
+// it is empty. Private keys written without key are still read with one,
+// and are encrypted by the next snapshot.
+func OpenFileEventLog(dir string, key []byte) (*FileEventLog, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	log := &FileEventLog{dir: dir}
+	if len(key) > 0 {
+		aead, err := crypto.NewAEAD("storage key", key)
+		if err != nil {
+			return nil, err
+		}
+		log.aead = aead
+	}
+	snapshot, found, err := log.LoadSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		log.sequence = snapshot.Sequence
+	}
+
+	path := filepath.Join(dir, walFileName)
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	valid, err := parseEntries(data, func(payload []byte) error {
+		records, err := log.decodeEntry(payload)
+		if err != nil {
+			return err
+		}
+		last := records[len(records)-1].Sequence
+		if last > log.sequence {
+			log.sequence = last
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.wal, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	if valid < len(data) {
+		if err := log.truncate(int64(valid)); err != nil {
+			log.wal.Close()
+			return nil, fmt.Errorf("could not truncate torn tail: %w", err)
+		}
+	}
+	log.size = int64(valid)
+	if err := syncDir(dir); err != nil {
+		log.wal.Close()
+		return nil, err
+	}
+	return log, nil
+}
+
+func (log *FileEventLog) decodeEntry(payload []byte) ([]Record, error) {
+	var encoded []encodedRecord
+	if err := json.Unmarshal(payload, &encoded); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrCorruptLog, err)
+	}
+	if len(encoded) == 0 {
+		return nil, fmt.Errorf("%w: empty entry", ErrCorruptLog)
+	}
+
+	records := []Record{}
+	for _, encodedRecord := range encoded {
+		if encodedRecord.Device != nil {
+			if err := encodedRecord.Device.open(log.aead); err != nil {
+				return nil, err
+			}
+		}
+		record, err := encodedRecord.decode()
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+func (log *FileEventLog) truncate(size int64) error {
+	if err := log.wal.Truncate(size); err != nil {
+		return err
+	}
+	return log.wal.Sync()
+}
+
+func (log *FileEventLog) Append(records []Record) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+
+	encoded := []encodedRecord{}
+	for i, record := range records {
+		if record.Sequence != log.sequence+uint64(i)+1 {
+			return fmt.Errorf("record %d does not follow record %d", record.Sequence, log.sequence+uint64(i))
+		}
+		encodedRecord, err := encodeRecord(record)
+		if err != nil {
+			return err
+		}
+		if encodedRecord.Device != nil && log.aead != nil {
+			if err := encodedRecord.Device.seal(log.aead); err != nil {
+				return err
+			}
+		}
+		encoded = append(encoded, encodedRecord)
+	}
+	payload, err := json.Marshal(encoded)
+	if err != nil {
+		return err
+	}
+
+	entry := appendEntry(nil, payload)
+	if _, err := log.wal.WriteAt(entry, log.size); err != nil {
+		// a partial entry would be taken for a torn tail, but it must not
+		// be followed by the next one
+		log.truncate(log.size)
+		return err
+	}
+	if err := log.wal.Sync(); err != nil {
+		log.truncate(log.size)
+		return err
+	}
+	log.size += int64(len(entry))
+	log.sequence = records[len(records)-1].Sequence
+	return nil
+}
+
+func (log *FileEventLog) Read(after uint64, do func(Record) error) error {
+	log.mutex.Lock()
+	data := make([]byte, log.size)
+	_, err := log.wal.ReadAt(data, 0)
+	log.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	_, err = parseEntries(data, func(payload []byte) error {
+		records, err := log.decodeEntry(payload)
+		if err != nil {
+			return err
+		}
+		for _, record := range records {
+			if record.Sequence <= after {
+				continue
+			}
+			if err := do(record); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return err
+}
+
+// SaveSnapshot replaces the snapshot file atomically, and then removes
+// the records before the snapshot from the write-ahead log.
+func (log *FileEventLog) SaveSnapshot(snapshot Snapshot) error {
+	encoded, err := encodeSnapshot(snapshot)
+	if err != nil {
+		return err
+	}
+	if log.aead != nil {
+		for i := range encoded.Devices {
+			if err := encoded.Devices[i].seal(log.aead); err != nil {
+				return err
+			}
+		}
+	}
+	payload, err := json.Marshal(encoded)
+	if err != nil {
+		return err
+	}
+
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+
+	if err := writeFileAtomically(filepath.Join(log.dir, snapshotFileName), appendEntry(nil, payload)); err != nil {
+		return fmt.Errorf("could not write snapshot: %w", err)
+	}
+	return log.compact(snapshot.Sequence)
+}
+
+// compact rewrites the write-ahead log without the records up to
+// sequence. A crash while compacting leaves the previous log, whose
+// records up to sequence are skipped when reading after the snapshot.
+func (log *FileEventLog) compact(sequence uint64) error {
+	data := make([]byte, log.size)
+	if _, err := log.wal.ReadAt(data, 0); err != nil {
+		return err
+	}
+
+	compacted := []byte{}
+	_, err := parseEntries(data, func(payload []byte) error {
+		records, err := log.decodeEntry(payload)
+		if err != nil {
+			return err
+		}
+		// transactions are never split by a snapshot
+		if records[len(records)-1].Sequence > sequence {
+			compacted = appendEntry(compacted, payload)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(log.dir, walFileName)
+	if err := writeFileAtomically(path, compacted); err != nil {
+		return fmt.Errorf("could not compact write-ahead log: %w", err)
+	}
+	wal, err := os.OpenFile(path, os.O_RDWR, 0o600)
+	if err != nil {
+		return err
+	}
+	log.wal.Close()
+	log.wal = wal
+	log.size = int64(len(compacted))
+	return nil
+}
+
+func (log *FileEventLog) LoadSnapshot() (Snapshot, bool, error) {
+	data, err := os.ReadFile(filepath.Join(log.dir, snapshotFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return Snapshot{}, false, nil
+	}
+	if err != nil {
+		return Snapshot{}, false, err
+	}
+
+	var encoded *encodedSnapshot
+	valid, err := parseEntries(data, func(payload []byte) error {
+		encoded = &encodedSnapshot{}
+		return json.Unmarshal(payload, encoded)
+	})
+	if err != nil {
+		return Snapshot{}, false, err
+	}
+	// snapshots are replaced atomically, so they cannot be torn
+	if encoded == nil || valid != len(data) {
+		return Snapshot{}, false, fmt.Errorf("%w: invalid snapshot", ErrCorruptLog)
+	}
+	for i := range encoded.Devices {
+		if err := encoded.Devices[i].open(log.aead); err != nil {
+			return Snapshot{}, false, err
+		}
+	}
+
+	snapshot, err := encoded.decode()
+	if err != nil {
+		return Snapshot{}, false, err
+	}
+	return snapshot, true, nil
+}
+
+func (log *FileEventLog) Close() error {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	return log.wal.Close()
+}
+
+// writeFileAtomically replaces the file at path with data, so that
+// either the old or the new content is found after a crash.
+func writeFileAtomically(path string, data []byte) error {
+	temporary := path + ".tmp"
+	file, err := os.OpenFile(temporary, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(temporary, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir makes the creation and renaming of the files in dir durable.
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
+
+// NewFileSignatureDeviceRepositoryProvider keeps the devices in memory and
+// appends every write to the FileEventLog in dir, from which they are
+// replayed on startup. A snapshot compacts the log every snapshotInterval
+// records. The private keys are encrypted with key, unless it is empty,
+// see OpenFileEventLog.
+func NewFileSignatureDeviceRepositoryProvider(dir string, snapshotInterval int, key []byte) (*EventSourcedSignatureDeviceRepositoryProvider, error) {
+	log, err := OpenFileEventLog(dir, key)
+	if err != nil {
+		return nil, err
+	}
+	provider, err := NewEventSourcedSignatureDeviceRepositoryProvider(log, snapshotInterval)
+	if err != nil {
+		log.Close()
+		return nil, err
+	}
+	return provider, nil
+}
@@ -0,0 +1,415 @@
+package persistence
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/crypto"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/uuid"
+)
+
+func openFileProvider(t *testing.T, dir string, snapshotInterval int) *EventSourcedSignatureDeviceRepositoryProvider {
+	t.Helper()
+	return openEncryptedFileProvider(t, dir, snapshotInterval, nil)
+}
+
+func openEncryptedFileProvider(t *testing.T, dir string, snapshotInterval int, key []byte) *EventSourcedSignatureDeviceRepositoryProvider {
+	t.Helper()
+
+	provider, err := NewFileSignatureDeviceRepositoryProvider(dir, snapshotInterval, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { provider.Close() })
+	return provider
+}
+
+// comparableDevices returns the devices with the encoded public keys instead of
+// the key pairs, as decoded key pairs are not equal to the original ones.
+func comparableDevices(t *testing.T, devices map[uuid.UUID]domain.SignatureDevice) map[uuid.UUID]any {
+	t.Helper()
+
+	type comparableDevice struct {
+		domain.SignatureDevice
+		PublicKey string
+	}
+	result := map[uuid.UUID]any{}
+	for id, device := range devices {
+		publicKey, err := device.KeyPair.EncodedPublicKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		device.KeyPair = nil
+		result[id] = comparableDevice{device, publicKey}
+	}
+	return result
+}
+
+func signatureCounter(t *testing.T, provider domain.SignatureDeviceRepositoryProvider, id uuid.UUID) uint {
+	t.Helper()
+
+	var device domain.SignatureDevice
+	err := provider.ReadTx(func(repository domain.SignatureDeviceRepository) error {
+		var err error
+		device, _, err = repository.Find(id)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return device.SignatureCounter
+}
+
+func markSignatureCreated(t *testing.T, provider domain.SignatureDeviceRepositoryProvider, id uuid.UUID) {
+	t.Helper()
+
+	err := provider.WriteTx(func(repository domain.SignatureDeviceRepository) error {
+		return repository.MarkSignatureCreated(id, "signature")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func fileSize(t *testing.T, path string) int64 {
+	t.Helper()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Size()
+}
+
+func TestFileConformance(t *testing.T) {
+	testConformance(t, func(t *testing.T) domain.SignatureDeviceRepositoryProvider {
+		return openFileProvider(t, t.TempDir(), 2)
+	})
+}
+
+func TestFileEventLog(t *testing.T) {
+	t.Run("replays the committed transactions on startup", func(t *testing.T) {
+		dir := t.TempDir()
+		provider := openFileProvider(t, dir, 0)
+		signDevices(t, provider, 3)
+		expectedDevices, expectedOutbox := state(t, provider)
+		if err := provider.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		devices, outbox := state(t, openFileProvider(t, dir, 0))
+
+		if diff := cmp.Diff(comparableDevices(t, devices), comparableDevices(t, expectedDevices)); diff != "" {
+			t.Errorf("unexpected diff: %s", diff)
+		}
+		if diff := cmp.Diff(outbox, expectedOutbox); diff != "" {
+			t.Errorf("unexpected diff: %s", diff)
+		}
+	})
+
+	t.Run("does not lose committed counters when a write is torn by a crash", func(t *testing.T) {
+		dir := t.TempDir()
+		provider := openFileProvider(t, dir, 0)
+		id := signDevices(t, provider, 1)[0]
+		markSignatureCreated(t, provider, id)
+
+		walPath := filepath.Join(dir, walFileName)
+		committedSize := fileSize(t, walPath)
+		// the entry of the last transaction is cut at every offset below
+		markSignatureCreated(t, provider, id)
+		if err := provider.Close(); err != nil {
+			t.Fatal(err)
+		}
+		wal, err := os.ReadFile(walPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for size := committedSize; size < int64(len(wal)); size++ {
+			crashedDir := t.TempDir()
+			err := os.WriteFile(filepath.Join(crashedDir, walFileName), wal[:size], 0o600)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			recovered := openFileProvider(t, crashedDir, 0)
+			if counter := signatureCounter(t, recovered, id); counter != 2 {
+				t.Fatalf("expected counter 2 after a write torn at %d bytes, got: %d", size-committedSize, counter)
+			}
+
+			// the torn tail must not hide the transactions after it
+			markSignatureCreated(t, recovered, id)
+			if err := recovered.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if counter := signatureCounter(t, openFileProvider(t, crashedDir, 0), id); counter != 3 {
+				t.Fatalf("expected counter 3 after recovering from a write torn at %d bytes, got: %d", size-committedSize, counter)
+			}
+		}
+	})
+
+	t.Run("truncates zeroes left by a torn write", func(t *testing.T) {
+		dir := t.TempDir()
+		provider := openFileProvider(t, dir, 0)
+		id := signDevices(t, provider, 1)[0]
+		if err := provider.Close(); err != nil {
+			t.Fatal(err)
+		}
+		walPath := filepath.Join(dir, walFileName)
+		committedSize := fileSize(t, walPath)
+
+		file, err := os.OpenFile(walPath, os.O_WRONLY|os.O_APPEND, 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Write(make([]byte, 100))
+		file.Close()
+
+		recovered := openFileProvider(t, dir, 0)
+		if counter := signatureCounter(t, recovered, id); counter != 1 {
+			t.Errorf("expected counter 1, got: %d", counter)
+		}
+		if size := fileSize(t, walPath); size != committedSize {
+			t.Errorf("expected the log to be truncated to %d bytes, got: %d", committedSize, size)
+		}
+	})
+
+	t.Run("refuses to open a log corrupted before its end", func(t *testing.T) {
+		dir := t.TempDir()
+		provider := openFileProvider(t, dir, 0)
+		signDevices(t, provider, 2)
+		if err := provider.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		walPath := filepath.Join(dir, walFileName)
+		wal, err := os.ReadFile(walPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wal[entryHeaderSize+1] ^= 0xff
+		if err := os.WriteFile(walPath, wal, 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = NewFileSignatureDeviceRepositoryProvider(dir, 0, nil)
+		if !errors.Is(err, ErrCorruptLog) {
+			t.Errorf("expected ErrCorruptLog, got: %v", err)
+		}
+	})
+
+	t.Run("refuses to open a log with a corrupt length before its end", func(t *testing.T) {
+		for name, length := range map[string]uint32{"empty": 0, "past the end": 1 << 30} {
+			dir := t.TempDir()
+			provider := openFileProvider(t, dir, 0)
+			signDevices(t, provider, 2)
+			if err := provider.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			walPath := filepath.Join(dir, walFileName)
+			wal, err := os.ReadFile(walPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			binary.BigEndian.PutUint32(wal, length)
+			if err := os.WriteFile(walPath, wal, 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = NewFileSignatureDeviceRepositoryProvider(dir, 0, nil)
+			if !errors.Is(err, ErrCorruptLog) {
+				t.Errorf("expected ErrCorruptLog for a length %s, got: %v", name, err)
+			}
+			if size := fileSize(t, walPath); size != int64(len(wal)) {
+				t.Errorf("expected the log to be kept, got %d of %d bytes", size, len(wal))
+			}
+		}
+	})
+
+	t.Run("encrypts the private keys with a key", func(t *testing.T) {
+		dir := t.TempDir()
+		key := bytes.Repeat([]byte{1}, crypto.AEADKeySize)
+		// written before the key was configured
+		ids := signDevices(t, openFileProvider(t, dir, 0), 1)
+		provider := openEncryptedFileProvider(t, dir, 0, key)
+		signDevices(t, provider, 1)
+		if err := provider.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		wal, err := os.ReadFile(filepath.Join(dir, walFileName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if keys := bytes.Count(wal, []byte("-----BEGIN")); keys != 1 {
+			t.Errorf("expected only the private key written without key in plain text, got %d", keys)
+		}
+		if _, err := NewFileSignatureDeviceRepositoryProvider(dir, 0, nil); err == nil {
+			t.Error("expected an error without key")
+		}
+		if _, err := NewFileSignatureDeviceRepositoryProvider(dir, 0, bytes.Repeat([]byte{2}, crypto.AEADKeySize)); err == nil {
+			t.Error("expected an error with another key")
+		}
+
+		// the snapshot encrypts the private keys written before
+		provider = openEncryptedFileProvider(t, dir, 1, key)
+		markSignatureCreated(t, provider, ids[0])
+		expectedDevices, _ := state(t, provider)
+		if err := provider.Close(); err != nil {
+			t.Fatal(err)
+		}
+		snapshot, err := os.ReadFile(filepath.Join(dir, snapshotFileName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if keys := bytes.Count(snapshot, []byte("-----BEGIN")); keys != 0 {
+			t.Errorf("expected no private key in plain text, got %d", keys)
+		}
+
+		devices, _ := state(t, openEncryptedFileProvider(t, dir, 0, key))
+		if diff := cmp.Diff(comparableDevices(t, devices), comparableDevices(t, expectedDevices)); diff != "" {
+			t.Errorf("unexpected diff: %s", diff)
+		}
+	})
+
+	t.Run("compacts the log into a snapshot", func(t *testing.T) {
+		dir := t.TempDir()
+		provider := openFileProvider(t, dir, 5)
+		ids := signDevices(t, provider, 2)
+		markSignatureCreated(t, provider, ids[0])
+		expectedDevices, expectedOutbox := state(t, provider)
+		if err := provider.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// the snapshot after the second device leaves 1 record in the log
+		log, err := OpenFileEventLog(dir, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records := readRecords(t, log)
+		log.Close()
+		if len(records) != 1 || records[0].Sequence != 7 {
+			t.Errorf("expected only record 7 to be left, got: %v", records)
+		}
+
+		devices, outbox := state(t, openFileProvider(t, dir, 5))
+		if diff := cmp.Diff(comparableDevices(t, devices), comparableDevices(t, expectedDevices)); diff != "" {
+			t.Errorf("unexpected diff: %s", diff)
+		}
+		if diff := cmp.Diff(outbox, expectedOutbox); diff != "" {
+			t.Errorf("unexpected diff: %s", diff)
+		}
+	})
+
+	t.Run("keeps webhooks and their unfinished deliveries in the log and the snapshot", func(t *testing.T) {
+		for _, snapshotInterval := range []int{0, 1} {
+			dir := t.TempDir()
+			provider := openFileProvider(t, dir, snapshotInterval)
+			webhook := domain.Webhook{
+				ID:         uuid.New(),
+				URL:        "https://example.com",
+				Secret:     "secret",
+				EventTypes: []domain.EventType{domain.EventSignatureCreated},
+				CreatedAt:  time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+			}
+			deliveries := []domain.WebhookDelivery{}
+			for i := 0; i < 3; i++ {
+				deliveries = append(deliveries, domain.WebhookDelivery{
+					ID:        uuid.New(),
+					WebhookID: webhook.ID,
+					Event: domain.Event{
+						ID:     uuid.New(),
+						Type:   domain.EventSignatureCreated,
+						Device: domain.SignatureDevice{ID: uuid.New(), Status: domain.DeviceStatusActive},
+						Time:   time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+					},
+					CreatedAt: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+				})
+			}
+			err := provider.WriteTx(func(repository domain.SignatureDeviceRepository) error {
+				if err := repository.SaveWebhook(webhook); err != nil {
+					return err
+				}
+				for _, delivery := range deliveries {
+					if err := repository.AddWebhookDelivery(delivery); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = provider.WriteTx(func(repository domain.SignatureDeviceRepository) error {
+				return repository.RemoveWebhookDelivery(deliveries[0].ID)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := provider.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			var webhooks []domain.Webhook
+			var stored []domain.WebhookDelivery
+			err = openFileProvider(t, dir, snapshotInterval).ReadTx(func(repository domain.SignatureDeviceRepository) error {
+				var err error
+				if webhooks, err = repository.ListWebhooks(); err != nil {
+					return err
+				}
+				stored, err = repository.ListWebhookDeliveries(webhook.ID, 10)
+				return err
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(webhooks, []domain.Webhook{webhook}); diff != "" {
+				t.Errorf("snapshot interval %d: unexpected diff: %s", snapshotInterval, diff)
+			}
+			if diff := cmp.Diff(stored, deliveries[1:]); diff != "" {
+				t.Errorf("snapshot interval %d: unexpected diff: %s", snapshotInterval, diff)
+			}
+		}
+	})
+
+	t.Run("recovers from a crash between saving a snapshot and compacting", func(t *testing.T) {
+		dir := t.TempDir()
+		provider := openFileProvider(t, dir, 0)
+		ids := signDevices(t, provider, 2)
+		walPath := filepath.Join(dir, walFileName)
+		wal, err := os.ReadFile(walPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := provider.saveSnapshot(); err != nil {
+			t.Fatal(err)
+		}
+		if err := provider.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(walPath, wal, 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		recovered := openFileProvider(t, dir, 0)
+		for _, id := range ids {
+			if counter := signatureCounter(t, recovered, id); counter != 1 {
+				t.Errorf("expected counter 1, got: %d", counter)
+			}
+		}
+		markSignatureCreated(t, recovered, ids[0])
+		if counter := signatureCounter(t, recovered, ids[0]); counter != 2 {
+			t.Errorf("expected counter 2, got: %d", counter)
+		}
+	})
+}
@@ -0,0 +1,157 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Clock abstracts time.Now, so that tests can control the refill of buckets.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// SystemClock is the real wall clock.
+var SystemClock Clock = systemClock{}
+
+// Limit allows Rate requests per second on average, and bursts of up to
+// Burst requests. A Rate of zero means unlimited.
+type Limit struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+// Unlimited reports whether the limit never rejects a request.
+func (l Limit) Unlimited() bool {
+	return l.Rate <= 0
+}
+
+// Limits are the limits applied by a Limiter.
+type Limits struct {
+	// applied to every key without an override
+	Default Limit `json:"default"`
+	// keyed by the key of the bucket, e.g. a device ID
+	Overrides map[string]Limit `json:"overrides"`
+}
+
+func (l Limits) forKey(key string) Limit {
+	if limit, ok := l.Overrides[key]; ok {
+		return limit
+	}
+	return l.Default
+}
+
+func (l Limits) copy() Limits {
+	c := Limits{
+		Default:   l.Default,
+		Overrides: map[string]Limit{},
+	}
+	for key, limit := range l.Overrides {
+		c.Overrides[key] = limit
+	}
+	return c
+}
+
+type bucket struct {
+	tokens float64
+	// when tokens was last brought up to date
+	updated time.Time
+}
+
+// sweepThreshold is the number of buckets above which full buckets,
+// which behave exactly like new ones, are dropped to bound memory.
+const sweepThreshold = 10000
+
+// Limiter keeps a token bucket per key.
+// It is safe for concurrent use.
+type Limiter struct {
+	clock Clock
+
+	mutex   sync.Mutex
+	limits  Limits
+	buckets map[string]*bucket
+}
+
+func NewLimiter(clock Clock, limits Limits) *Limiter {
+	return &Limiter{
+		clock:   clock,
+		limits:  limits.copy(),
+		buckets: map[string]*bucket{},
+	}
+}
+
+// Limits returns a copy of the current limits.
+func (l *Limiter) Limits() Limits {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.limits.copy()
+}
+
+// SetLimits replaces the limits. Buckets keep their tokens, capped at
+// the new burst size.
+func (l *Limiter) SetLimits(limits Limits) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.limits = limits.copy()
+}
+
+// Allow takes a token from the bucket of key.
+// When the bucket is empty, it returns false and how long to wait until
+// the next token is available.
+func (l *Limiter) Allow(key string) (allowed bool, retryAfter time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	limit := l.limits.forKey(key)
+	if limit.Unlimited() {
+		return true, 0
+	}
+	burst := math.Max(float64(limit.Burst), 1)
+	now := l.clock.Now()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= sweepThreshold {
+			l.sweep(now)
+		}
+		b = &bucket{tokens: burst, updated: now}
+		l.buckets[key] = b
+	}
+
+	elapsed := now.Sub(b.updated).Seconds()
+	if elapsed > 0 {
+		b.tokens += elapsed * limit.Rate
+		b.updated = now
+	}
+	b.tokens = math.Min(b.tokens, burst)
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	missing := 1 - b.tokens
+	return false, time.Duration(math.Ceil(missing / limit.Rate * float64(time.Second)))
+}
+
+// sweep drops buckets that have refilled completely.
+// The caller must hold the mutex.
+func (l *Limiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		limit := l.limits.forKey(key)
+		if limit.Unlimited() {
+			delete(l.buckets, key)
+			continue
+		}
+		refilled := b.tokens + now.Sub(b.updated).Seconds()*limit.Rate
+		if refilled >= math.Max(float64(limit.Burst), 1) {
+			delete(l.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package ratelimit
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock only moves when advanced by the test.
+type fakeClock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestLimiter(t *testing.T) {
+	t.Run("allows a burst and then refills at the rate", func(t *testing.T) {
+		clock := newFakeClock()
+		limiter := NewLimiter(clock, Limits{Default: Limit{Rate: 2, Burst: 3}})
+
+		for i := 0; i < 3; i++ {
+			if allowed, _ := limiter.Allow("till-1"); !allowed {
+				t.Fatalf("expected request %d of the burst to be allowed", i)
+			}
+		}
+		allowed, retryAfter := limiter.Allow("till-1")
+		if allowed {
+			t.Fatal("expected request after the burst to be rejected")
+		}
+		if retryAfter != 500*time.Millisecond {
+			t.Errorf("expected retry after 500ms, got: %s", retryAfter)
+		}
+
+		clock.Advance(499 * time.Millisecond)
+		if allowed, _ := limiter.Allow("till-1"); allowed {
+			t.Error("expected request before the refill to be rejected")
+		}
+		clock.Advance(time.Millisecond)
+		if allowed, _ := limiter.Allow("till-1"); !allowed {
+			t.Error("expected request after the refill to be allowed")
+		}
+	})
+
+	t.Run("keeps a bucket per key", func(t *testing.T) {
+		limiter := NewLimiter(newFakeClock(), Limits{Default: Limit{Rate: 1, Burst: 1}})
+
+		if allowed, _ := limiter.Allow("till-1"); !allowed {
+			t.Fatal("expected first request to be allowed")
+		}
+		if allowed, _ := limiter.Allow("till-1"); allowed {
+			t.Fatal("expected second request to be rejected")
+		}
+		if allowed, _ := limiter.Allow("till-2"); !allowed {
+			t.Error("expected request of another key to be allowed")
+		}
+	})
+
+	t.Run("applies overrides and unlimited limits", func(t *testing.T) {
+		limiter := NewLimiter(newFakeClock(), Limits{
+			Default: Limit{Rate: 1, Burst: 1},
+			Overrides: map[string]Limit{
+				"trusted": {},
+			},
+		})
+
+		for i := 0; i < 100; i++ {
+			if allowed, _ := limiter.Allow("trusted"); !allowed {
+				t.Fatalf("expected request %d of unlimited key to be allowed", i)
+			}
+		}
+	})
+
+	t.Run("applies changed limits immediately", func(t *testing.T) {
+		clock := newFakeClock()
+		limiter := NewLimiter(clock, Limits{Default: Limit{Rate: 1, Burst: 10}})
+		limiter.Allow("till-1")
+
+		limiter.SetLimits(Limits{Default: Limit{Rate: 1, Burst: 2}})
+
+		// the 9 remaining tokens are capped at the new burst of 2
+		for i := 0; i < 2; i++ {
+			if allowed, _ := limiter.Allow("till-1"); !allowed {
+				t.Fatalf("expected request %d to be allowed", i)
+			}
+		}
+		if allowed, _ := limiter.Allow("till-1"); allowed {
+			t.Error("expected request beyond the new burst to be rejected")
+		}
+		if limiter.Limits().Default.Burst != 2 {
+			t.Errorf("expected the new limits, got: %+v", limiter.Limits())
+		}
+	})
+
+	t.Run("drops refilled buckets when there are many", func(t *testing.T) {
+		clock := newFakeClock()
+		limiter := NewLimiter(clock, Limits{Default: Limit{Rate: 1, Burst: 1}})
+		for i := 0; i < sweepThreshold; i++ {
+			limiter.Allow(time.Duration(i).String())
+		}
+
+		clock.Advance(time.Second)
+		limiter.Allow("new")
+
+		if len(limiter.buckets) != 1 {
+			t.Errorf("expected only the new bucket to be kept, got: %d", len(limiter.buckets))
+		}
+	})
+}
@@ -0,0 +1,65 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/version"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+)
+
+const ServiceName = "signing-service"
+
+// NewStdoutExporter writes finished spans as JSON to w.
+func NewStdoutExporter(w io.Writer) (sdktrace.SpanExporter, error) {
+	return stdouttrace.New(stdouttrace.WithWriter(w))
+}
+
+// NewOTLPExporter sends finished spans to an OTLP/HTTP endpoint,
+// e.g. "http://localhost:4318" of an OpenTelemetry collector.
+// When the URL has no path, the default path `/v1/traces` is used.
+func NewOTLPExporter(ctx context.Context, endpoint string) (sdktrace.SpanExporter, error) {
+	parsed, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OTLP endpoint %q: %w", endpoint, err)
+	}
+	if parsed.Path == "" || parsed.Path == "/" {
+		parsed.Path = "/v1/traces"
+	}
+
+	return otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(parsed.String()))
+}
+
+// Install makes the spans created by every package of the service be
+// exported by exporter, and enables the propagation of W3C trace context
+// and baggage.
+// The returned TracerProvider must be shut down to flush pending spans.
+func Install(exporter sdktrace.SpanExporter) *sdktrace.TracerProvider {
+	tracerProvider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(
+			semconv.ServiceName(ServiceName),
+			semconv.ServiceVersion(version.Version),
+		)),
+	)
+	otel.SetTracerProvider(tracerProvider)
+	InstallPropagator()
+	return tracerProvider
+}
+
+// InstallPropagator enables the propagation of W3C trace context and
+// baggage, without recording spans of the service itself.
+func InstallPropagator() {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+}
@@ -0,0 +1,123 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// collector is a stand-in for an OpenTelemetry collector receiving OTLP/HTTP.
+type collector struct {
+	mutex    sync.Mutex
+	paths    []string
+	requests []*coltracepb.ExportTraceServiceRequest
+}
+
+func (c *collector) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	body, err := io.ReadAll(request.Body)
+	if err != nil {
+		http.Error(response, err.Error(), http.StatusBadRequest)
+		return
+	}
+	exportRequest := &coltracepb.ExportTraceServiceRequest{}
+	if err := proto.Unmarshal(body, exportRequest); err != nil {
+		http.Error(response, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	c.mutex.Lock()
+	c.paths = append(c.paths, request.URL.Path)
+	c.requests = append(c.requests, exportRequest)
+	c.mutex.Unlock()
+
+	response.Header().Set("Content-Type", "application/x-protobuf")
+	responseBody, _ := proto.Marshal(&coltracepb.ExportTraceServiceResponse{})
+	response.Write(responseBody)
+}
+
+// restoreGlobals resets the globally installed TracerProvider and
+// propagator at the end of the test.
+func restoreGlobals(t *testing.T) {
+	previousTracerProvider := otel.GetTracerProvider()
+	previousPropagator := otel.GetTextMapPropagator()
+	t.Cleanup(func() {
+		otel.SetTracerProvider(previousTracerProvider)
+		otel.SetTextMapPropagator(previousPropagator)
+	})
+}
+
+func TestOTLPExporter(t *testing.T) {
+	restoreGlobals(t)
+	receiver := &collector{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	exporter, err := NewOTLPExporter(context.Background(), server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracerProvider := Install(exporter)
+
+	_, span := otel.Tracer("test").Start(context.Background(), "SignTransaction")
+	span.End()
+	if err := tracerProvider.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	if len(receiver.requests) != 1 {
+		t.Fatalf("expected 1 export request, got: %d", len(receiver.requests))
+	}
+	if receiver.paths[0] != "/v1/traces" {
+		t.Errorf("expected default path /v1/traces, got: %s", receiver.paths[0])
+	}
+
+	resourceSpans := receiver.requests[0].ResourceSpans
+	if len(resourceSpans) != 1 {
+		t.Fatalf("expected spans of 1 resource, got: %d", len(resourceSpans))
+	}
+	serviceName := ""
+	for _, attribute := range resourceSpans[0].Resource.Attributes {
+		if attribute.Key == "service.name" {
+			serviceName = attribute.Value.GetStringValue()
+		}
+	}
+	if serviceName != ServiceName {
+		t.Errorf("expected service name %s, got: %s", ServiceName, serviceName)
+	}
+	spans := resourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 1 || spans[0].Name != "SignTransaction" {
+		t.Errorf("expected the SignTransaction span, got: %v", spans)
+	}
+}
+
+func TestStdoutExporter(t *testing.T) {
+	restoreGlobals(t)
+	var out bytes.Buffer
+
+	exporter, err := NewStdoutExporter(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracerProvider := Install(exporter)
+
+	_, span := otel.Tracer("test").Start(context.Background(), "KeyPair.Sign")
+	span.End()
+	if err := tracerProvider.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(out.String(), `"Name":"KeyPair.Sign"`) {
+		t.Errorf("expected the span to be written, got: %s", out.String())
+	}
+}
@@ -0,0 +1,290 @@
+package transfer
+
+import (
+	"bufio"
+	"bytes"
+	stdcrypto "crypto"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/crypto"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
+	"github.com/google/uuid"
+)
+
+// KeySize is the size of the AES-256 transport keys wrapping the private
+// keys of exported devices.
+const KeySize = crypto.AEADKeySize
+
+// maxLineSize limits the lines of an export, which hold a single device.
+const maxLineSize = 1 << 20
+
+// ExportedDevice is a line of an export, which is a JSON object per
+// device followed by a newline.
+type ExportedDevice struct {
+	ID               uuid.UUID           `json:"id"`
+	Algorithm        string              `json:"algorithm"`
+	Label            string              `json:"label"`
+	Status           domain.DeviceStatus `json:"status"`
+	LastSignature    string              `json:"last_signature"`
+	SignatureCounter uint                `json:"signature_counter"`
+	// PEM encoded
+	PublicKey string `json:"public_key"`
+	// the PEM encoded private key, encrypted with AES-256-GCM by the
+	// transport key and authenticated together with the device ID, as
+	// base64 encoded nonce followed by the ciphertext
+	WrappedPrivateKey string `json:"wrapped_private_key"`
+	// (optional) PEM encoded certificate chain of the public key
+	CertificateChain string `json:"certificate_chain,omitempty"`
+}
+
+// ErrDeviceNotFound is returned by Export for unknown device IDs.
+var ErrDeviceNotFound = errors.New("signature device not found")
+
+// InvalidExportError is returned by Import when lines of the export are
+// invalid. Nothing is imported then.
+type InvalidExportError struct {
+	Problems []string
+}
+
+func (e InvalidExportError) Error() string {
+	return "invalid export: " + strings.Join(e.Problems, "; ")
+}
+
+// CollisionError is returned by Import when devices with the IDs of the
+// export exist already. Nothing is imported then.
+type CollisionError struct {
+	DeviceIDs []uuid.UUID
+}
+
+func (e CollisionError) Error() string {
+	return fmt.Sprintf("%d signature devices exist already", len(e.DeviceIDs))
+}
+
+func wrap(aead cipher.AEAD, deviceID uuid.UUID, privateKey []byte) (string, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, privateKey, deviceID[:])), nil
+}
+
+func unwrap(aead cipher.AEAD, deviceID uuid.UUID, wrapped string) ([]byte, error) {
+	decoded, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil {
+		return nil, err
+	}
+	if len(decoded) < aead.NonceSize() {
+		return nil, errors.New("wrapped private key is too short")
+	}
+	nonce, ciphertext := decoded[:aead.NonceSize()], decoded[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, deviceID[:])
+}
+
+// Export returns the devices with the IDs, or all devices when none are
+// given, as JSON lines. The private keys are wrapped by the transport
+// key.
+func Export(provider domain.SignatureDeviceRepositoryProvider, key []byte, deviceIDs []uuid.UUID) ([]byte, error) {
+	aead, err := crypto.NewAEAD("transport key", key)
+	if err != nil {
+		return nil, err
+	}
+
+	var devices []domain.SignatureDevice
+	err = provider.ReadTx(func(repository domain.SignatureDeviceRepository) error {
+		if len(deviceIDs) == 0 {
+			var err error
+			devices, err = repository.List()
+			return err
+		}
+		for _, id := range deviceIDs {
+			device, found, err := repository.Find(id)
+			if err != nil {
+				return err
+			}
+			if !found {
+				return fmt.Errorf("%w: %s", ErrDeviceNotFound, id)
+			}
+			devices = append(devices, device)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var export bytes.Buffer
+	encoder := json.NewEncoder(&export)
+	for _, device := range devices {
+		publicKey, err := device.KeyPair.EncodedPublicKey()
+		if err != nil {
+			return nil, err
+		}
+		privateKey, err := crypto.EncodePrivateKey(device.KeyPair)
+		if err != nil {
+			return nil, fmt.Errorf("could not encode key pair of device %s: %w", device.ID, err)
+		}
+		wrapped, err := wrap(aead, device.ID, privateKey)
+		if err != nil {
+			return nil, err
+		}
+		// writes the newline ending the line
+		err = encoder.Encode(ExportedDevice{
+			ID:                device.ID,
+			Algorithm:         device.KeyPair.AlgorithmName(),
+			Label:             device.Label,
+			Status:            device.Status,
+			LastSignature:     device.LastSignature,
+			SignatureCounter:  device.SignatureCounter,
+			PublicKey:         publicKey,
+			WrappedPrivateKey: wrapped,
+			CertificateChain:  string(crypto.EncodeCertificateChain(device.CertificateChain)),
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return export.Bytes(), nil
+}
+
+// decodeLine returns the device of a line, or the problem with it.
+func decodeLine(aead cipher.AEAD, line []byte) (domain.SignatureDevice, string) {
+	var exported ExportedDevice
+	decoder := json.NewDecoder(bytes.NewReader(line))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&exported); err != nil {
+		return domain.SignatureDevice{}, "invalid json"
+	}
+
+	if exported.ID == uuid.Nil {
+		return domain.SignatureDevice{}, "id is not a valid uuid"
+	}
+	if exported.Status != domain.DeviceStatusActive && exported.Status != domain.DeviceStatusDeactivated {
+		return domain.SignatureDevice{}, fmt.Sprintf("status %q is not supported", exported.Status)
+	}
+	if (exported.SignatureCounter == 0) != (exported.LastSignature == "") {
+		return domain.SignatureDevice{}, "last_signature must be set exactly when signature_counter is not 0"
+	}
+
+	privateKey, err := unwrap(aead, exported.ID, exported.WrappedPrivateKey)
+	if err != nil {
+		return domain.SignatureDevice{}, "private key cannot be unwrapped with the transport key"
+	}
+	keyPair, err := crypto.DecodePrivateKey(exported.Algorithm, privateKey)
+	if err != nil {
+		return domain.SignatureDevice{}, fmt.Sprintf("invalid private key: %s", err)
+	}
+	// exports of previous versions encode RSA public keys as PKCS#1
+	exportedPublicKey, err := crypto.DecodePublicKey([]byte(exported.PublicKey))
+	if err != nil {
+		return domain.SignatureDevice{}, fmt.Sprintf("invalid public key: %s", err)
+	}
+	publicKey, err := crypto.PublicKey(keyPair)
+	if err != nil {
+		return domain.SignatureDevice{}, fmt.Sprintf("invalid private key: %s", err)
+	}
+	comparablePublicKey, ok := publicKey.(interface {
+		Equal(stdcrypto.PublicKey) bool
+	})
+	if !ok || !comparablePublicKey.Equal(exportedPublicKey) {
+		return domain.SignatureDevice{}, "public key does not match the private key"
+	}
+	var chain [][]byte
+	if exported.CertificateChain != "" {
+		chain, err = crypto.DecodeCertificateChain([]byte(exported.CertificateChain))
+		if err != nil {
+			return domain.SignatureDevice{}, fmt.Sprintf("invalid certificate chain: %s", err)
+		}
+	}
+
+	return domain.SignatureDevice{
+		ID:               exported.ID,
+		KeyPair:          keyPair,
+		Label:            exported.Label,
+		Status:           exported.Status,
+		LastSignature:    exported.LastSignature,
+		SignatureCounter: exported.SignatureCounter,
+		CertificateChain: chain,
+	}, ""
+}
+
+// Import creates the devices of the export, with their IDs, key pairs,
+// signature counters and last signatures, so that their signature chains
+// continue. The devices are created in a single transaction, and only
+// when all lines are valid and none of the IDs exists already.
+func Import(provider domain.SignatureDeviceRepositoryProvider, key []byte, export io.Reader) ([]uuid.UUID, error) {
+	aead, err := crypto.NewAEAD("transport key", key)
+	if err != nil {
+		return nil, err
+	}
+
+	devices := []domain.SignatureDevice{}
+	problems := []string{}
+	lines := map[uuid.UUID]int{}
+	scanner := bufio.NewScanner(export)
+	scanner.Buffer(nil, maxLineSize)
+	for number := 1; scanner.Scan(); number++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		device, problem := decodeLine(aead, line)
+		if problem != "" {
+			problems = append(problems, fmt.Sprintf("line %d: %s", number, problem))
+			continue
+		}
+		if previous, found := lines[device.ID]; found {
+			problems = append(problems, fmt.Sprintf("line %d: id %s is used by line %d already", number, device.ID, previous))
+			continue
+		}
+		lines[device.ID] = number
+		devices = append(devices, device)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, InvalidExportError{Problems: append(problems, err.Error())}
+	}
+	if len(problems) > 0 {
+		return nil, InvalidExportError{Problems: problems}
+	}
+	if len(devices) == 0 {
+		return nil, InvalidExportError{Problems: []string{"export contains no devices"}}
+	}
+
+	err = provider.WriteTx(func(repository domain.SignatureDeviceRepository) error {
+		collisions := []uuid.UUID{}
+		for _, device := range devices {
+			_, found, err := repository.Find(device.ID)
+			if err != nil {
+				return err
+			}
+			if found {
+				collisions = append(collisions, device.ID)
+			}
+		}
+		if len(collisions) > 0 {
+			return CollisionError{DeviceIDs: collisions}
+		}
+
+		for _, device := range devices {
+			if err := repository.Create(device); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []uuid.UUID{}
+	for _, device := range devices {
+		ids = append(ids, device.ID)
+	}
+	return ids, nil
+}
@@ -0,0 +1,282 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/crypto"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/persistence"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/uuid"
+)
+
+func newKey(t *testing.T) []byte {
+	t.Helper()
+
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func newProvider() domain.SignatureDeviceRepositoryProvider {
+	return persistence.NewInMemorySignatureDeviceRepositoryProvider(
+		persistence.NewInMemorySignatureDeviceRepository(),
+	)
+}
+
+// createDevices creates a device per generator, and signs once with each.
+func createDevices(t *testing.T, provider domain.SignatureDeviceRepositoryProvider, generators ...domain.KeyPairGenerator) []uuid.UUID {
+	t.Helper()
+
+	ids := []uuid.UUID{}
+	for _, generator := range generators {
+		device, err := domain.BuildSignatureDevice(uuid.New(), generator, "my key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = provider.WriteTx(func(repository domain.SignatureDeviceRepository) error {
+			return repository.Create(device)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, _, err := domain.SignTransaction(context.Background(), device.ID, provider, "data"); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, device.ID)
+	}
+	return ids
+}
+
+func find(t *testing.T, provider domain.SignatureDeviceRepositoryProvider, id uuid.UUID) (domain.SignatureDevice, bool) {
+	t.Helper()
+
+	var device domain.SignatureDevice
+	var found bool
+	err := provider.ReadTx(func(repository domain.SignatureDeviceRepository) error {
+		var err error
+		device, found, err = repository.Find(id)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return device, found
+}
+
+func export(t *testing.T, provider domain.SignatureDeviceRepositoryProvider, key []byte, ids ...uuid.UUID) []byte {
+	t.Helper()
+
+	exported, err := Export(provider, key, ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return exported
+}
+
+// lines decodes the lines of an export.
+func lines(t *testing.T, export []byte) []ExportedDevice {
+	t.Helper()
+
+	devices := []ExportedDevice{}
+	for _, line := range strings.Split(strings.TrimSpace(string(export)), "\n") {
+		var device ExportedDevice
+		if err := json.Unmarshal([]byte(line), &device); err != nil {
+			t.Fatal(err)
+		}
+		devices = append(devices, device)
+	}
+	return devices
+}
+
+func encodeLines(t *testing.T, devices ...ExportedDevice) []byte {
+	t.Helper()
+
+	var export bytes.Buffer
+	for _, device := range devices {
+		if err := json.NewEncoder(&export).Encode(device); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return export.Bytes()
+}
+
+func sortedIDs(ids []uuid.UUID) []string {
+	sorted := []string{}
+	for _, id := range ids {
+		sorted = append(sorted, id.String())
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+func TestTransfer(t *testing.T) {
+	t.Run("moves devices without changing their ids, keys or counters", func(t *testing.T) {
+		key := newKey(t)
+		source := newProvider()
+		ids := createDevices(t, source, crypto.RSAGenerator{}, crypto.ECCGenerator{})
+
+		target := newProvider()
+		imported, err := Import(target, key, bytes.NewReader(export(t, source, key)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// exported in the order of the IDs
+		if diff := cmp.Diff(sortedIDs(imported), sortedIDs(ids)); diff != "" {
+			t.Errorf("unexpected diff: %s", diff)
+		}
+		for _, id := range ids {
+			expected, _ := find(t, source, id)
+			got, found := find(t, target, id)
+			if !found {
+				t.Fatalf("expected device %s to be imported", id)
+			}
+			expectedPublicKey, _ := expected.KeyPair.EncodedPublicKey()
+			gotPublicKey, _ := got.KeyPair.EncodedPublicKey()
+			if gotPublicKey != expectedPublicKey {
+				t.Errorf("expected the key pair of device %s to be imported", id)
+			}
+			expected.KeyPair, got.KeyPair = nil, nil
+			if diff := cmp.Diff(got, expected); diff != "" {
+				t.Errorf("unexpected diff: %s", diff)
+			}
+
+			// the signature chain continues on the target
+			_, _, signedData, err := domain.SignTransaction(context.Background(), id, target, "data")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if signedData != "1_data_"+expected.LastSignature {
+				t.Errorf("expected signed data to continue the chain, got: %s", signedData)
+			}
+		}
+	})
+
+	t.Run("imports exports with the public keys of previous versions", func(t *testing.T) {
+		key := newKey(t)
+		source := newProvider()
+		ids := createDevices(t, source, crypto.RSAGenerator{}, crypto.ECCGenerator{})
+		exported := lines(t, export(t, source, key))
+
+		// RSA public keys were PKCS#1, both in PEM blocks of custom types
+		for i := range exported {
+			device, _ := find(t, source, exported[i].ID)
+			var block pem.Block
+			switch keyPair := device.KeyPair.(type) {
+			case *crypto.RSAKeyPair:
+				block = pem.Block{Type: "RSA_PUBLIC_KEY", Bytes: x509.MarshalPKCS1PublicKey(keyPair.Public)}
+			case *crypto.ECCKeyPair:
+				der, err := x509.MarshalPKIXPublicKey(keyPair.Public)
+				if err != nil {
+					t.Fatal(err)
+				}
+				block = pem.Block{Type: "PUBLIC_KEY", Bytes: der}
+			}
+			exported[i].PublicKey = string(pem.EncodeToMemory(&block))
+		}
+
+		target := newProvider()
+		imported, err := Import(target, key, bytes.NewReader(encodeLines(t, exported...)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(sortedIDs(imported), sortedIDs(ids)); diff != "" {
+			t.Errorf("unexpected diff: %s", diff)
+		}
+	})
+
+	t.Run("exports the requested devices", func(t *testing.T) {
+		key := newKey(t)
+		provider := newProvider()
+		ids := createDevices(t, provider, crypto.ECCGenerator{}, crypto.ECCGenerator{})
+
+		exported := lines(t, export(t, provider, key, ids[1]))
+		if len(exported) != 1 || exported[0].ID != ids[1] {
+			t.Errorf("expected only device %s, got: %v", ids[1], exported)
+		}
+
+		_, err := Export(provider, key, []uuid.UUID{uuid.New()})
+		if !errors.Is(err, ErrDeviceNotFound) {
+			t.Errorf("expected ErrDeviceNotFound, got: %v", err)
+		}
+	})
+
+	t.Run("rejects invalid lines and imports nothing", func(t *testing.T) {
+		key := newKey(t)
+		source := newProvider()
+		createDevices(t, source, crypto.ECCGenerator{}, crypto.ECCGenerator{}, crypto.ECCGenerator{})
+		exported := lines(t, export(t, source, key))
+
+		swappedPublicKey := exported[0]
+		swappedPublicKey.PublicKey = exported[1].PublicKey
+		movedKey := exported[1]
+		movedKey.ID = uuid.New()
+		missingLastSignature := exported[2]
+		missingLastSignature.LastSignature = ""
+		wrongKey := lines(t, export(t, source, newKey(t)))[0]
+
+		input := bytes.Join([][]byte{
+			encodeLines(t, swappedPublicKey, movedKey, missingLastSignature, wrongKey),
+			[]byte("{not json}\n"),
+			encodeLines(t, exported[2], exported[2]),
+		}, nil)
+
+		target := newProvider()
+		_, err := Import(target, key, bytes.NewReader(input))
+
+		var invalidExportError InvalidExportError
+		if !errors.As(err, &invalidExportError) {
+			t.Fatalf("expected InvalidExportError, got: %v", err)
+		}
+		expected := []string{
+			"line 1: public key does not match the private key",
+			"line 2: private key cannot be unwrapped with the transport key",
+			"line 3: last_signature must be set exactly when signature_counter is not 0",
+			"line 4: private key cannot be unwrapped with the transport key",
+			"line 5: invalid json",
+			fmt.Sprintf("line 7: id %s is used by line 6 already", exported[2].ID),
+		}
+		if diff := cmp.Diff(invalidExportError.Problems, expected); diff != "" {
+			t.Errorf("unexpected diff: %s", diff)
+		}
+		if _, found := find(t, target, exported[2].ID); found {
+			t.Error("expected the valid line not to be imported")
+		}
+	})
+
+	t.Run("rejects collisions with existing ids and imports nothing", func(t *testing.T) {
+		key := newKey(t)
+		source := newProvider()
+		ids := createDevices(t, source, crypto.ECCGenerator{}, crypto.ECCGenerator{})
+		target := newProvider()
+		if _, err := Import(target, key, bytes.NewReader(export(t, source, key, ids[0]))); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := Import(target, key, bytes.NewReader(export(t, source, key)))
+
+		var collisionError CollisionError
+		if !errors.As(err, &collisionError) {
+			t.Fatalf("expected CollisionError, got: %v", err)
+		}
+		if diff := cmp.Diff(collisionError.DeviceIDs, []uuid.UUID{ids[0]}); diff != "" {
+			t.Errorf("unexpected diff: %s", diff)
+		}
+		if _, found := find(t, target, ids[1]); found {
+			t.Error("expected the other device not to be imported")
+		}
+	})
+}
@@ -0,0 +1,41 @@
+package version
+
+import "runtime/debug"
+
+// These are set at build time, e.g.
+//
+//	go build -ldflags "-X github.com/fiskaly/coding-challenges/signing-service-challenge/version.Version=$(git describe --tags --always)"
+var (
+	// Version is the released version of the service.
+	Version = "dev"
+	// Commit is the VCS revision the service was built from.
+	// When it is not set at build time, the revision recorded by the
+	// Go toolchain is used, if any.
+	Commit = ""
+)
+
+// Revision returns the VCS revision the service was built from, or "".
+func Revision() string {
+	if Commit != "" {
+		return Commit
+	}
+
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return ""
+	}
+	revision := ""
+	modified := false
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			revision = setting.Value
+		case "vcs.modified":
+			modified = setting.Value == "true"
+		}
+	}
+	if revision != "" && modified {
+		revision += "-dirty"
+	}
+	return revision
+}
@@ -0,0 +1,599 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
+	"github.com/google/uuid"
+)
+
+const (
+	// the hex encoded HMAC-SHA256 of the request body, keyed with the
+	// secret of the webhook, e.g. "sha256=5d5b09f6dcb2d53a5fffc60c4ac0d55f..."
+	SignatureHeader = "X-Webhook-Signature"
+	// the ID of the delivery, which stays the same when it is retried
+	DeliveryIDHeader = "X-Webhook-Delivery"
+	// the ID of the event, which stays the same when the event is
+	// published again, e.g. after a restart
+	EventIDHeader   = "X-Webhook-Event-ID"
+	EventTypeHeader = "X-Webhook-Event"
+)
+
+// Sign returns the value of the SignatureHeader for the body.
+// Receivers should compare it to the header with hmac.Equal.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Webhook is a subscription of a receiver URL to events.
+type Webhook = domain.Webhook
+
+type DeliveryStatus string
+
+const (
+	DeliveryPending   DeliveryStatus = "pending"
+	DeliverySucceeded DeliveryStatus = "succeeded"
+	DeliveryFailed    DeliveryStatus = "failed"
+)
+
+type Attempt struct {
+	Time time.Time
+	// 0 when no response was received
+	StatusCode int
+	// empty when the receiver responded with 2xx
+	Error    string
+	Duration time.Duration
+}
+
+// Delivery is the delivery of an event to a webhook, with all its attempts.
+type Delivery struct {
+	ID        uuid.UUID
+	WebhookID uuid.UUID
+	EventType domain.EventType
+	Status    DeliveryStatus
+	Attempts  []Attempt
+	CreatedAt time.Time
+}
+
+// Payload is the JSON body sent to webhooks.
+type Payload struct {
+	// the delivery ID, so that receivers can detect retried deliveries
+	ID string `json:"id"`
+	// the event ID, so that receivers can detect events delivered again
+	EventID   string           `json:"event_id"`
+	Type      domain.EventType `json:"type"`
+	CreatedAt time.Time        `json:"created_at"`
+	Data      PayloadData      `json:"data"`
+}
+
+type PayloadData struct {
+	DeviceID         string              `json:"device_id"`
+	Label            string              `json:"label"`
+	Status           domain.DeviceStatus `json:"status"`
+	SignatureCounter uint                `json:"signature_counter"`
+	// only set for signature.created
+	Signature string `json:"signature,omitempty"`
+}
+
+func newPayload(deliveryID uuid.UUID, event domain.Event) Payload {
+	return Payload{
+		ID:        deliveryID.String(),
+		EventID:   event.ID.String(),
+		Type:      event.Type,
+		CreatedAt: event.Time.UTC(),
+		Data: PayloadData{
+			DeviceID:         event.Device.ID.String(),
+			Label:            event.Device.Label,
+			Status:           event.Device.Status,
+			SignatureCounter: event.Device.SignatureCounter,
+			Signature:        event.Signature,
+		},
+	}
+}
+
+type Options struct {
+	// attempts per delivery, including the first one
+	MaxAttempts int
+	// the wait before the first retry, which doubles with every further
+	// retry up to MaxBackoff
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// timeout of a single attempt
+	Timeout time.Duration
+	// number of deliveries kept per webhook in the delivery log
+	LogSize int
+	// unfinished deliveries per webhook read from the repository at a
+	// time, the others wait there
+	QueueSize int
+}
+
+// ErrClosed is returned when publishing events or creating webhooks
+// after Close.
+var ErrClosed = errors.New("webhook dispatcher is closed")
+
+// webhook is a registered Webhook with its own worker, so that a slow
+// receiver does not delay the others.
+type webhook struct {
+	Webhook
+	// signaled when deliveries were added
+	wake chan struct{}
+	// closed when the webhook is deleted
+	deleted chan struct{}
+	// newest last, guarded by the mutex of the dispatcher
+	log []*Delivery
+}
+
+// notify makes the worker of the webhook read its deliveries. It never
+// blocks.
+func (w *webhook) notify() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+		// a read is pending already
+	}
+}
+
+// Dispatcher delivers the events published from the outbox to the
+// registered webhooks. Webhooks and unfinished deliveries are stored in
+// the repository: Publish stores a delivery for every webhook receiving
+// the event before it returns, and the delivery is removed once it
+// succeeded or was given up. Deliveries interrupted by Close are retried
+// by the next process.
+// Events of a webhook are delivered one at a time, in the order they were
+// published; a delivery is retried with exponential backoff before the
+// next one is attempted.
+type Dispatcher struct {
+	provider domain.SignatureDeviceRepositoryProvider
+	options  Options
+	client   *http.Client
+	now      func() time.Time
+
+	// also held while writing webhooks and deliveries to the repository,
+	// so that no delivery is added for a deleted webhook
+	mutex    sync.Mutex
+	webhooks map[uuid.UUID]*webhook
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewDispatcher loads the webhooks from the repository and starts
+// delivering their unfinished and published events, until Close is called.
+func NewDispatcher(provider domain.SignatureDeviceRepositoryProvider, client *http.Client, options Options) (*Dispatcher, error) {
+	if options.MaxAttempts < 1 {
+		options.MaxAttempts = 1
+	}
+	if options.QueueSize < 1 {
+		options.QueueSize = 1
+	}
+
+	var stored []Webhook
+	unfinished := map[uuid.UUID][]domain.WebhookDelivery{}
+	err := provider.ReadTx(func(repository domain.SignatureDeviceRepository) error {
+		var err error
+		stored, err = repository.ListWebhooks()
+		if err != nil {
+			return err
+		}
+		for _, w := range stored {
+			unfinished[w.ID], err = repository.ListWebhookDeliveries(w.ID, options.LogSize)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not load webhooks: %w", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &Dispatcher{
+		provider: provider,
+		options:  options,
+		client:   client,
+		now:      time.Now,
+		webhooks: map[uuid.UUID]*webhook{},
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+	for _, w := range stored {
+		registered := d.register(w)
+		for _, delivery := range unfinished[w.ID] {
+			d.appendToLog(registered, delivery)
+		}
+	}
+	return d, nil
+}
+
+// register starts the worker of the webhook.
+// The caller must hold the mutex, unless the dispatcher is not shared yet.
+func (d *Dispatcher) register(w Webhook) *webhook {
+	registered := &webhook{
+		Webhook: w,
+		wake:    make(chan struct{}, 1),
+		deleted: make(chan struct{}),
+	}
+	d.webhooks[w.ID] = registered
+	d.wg.Add(1)
+	go d.work(registered)
+	return registered
+}
+
+// appendToLog adds the delivery to the delivery log of the webhook, as
+// pending.
+// The caller must hold the mutex, unless the dispatcher is not shared yet.
+func (d *Dispatcher) appendToLog(w *webhook, delivery domain.WebhookDelivery) {
+	w.log = append(w.log, &Delivery{
+		ID:        delivery.ID,
+		WebhookID: w.ID,
+		EventType: delivery.Event.Type,
+		Status:    DeliveryPending,
+		CreatedAt: delivery.CreatedAt,
+	})
+	if len(w.log) > d.options.LogSize {
+		w.log = w.log[len(w.log)-d.options.LogSize:]
+	}
+}
+
+// logged returns the entry of the delivery log for the delivery, or an
+// entry outside of the log when it was dropped from there already.
+// The caller must hold the mutex.
+func (d *Dispatcher) logged(w *webhook, delivery domain.WebhookDelivery) *Delivery {
+	for _, logged := range w.log {
+		if logged.ID == delivery.ID {
+			return logged
+		}
+	}
+	return &Delivery{
+		ID:        delivery.ID,
+		WebhookID: w.ID,
+		EventType: delivery.Event.Type,
+		Status:    DeliveryPending,
+		CreatedAt: delivery.CreatedAt,
+	}
+}
+
+// Publish stores a delivery of the event for every webhook receiving it.
+// It implements domain.EventPublisher.
+func (d *Dispatcher) Publish(event domain.Event) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.ctx.Err() != nil {
+		return ErrClosed
+	}
+
+	deliveries := []domain.WebhookDelivery{}
+	for _, w := range d.webhooks {
+		if w.Receives(event.Type) {
+			deliveries = append(deliveries, domain.WebhookDelivery{
+				ID:        uuid.New(),
+				WebhookID: w.ID,
+				Event:     event,
+				CreatedAt: d.now(),
+			})
+		}
+	}
+	if len(deliveries) == 0 {
+		return nil
+	}
+
+	err := d.provider.WriteTx(func(repository domain.SignatureDeviceRepository) error {
+		for _, delivery := range deliveries {
+			if err := repository.AddWebhookDelivery(delivery); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("could not store webhook deliveries: %w", err)
+	}
+
+	for _, delivery := range deliveries {
+		w := d.webhooks[delivery.WebhookID]
+		d.appendToLog(w, delivery)
+		w.notify()
+	}
+	return nil
+}
+
+// stopped reports whether the worker of the webhook has to stop.
+func (d *Dispatcher) stopped(w *webhook) bool {
+	select {
+	case <-d.ctx.Done():
+		return true
+	case <-w.deleted:
+		return true
+	default:
+		return false
+	}
+}
+
+// work delivers the unfinished deliveries of the webhook, reading up to
+// QueueSize of them from the repository at a time, until the webhook is
+// deleted or the dispatcher is closed.
+func (d *Dispatcher) work(w *webhook) {
+	defer d.wg.Done()
+
+	for {
+		var deliveries []domain.WebhookDelivery
+		err := d.provider.ReadTx(func(repository domain.SignatureDeviceRepository) error {
+			var err error
+			deliveries, err = repository.ListWebhookDeliveries(w.ID, d.options.QueueSize)
+			return err
+		})
+		for i := 0; err == nil && i < len(deliveries); i++ {
+			err = d.deliver(w, deliveries[i])
+			if d.stopped(w) {
+				return
+			}
+		}
+		if err == nil && len(deliveries) > 0 {
+			continue
+		}
+
+		// the repository is read again after MaxBackoff when it failed
+		var retry <-chan time.Time
+		var timer *time.Timer
+		if err != nil {
+			timer = time.NewTimer(d.options.MaxBackoff)
+			retry = timer.C
+		}
+		select {
+		case <-d.ctx.Done():
+		case <-w.deleted:
+		case <-w.wake:
+		case <-retry:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if d.stopped(w) {
+			return
+		}
+	}
+}
+
+// deliver attempts the delivery until it succeeds or is given up, and then
+// removes it from the repository. It returns early when the webhook is
+// deleted or the dispatcher is closed, leaving the delivery unfinished.
+func (d *Dispatcher) deliver(w *webhook, stored domain.WebhookDelivery) error {
+	d.mutex.Lock()
+	delivery := d.logged(w, stored)
+	d.mutex.Unlock()
+
+	// marshaling strings and numbers cannot fail
+	body, _ := json.Marshal(newPayload(stored.ID, stored.Event))
+
+	backoff := d.options.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		d.mutex.Lock()
+		// the URL and secret may have been updated in the meantime
+		url, secret := w.URL, w.Secret
+		d.mutex.Unlock()
+
+		result := d.attempt(url, secret, stored, body)
+
+		d.mutex.Lock()
+		delivery.Attempts = append(delivery.Attempts, result)
+		if result.Error == "" {
+			delivery.Status = DeliverySucceeded
+		} else if attempt >= d.options.MaxAttempts {
+			delivery.Status = DeliveryFailed
+		}
+		status := delivery.Status
+		d.mutex.Unlock()
+
+		if status != DeliveryPending {
+			return d.provider.WriteTx(func(repository domain.SignatureDeviceRepository) error {
+				return repository.RemoveWebhookDelivery(stored.ID)
+			})
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-d.ctx.Done():
+			timer.Stop()
+			return nil
+		case <-w.deleted:
+			timer.Stop()
+			return nil
+		case <-timer.C:
+		}
+		backoff *= 2
+		if backoff > d.options.MaxBackoff {
+			backoff = d.options.MaxBackoff
+		}
+	}
+}
+
+func (d *Dispatcher) attempt(url, secret string, delivery domain.WebhookDelivery, body []byte) Attempt {
+	start := d.now()
+	result := Attempt{Time: start}
+	defer func() { result.Duration = d.now().Sub(start) }()
+
+	ctx, cancel := context.WithTimeout(d.ctx, d.options.Timeout)
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(SignatureHeader, Sign(secret, body))
+	request.Header.Set(DeliveryIDHeader, delivery.ID.String())
+	request.Header.Set(EventIDHeader, delivery.Event.ID.String())
+	request.Header.Set(EventTypeHeader, string(delivery.Event.Type))
+
+	response, err := d.client.Do(request)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	response.Body.Close()
+
+	result.StatusCode = response.StatusCode
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		result.Error = fmt.Sprintf("receiver responded with %d", response.StatusCode)
+	}
+	return result
+}
+
+// Create stores and registers the webhook with a new ID. A random secret
+// is generated when none is given.
+func (d *Dispatcher) Create(w Webhook) (Webhook, error) {
+	if w.Secret == "" {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return Webhook{}, err
+		}
+		w.Secret = hex.EncodeToString(secret)
+	}
+	w.ID = uuid.New()
+	w.CreatedAt = d.now()
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	// checked under the mutex, so that no worker is started after Close
+	if d.ctx.Err() != nil {
+		return Webhook{}, ErrClosed
+	}
+	err := d.provider.WriteTx(func(repository domain.SignatureDeviceRepository) error {
+		return repository.SaveWebhook(w)
+	})
+	if err != nil {
+		return Webhook{}, fmt.Errorf("could not store webhook: %w", err)
+	}
+	d.register(w)
+
+	return w, nil
+}
+
+// List returns all webhooks, in no particular order.
+func (d *Dispatcher) List() []Webhook {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	webhooks := []Webhook{}
+	for _, w := range d.webhooks {
+		webhooks = append(webhooks, w.Webhook)
+	}
+	return webhooks
+}
+
+func (d *Dispatcher) Get(id uuid.UUID) (Webhook, bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	w, ok := d.webhooks[id]
+	if !ok {
+		return Webhook{}, false
+	}
+	return w.Webhook, true
+}
+
+// Update replaces the URL, event types and, unless it is empty, the secret
+// of the webhook. Pending deliveries are sent to the new URL.
+func (d *Dispatcher) Update(update Webhook) (Webhook, bool, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	w, ok := d.webhooks[update.ID]
+	if !ok {
+		return Webhook{}, false, nil
+	}
+	updated := w.Webhook
+	updated.URL = update.URL
+	updated.EventTypes = update.EventTypes
+	if update.Secret != "" {
+		updated.Secret = update.Secret
+	}
+
+	err := d.provider.WriteTx(func(repository domain.SignatureDeviceRepository) error {
+		return repository.SaveWebhook(updated)
+	})
+	if err != nil {
+		return Webhook{}, true, fmt.Errorf("could not store webhook: %w", err)
+	}
+	w.Webhook = updated
+	return updated, true, nil
+}
+
+// Delete removes the webhook. Its pending deliveries are dropped.
+func (d *Dispatcher) Delete(id uuid.UUID) (bool, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	w, ok := d.webhooks[id]
+	if !ok {
+		return false, nil
+	}
+	err := d.provider.WriteTx(func(repository domain.SignatureDeviceRepository) error {
+		return repository.DeleteWebhook(id)
+	})
+	if err != nil {
+		return true, fmt.Errorf("could not delete webhook: %w", err)
+	}
+	delete(d.webhooks, id)
+	close(w.deleted)
+	return true, nil
+}
+
+// Deliveries returns the most recent deliveries to the webhook, newest first.
+func (d *Dispatcher) Deliveries(id uuid.UUID) ([]Delivery, bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	w, ok := d.webhooks[id]
+	if !ok {
+		return nil, false
+	}
+
+	deliveries := make([]Delivery, 0, len(w.log))
+	for i := len(w.log) - 1; i >= 0; i-- {
+		delivery := *w.log[i]
+		delivery.Attempts = append([]Attempt(nil), delivery.Attempts...)
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, true
+}
+
+// Close stops delivering, cancelling running attempts, and waits until
+// all workers have stopped or ctx expires. Unfinished deliveries stay in
+// the repository.
+func (d *Dispatcher) Close(ctx context.Context) error {
+	d.mutex.Lock()
+	d.cancel()
+	d.mutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,420 @@
+package webhooks
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/persistence"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/uuid"
+)
+
+type receivedRequest struct {
+	header http.Header
+	body   []byte
+}
+
+// receiver records the requests it receives, and responds with the given
+// status codes in turn, then with 204.
+type receiver struct {
+	mutex    sync.Mutex
+	statuses []int
+	requests []receivedRequest
+}
+
+func (r *receiver) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	body, _ := io.ReadAll(request.Body)
+
+	r.mutex.Lock()
+	r.requests = append(r.requests, receivedRequest{header: request.Header, body: body})
+	status := http.StatusNoContent
+	if len(r.statuses) > 0 {
+		status, r.statuses = r.statuses[0], r.statuses[1:]
+	}
+	r.mutex.Unlock()
+
+	response.WriteHeader(status)
+}
+
+func (r *receiver) received() []receivedRequest {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]receivedRequest(nil), r.requests...)
+}
+
+func newTestProvider() domain.SignatureDeviceRepositoryProvider {
+	return persistence.NewInMemorySignatureDeviceRepositoryProvider(persistence.NewInMemorySignatureDeviceRepository())
+}
+
+func newTestDispatcher(t *testing.T, provider domain.SignatureDeviceRepositoryProvider, options Options) *Dispatcher {
+	t.Helper()
+
+	dispatcher, err := NewDispatcher(provider, &http.Client{}, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dispatcher.Close(context.Background()) })
+	return dispatcher
+}
+
+// storedDeliveries returns the IDs of the unfinished deliveries of the
+// webhook in the repository.
+func storedDeliveries(t *testing.T, provider domain.SignatureDeviceRepositoryProvider, webhookID uuid.UUID) []uuid.UUID {
+	t.Helper()
+
+	ids := []uuid.UUID{}
+	err := provider.ReadTx(func(repository domain.SignatureDeviceRepository) error {
+		deliveries, err := repository.ListWebhookDeliveries(webhookID, 100)
+		for _, delivery := range deliveries {
+			ids = append(ids, delivery.ID)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ids
+}
+
+var testOptions = Options{
+	MaxAttempts:    3,
+	InitialBackoff: time.Millisecond,
+	MaxBackoff:     2 * time.Millisecond,
+	Timeout:        time.Second,
+	LogSize:        10,
+	QueueSize:      10,
+}
+
+func signatureCreated(counter uint) domain.Event {
+	return domain.Event{
+		Type: domain.EventSignatureCreated,
+		Device: domain.SignatureDevice{
+			ID:               uuid.MustParse("0b6c5b5f-6b8e-4fb1-9d4a-6d1b5f8e7c2a"),
+			Status:           domain.DeviceStatusActive,
+			SignatureCounter: counter,
+		},
+		Signature: "c2lnbmF0dXJl",
+		Time:      time.Now(),
+	}
+}
+
+// waitForDeliveries waits until the webhook has the number of finished
+// deliveries.
+func waitForDeliveries(t *testing.T, dispatcher *Dispatcher, webhookID uuid.UUID, count int) []Delivery {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		deliveries, _ := dispatcher.Deliveries(webhookID)
+		finished := 0
+		for _, delivery := range deliveries {
+			if delivery.Status != DeliveryPending {
+				finished++
+			}
+		}
+		if finished == count {
+			return deliveries
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("expected %d finished deliveries", count)
+	return nil
+}
+
+func TestDispatcher(t *testing.T) {
+	t.Run("delivers signed payloads", func(t *testing.T) {
+		receiver := &receiver{}
+		server := httptest.NewServer(receiver)
+		defer server.Close()
+		dispatcher := newTestDispatcher(t, newTestProvider(), testOptions)
+
+		webhook, err := dispatcher.Create(Webhook{URL: server.URL})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(webhook.Secret) != 64 {
+			t.Errorf("expected a generated secret, got: %q", webhook.Secret)
+		}
+
+		dispatcher.Publish(signatureCreated(1))
+		deliveries := waitForDeliveries(t, dispatcher, webhook.ID, 1)
+
+		requests := receiver.received()
+		if len(requests) != 1 {
+			t.Fatalf("expected 1 request, got: %d", len(requests))
+		}
+		request := requests[0]
+		if !hmac.Equal([]byte(request.header.Get(SignatureHeader)), []byte(Sign(webhook.Secret, request.body))) {
+			t.Error("expected a valid signature header")
+		}
+		if request.header.Get(DeliveryIDHeader) != deliveries[0].ID.String() {
+			t.Errorf("expected delivery ID %s, got: %s", deliveries[0].ID, request.header.Get(DeliveryIDHeader))
+		}
+		if request.header.Get(EventTypeHeader) != "signature.created" {
+			t.Errorf("expected event type header, got: %s", request.header.Get(EventTypeHeader))
+		}
+
+		var payload Payload
+		if err := json.Unmarshal(request.body, &payload); err != nil {
+			t.Fatal(err)
+		}
+		if payload.ID != deliveries[0].ID.String() || payload.Type != domain.EventSignatureCreated ||
+			payload.Data.SignatureCounter != 1 || payload.Data.Signature != "c2lnbmF0dXJl" {
+			t.Errorf("unexpected payload: %+v", payload)
+		}
+		if deliveries[0].Status != DeliverySucceeded || deliveries[0].Attempts[0].StatusCode != http.StatusNoContent {
+			t.Errorf("expected succeeded delivery, got: %+v", deliveries[0])
+		}
+	})
+
+	t.Run("retries failed deliveries", func(t *testing.T) {
+		receiver := &receiver{statuses: []int{http.StatusInternalServerError, http.StatusBadGateway}}
+		server := httptest.NewServer(receiver)
+		defer server.Close()
+		dispatcher := newTestDispatcher(t, newTestProvider(), testOptions)
+
+		webhook, err := dispatcher.Create(Webhook{URL: server.URL, Secret: "secret"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		dispatcher.Publish(signatureCreated(1))
+		dispatcher.Publish(signatureCreated(2))
+		deliveries := waitForDeliveries(t, dispatcher, webhook.ID, 2)
+
+		// newest first
+		first, second := deliveries[1], deliveries[0]
+		if first.Status != DeliverySucceeded || len(first.Attempts) != 3 {
+			t.Errorf("expected first delivery to succeed with the third attempt, got: %+v", first)
+		}
+		if first.Attempts[0].Error != "receiver responded with 500" || first.Attempts[1].StatusCode != http.StatusBadGateway {
+			t.Errorf("expected failed attempts to be logged, got: %+v", first.Attempts)
+		}
+		if second.Status != DeliverySucceeded || len(second.Attempts) != 1 {
+			t.Errorf("expected second delivery to succeed at once, got: %+v", second)
+		}
+
+		// the retries of the first delivery come before the second one
+		requests := receiver.received()
+		var counters []uint
+		for _, request := range requests {
+			var payload Payload
+			json.Unmarshal(request.body, &payload)
+			counters = append(counters, payload.Data.SignatureCounter)
+		}
+		if len(counters) != 4 || counters[2] != 1 || counters[3] != 2 {
+			t.Errorf("expected deliveries in order, got counters: %v", counters)
+		}
+	})
+
+	t.Run("gives up after the maximum attempts", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+			response.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer server.Close()
+		dispatcher := newTestDispatcher(t, newTestProvider(), testOptions)
+
+		webhook, err := dispatcher.Create(Webhook{URL: server.URL})
+		if err != nil {
+			t.Fatal(err)
+		}
+		dispatcher.Publish(signatureCreated(1))
+		deliveries := waitForDeliveries(t, dispatcher, webhook.ID, 1)
+
+		if deliveries[0].Status != DeliveryFailed || len(deliveries[0].Attempts) != testOptions.MaxAttempts {
+			t.Errorf("expected failed delivery after %d attempts, got: %+v", testOptions.MaxAttempts, deliveries[0])
+		}
+	})
+
+	t.Run("only delivers the subscribed event types", func(t *testing.T) {
+		receiver := &receiver{}
+		server := httptest.NewServer(receiver)
+		defer server.Close()
+		dispatcher := newTestDispatcher(t, newTestProvider(), testOptions)
+
+		webhook, err := dispatcher.Create(Webhook{URL: server.URL, EventTypes: []domain.EventType{domain.EventDeviceDeactivated}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		dispatcher.Publish(signatureCreated(1))
+		dispatcher.Publish(domain.Event{Type: domain.EventDeviceDeactivated})
+		deliveries := waitForDeliveries(t, dispatcher, webhook.ID, 1)
+
+		if deliveries[0].EventType != domain.EventDeviceDeactivated {
+			t.Errorf("expected only the deactivation to be delivered, got: %+v", deliveries)
+		}
+	})
+
+	t.Run("stops delivering to deleted webhooks", func(t *testing.T) {
+		dispatcher := newTestDispatcher(t, newTestProvider(), testOptions)
+
+		webhook, err := dispatcher.Create(Webhook{URL: "http://127.0.0.1:0"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if deleted, err := dispatcher.Delete(webhook.ID); !deleted || err != nil {
+			t.Fatalf("expected webhook to be deleted, got: %v", err)
+		}
+		dispatcher.Publish(signatureCreated(1))
+
+		if _, found := dispatcher.Deliveries(webhook.ID); found {
+			t.Error("expected webhook to be gone")
+		}
+		if len(dispatcher.List()) != 0 {
+			t.Error("expected no webhooks")
+		}
+	})
+
+	t.Run("stores deliveries until they finish", func(t *testing.T) {
+		release := make(chan struct{})
+		server := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+			<-release
+			response.WriteHeader(http.StatusNoContent)
+		}))
+		defer server.Close()
+		provider := newTestProvider()
+		dispatcher := newTestDispatcher(t, provider, testOptions)
+
+		webhook, err := dispatcher.Create(Webhook{URL: server.URL})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := dispatcher.Publish(signatureCreated(1)); err != nil {
+			t.Fatal(err)
+		}
+		if stored := storedDeliveries(t, provider, webhook.ID); len(stored) != 1 {
+			t.Errorf("expected the delivery to be stored while it is delivered, got: %v", stored)
+		}
+
+		close(release)
+		waitForDeliveries(t, dispatcher, webhook.ID, 1)
+		deadline := time.Now().Add(5 * time.Second)
+		for len(storedDeliveries(t, provider, webhook.ID)) != 0 {
+			if time.Now().After(deadline) {
+				t.Fatal("expected the finished delivery to be removed")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	})
+
+	t.Run("retries unfinished deliveries after a restart", func(t *testing.T) {
+		receiver := &receiver{statuses: []int{http.StatusServiceUnavailable}}
+		server := httptest.NewServer(receiver)
+		defer server.Close()
+		provider := newTestProvider()
+		options := testOptions
+		options.InitialBackoff = time.Hour
+		options.MaxBackoff = time.Hour
+		dispatcher := newTestDispatcher(t, provider, options)
+
+		webhook, err := dispatcher.Create(Webhook{URL: server.URL})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := dispatcher.Publish(signatureCreated(1)); err != nil {
+			t.Fatal(err)
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for len(receiver.received()) == 0 {
+			if time.Now().After(deadline) {
+				t.Fatal("expected a first attempt")
+			}
+			time.Sleep(time.Millisecond)
+		}
+		if err := dispatcher.Close(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if err := dispatcher.Publish(signatureCreated(2)); err != ErrClosed {
+			t.Errorf("expected events to be rejected after close, got: %v", err)
+		}
+
+		restarted := newTestDispatcher(t, provider, testOptions)
+		if got, found := restarted.Get(webhook.ID); !found || got.Secret != webhook.Secret {
+			t.Errorf("expected the webhook to be loaded, got: %+v", got)
+		}
+		deliveries := waitForDeliveries(t, restarted, webhook.ID, 1)
+		if deliveries[0].Status != DeliverySucceeded {
+			t.Errorf("expected the delivery to succeed after the restart, got: %+v", deliveries[0])
+		}
+		requests := receiver.received()
+		if len(requests) != 2 || requests[0].header.Get(DeliveryIDHeader) != requests[1].header.Get(DeliveryIDHeader) {
+			t.Errorf("expected the same delivery to be retried, got %d requests", len(requests))
+		}
+	})
+
+	t.Run("reads deliveries beyond the queue size from the repository", func(t *testing.T) {
+		receiver := &receiver{}
+		server := httptest.NewServer(receiver)
+		defer server.Close()
+		options := testOptions
+		options.QueueSize = 1
+		dispatcher := newTestDispatcher(t, newTestProvider(), options)
+
+		webhook, err := dispatcher.Create(Webhook{URL: server.URL})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for counter := uint(1); counter <= 3; counter++ {
+			if err := dispatcher.Publish(signatureCreated(counter)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		waitForDeliveries(t, dispatcher, webhook.ID, 3)
+
+		var counters []uint
+		for _, request := range receiver.received() {
+			var payload Payload
+			json.Unmarshal(request.body, &payload)
+			counters = append(counters, payload.Data.SignatureCounter)
+		}
+		if diff := cmp.Diff(counters, []uint{1, 2, 3}); diff != "" {
+			t.Errorf("expected all deliveries in order, diff: %s", diff)
+		}
+	})
+
+	t.Run("removes the deliveries of deleted webhooks", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+			response.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer server.Close()
+		provider := newTestProvider()
+		options := testOptions
+		options.InitialBackoff = time.Hour
+		options.MaxBackoff = time.Hour
+		dispatcher := newTestDispatcher(t, provider, options)
+
+		webhook, err := dispatcher.Create(Webhook{URL: server.URL})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for counter := uint(1); counter <= 2; counter++ {
+			if err := dispatcher.Publish(signatureCreated(counter)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := dispatcher.Delete(webhook.ID); err != nil {
+			t.Fatal(err)
+		}
+
+		if stored := storedDeliveries(t, provider, webhook.ID); len(stored) != 0 {
+			t.Errorf("expected the deliveries to be removed, got: %v", stored)
+		}
+		err = provider.ReadTx(func(repository domain.SignatureDeviceRepository) error {
+			webhooks, err := repository.ListWebhooks()
+			if len(webhooks) != 0 {
+				t.Errorf("expected the webhook to be removed, got: %v", webhooks)
+			}
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}